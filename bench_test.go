@@ -0,0 +1,167 @@
+package proxyproto
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+var (
+	benchV1 = []byte("PROXY TCP6 2607:f8b0:4008:80e::200e 2606:4700:4700::1111 8000 9000\r\nGET / HTTP/1.1\r\n\r\n")
+	benchV2 = []byte{
+		0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A,
+		0x21, 0x11, 0x0, 0xc,
+		10, 20, 30, 40,
+		40, 30, 20, 10,
+		0x1f, 0x40,
+		0x23, 0x28,
+		'G', 'E', 'T', ' ', '/', '\r', '\n', '\r', '\n',
+	}
+	benchV2SSL = func() []byte {
+		tlvs := appendTLV(nil, byte(TLVTypeAuthority), []byte("example.com"))
+		tlvs = appendTLV(tlvs, byte(TLVTypeSSL), appendSSLTLV(nil, &SSLTLVData{
+			Client:   TLVSSLClientSSL | TLVSSLClientCertConn,
+			Verified: true,
+			SubTLVs: map[SSLTLVSubType][]byte{
+				TLVSubTypeSSLVersion: []byte("TLSv1.3"),
+				TLVSubTypeSSLCN:      []byte("client.example.com"),
+				TLVSubTypeSSLCipher:  []byte("TLS_AES_128_GCM_SHA256"),
+			},
+		}))
+		b := []byte{
+			0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A,
+			0x21, 0x11, byte((12 + len(tlvs)) >> 8), byte(12 + len(tlvs)),
+			10, 20, 30, 40,
+			40, 30, 20, 10,
+			0x1f, 0x40,
+			0x23, 0x28,
+		}
+		return append(append(b, tlvs...), "GET / HTTP/1.1\r\n\r\n"...)
+	}()
+)
+
+func benchmarkParse(b *testing.B, buf []byte) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(buf)))
+	r := bytes.NewReader(buf)
+	for i := 0; i < b.N; i++ {
+		r.Reset(buf)
+		if _, err := Parse(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParse_v1(b *testing.B) {
+	benchmarkParse(b, benchV1)
+}
+
+func BenchmarkParse_v2(b *testing.B) {
+	benchmarkParse(b, benchV2)
+}
+
+func BenchmarkParse_v2SSL(b *testing.B) {
+	benchmarkParse(b, benchV2SSL)
+}
+
+// deadlineReader is a bytes.Reader with a no-op SetReadDeadline, so ParseContext
+// takes the same path as it does for a net.Conn
+type deadlineReader struct {
+	*bytes.Reader
+}
+
+func (deadlineReader) SetReadDeadline(time.Time) error { return nil }
+
+func benchmarkParseContext(b *testing.B, ctx context.Context) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchV2)))
+	r := deadlineReader{bytes.NewReader(benchV2)}
+	for i := 0; i < b.N; i++ {
+		r.Reset(benchV2)
+		if _, err := ParseContext(ctx, r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseContext_background(b *testing.B) {
+	benchmarkParseContext(b, context.Background())
+}
+
+func BenchmarkParseContext_cancel(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	benchmarkParseContext(b, ctx)
+}
+
+func benchmarkParseBytes(b *testing.B, buf []byte) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(buf)))
+	for i := 0; i < b.N; i++ {
+		if _, _, err := ParseBytes(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseBytes_v1(b *testing.B) {
+	benchmarkParseBytes(b, benchV1)
+}
+
+func BenchmarkParseBytes_v2(b *testing.B) {
+	benchmarkParseBytes(b, benchV2)
+}
+
+func BenchmarkParseBytes_v2SSL(b *testing.B) {
+	benchmarkParseBytes(b, benchV2SSL)
+}
+
+func BenchmarkTLVGetSSL(b *testing.B) {
+	d, _, err := ParseBytes(benchV2SSL)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ssl, ok := d.TLVGetSSL()
+		if !ok || !ssl.Verified {
+			b.Fatal("missing SSL TLV")
+		}
+	}
+}
+
+func BenchmarkTLVGetSSLView(b *testing.B) {
+	d, _, err := ParseBytes(benchV2SSL)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ssl, ok := d.TLVGetSSLView()
+		if !ok || !ssl.Verified() {
+			b.Fatal("missing SSL TLV")
+		}
+		if cn, ok := ssl.SubTLV(TLVSubTypeSSLCN); !ok || len(cn) == 0 {
+			b.Fatal("missing CN sub-TLV")
+		}
+	}
+}
+
+func BenchmarkTLVIterator(b *testing.B) {
+	d, _, err := ParseBytes(benchV2SSL)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		n := 0
+		it := d.TLVIterator()
+		for it.Next() {
+			n++
+		}
+		if n != 2 {
+			b.Fatalf("TLVIterator() found %v TLVs, want 2", n)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package proxyproto
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+)
+
+const (
+	// DefaultClientCertChainTLVType is the custom TLV type that carries the client
+	// certificate chain unless WithClientCertChainTLVType says otherwise
+	DefaultClientCertChainTLVType = TLVTypeMinCustom
+
+	defaultClientCertChainMaxCerts = 10
+)
+
+// ClientCertChainOption configures the client certificate chain TLV
+type ClientCertChainOption func(*clientCertChainConfig)
+
+type clientCertChainConfig struct {
+	tlvType  TLVType
+	maxCerts int
+	maxBytes int
+}
+
+// WithClientCertChainTLVType sets the TLV type carrying the chain, which must be in the
+// custom range TLVTypeMinCustom to TLVTypeMaxCustom. Both sides must agree on it. It is
+// DefaultClientCertChainTLVType by default
+func WithClientCertChainTLVType(t TLVType) ClientCertChainOption {
+	return func(c *clientCertChainConfig) {
+		c.tlvType = t
+	}
+}
+
+// WithClientCertChainMaxCerts limits how many certificates a chain may have, 10 by default
+func WithClientCertChainMaxCerts(n int) ClientCertChainOption {
+	return func(c *clientCertChainConfig) {
+		c.maxCerts = n
+	}
+}
+
+// WithClientCertChainMaxBytes limits the size of the encoded chain, which can never be
+// more than the 65535 bytes a TLV holds (the default)
+func WithClientCertChainMaxBytes(n int) ClientCertChainOption {
+	return func(c *clientCertChainConfig) {
+		c.maxBytes = n
+	}
+}
+
+// newClientCertChainConfig applies opts to the defaults and checks the result
+func newClientCertChainConfig(opts []ClientCertChainOption) (*clientCertChainConfig, error) {
+	c := &clientCertChainConfig{
+		tlvType:  DefaultClientCertChainTLVType,
+		maxCerts: defaultClientCertChainMaxCerts,
+		maxBytes: maxTLVLen,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.tlvType < TLVTypeMinCustom || c.tlvType > TLVTypeMaxCustom {
+		return nil, fmt.Errorf("proxyproto: client certificate chain TLV type must be in the custom range %v-%v, got %v", TLVTypeMinCustom, TLVTypeMaxCustom, c.tlvType)
+	}
+	if c.maxBytes <= 0 || c.maxBytes > maxTLVLen {
+		c.maxBytes = maxTLVLen
+	}
+	return c, nil
+}
+
+// SetClientCertChain stores a client certificate chain, leaf first, in a custom TLV
+// for backends that authorize on more than the CN the SSL TLV carries, such as SANs,
+// the issuer or SPIFFE IDs. The value is the concatenated DER certificates. An empty
+// chain removes the TLV
+func (d *Data) SetClientCertChain(chain []*x509.Certificate, opts ...ClientCertChainOption) error {
+	c, err := newClientCertChainConfig(opts)
+	if err != nil {
+		return err
+	}
+	if len(chain) > c.maxCerts {
+		return fmt.Errorf("proxyproto: client certificate chain has %v certificates, more than the limit of %v", len(chain), c.maxCerts)
+	}
+	var v []byte
+	for _, cert := range chain {
+		v = append(v, cert.Raw...)
+	}
+	if len(v) > c.maxBytes {
+		return fmt.Errorf("proxyproto: client certificate chain is %v bytes, more than the limit of %v", len(v), c.maxBytes)
+	}
+
+	d.setTLV(c.tlvType, v)
+	return nil
+}
+
+// SetClientCertChainFromConn stores the certificate chain the client of conn presented,
+// see SetClientCertChain. The handshake must be complete. If the client sent no
+// certificate the TLV is removed
+func (d *Data) SetClientCertChainFromConn(conn *tls.Conn, opts ...ClientCertChainOption) error {
+	cs := conn.ConnectionState()
+	if !cs.HandshakeComplete {
+		return errors.New("proxyproto: TLS handshake is not complete")
+	}
+	return d.SetClientCertChain(cs.PeerCertificates, opts...)
+}
+
+// ClientCertChain decodes the client certificate chain stored by SetClientCertChain,
+// leaf first. The certificates are not verified, see VerifyClientCertChain. It returns
+// nil and no error if the TLV is not present
+func (d *Data) ClientCertChain(opts ...ClientCertChainOption) ([]*x509.Certificate, error) {
+	c, err := newClientCertChainConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := d.TLV(c.tlvType)
+	if !ok {
+		return nil, nil
+	}
+	if len(v) > c.maxBytes {
+		return nil, fmt.Errorf("proxyproto: client certificate chain is %v bytes, more than the limit of %v", len(v), c.maxBytes)
+	}
+
+	var chain []*x509.Certificate
+	for rest := v; len(rest) > 0; {
+		if len(chain) == c.maxCerts {
+			return nil, fmt.Errorf("proxyproto: client certificate chain has more than the limit of %v certificates", c.maxCerts)
+		}
+		var raw asn1.RawValue
+		var err error
+		der := rest
+		if rest, err = asn1.Unmarshal(rest, &raw); err != nil {
+			return nil, fmt.Errorf("proxyproto: invalid client certificate chain: %w", err)
+		}
+		cert, err := x509.ParseCertificate(der[:len(der)-len(rest)])
+		if err != nil {
+			return nil, fmt.Errorf("proxyproto: invalid client certificate chain: %w", err)
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("proxyproto: invalid client certificate chain: empty")
+	}
+	return chain, nil
+}
+
+// VerifyClientCertChain decodes the client certificate chain like ClientCertChain and
+// verifies it for client authentication against roots, with the rest of the chain as
+// intermediates, like tls.RequireAndVerifyClientCert does. It returns the verified
+// chains, or an error if the TLV is not present or the chain is not valid
+func (d *Data) VerifyClientCertChain(roots *x509.CertPool, opts ...ClientCertChainOption) ([][]*x509.Certificate, error) {
+	chain, err := d.ClientCertChain(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return verifyClientCertChain(chain, roots)
+}
+
+// verifyClientCertChain verifies a client certificate chain, leaf first, against roots
+// with chain[1:] as intermediates
+func verifyClientCertChain(chain []*x509.Certificate, roots *x509.CertPool) ([][]*x509.Certificate, error) {
+	if len(chain) == 0 {
+		return nil, errors.New("proxyproto: no client certificate chain")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range chain[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	return chain[0].Verify(opts)
+}
@@ -0,0 +1,188 @@
+package proxyproto
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// issueCertificate creates a certificate signed by parent, or self-signed if parent is nil
+func issueCertificate(t *testing.T, cn string, isCA bool, usage x509.ExtKeyUsage, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{usage},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if !isCA {
+		tmpl.URIs = []*url.URL{{Scheme: "spiffe", Host: "example.org", Path: "/" + cn}}
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error = %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate() error = %v", err)
+	}
+	return cert, key
+}
+
+// clientChain creates a root, an intermediate and a client certificate it issued,
+// returning the chain as a client sends it and a pool with the root
+func clientChain(t *testing.T, usage x509.ExtKeyUsage) ([]*x509.Certificate, *x509.CertPool) {
+	t.Helper()
+	root, rootKey := issueCertificate(t, "root", true, x509.ExtKeyUsageAny, nil, nil)
+	inter, interKey := issueCertificate(t, "intermediate", true, x509.ExtKeyUsageAny, root, rootKey)
+	leaf, _ := issueCertificate(t, "workload", false, usage, inter, interKey)
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	return []*x509.Certificate{leaf, inter}, roots
+}
+
+func Test_Data_ClientCertChain(t *testing.T) {
+	chain, roots := clientChain(t, x509.ExtKeyUsageClientAuth)
+	d, err := NewData(TransportStream, netip.MustParseAddrPort("10.20.30.40:8000"), netip.MustParseAddrPort("40.30.20.10:443"))
+	if err != nil {
+		t.Fatalf("NewData() error = %v", err)
+	}
+	if err := d.SetClientCertChain(chain, WithClientCertChainTLVType(0xE7)); err != nil {
+		t.Fatalf("SetClientCertChain() error = %v", err)
+	}
+	b, err := d.AppendHeader(nil, Version2)
+	if err != nil {
+		t.Fatalf("AppendHeader() error = %v", err)
+	}
+	parsed, _, err := ParseBytes(b)
+	if err != nil {
+		t.Fatalf("ParseBytes() error = %v", err)
+	}
+
+	if got, err := parsed.ClientCertChain(); got != nil || err != nil {
+		t.Fatalf("ClientCertChain() with the default type = %v, %v, want nothing", got, err)
+	}
+	got, err := parsed.ClientCertChain(WithClientCertChainTLVType(0xE7))
+	if err != nil || len(got) != 2 {
+		t.Fatalf("ClientCertChain() = %v, %v", got, err)
+	}
+	for i := range chain {
+		if !bytes.Equal(got[i].Raw, chain[i].Raw) {
+			t.Fatalf("ClientCertChain()[%v] differs from the sent certificate", i)
+		}
+	}
+	if got[0].URIs[0].String() != "spiffe://example.org/workload" {
+		t.Fatalf("leaf URI = %v", got[0].URIs[0])
+	}
+
+	verified, err := parsed.VerifyClientCertChain(roots, WithClientCertChainTLVType(0xE7))
+	if err != nil || len(verified) != 1 || len(verified[0]) != 3 {
+		t.Fatalf("VerifyClientCertChain() = %v, %v", verified, err)
+	}
+	if _, err := parsed.VerifyClientCertChain(x509.NewCertPool(), WithClientCertChainTLVType(0xE7)); err == nil {
+		t.Fatalf("VerifyClientCertChain() succeeded with other roots")
+	}
+	if _, err := parsed.VerifyClientCertChain(roots); err == nil {
+		t.Fatalf("VerifyClientCertChain() succeeded without the TLV")
+	}
+
+	// an empty chain removes the TLV
+	if err := d.SetClientCertChain(nil, WithClientCertChainTLVType(0xE7)); err != nil || len(d.TLVMap()) != 0 {
+		t.Fatalf("SetClientCertChain(nil) = %v, TLVs %v", err, d.TLVMap())
+	}
+}
+
+func Test_Data_ClientCertChain_limits(t *testing.T) {
+	chain, _ := clientChain(t, x509.ExtKeyUsageClientAuth)
+	size := len(chain[0].Raw) + len(chain[1].Raw)
+	tests := []struct {
+		name  string
+		value []byte
+		opts  []ClientCertChainOption
+	}{
+		{name: "type", value: chain[0].Raw, opts: []ClientCertChainOption{WithClientCertChainTLVType(TLVTypeSSL)}},
+		{name: "certs", value: append(append([]byte{}, chain[0].Raw...), chain[1].Raw...), opts: []ClientCertChainOption{WithClientCertChainMaxCerts(1)}},
+		{name: "bytes", value: append(append([]byte{}, chain[0].Raw...), chain[1].Raw...), opts: []ClientCertChainOption{WithClientCertChainMaxBytes(size - 1)}},
+		{name: "truncated", value: chain[0].Raw[:len(chain[0].Raw)-1]},
+		{name: "trailing", value: append(append([]byte{}, chain[0].Raw...), 0x30)},
+		{name: "not a certificate", value: []byte{0x30, 0x03, 0x02, 0x01, 0x01}},
+		{name: "empty", value: []byte{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Data{TLVs: map[TLVType][]byte{DefaultClientCertChainTLVType: tt.value}}
+			if got, err := d.ClientCertChain(tt.opts...); err == nil {
+				t.Fatalf("ClientCertChain() = %v, want an error", got)
+			}
+		})
+	}
+
+	d := &Data{}
+	if err := d.SetClientCertChain(chain, WithClientCertChainMaxCerts(1)); err == nil {
+		t.Fatalf("SetClientCertChain() accepted more certificates than the limit")
+	}
+	if err := d.SetClientCertChain(chain, WithClientCertChainMaxBytes(size-1)); err == nil {
+		t.Fatalf("SetClientCertChain() accepted more bytes than the limit")
+	}
+	if err := d.SetClientCertChain(chain, WithClientCertChainTLVType(TLVTypeMaxCustom+1)); err == nil {
+		t.Fatalf("SetClientCertChain() accepted a type outside the custom range")
+	}
+}
+
+func Test_verifyClientCertChain(t *testing.T) {
+	server, serverRoots := clientChain(t, x509.ExtKeyUsageServerAuth)
+	if _, err := verifyClientCertChain(server, serverRoots); err == nil {
+		t.Fatalf("verifyClientCertChain() accepted a server certificate")
+	}
+	chain, roots := clientChain(t, x509.ExtKeyUsageClientAuth)
+	if _, err := verifyClientCertChain(chain, roots); err != nil {
+		t.Fatalf("verifyClientCertChain() error = %v", err)
+	}
+	if _, err := verifyClientCertChain(chain[:1], roots); err == nil {
+		t.Fatalf("verifyClientCertChain() succeeded without the intermediate")
+	}
+	if _, err := verifyClientCertChain(nil, roots); err == nil {
+		t.Fatalf("verifyClientCertChain() succeeded without a chain")
+	}
+}
+
+func Test_Data_SetClientCertChainFromConn(t *testing.T) {
+	client, server := tcpPair(t)
+	clientCert, leaf := testCertificate(t, "client.example.com")
+	_, sc := tlsPair(t, client, server, clientCert)
+
+	d := &Data{}
+	if err := d.SetClientCertChainFromConn(sc); err != nil {
+		t.Fatalf("SetClientCertChainFromConn() error = %v", err)
+	}
+	chain, err := d.ClientCertChain()
+	if err != nil || len(chain) != 1 || !chain[0].Equal(leaf) {
+		t.Fatalf("ClientCertChain() = %v, %v", chain, err)
+	}
+
+	_, server = tcpPair(t)
+	if err := d.SetClientCertChainFromConn(tls.Server(server, &tls.Config{})); err == nil {
+		t.Fatalf("SetClientCertChainFromConn() succeeded before the handshake")
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/everettcaleb/go-proxyproto"
+)
+
+var (
+	v1Signature = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+const (
+	// v2FixedSize is the length of the v2 signature, version/command, family and length
+	v2FixedSize = 16
+)
+
+// report describes a parsed header and where each part of it is in the input
+type report struct {
+	Version       int                      `json:"version"`
+	Command       proxyproto.Command       `json:"command"`
+	AddressFamily proxyproto.AddressFamily `json:"addressFamily"`
+	Transport     proxyproto.Transport     `json:"transport"`
+	Source        string                   `json:"source,omitempty"`
+	Dest          string                   `json:"dest,omitempty"`
+	TLVs          []tlvReport              `json:"tlvs,omitempty"`
+	CRC32C        *crcReport               `json:"crc32c,omitempty"`
+	HeaderLength  int                      `json:"headerLength"`
+	DataOffset    int                      `json:"dataOffset"`
+	DataLength    int                      `json:"dataLength"`
+	Warnings      []*dumpError             `json:"warnings,omitempty"`
+}
+
+// tlvReport is a TLV at Offset in the input. Value is hex encoded, and values the spec
+// defines as strings are also given as Text
+type tlvReport struct {
+	Offset int                `json:"offset"`
+	Type   proxyproto.TLVType `json:"type"`
+	Length int                `json:"length"`
+	Value  string             `json:"value"`
+	Text   string             `json:"text,omitempty"`
+	SSL    *sslReport         `json:"ssl,omitempty"`
+}
+
+// sslReport is the decoded value of an SSL TLV
+type sslReport struct {
+	Client   string         `json:"client"`
+	Verify   uint32         `json:"verify"`
+	Verified bool           `json:"verified"`
+	SubTLVs  []subTLVReport `json:"subTLVs,omitempty"`
+}
+
+// subTLVReport is an SSL sub-TLV at Offset in the input, with a Value and Text like
+// tlvReport
+type subTLVReport struct {
+	Offset int                      `json:"offset"`
+	Type   proxyproto.SSLTLVSubType `json:"type"`
+	Length int                      `json:"length"`
+	Value  string                   `json:"value"`
+	Text   string                   `json:"text,omitempty"`
+}
+
+// crcReport is the result of checking the CRC32C TLV
+type crcReport struct {
+	Offset   int    `json:"offset"`
+	Value    string `json:"value"`
+	Computed string `json:"computed"`
+	Valid    bool   `json:"valid"`
+}
+
+// dumpError is a problem with the input, located at the Length bytes starting at Offset.
+// An Offset equal to the input length means the input ended too soon
+type dumpError struct {
+	Offset  int    `json:"offset"`
+	Length  int    `json:"length"`
+	Message string `json:"message"`
+}
+
+func (e *dumpError) Error() string {
+	return fmt.Sprintf("byte %v: %v", e.Offset, e.Message)
+}
+
+// dump parses the header at the start of b. If that fails, the error is a *dumpError
+// pointing at the bytes that caused it
+func dump(b []byte) (*report, error) {
+	d, n, err := proxyproto.ParseBytes(b)
+	if err != nil {
+		return nil, locate(b, err)
+	}
+
+	r := &report{
+		Version:       int(d.Version),
+		Command:       d.Command,
+		AddressFamily: d.AddressFamily,
+		Transport:     d.Transport,
+		HeaderLength:  n,
+		DataOffset:    n,
+		DataLength:    len(b) - n,
+	}
+	// both are empty for headers without addresses
+	r.Source = d.Source().String()
+	r.Dest = d.Dest().String()
+	if d.Version != proxyproto.Version2 {
+		return r, nil
+	}
+	if d.Command == proxyproto.CommandLocal {
+		if n > v2FixedSize {
+			r.Warnings = append(r.Warnings, &dumpError{Offset: v2FixedSize, Length: n - v2FixedSize, Message: "LOCAL header: addresses and TLVs are ignored"})
+		}
+		return r, nil
+	}
+
+	start := v2FixedSize + v2AddressesLen(d.AddressFamily)
+	r.TLVs, r.Warnings = dumpTLVs(b[:n], start)
+	for _, t := range r.TLVs {
+		if t.Type == proxyproto.TLVTypeCRC32C {
+			r.CRC32C = checkCRC32C(b[:n], t)
+			break
+		}
+	}
+	return r, nil
+}
+
+// v2AddressesLen gets the length of the addresses and ports of a v2 header
+func v2AddressesLen(af proxyproto.AddressFamily) int {
+	switch af {
+	case proxyproto.AddressFamilyIPv4:
+		return 12
+	case proxyproto.AddressFamilyIPv6:
+		return 36
+	case proxyproto.AddressFamilyUnix:
+		return 216
+	default:
+		return 0
+	}
+}
+
+// dumpTLVs describes the TLVs of the v2 header hdr, which start at offset start
+func dumpTLVs(hdr []byte, start int) ([]tlvReport, []*dumpError) {
+	var tlvs []tlvReport
+	var warnings []*dumpError
+	off := start
+	for it := proxyproto.NewTLVIterator(hdr[start:]); it.Next(); {
+		t := tlvReport{Offset: off, Type: it.Type(), Length: len(it.Value()), Value: hex.EncodeToString(it.Value())}
+		switch it.Type() {
+		case proxyproto.TLVTypeSSL:
+			var w *dumpError
+			t.SSL, w = dumpSSL(it.Value(), off+3)
+			if w != nil {
+				warnings = append(warnings, w)
+			}
+		case proxyproto.TLVTypeALPN, proxyproto.TLVTypeAuthority, proxyproto.TLVTypeNetNS:
+			t.Text = string(it.Value())
+		case proxyproto.TLVTypeCRC32C:
+			if len(it.Value()) != 4 {
+				warnings = append(warnings, &dumpError{Offset: off + 1, Length: 2, Message: fmt.Sprintf("CRC32C TLV must be 4 bytes, got %v", len(it.Value()))})
+			}
+		}
+		tlvs = append(tlvs, t)
+		off += 3 + len(it.Value())
+	}
+	if off < len(hdr) {
+		warnings = append(warnings, &dumpError{Offset: off, Length: len(hdr) - off, Message: "truncated TLV is ignored"})
+	}
+	return tlvs, warnings
+}
+
+// dumpSSL decodes the value of an SSL TLV, which starts at offset off
+func dumpSSL(v []byte, off int) (*sslReport, *dumpError) {
+	if len(v) < 5 {
+		return nil, &dumpError{Offset: off, Length: len(v), Message: fmt.Sprintf("SSL TLV must be at least 5 bytes, got %v", len(v))}
+	}
+	view := proxyproto.SSLTLVView(v)
+	s := &sslReport{
+		Client:   view.Client().String(),
+		Verify:   view.Verify(),
+		Verified: view.Verified(),
+	}
+	sub := off + 5
+	for it := view.SubTLVs(); it.Next(); {
+		st := proxyproto.SSLTLVSubType(it.Type())
+		s.SubTLVs = append(s.SubTLVs, subTLVReport{Offset: sub, Type: st, Length: len(it.Value()), Value: hex.EncodeToString(it.Value())})
+		switch st {
+		case proxyproto.TLVSubTypeSSLVersion, proxyproto.TLVSubTypeSSLCN, proxyproto.TLVSubTypeSSLCipher,
+			proxyproto.TLVSubTypeSSLSigAlg, proxyproto.TLVSubTypeSSLKeyAlg:
+			s.SubTLVs[len(s.SubTLVs)-1].Text = string(it.Value())
+		}
+		sub += 3 + len(it.Value())
+	}
+	if end := off + len(v); sub < end {
+		return s, &dumpError{Offset: sub, Length: end - sub, Message: "truncated SSL sub-TLV is ignored"}
+	}
+	return s, nil
+}
+
+// checkCRC32C checks the CRC32C TLV t of the v2 header hdr, which is computed over the
+// whole header with the checksum zeroed
+func checkCRC32C(hdr []byte, t tlvReport) *crcReport {
+	if t.Length != 4 {
+		return &crcReport{Offset: t.Offset, Value: "0x" + t.Value}
+	}
+	at := t.Offset + 3
+	want := binary.BigEndian.Uint32(hdr[at:])
+	zeroed := append([]byte{}, hdr...)
+	copy(zeroed[at:at+4], []byte{0, 0, 0, 0})
+	got := crc32.Checksum(zeroed, crc32cTable)
+	return &crcReport{
+		Offset:   t.Offset,
+		Value:    fmt.Sprintf("0x%08x", want),
+		Computed: fmt.Sprintf("0x%08x", got),
+		Valid:    got == want,
+	}
+}
+
+// locate gets the bytes of b that made parsing fail with err, as the parser reports them
+func locate(b []byte, err error) *dumpError {
+	se := proxyproto.LocateError(b)
+	if se == nil {
+		// b parses on its own, so err is not about its bytes
+		return &dumpError{Message: err.Error()}
+	}
+	return &dumpError{Offset: se.Offset, Length: se.Length, Message: err.Error()}
+}
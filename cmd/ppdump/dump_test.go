@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/everettcaleb/go-proxyproto"
+)
+
+// testHeader builds a v2 header with an authority, CRC32C and SSL TLV, in that order
+func testHeader(t *testing.T) []byte {
+	t.Helper()
+	d, err := proxyproto.NewData(proxyproto.TransportStream, netip.MustParseAddrPort("10.20.30.40:8000"), netip.MustParseAddrPort("40.30.20.10:443"))
+	if err != nil {
+		t.Fatalf("NewData() error = %v", err)
+	}
+	d.TLVs = map[proxyproto.TLVType][]byte{proxyproto.TLVTypeCRC32C: make([]byte, 4)}
+	d.SetTLSConnectionState(&tls.ConnectionState{
+		HandshakeComplete: true,
+		Version:           tls.VersionTLS13,
+		CipherSuite:       tls.TLS_AES_128_GCM_SHA256,
+		ServerName:        "example.com",
+	})
+	b, err := d.AppendHeader(nil, proxyproto.Version2)
+	if err != nil {
+		t.Fatalf("AppendHeader() error = %v", err)
+	}
+	return b
+}
+
+func Test_decodeInput(t *testing.T) {
+	v1 := []byte("PROXY TCP4 10.0.0.1 10.0.0.2 80 443\r\n")
+	v2 := []byte("\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00")
+	tests := []struct {
+		name    string
+		in      string
+		format  string
+		want    []byte
+		wantErr bool
+	}{
+		{name: "v1", in: string(v1), format: "auto", want: v1},
+		{name: "v2", in: string(v2), format: "auto", want: v2},
+		{name: "hex", in: hex.EncodeToString(v2) + "\n", format: "auto", want: v2},
+		{name: "hex with separators", in: "0d 0a 0d 0a 00 0d\n0a:51:55:49:54:0a\n0x20 0x00 \\x00\\x00", format: "auto", want: v2},
+		{name: "base64", in: base64.StdEncoding.EncodeToString(v1) + "\n", format: "auto", want: v1},
+		{name: "raw base64", in: base64.RawURLEncoding.EncodeToString(v2), format: "auto", want: v2},
+		{name: "other binary", in: "GET / HTTP/1.1\r\n", format: "auto", want: []byte("GET / HTTP/1.1\r\n")},
+		{name: "forced binary", in: "0d0a", format: "binary", want: []byte("0d0a")},
+		{name: "forced base64", in: "0d0a", format: "base64", want: []byte{0xd1, 0xdd, 0x1a}},
+		{name: "bad hex", in: "0d0", format: "hex", wantErr: true},
+		{name: "empty hex", in: " \n", format: "hex", wantErr: true},
+		{name: "bad base64", in: "!!", format: "base64", wantErr: true},
+		{name: "bad format", in: "", format: "pcap", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeInput([]byte(tt.in), tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeInput() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Fatalf("decodeInput() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_dump(t *testing.T) {
+	b := append(testHeader(t), "GET /"...)
+	r, err := dump(b)
+	if err != nil {
+		t.Fatalf("dump() error = %v", err)
+	}
+	if r.Version != 2 || r.Command != proxyproto.CommandProxy || r.Source != "10.20.30.40:8000" || r.Dest != "40.30.20.10:443" {
+		t.Fatalf("dump() = %+v", r)
+	}
+	if r.HeaderLength != len(b)-5 || r.DataOffset != r.HeaderLength || r.DataLength != 5 {
+		t.Fatalf("dump() lengths = %v, %v, %v", r.HeaderLength, r.DataOffset, r.DataLength)
+	}
+
+	var types []string
+	for _, tlv := range r.TLVs {
+		types = append(types, tlv.Type.String())
+		if got := b[tlv.Offset]; got != byte(tlv.Type) {
+			t.Errorf("TLV %v at offset %v has type %#x", tlv.Type, tlv.Offset, got)
+		}
+	}
+	if got := strings.Join(types, ","); got != "authority,crc32c,ssl" {
+		t.Fatalf("TLV types = %v", got)
+	}
+	if r.TLVs[0].Text != "example.com" {
+		t.Fatalf("authority = %q", r.TLVs[0].Text)
+	}
+	ssl := r.TLVs[2].SSL
+	if ssl == nil || ssl.Client != "ssl" || !ssl.Verified || len(ssl.SubTLVs) != 2 || ssl.SubTLVs[1].Text != "TLS_AES_128_GCM_SHA256" {
+		t.Fatalf("SSL = %+v", ssl)
+	}
+	if sub := ssl.SubTLVs[0]; string(b[sub.Offset+3:sub.Offset+3+sub.Length]) != "TLSv1.3" {
+		t.Fatalf("SSL version sub-TLV offset %v is wrong", sub.Offset)
+	}
+	if r.CRC32C == nil || !r.CRC32C.Valid || r.CRC32C.Offset != r.TLVs[1].Offset {
+		t.Fatalf("CRC32C = %+v, want valid", r.CRC32C)
+	}
+	if len(r.Warnings) != 0 {
+		t.Fatalf("Warnings = %v", r.Warnings)
+	}
+
+	b[r.TLVs[1].Offset+3]++
+	if r, err := dump(b); err != nil || r.CRC32C.Valid {
+		t.Fatalf("dump() with a bad checksum = %+v, %v", r.CRC32C, err)
+	}
+}
+
+func Test_dump_warnings(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want []dumpError
+	}{
+		{
+			name: "LOCAL with addresses",
+			in:   []byte("\r\n\r\n\x00\r\nQUIT\n\x20\x11\x00\x02ab"),
+			want: []dumpError{{Offset: 16, Length: 2}},
+		},
+		{
+			name: "truncated TLV",
+			in:   []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x00\x00\x06\x04\x00\x00\x01\x00\x05"),
+			want: []dumpError{{Offset: 19, Length: 3}},
+		},
+		{
+			name: "CRC32C length",
+			in:   []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x00\x00\x05\x03\x00\x02ab"),
+			want: []dumpError{{Offset: 17, Length: 2}},
+		},
+		{
+			name: "truncated SSL sub-TLV",
+			in:   []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x00\x00\x0a\x20\x00\x07\x01\x00\x00\x00\x00\x21\x00"),
+			want: []dumpError{{Offset: 24, Length: 2}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := dump(tt.in)
+			if err != nil {
+				t.Fatalf("dump() error = %v", err)
+			}
+			if len(r.Warnings) != len(tt.want) {
+				t.Fatalf("Warnings = %v, want %v", r.Warnings, tt.want)
+			}
+			for i, w := range r.Warnings {
+				if w.Offset != tt.want[i].Offset || w.Length != tt.want[i].Length {
+					t.Fatalf("Warnings[%v] = %v (length %v), want offset %v length %v", i, w, w.Length, tt.want[i].Offset, tt.want[i].Length)
+				}
+			}
+		})
+	}
+}
+
+func Test_dump_errors(t *testing.T) {
+	v2 := testHeader(t)
+	tests := []struct {
+		name       string
+		in         []byte
+		wantOffset int
+		wantLength int
+	}{
+		{name: "not a header", in: []byte("GET / HTTP/1.1\r\n"), wantOffset: 0, wantLength: 1},
+		{name: "bad v1 signature", in: []byte("PROXX TCP4"), wantOffset: 4, wantLength: 1},
+		{name: "bad v2 signature", in: []byte("\r\n\r\n\x00\r\nQUIX\n\x21\x11\x00\x0c"), wantOffset: 10, wantLength: 1},
+		{name: "incomplete v1", in: []byte("PROXY TCP4 1.2.3.4"), wantOffset: 18, wantLength: 0},
+		{name: "incomplete v2", in: v2[:30], wantOffset: 30, wantLength: 0},
+		{name: "v1 protocol", in: []byte("PROXY TCP5 1.2.3.4 5.6.7.8 1 2\r\n"), wantOffset: 9, wantLength: 1},
+		{name: "v1 protocol without space", in: []byte("PROXY TCP4\r\n"), wantOffset: 10, wantLength: 1},
+		{name: "v1 line too long", in: append([]byte("PROXY UNKNOWN "), bytes.Repeat([]byte{'x'}, 100)...), wantOffset: 105, wantLength: 2},
+		{name: "v1 source", in: []byte("PROXY TCP4 1.2.3 5.6.7.8 1 2\r\n"), wantOffset: 11, wantLength: 5},
+		{name: "v1 IPv6 in TCP4", in: []byte("PROXY TCP4 1.2.3.4 ::1 1 2\r\n"), wantOffset: 19, wantLength: 3},
+		{name: "v1 zone", in: []byte("PROXY TCP6 ::1 fe80::1%eth0 1 2\r\n"), wantOffset: 15, wantLength: 12},
+		{name: "v1 source port", in: []byte("PROXY TCP6 ::1 ::2 +1 2\r\n"), wantOffset: 19, wantLength: 2},
+		{name: "v1 dest port", in: []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1 65536\r\n"), wantOffset: 29, wantLength: 5},
+		{name: "v1 double space", in: []byte("PROXY TCP4 1.2.3.4  5.6.7.8 1 2\r\n"), wantOffset: 19, wantLength: 1},
+		{name: "v1 missing field", in: []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1\r\n"), wantOffset: 28, wantLength: 1},
+		{name: "v1 missing dest port", in: []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1 \r\n"), wantOffset: 29, wantLength: 1},
+		{name: "v2 version", in: append(append([]byte{}, v2[:12]...), 0x11, 0x11, 0, 0), wantOffset: 12, wantLength: 1},
+		{name: "v2 family", in: append(append([]byte{}, v2[:12]...), 0x21, 0x41, 0, 0), wantOffset: 13, wantLength: 1},
+		{name: "v2 transport", in: append(append([]byte{}, v2[:12]...), 0x21, 0x13, 0, 0), wantOffset: 13, wantLength: 1},
+		{name: "v2 length", in: append(append([]byte{}, v2[:12]...), 0x21, 0x21, 0, 12, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0), wantOffset: 14, wantLength: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := dump(tt.in)
+			e, ok := err.(*dumpError)
+			if !ok {
+				t.Fatalf("dump() = %+v, %v, want a *dumpError", r, err)
+			}
+			if e.Offset != tt.wantOffset || e.Length != tt.wantLength {
+				t.Fatalf("dump() error = %v (length %v), want offset %v length %v", e, e.Length, tt.wantOffset, tt.wantLength)
+			}
+			if _, _, perr := proxyproto.ParseBytes(tt.in); e.Message != perr.Error() {
+				t.Fatalf("dump() error message = %q, want the parser's %q", e.Message, perr)
+			}
+		})
+	}
+}
+
+func Test_run(t *testing.T) {
+	v2 := hex.EncodeToString(testHeader(t))
+	tests := []struct {
+		name       string
+		in         string
+		json       bool
+		wantStatus int
+		wantOut    []string
+		wantErr    []string
+	}{
+		{
+			name:    "text",
+			in:      v2,
+			wantOut: []string{"version         v2", "source          10.20.30.40:8000", "data offset     92 (0 bytes of application data)", "(valid)", `"TLSv1.3"`},
+		},
+		{
+			name:    "json",
+			in:      v2,
+			json:    true,
+			wantOut: []string{`"dataOffset": 92`, `"valid": true`, `"text": "example.com"`},
+		},
+		{
+			name:       "bad checksum",
+			in:         strings.Replace(v2, "030004", "030004ff", 1)[:len(v2)],
+			wantStatus: 1,
+			wantOut:    []string{"(INVALID, computed 0x"},
+		},
+		{
+			name:       "invalid header",
+			in:         "PROXY TCP4 1.2.3.4 5.6.7.8 1 99999\r\n",
+			wantStatus: 1,
+			wantErr: []string{
+				`ppdump: byte 29: failed to parse proxy protocol v1: failed to parse dest port "99999"`,
+				"00000010  2e 34 20 35 2e 36 2e 37 2e 38 20 31 20 39 39 39  |.4 5.6.7.8 1 999|\n" +
+					strings.Repeat(" ", 10+13*3) + "^^ ^^ ^^\n",
+			},
+		},
+		{
+			name:       "invalid header as json",
+			in:         "PROXY TCP4 1.2.3.4",
+			json:       true,
+			wantStatus: 1,
+			wantOut:    []string{`"offset": 18`, `"length": 0`, "incomplete"},
+		},
+		{
+			name:       "bad input",
+			in:         "0d0a",
+			wantStatus: 1,
+			wantErr:    []string{"byte 2: proxy protocol header is incomplete"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if got := run(&stdout, &stderr, []byte(tt.in), "auto", tt.json); got != tt.wantStatus {
+				t.Fatalf("run() = %v, want %v, stderr %q", got, tt.wantStatus, stderr.String())
+			}
+			for _, want := range tt.wantOut {
+				if !strings.Contains(stdout.String(), want) {
+					t.Errorf("stdout %q does not contain %q", stdout.String(), want)
+				}
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(stderr.String(), want) {
+					t.Errorf("stderr %q does not contain %q", stderr.String(), want)
+				}
+			}
+			if tt.json && !json.Valid(stdout.Bytes()) {
+				t.Errorf("stdout is not JSON: %q", stdout.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// decodeInput gets the bytes to parse from in, which is binary, hex or base64. With
+// format "auto", input that starts like a PROXY header is binary; otherwise hex is
+// tried, then base64, and anything else is treated as binary
+func decodeInput(in []byte, format string) ([]byte, error) {
+	switch format {
+	case "binary":
+		return in, nil
+	case "hex":
+		return decodeHex(in)
+	case "base64":
+		return decodeBase64(in)
+	case "auto":
+		if bytes.HasPrefix(in, v1Signature) || (len(in) > 0 && in[0] == v2Signature[0]) {
+			return in, nil
+		}
+		if b, err := decodeHex(in); err == nil {
+			return b, nil
+		}
+		if b, err := decodeBase64(in); err == nil {
+			return b, nil
+		}
+		return in, nil
+	default:
+		return nil, fmt.Errorf("unknown input format %q, expected auto, binary, hex or base64", format)
+	}
+}
+
+// decodeHex decodes hex that may be split by whitespace or colons and have "0x" or
+// "\x" prefixes, as pasted from xxd -p, Wireshark or string literals
+func decodeHex(in []byte) ([]byte, error) {
+	s := strings.Join(strings.Fields(string(in)), "")
+	s = strings.NewReplacer(`\x`, "", "0x", "", "0X", "", ":", "").Replace(s)
+	if s == "" {
+		return nil, fmt.Errorf("no hex digits in the input")
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex input: %w", err)
+	}
+	return b, nil
+}
+
+// decodeBase64 decodes standard or URL-safe base64, padded or not, that may be split
+// by whitespace
+func decodeBase64(in []byte) ([]byte, error) {
+	s := strings.Join(strings.Fields(string(in)), "")
+	if s == "" {
+		return nil, fmt.Errorf("no base64 in the input")
+	}
+	var err error
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+		var b []byte
+		if b, err = enc.DecodeString(s); err == nil {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid base64 input: %w", err)
+}
@@ -0,0 +1,203 @@
+// Command ppdump decodes a PROXY protocol header and prints every field, for debugging
+// load balancer configurations:
+//
+//	echo 0d0a0d0a000d0a515549540a2111000c0a141e28281e140a1f4001bb | ppdump
+//	ppdump -json first-bytes.bin
+//
+// The input is read from the file named on the command line, or stdin, and may be
+// binary, hex or base64 (see -format). The output lists the version, command and
+// addresses, each TLV (and SSL sub-TLV) with its offset, whether the CRC32C checksum
+// is valid and the offset where application data begins. If the header is invalid,
+// the error names the byte that failed and ppdump exits with status 1, as it does
+// when the checksum does not match.
+//
+// The pcap subcommand reads a pcap or pcapng capture instead and prints the header at
+// the start of each TCP connection and in each UDP datagram, flagging those that are
+// malformed or cut short:
+//
+//	tcpdump -w lb.pcap -s 0 'tcp port 8080'
+//	ppdump pcap lb.pcap
+//	ppdump pcap -json -ports 8080,8443 lb.pcapng
+//
+// Without -ports, only connections and datagrams that start like a PROXY header are
+// shown. With it, every connection and datagram to those ports is, so backends that
+// receive traffic without a header stand out.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "pcap" {
+		os.Exit(pcapMain(os.Args[2:]))
+	}
+	format := flag.String("format", "auto", "input format: auto, binary, hex or base64")
+	asJSON := flag.Bool("json", false, "print JSON instead of text")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: ppdump [flags] [file]\n       ppdump pcap [flags] file\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var in []byte
+	var err error
+	if name := flag.Arg(0); name != "" && name != "-" {
+		in, err = os.ReadFile(name)
+	} else {
+		in, err = io.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ppdump: %v\n", err)
+		os.Exit(2)
+	}
+	os.Exit(run(os.Stdout, os.Stderr, in, *format, *asJSON))
+}
+
+// jsonOutput is what -json prints: the report, or the error if the header is invalid
+type jsonOutput struct {
+	*report
+	Error *dumpError `json:"error,omitempty"`
+}
+
+// run dumps the header in the input to stdout and returns the exit status: 0 if it is
+// valid, 1 if it is not (including a CRC32C checksum that does not match) and 2 if the
+// input cannot be decoded
+func run(stdout, stderr io.Writer, in []byte, format string, asJSON bool) int {
+	b, err := decodeInput(in, format)
+	if err != nil {
+		fmt.Fprintf(stderr, "ppdump: %v\n", err)
+		return 2
+	}
+	r, err := dump(b)
+	var derr *dumpError
+	if err != nil && !errors.As(err, &derr) {
+		fmt.Fprintf(stderr, "ppdump: %v\n", err)
+		return 2
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(jsonOutput{report: r, Error: derr}); err != nil {
+			fmt.Fprintf(stderr, "ppdump: %v\n", err)
+			return 2
+		}
+	} else if derr != nil {
+		fmt.Fprintf(stderr, "ppdump: %v\n", derr)
+		printContext(stderr, b, derr)
+	} else {
+		printReport(stdout, r)
+	}
+	if derr != nil || (r.CRC32C != nil && !r.CRC32C.Valid) {
+		return 1
+	}
+	return 0
+}
+
+// printReport prints r as aligned text
+func printReport(w io.Writer, r *report) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "version\tv%v\n", r.Version)
+	fmt.Fprintf(tw, "command\t%v\n", r.Command)
+	fmt.Fprintf(tw, "address family\t%v\n", r.AddressFamily)
+	fmt.Fprintf(tw, "transport\t%v\n", r.Transport)
+	if r.Source != "" {
+		fmt.Fprintf(tw, "source\t%v\n", r.Source)
+		fmt.Fprintf(tw, "destination\t%v\n", r.Dest)
+	}
+	fmt.Fprintf(tw, "header length\t%v\n", r.HeaderLength)
+	fmt.Fprintf(tw, "data offset\t%v (%v bytes of application data)\n", r.DataOffset, r.DataLength)
+	tw.Flush()
+
+	if len(r.TLVs) > 0 {
+		fmt.Fprintln(w, "TLVs:")
+		tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "  offset\ttype\tlength\tvalue\n")
+		for _, t := range r.TLVs {
+			v := t.Value
+			switch {
+			case t.Text != "":
+				v = strconv.Quote(t.Text)
+			case t.SSL != nil:
+				v = fmt.Sprintf("client=%v verify=%v", t.SSL.Client, t.SSL.Verify)
+				if t.SSL.Verified {
+					v += " (verified)"
+				}
+			case r.CRC32C != nil && r.CRC32C.Offset == t.Offset && r.CRC32C.Computed != "":
+				v = r.CRC32C.Value
+				if r.CRC32C.Valid {
+					v += " (valid)"
+				} else {
+					v += " (INVALID, computed " + r.CRC32C.Computed + ")"
+				}
+			}
+			fmt.Fprintf(tw, "  %v\t%v\t%v\t%v\n", t.Offset, t.Type, t.Length, v)
+			if t.SSL != nil {
+				for _, st := range t.SSL.SubTLVs {
+					v := st.Value
+					if st.Text != "" {
+						v = strconv.Quote(st.Text)
+					}
+					fmt.Fprintf(tw, "    %v\t%v\t%v\t%v\n", st.Offset, st.Type, st.Length, v)
+				}
+			}
+		}
+		tw.Flush()
+	}
+	for _, warning := range r.Warnings {
+		fmt.Fprintf(w, "warning: %v\n", warning)
+	}
+}
+
+// printContext prints the row of a hex dump of b holding the start of e, with the
+// bytes e points at marked
+func printContext(w io.Writer, b []byte, e *dumpError) {
+	if len(b) == 0 {
+		return
+	}
+	off := e.Offset
+	if off >= len(b) {
+		off = len(b) - 1
+	}
+	row := off - off%16
+	end := row + 16
+	if end > len(b) {
+		end = len(b)
+	}
+
+	var hexCol, textCol, marks strings.Builder
+	for i := row; i < end; i++ {
+		fmt.Fprintf(&hexCol, " %02x", b[i])
+		if b[i] >= 0x20 && b[i] < 0x7f {
+			textCol.WriteByte(b[i])
+		} else {
+			textCol.WriteByte('.')
+		}
+		if i >= e.Offset && i < e.Offset+e.Length {
+			marks.WriteString(" ^^")
+		} else {
+			marks.WriteString("   ")
+		}
+	}
+	if e.Offset >= len(b) {
+		// the input ended too soon, mark just past the last byte
+		marks.Reset()
+		marks.WriteString(strings.Repeat("   ", end-row))
+		marks.WriteString(" ^^")
+	}
+	fmt.Fprintf(w, "%08x %-48s  |%s|\n", row, hexCol.String(), textCol.String())
+	fmt.Fprintf(w, "%8s %s\n", "", strings.TrimRight(marks.String(), " "))
+}
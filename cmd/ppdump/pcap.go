@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/everettcaleb/go-proxyproto"
+	"github.com/everettcaleb/go-proxyproto/pcap"
+)
+
+// pcapMain runs the pcap subcommand with its arguments and returns the exit status
+func pcapMain(args []string) int {
+	fs := flag.NewFlagSet("ppdump pcap", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print a JSON object per line instead of text")
+	portList := fs.String("ports", "", "comma-separated ports to check every connection and datagram to, flagging those without a header")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: ppdump pcap [flags] file\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	var opts []pcap.ScannerOption
+	if *portList != "" {
+		ports, err := parsePorts(*portList)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ppdump: %v\n", err)
+			return 2
+		}
+		opts = append(opts, pcap.WithPorts(ports...))
+	}
+
+	var r io.Reader = os.Stdin
+	if name := fs.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ppdump: %v\n", err)
+			return 2
+		}
+		defer f.Close()
+		r = f
+	}
+	return runPcap(os.Stdout, os.Stderr, r, opts, *asJSON)
+}
+
+// parsePorts parses a comma-separated list of ports
+func parsePorts(s string) ([]uint16, error) {
+	var ports []uint16
+	for _, f := range strings.Split(s, ",") {
+		p, err := strconv.ParseUint(strings.TrimSpace(f), 10, 16)
+		if err != nil || p == 0 {
+			return nil, fmt.Errorf("invalid port %q", f)
+		}
+		ports = append(ports, uint16(p))
+	}
+	return ports, nil
+}
+
+// pcapOutput is what -json prints for each connection or datagram: the header, or the
+// error if it is missing or invalid
+type pcapOutput struct {
+	Time     time.Time  `json:"time"`
+	Protocol string     `json:"protocol"`
+	Src      string     `json:"src"`
+	Dst      string     `json:"dst"`
+	Header   *report    `json:"header,omitempty"`
+	Error    *dumpError `json:"error,omitempty"`
+}
+
+// runPcap prints the header of each connection and datagram in the capture read from r
+// and returns the exit status: 0 if every header is valid, 1 if any is not (including a
+// CRC32C checksum that does not match) and 2 if the capture cannot be read
+func runPcap(stdout, stderr io.Writer, r io.Reader, opts []pcap.ScannerOption, asJSON bool) int {
+	s, err := pcap.NewScanner(r, opts...)
+	if err != nil {
+		fmt.Fprintf(stderr, "ppdump: %v\n", err)
+		return 2
+	}
+	enc := json.NewEncoder(stdout)
+	var total, bad int
+	for {
+		res, err := s.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "ppdump: %v\n", err)
+			return 2
+		}
+		total++
+		out := pcapOutput{
+			Time:     res.Time,
+			Protocol: "tcp",
+			Src:      res.Src.String(),
+			Dst:      res.Dst.String(),
+		}
+		if res.Transport == proxyproto.TransportDgram {
+			out.Protocol = "udp"
+		}
+		out.Header, out.Error = dumpResult(res)
+		if out.Error != nil || (out.Header.CRC32C != nil && !out.Header.CRC32C.Valid) {
+			bad++
+		}
+
+		if asJSON {
+			if err := enc.Encode(out); err != nil {
+				fmt.Fprintf(stderr, "ppdump: %v\n", err)
+				return 2
+			}
+			continue
+		}
+		fmt.Fprintf(stdout, "%v %v %v -> %v: ", out.Time.UTC().Format("2006-01-02 15:04:05.000000"), out.Protocol, out.Src, out.Dst)
+		if out.Error != nil {
+			fmt.Fprintf(stdout, "MALFORMED %v\n", out.Error)
+			continue
+		}
+		text, _ := res.Data.MarshalText()
+		fmt.Fprintf(stdout, "%s", text)
+		if c := out.Header.CRC32C; c != nil && !c.Valid {
+			fmt.Fprintf(stdout, " (INVALID checksum, computed %v)", c.Computed)
+		}
+		fmt.Fprintln(stdout)
+	}
+	if !asJSON {
+		fmt.Fprintf(stdout, "%v checked, %v invalid\n", total, bad)
+	}
+	if bad > 0 {
+		return 1
+	}
+	return 0
+}
+
+// dumpResult dumps the header of a scanner result, or locates its error in the bytes
+// that were captured
+func dumpResult(res *pcap.Result) (*report, *dumpError) {
+	if res.Err == nil {
+		// the scanner parsed the same bytes, so this does not fail
+		r, _ := dump(res.Header)
+		return r, nil
+	}
+	var pe proxyproto.ParseError
+	if errors.As(res.Err, &pe) || errors.Is(res.Err, proxyproto.ErrIncomplete) {
+		return nil, locate(res.Header, res.Err)
+	}
+	// the header is valid but not allowed where it was sent
+	return nil, &dumpError{Length: len(res.Header), Message: res.Err.Error()}
+}
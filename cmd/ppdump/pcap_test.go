@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/everettcaleb/go-proxyproto/pcap"
+)
+
+// testCapture builds a pcap file of raw IPv4 packets
+func testCapture(packets ...[]byte) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, []uint32{0xa1b2c3d4, 0x00040002, 0, 0, 0xffff, uint32(pcap.LinkTypeRaw)})
+	for i, p := range packets {
+		binary.Write(&b, binary.LittleEndian, []uint32{1792324800, uint32(i), uint32(len(p)), uint32(len(p))})
+		b.Write(p)
+	}
+	return b.Bytes()
+}
+
+// testPacket builds an IPv4 packet from src to dst carrying a TCP segment with the
+// given flags and sequence number, or a UDP datagram if udp is set
+func testPacket(src, dst netip.AddrPort, udp bool, flags byte, seq uint32, payload string) []byte {
+	transport := make([]byte, 20)
+	proto := byte(6)
+	transport[12] = 5 << 4
+	transport[13] = flags
+	binary.BigEndian.PutUint32(transport[4:], seq)
+	if udp {
+		transport = make([]byte, 8)
+		proto = 17
+		binary.BigEndian.PutUint16(transport[4:], uint16(8+len(payload)))
+	}
+	binary.BigEndian.PutUint16(transport[0:], src.Port())
+	binary.BigEndian.PutUint16(transport[2:], dst.Port())
+	transport = append(transport, payload...)
+
+	ip := make([]byte, 20)
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(20+len(transport)))
+	ip[9] = proto
+	copy(ip[12:], src.Addr().AsSlice())
+	copy(ip[16:], dst.Addr().AsSlice())
+	return append(ip, transport...)
+}
+
+func Test_runPcap(t *testing.T) {
+	const syn, ack, fin = 0x02, 0x10, 0x01
+	lb := func(port uint16) netip.AddrPort { return netip.AddrPortFrom(netip.MustParseAddr("10.0.0.1"), port) }
+	backend := netip.MustParseAddrPort("10.0.0.2:8080")
+	v2 := string(testHeader(t))
+	badCRC := []byte(v2)
+	badCRC[len(badCRC)-1] ^= 1
+	v1 := "PROXY TCP4 192.0.2.1 192.0.2.2 5000 443\r\n"
+
+	capture := testCapture(
+		testPacket(lb(40001), backend, false, syn, 100, ""),
+		testPacket(lb(40002), backend, false, syn, 200, ""),
+		testPacket(lb(40001), backend, false, ack, 101, v2[:30]),
+		testPacket(lb(40002), backend, false, ack, 201, v1+"GET / HTTP/1.1\r\n"),
+		testPacket(lb(40001), backend, false, ack, 131, v2[30:]),
+		testPacket(lb(40003), backend, false, syn, 300, ""),
+		testPacket(lb(40003), backend, false, ack, 301, "PROXY TCP4 192.0.2.1 192.0.2.2 5000 99999\r\n"),
+		testPacket(lb(40004), backend, false, syn, 400, ""),
+		testPacket(lb(40004), backend, false, ack, 401, v1[:10]),
+		testPacket(lb(40004), backend, false, fin|ack, 411, ""),
+		testPacket(lb(40005), backend, false, syn, 500, ""),
+		testPacket(lb(40005), backend, false, ack, 501, "GET / HTTP/1.1\r\n"),
+		testPacket(lb(40006), backend, true, 0, 0, string(badCRC)),
+	)
+
+	tests := []struct {
+		name       string
+		capture    []byte
+		opts       []pcap.ScannerOption
+		json       bool
+		wantStatus int
+		wantOut    []string
+		wantErr    string
+	}{
+		{
+			name:       "text",
+			capture:    capture,
+			wantStatus: 1,
+			wantOut: []string{
+				"2026-10-18 12:00:00.000000 tcp 10.0.0.1:40001 -> 10.0.0.2:8080: v2 tcp4 10.20.30.40:8000 -> 40.30.20.10:443 authority=\"example.com\"",
+				"2026-10-18 12:00:00.000001 tcp 10.0.0.1:40002 -> 10.0.0.2:8080: v1 tcp4 192.0.2.1:5000 -> 192.0.2.2:443\n",
+				`tcp 10.0.0.1:40003 -> 10.0.0.2:8080: MALFORMED byte 36: failed to parse proxy protocol v1: failed to parse dest port "99999"`,
+				"tcp 10.0.0.1:40004 -> 10.0.0.2:8080: MALFORMED byte 10: pcap: the connection closed before the header was complete",
+				"udp 10.0.0.1:40006 -> 10.0.0.2:8080: v2 tcp4 10.20.30.40:8000 -> 40.30.20.10:443",
+				"(INVALID checksum, computed 0x",
+				"5 checked, 3 invalid\n",
+			},
+		},
+		{
+			name:       "ports",
+			capture:    capture,
+			opts:       []pcap.ScannerOption{pcap.WithPorts(8080)},
+			wantStatus: 1,
+			wantOut: []string{
+				`tcp 10.0.0.1:40005 -> 10.0.0.2:8080: MALFORMED byte 0: failed to parse proxy protocol, expected "PROXY" or v2 binary header`,
+				"6 checked, 4 invalid\n",
+			},
+		},
+		{
+			name:       "json",
+			capture:    capture,
+			json:       true,
+			wantStatus: 1,
+			wantOut: []string{
+				`{"time":"2026-10-18T12:00:00Z","protocol":"tcp","src":"10.0.0.1:40001","dst":"10.0.0.2:8080","header":{"version":2,`,
+				`"src":"10.0.0.1:40004","dst":"10.0.0.2:8080","error":{"offset":10,"length":0,"message":"pcap: the connection closed`,
+			},
+		},
+		{
+			name:    "valid",
+			capture: testCapture(testPacket(lb(40001), backend, false, syn, 100, v1)),
+			wantOut: []string{"v1 tcp4 192.0.2.1:5000 -> 192.0.2.2:443\n1 checked, 0 invalid\n"},
+		},
+		{
+			name:       "not a capture",
+			capture:    []byte("PROXY TCP4 192.0.2.1 192.0.2.2 5000 443\r\n"),
+			wantStatus: 2,
+			wantErr:    "ppdump: pcap: invalid capture file",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if got := runPcap(&stdout, &stderr, bytes.NewReader(tt.capture), tt.opts, tt.json); got != tt.wantStatus {
+				t.Fatalf("runPcap() = %v, want %v, stderr %q", got, tt.wantStatus, stderr.String())
+			}
+			for _, want := range tt.wantOut {
+				if !strings.Contains(stdout.String(), want) {
+					t.Errorf("stdout %q does not contain %q", stdout.String(), want)
+				}
+			}
+			if !strings.Contains(stderr.String(), tt.wantErr) {
+				t.Errorf("stderr %q does not contain %q", stderr.String(), tt.wantErr)
+			}
+			if tt.json {
+				for _, line := range strings.Split(strings.TrimSpace(stdout.String()), "\n") {
+					if !json.Valid([]byte(line)) {
+						t.Errorf("line is not JSON: %q", line)
+					}
+				}
+			}
+		})
+	}
+}
+
+func Test_parsePorts(t *testing.T) {
+	got, err := parsePorts("80, 443,8080")
+	if err != nil || len(got) != 3 || got[0] != 80 || got[1] != 443 || got[2] != 8080 {
+		t.Fatalf("parsePorts() = %v, %v", got, err)
+	}
+	for _, s := range []string{"", "80,", "0", "65536", "http"} {
+		if _, err := parsePorts(s); err == nil {
+			t.Errorf("parsePorts(%q) error = nil", s)
+		}
+	}
+}
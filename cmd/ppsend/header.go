@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/everettcaleb/go-proxyproto"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// headerOptions are the header fields given on the command line
+type headerOptions struct {
+	v1     bool
+	local  bool
+	unspec bool
+	// src and dst are "ip:port" or "unix:path", or empty for the connection's addresses
+	src, dst  string
+	transport string
+	tlvs      tlvList
+	// ssl is the client flags of the SSL TLV, which is only sent if ssl or sslTLVs is set
+	ssl           string
+	sslUnverified bool
+	sslTLVs       sslTLVList
+	// crc32c is "valid", "invalid" or a hex value to send as is, or empty for no CRC32C TLV
+	crc32c string
+}
+
+// tlvList collects repeated -tlv flags
+type tlvList map[proxyproto.TLVType][]byte
+
+func (l tlvList) String() string {
+	return fmt.Sprint(len(l), " TLVs")
+}
+
+func (l tlvList) Set(s string) error {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("expected type=value, got %q", s)
+	}
+	var t proxyproto.TLVType
+	if err := t.UnmarshalText([]byte(name)); err != nil {
+		return err
+	}
+	v, err := parseValue(value)
+	if err != nil {
+		return err
+	}
+	l[t] = v
+	return nil
+}
+
+// sslTLVList collects repeated -ssl-tlv flags
+type sslTLVList map[proxyproto.SSLTLVSubType][]byte
+
+func (l sslTLVList) String() string {
+	return fmt.Sprint(len(l), " SSL sub-TLVs")
+}
+
+func (l sslTLVList) Set(s string) error {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("expected type=value, got %q", s)
+	}
+	var t proxyproto.SSLTLVSubType
+	if err := t.UnmarshalText([]byte(name)); err != nil {
+		return err
+	}
+	v, err := parseValue(value)
+	if err != nil {
+		return err
+	}
+	l[t] = v
+	return nil
+}
+
+// parseValue parses a TLV value, which is hex if it starts with "0x" and text otherwise
+func parseValue(s string) ([]byte, error) {
+	if !strings.HasPrefix(s, "0x") {
+		return []byte(s), nil
+	}
+	v, err := hex.DecodeString(s[2:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex value %q: %v", s, err)
+	}
+	return v, nil
+}
+
+// buildHeader encodes the header described by o. Addresses and the transport not given
+// in o are taken from the connection's local (source) and remote (destination)
+// addresses, which are nil when there is no connection
+func buildHeader(o *headerOptions, local, remote net.Addr) ([]byte, error) {
+	tr := proxyproto.TransportStream
+	if _, ok := local.(*net.UDPAddr); ok {
+		tr = proxyproto.TransportDgram
+	}
+	if o.unspec {
+		tr = proxyproto.TransportUnspec
+	}
+	if o.transport != "" {
+		if err := tr.UnmarshalText([]byte(o.transport)); err != nil {
+			return nil, err
+		}
+	}
+
+	var d *proxyproto.Data
+	switch {
+	case o.local:
+		// LOCAL headers are sent without addresses
+		d = &proxyproto.Data{Command: proxyproto.CommandLocal}
+	case o.unspec:
+		d = &proxyproto.Data{Transport: tr}
+	default:
+		var err error
+		if d, err = addressData(tr, o.src, local, o.dst, remote); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(o.tlvs) > 0 {
+		d.TLVs = make(map[proxyproto.TLVType][]byte, len(o.tlvs))
+		for t, v := range o.tlvs {
+			d.TLVs[t] = v
+		}
+	}
+	if o.ssl != "" || len(o.sslTLVs) > 0 {
+		ssl := &proxyproto.SSLTLVData{Client: proxyproto.TLVSSLClientSSL, Verified: !o.sslUnverified, SubTLVs: o.sslTLVs}
+		if o.ssl != "" {
+			if err := ssl.Client.UnmarshalText([]byte(o.ssl)); err != nil {
+				return nil, err
+			}
+		}
+		if err := d.SetSSL(ssl); err != nil {
+			return nil, err
+		}
+	}
+	var crc []byte
+	if o.crc32c != "" {
+		if o.crc32c != "valid" && o.crc32c != "invalid" {
+			v, err := strconv.ParseUint(strings.TrimPrefix(o.crc32c, "0x"), 16, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CRC32C %q, expected valid, invalid or a hex value", o.crc32c)
+			}
+			crc = make([]byte, 4)
+			binary.BigEndian.PutUint32(crc, uint32(v))
+		}
+		if d.TLVs == nil {
+			d.TLVs = make(map[proxyproto.TLVType][]byte, 1)
+		}
+		// a placeholder the encoder replaces with the checksum
+		d.TLVs[proxyproto.TLVTypeCRC32C] = make([]byte, 4)
+	}
+
+	v := proxyproto.Version2
+	if o.v1 {
+		if len(d.TLVs) > 0 {
+			return nil, errors.New("TLVs can only be sent in v2 headers")
+		}
+		v = proxyproto.Version1
+	}
+	b, err := d.AppendHeader(nil, v)
+	if err != nil {
+		return nil, err
+	}
+	if o.crc32c == "invalid" || crc != nil {
+		value := crc32cValue(b)
+		if crc == nil {
+			crc = make([]byte, 4)
+			binary.BigEndian.PutUint32(crc, ^binary.BigEndian.Uint32(value))
+		}
+		copy(value, crc)
+	}
+	return b, nil
+}
+
+// addressData builds the data for a source and destination given as "ip:port" or
+// "unix:path", using the connection's addresses for those not given
+func addressData(tr proxyproto.Transport, src string, local net.Addr, dst string, remote net.Addr) (*proxyproto.Data, error) {
+	srcUnix, dstUnix := strings.HasPrefix(src, "unix:"), strings.HasPrefix(dst, "unix:")
+	if srcUnix || dstUnix {
+		if !srcUnix || !dstUnix {
+			return nil, errors.New("a header cannot mix Unix and IP addresses, -src and -dst must both be unix:path")
+		}
+		return &proxyproto.Data{
+			AddressFamily: proxyproto.AddressFamilyUnix,
+			Transport:     tr,
+			SourceAddr:    []byte(strings.TrimPrefix(src, "unix:")),
+			DestAddr:      []byte(strings.TrimPrefix(dst, "unix:")),
+		}, nil
+	}
+
+	sa, err := addrPort("-src", src, local)
+	if err != nil {
+		return nil, err
+	}
+	da, err := addrPort("-dst", dst, remote)
+	if err != nil {
+		return nil, err
+	}
+	return proxyproto.NewData(tr, sa, da)
+}
+
+// addrPort parses an address given with flag, or gets the connection's address a if it
+// was not given
+func addrPort(flag, s string, a net.Addr) (netip.AddrPort, error) {
+	if s != "" {
+		ap, err := netip.ParseAddrPort(s)
+		if err != nil {
+			return netip.AddrPort{}, fmt.Errorf("invalid %v address: %v", flag, err)
+		}
+		return ap, nil
+	}
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		return a.AddrPort(), nil
+	case *net.UDPAddr:
+		return a.AddrPort(), nil
+	default:
+		return netip.AddrPort{}, fmt.Errorf("%v is required without a connection", flag)
+	}
+}
+
+// checksumValid reports whether the CRC32C TLV of an encoded v2 header holds the
+// checksum of the header
+func checksumValid(b []byte) bool {
+	value := crc32cValue(b)
+	want := binary.BigEndian.Uint32(value)
+	zeroed := append([]byte{}, b...)
+	copy(crc32cValue(zeroed), []byte{0, 0, 0, 0})
+	return crc32.Checksum(zeroed, crc32cTable) == want
+}
+
+// crc32cValue gets the value of the CRC32C TLV in an encoded v2 header, for replacing
+// the checksum the encoder computed
+func crc32cValue(b []byte) []byte {
+	off := 16
+	switch b[13] >> 4 {
+	case 1:
+		off += 12
+	case 2:
+		off += 36
+	case 3:
+		off += 216
+	}
+	for off+3 <= len(b) {
+		t, n := proxyproto.TLVType(b[off]), int(binary.BigEndian.Uint16(b[off+1:]))
+		if t == proxyproto.TLVTypeCRC32C && n == 4 {
+			return b[off+3 : off+7]
+		}
+		off += 3 + n
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/everettcaleb/go-proxyproto"
+)
+
+func Test_tlvList_Set(t *testing.T) {
+	l := tlvList{}
+	for _, s := range []string{"authority=example.com", "0xe0=0xdeadbeef", "netns=0x", "alpn=h2=x"} {
+		if err := l.Set(s); err != nil {
+			t.Fatalf("Set(%q) error = %v", s, err)
+		}
+	}
+	want := tlvList{
+		proxyproto.TLVTypeAuthority: []byte("example.com"),
+		0xe0:                        {0xde, 0xad, 0xbe, 0xef},
+		proxyproto.TLVTypeNetNS:     {},
+		proxyproto.TLVTypeALPN:      []byte("h2=x"),
+	}
+	for typ, v := range want {
+		if !bytes.Equal(l[typ], v) {
+			t.Fatalf("TLV %v = %q, want %q", typ, l[typ], v)
+		}
+	}
+	for _, s := range []string{"authority", "nope=x", "0xe0=0xzz", "0x100=x"} {
+		if err := l.Set(s); err == nil {
+			t.Errorf("Set(%q) error = nil", s)
+		}
+	}
+
+	sl := sslTLVList{}
+	if err := sl.Set("cn=client"); err != nil || string(sl[proxyproto.TLVSubTypeSSLCN]) != "client" {
+		t.Fatalf("Set() = %v, %q", err, sl[proxyproto.TLVSubTypeSSLCN])
+	}
+	if err := sl.Set("common_name=client"); err == nil {
+		t.Fatalf("Set() accepted an unknown sub-TLV type")
+	}
+}
+
+func Test_buildHeader(t *testing.T) {
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 8080}
+	udpLocal := &net.UDPAddr{IP: net.ParseIP("::1"), Port: 40000}
+	udpRemote := &net.UDPAddr{IP: net.ParseIP("::2"), Port: 53}
+
+	tests := []struct {
+		name          string
+		opts          headerOptions
+		local, remote net.Addr
+		// want is the header's MarshalText summary
+		want string
+		// wantCRC is whether the CRC32C TLV is valid, if there is one
+		wantCRC bool
+	}{
+		{
+			name:   "connection addresses",
+			local:  local,
+			remote: remote,
+			want:   "v2 tcp4 127.0.0.1:40000 -> 127.0.0.2:8080",
+		},
+		{
+			name:   "datagrams",
+			local:  udpLocal,
+			remote: udpRemote,
+			want:   "v2 udp6 [::1]:40000 -> [::2]:53",
+		},
+		{
+			name:   "v1",
+			opts:   headerOptions{v1: true, src: "192.0.2.1:5000"},
+			local:  local,
+			remote: remote,
+			want:   "v1 tcp4 192.0.2.1:5000 -> 127.0.0.2:8080",
+		},
+		{
+			name: "v1 unknown",
+			opts: headerOptions{v1: true, unspec: true},
+			want: "v1 unspec",
+		},
+		{
+			name: "unspec",
+			opts: headerOptions{unspec: true, tlvs: tlvList{proxyproto.TLVTypeNoop: nil}},
+			want: "v2 unspec noop=",
+		},
+		{
+			name: "local",
+			opts: headerOptions{local: true, src: "192.0.2.1:5000"},
+			want: "v2 local",
+		},
+		{
+			name: "unix",
+			opts: headerOptions{src: "unix:/run/client.sock", dst: "unix:/run/server.sock", transport: "dgram"},
+			want: `v2 unixgram "/run/client.sock" -> "/run/server.sock"`,
+		},
+		{
+			name: "TLVs",
+			opts: headerOptions{
+				src:  "[2001:db8::1]:5000",
+				dst:  "[2001:db8::2]:443",
+				tlvs: tlvList{proxyproto.TLVTypeAuthority: []byte("example.com"), 0xe5: {1, 2}},
+				ssl:  "ssl|cert_conn|cert_sess",
+				sslTLVs: sslTLVList{
+					proxyproto.TLVSubTypeSSLVersion: []byte("TLSv1.3"),
+					proxyproto.TLVSubTypeSSLCN:      []byte("client"),
+					0x30:                            {0xff},
+				},
+				sslUnverified: true,
+				crc32c:        "valid",
+			},
+			want:    `v2 tcp6 [2001:db8::1]:5000 -> [2001:db8::2]:443 authority="example.com" crc32c=0x`,
+			wantCRC: true,
+		},
+		{
+			name:   "wrong checksum",
+			opts:   headerOptions{crc32c: "invalid", sslTLVs: sslTLVList{proxyproto.TLVSubTypeSSLVersion: []byte("TLSv1.2")}},
+			local:  local,
+			remote: remote,
+			want:   "v2 tcp4 127.0.0.1:40000 -> 127.0.0.2:8080 crc32c=0x",
+		},
+		{
+			name:   "given checksum",
+			opts:   headerOptions{crc32c: "0xdeadbeef"},
+			local:  local,
+			remote: remote,
+			want:   "v2 tcp4 127.0.0.1:40000 -> 127.0.0.2:8080 crc32c=0xdeadbeef",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := buildHeader(&tt.opts, tt.local, tt.remote)
+			if err != nil {
+				t.Fatalf("buildHeader() error = %v", err)
+			}
+			d, n, err := proxyproto.ParseBytes(b)
+			if err != nil || n != len(b) {
+				t.Fatalf("ParseBytes() = %v, %v, want the whole header %q", n, err, b)
+			}
+			text, _ := d.MarshalText()
+			if !strings.HasPrefix(string(text), tt.want) {
+				t.Fatalf("header = %s, want %s", text, tt.want)
+			}
+			if _, ok := d.TLVGetCRC32Checksum(); ok && checksumValid(b) != tt.wantCRC {
+				t.Fatalf("checksumValid() = %v, want %v", !tt.wantCRC, tt.wantCRC)
+			}
+
+			if len(tt.opts.sslTLVs) == 0 {
+				return
+			}
+			ssl, ok := d.TLVGetSSL()
+			if !ok {
+				t.Fatalf("TLVGetSSL() found no SSL TLV")
+			}
+			wantSSL := &proxyproto.SSLTLVData{Client: proxyproto.TLVSSLClientSSL, Verified: !tt.opts.sslUnverified, SubTLVs: tt.opts.sslTLVs}
+			if tt.opts.ssl != "" {
+				wantSSL.Client.UnmarshalText([]byte(tt.opts.ssl))
+			}
+			if !ssl.Equal(wantSSL) {
+				t.Fatalf("TLVGetSSL() = %+v, want %+v", ssl, wantSSL)
+			}
+		})
+	}
+}
+
+func Test_buildHeader_errors(t *testing.T) {
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 8080}
+	tests := []struct {
+		name string
+		opts headerOptions
+		// noConn builds the header without a connection, as -print does
+		noConn bool
+		want   string
+	}{
+		{name: "no connection", opts: headerOptions{src: "192.0.2.1:5000"}, noConn: true, want: "-dst is required without a connection"},
+		{name: "bad address", opts: headerOptions{src: "192.0.2.1"}, want: "invalid -src address"},
+		{name: "mixed families", opts: headerOptions{src: "unix:/run/client.sock"}, want: "cannot mix Unix and IP addresses"},
+		{name: "bad transport", opts: headerOptions{transport: "sctp"}, want: "sctp"},
+		{name: "v1 TLVs", opts: headerOptions{v1: true, crc32c: "valid"}, want: "TLVs can only be sent in v2 headers"},
+		{name: "v1 LOCAL", opts: headerOptions{v1: true, local: true}, want: "does not exist in v1"},
+		{name: "v1 Unix", opts: headerOptions{v1: true, src: "unix:/a", dst: "unix:/b"}, want: "not supported"},
+		{name: "bad checksum", opts: headerOptions{crc32c: "wrong"}, want: `invalid CRC32C "wrong"`},
+		{name: "bad SSL flags", opts: headerOptions{ssl: "tls"}, want: `unknown SSL client flag "tls"`},
+		{name: "long Unix address", opts: headerOptions{src: "unix:/" + strings.Repeat("a", 200), dst: "unix:/b"}, want: "at most 108 bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			if tt.noConn {
+				_, err = buildHeader(&tt.opts, nil, nil)
+			} else {
+				_, err = buildHeader(&tt.opts, local, remote)
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("buildHeader() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func Test_crc32cValue(t *testing.T) {
+	d, err := proxyproto.NewData(proxyproto.TransportStream, netip.MustParseAddrPort("192.0.2.1:5000"), netip.MustParseAddrPort("192.0.2.2:443"))
+	if err != nil {
+		t.Fatalf("NewData() error = %v", err)
+	}
+	// the ALPN TLV comes first and its value looks like a CRC32C TLV
+	d.TLVs = map[proxyproto.TLVType][]byte{
+		proxyproto.TLVTypeALPN:   {3, 0, 4, 0, 0, 0, 0},
+		proxyproto.TLVTypeCRC32C: make([]byte, 4),
+	}
+	b, err := d.AppendHeader(nil, proxyproto.Version2)
+	if err != nil {
+		t.Fatalf("AppendHeader() error = %v", err)
+	}
+	// 16 fixed bytes, 12 of addresses and the 10-byte ALPN TLV come before the CRC32C value
+	if got, want := crc32cValue(b), b[41:45]; &got[0] != &want[0] || len(got) != 4 {
+		t.Fatalf("crc32cValue() = %x, want %x", got, want)
+	}
+	if !checksumValid(b) {
+		t.Fatalf("checksumValid() = false for the encoder's checksum")
+	}
+	b[44] ^= 1
+	if checksumValid(b) {
+		t.Fatalf("checksumValid() = true for a changed checksum")
+	}
+}
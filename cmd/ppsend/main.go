@@ -0,0 +1,200 @@
+// Command ppsend works like netcat, but first sends a PROXY protocol header built from
+// its flags, for testing services behind a load balancer by hand:
+//
+//	ppsend -src 192.0.2.1:5000 -tlv authority=example.com localhost:8080
+//	ppsend -ssl 'ssl|cert_conn' -ssl-tlv version=TLSv1.3 -ssl-tlv cn=client -crc32c invalid localhost:8080
+//	ppsend -v1 -unspec localhost:8080
+//	ppsend -u -dst 192.0.2.2:53 localhost:5353
+//
+// After the header, stdin is copied to the connection and the connection to stdout
+// until the server closes it. With -u, each read from stdin is sent as a UDP datagram
+// prefixed with the header, and replies are printed until -wait after stdin ends.
+//
+// Unless they are given, the addresses in the header are those of the connection, so
+// a v2 header over UDP has the dgram transport. TLV values are text, or hex if they
+// start with 0x. The CRC32C TLV holds the checksum of the header unless -crc32c asks
+// for a wrong or specific one. With -print, the header is written to stdout instead,
+// e.g. for ppdump.
+//
+// The header is encoded with Data.AppendHeader, so ppsend doubles as an end-to-end
+// check of the library's encoder against other implementations.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/everettcaleb/go-proxyproto"
+)
+
+// maxDatagramSize is the largest UDP payload that can be sent over IPv4
+const maxDatagramSize = 65507
+
+// sendOptions configure how the header and stdin are sent
+type sendOptions struct {
+	header  headerOptions
+	udp     bool
+	timeout time.Duration
+	wait    time.Duration
+	verbose bool
+}
+
+func main() {
+	o := sendOptions{header: headerOptions{tlvs: tlvList{}, sslTLVs: sslTLVList{}}}
+	h := &o.header
+	flag.BoolVar(&h.v1, "v1", false, "send a v1 (text) header instead of v2")
+	flag.BoolVar(&h.local, "local", false, "send the LOCAL command, without addresses (v2 only)")
+	flag.BoolVar(&h.unspec, "unspec", false, "send no addresses: UNKNOWN in v1, the unspecified address family in v2")
+	flag.StringVar(&h.src, "src", "", "source address as ip:port or unix:path (default the connection's local address)")
+	flag.StringVar(&h.dst, "dst", "", "destination address as ip:port or unix:path (default the address connected to)")
+	flag.StringVar(&h.transport, "transport", "", "transport in the header: stream, dgram or unspec (default the connection's)")
+	flag.Var(h.tlvs, "tlv", "add a TLV as type=value, with a type name such as authority or a hex type such as 0xe0 (repeatable)")
+	flag.StringVar(&h.ssl, "ssl", "", "add an SSL TLV with these client flags, e.g. 'ssl|cert_conn'")
+	flag.BoolVar(&h.sslUnverified, "ssl-unverified", false, "send a nonzero verify result in the SSL TLV")
+	flag.Var(h.sslTLVs, "ssl-tlv", "add an SSL sub-TLV as type=value, e.g. version=TLSv1.3 or cn=client (repeatable, implies -ssl ssl)")
+	flag.StringVar(&h.crc32c, "crc32c", "", "add a CRC32C TLV: valid, invalid, or a hex checksum to send as is")
+	flag.BoolVar(&o.udp, "u", false, "send UDP datagrams, each prefixed with the header")
+	flag.DurationVar(&o.timeout, "timeout", 10*time.Second, "timeout for connecting")
+	flag.DurationVar(&o.wait, "wait", time.Second, "with -u, how long to wait for replies after stdin ends")
+	flag.BoolVar(&o.verbose, "verbose", false, "describe the header on stderr")
+	printOnly := flag.Bool("print", false, "write the header to stdout instead of connecting")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: ppsend [flags] host:port\n       ppsend -print [flags]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *printOnly {
+		if flag.NArg() != 0 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		b, err := buildHeader(h, nil, nil)
+		if err == nil {
+			describe(os.Stderr, o.verbose, b)
+			_, err = os.Stdout.Write(b)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ppsend: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := send(flag.Arg(0), &o, os.Stdin, os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintf(os.Stderr, "ppsend: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// send connects to addr, sends the header and then copies stdin to the connection and
+// the connection to stdout
+func send(addr string, o *sendOptions, stdin io.Reader, stdout, stderr io.Writer) error {
+	network := "tcp"
+	if o.udp {
+		network = "udp"
+	}
+	conn, err := net.DialTimeout(network, addr, o.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	b, err := buildHeader(&o.header, conn.LocalAddr(), conn.RemoteAddr())
+	if err != nil {
+		return err
+	}
+	describe(stderr, o.verbose, b)
+	if o.udp {
+		return sendDatagrams(conn, b, o.wait, stdin, stdout)
+	}
+
+	if _, err := conn.Write(b); err != nil {
+		return err
+	}
+	go func() {
+		// the server may close the connection before stdin ends, so only the
+		// connection is waited for
+		if _, err := io.Copy(conn, stdin); err == nil {
+			conn.(*net.TCPConn).CloseWrite()
+		}
+	}()
+	_, err = io.Copy(stdout, conn)
+	return err
+}
+
+// sendDatagrams sends each read from stdin prefixed with the header, and copies replies
+// to stdout until wait after stdin ends
+func sendDatagrams(conn net.Conn, header []byte, wait time.Duration, stdin io.Reader, stdout io.Writer) error {
+	if len(header) >= maxDatagramSize {
+		return fmt.Errorf("the header is %v bytes, too long for a datagram", len(header))
+	}
+	replies := make(chan error, 1)
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				replies <- err
+				return
+			}
+			if _, err := stdout.Write(buf[:n]); err != nil {
+				replies <- err
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+	n := copy(buf, header)
+	for {
+		m, err := stdin.Read(buf[n:])
+		if m > 0 {
+			if _, err := conn.Write(buf[:n+m]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(wait))
+	if err := <-replies; !errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	}
+	return nil
+}
+
+// describe prints the header b on stderr if verbose is set. It is parsed back first,
+// so what is printed is what the server will see
+func describe(stderr io.Writer, verbose bool, b []byte) {
+	if !verbose {
+		return
+	}
+	d, _, err := proxyproto.ParseBytes(b)
+	if err != nil {
+		fmt.Fprintf(stderr, "ppsend: header %q does not parse: %v\n", b, err)
+		return
+	}
+	text, _ := d.MarshalText()
+	fmt.Fprintf(stderr, "ppsend: header %s", text)
+	if _, ok := d.TLVGetCRC32Checksum(); ok {
+		if checksumValid(b) {
+			fmt.Fprintf(stderr, " (valid checksum)")
+		} else {
+			fmt.Fprintf(stderr, " (wrong checksum)")
+		}
+	}
+	fmt.Fprintln(stderr)
+}
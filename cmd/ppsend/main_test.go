@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/everettcaleb/go-proxyproto"
+)
+
+func Test_send(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	pl := proxyproto.WrapListener(l)
+	defer pl.Close()
+	go func() {
+		for {
+			conn, err := pl.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				// reply with the header and then echo the data
+				d, _ := proxyproto.DataFromConn(conn)
+				text, _ := d.MarshalText()
+				conn.Write(append(text, '\n'))
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	o := &sendOptions{
+		header: headerOptions{
+			src:     "192.0.2.1:5000",
+			tlvs:    tlvList{proxyproto.TLVTypeAuthority: []byte("example.com")},
+			sslTLVs: sslTLVList{proxyproto.TLVSubTypeSSLCN: []byte("client")},
+			crc32c:  "invalid",
+		},
+		timeout: time.Second,
+		verbose: true,
+	}
+	var stdout, stderr bytes.Buffer
+	if err := send(l.Addr().String(), o, strings.NewReader("hello\n"), &stdout, &stderr); err != nil {
+		t.Fatalf("send() error = %v", err)
+	}
+	want := `v2 tcp4 192.0.2.1:5000 -> ` + l.Addr().String() + ` authority="example.com" crc32c=0x`
+	if !strings.HasPrefix(stdout.String(), want) || !strings.HasSuffix(stdout.String(), ` ssl={client=ssl verified=true cn="client"}`+"\nhello\n") {
+		t.Fatalf("stdout = %q, want %q, the SSL TLV and the echo", stdout.String(), want)
+	}
+	if !strings.HasPrefix(stderr.String(), "ppsend: header "+want) || !strings.HasSuffix(stderr.String(), " (wrong checksum)\n") {
+		t.Fatalf("stderr = %q", stderr.String())
+	}
+}
+
+func Test_send_datagrams(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			// reply with the header and the payload
+			reply := []byte("error")
+			if d, hn, err := proxyproto.ParseBytes(buf[:n]); err == nil {
+				reply, _ = d.MarshalText()
+				reply = append(append(reply, ' '), buf[hn:n]...)
+			}
+			pc.WriteTo(reply, addr)
+		}
+	}()
+
+	o := &sendOptions{
+		header:  headerOptions{dst: "192.0.2.2:53"},
+		udp:     true,
+		timeout: time.Second,
+		wait:    200 * time.Millisecond,
+	}
+	var stdout, stderr bytes.Buffer
+	if err := send(pc.LocalAddr().String(), o, strings.NewReader("query"), &stdout, &stderr); err != nil {
+		t.Fatalf("send() error = %v", err)
+	}
+	if want := " -> 192.0.2.2:53 query"; !strings.HasPrefix(stdout.String(), "v2 udp4 127.0.0.1:") || !strings.HasSuffix(stdout.String(), want) {
+		t.Fatalf("stdout = %q, want a udp4 header to 192.0.2.2:53 and the payload", stdout.String())
+	}
+	if stderr.Len() != 0 {
+		t.Fatalf("stderr = %q, want nothing without -verbose", stderr.String())
+	}
+}
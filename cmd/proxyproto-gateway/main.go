@@ -0,0 +1,254 @@
+// Command proxyproto-gateway terminates TLS and forwards the plaintext to backends with
+// a PROXY protocol v2 header carrying the TLS details in the SSL TLV, like HAProxy's
+// send-proxy-v2-ssl-cn:
+//
+//	proxyproto-gateway -listen :443 -cert server.pem -key server-key.pem \
+//	    -client-ca clients.pem -client-auth verify-if-given \
+//	    -backend 10.0.0.2:8080,10.0.0.3:8080
+//
+// With -cert-chain-tlv, the client certificate chain is also sent in a custom TLV for
+// backends that read it with Data.ClientCertChain.
+//
+// The certificate and key are reloaded on SIGHUP. SIGINT and SIGTERM stop accepting
+// connections and wait up to -grace for open ones to finish.
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/everettcaleb/go-proxyproto"
+)
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"none":               tls.NoClientCert,
+	"request":            tls.RequestClientCert,
+	"require":            tls.RequireAnyClientCert,
+	"verify-if-given":    tls.VerifyClientCertIfGiven,
+	"require-and-verify": tls.RequireAndVerifyClientCert,
+}
+
+func main() {
+	listen := flag.String("listen", ":443", "address to accept TLS connections on")
+	certFile := flag.String("cert", "", "PEM certificate chain file")
+	keyFile := flag.String("key", "", "PEM private key file")
+	caFile := flag.String("client-ca", "", "PEM file of CAs that verify client certificates")
+	clientAuth := flag.String("client-auth", "none", "client certificate policy: none, request, require, verify-if-given or require-and-verify")
+	alpn := flag.String("alpn", "", "comma-separated ALPN protocols to offer, e.g. h2,http/1.1")
+	backends := flag.String("backend", "", "comma-separated backend addresses")
+	strategy := flag.String("strategy", "round-robin", "backend strategy: round-robin, least-connections or source-hash")
+	acceptProxy := flag.Bool("accept-proxy", false, "read a PROXY header from inbound connections before the TLS handshake")
+	headerTimeout := flag.Duration("header-timeout", 5*time.Second, "timeout for reading inbound PROXY headers")
+	idleTimeout := flag.Duration("idle-timeout", 0, "close connections without traffic for this long (0 disables)")
+	certChainTLV := flag.String("cert-chain-tlv", "", "also send the client certificate chain in this custom TLV type, e.g. 0xe0")
+	grace := flag.Duration("grace", 30*time.Second, "how long to wait for open connections on shutdown")
+	flag.Parse()
+
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	certs := &certStore{certFile: *certFile, keyFile: *keyFile}
+	if err := certs.reload(); err != nil {
+		logger.Fatal(err)
+	}
+	config, err := tlsConfig(certs, *caFile, *clientAuth, *alpn)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	var s proxyproto.PoolStrategy
+	if err := s.UnmarshalText([]byte(*strategy)); err != nil {
+		logger.Fatal(err)
+	}
+	if *backends == "" {
+		logger.Fatal("no -backend given")
+	}
+	pool, err := proxyproto.NewPool("tcp", strings.Split(*backends, ","), proxyproto.WithPoolStrategy(s))
+	if err != nil {
+		logger.Fatal(err)
+	}
+	defer pool.Close()
+
+	gatewayOpts := []proxyproto.GatewayOption{
+		proxyproto.WithGatewayIdleTimeout(*idleTimeout),
+		proxyproto.WithGatewayHeaderTimeout(*headerTimeout),
+		proxyproto.WithGatewayErrorLog(logger),
+	}
+	if *certChainTLV != "" {
+		var t proxyproto.TLVType
+		if err := t.UnmarshalText([]byte(*certChainTLV)); err != nil {
+			logger.Fatal(err)
+		}
+		if t < proxyproto.TLVTypeMinCustom || t > proxyproto.TLVTypeMaxCustom {
+			logger.Fatalf("-cert-chain-tlv %v is not a custom TLV type (0xe0-0xef)", t)
+		}
+		gatewayOpts = append(gatewayOpts, proxyproto.WithGatewayClientCertChain(proxyproto.WithClientCertChainTLVType(t)))
+	}
+
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	srv := &server{
+		gateway:     proxyproto.NewGateway(config, pool.Dial, gatewayOpts...),
+		acceptProxy: *acceptProxy,
+	}
+	go srv.serve(l)
+	logger.Printf("listening on %v", l.Addr())
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range sigs {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if err := certs.reload(); err != nil {
+			logger.Printf("reload failed, keeping the previous certificate: %v", err)
+			continue
+		}
+		logger.Printf("reloaded %v", *certFile)
+	}
+
+	logger.Printf("shutting down")
+	l.Close()
+	done := make(chan struct{})
+	go func() {
+		srv.conns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(*grace):
+		logger.Printf("closing open connections")
+		srv.closeAll()
+	}
+	<-done
+}
+
+// certStore holds the current certificate, reloaded from its files
+type certStore struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Value // *tls.Certificate
+}
+
+func (s *certStore) reload() error {
+	c, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return err
+	}
+	s.cert.Store(&c)
+	return nil
+}
+
+func (s *certStore) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.cert.Load().(*tls.Certificate), nil
+}
+
+// tlsConfig builds the server config from the command line flags
+func tlsConfig(certs *certStore, caFile, clientAuth, alpn string) (*tls.Config, error) {
+	auth, ok := clientAuthTypes[clientAuth]
+	if !ok {
+		return nil, fmt.Errorf("unknown -client-auth %q", clientAuth)
+	}
+	c := &tls.Config{
+		GetCertificate: certs.getCertificate,
+		ClientAuth:     auth,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if alpn != "" {
+		c.NextProtos = strings.Split(alpn, ",")
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		c.ClientCAs = x509.NewCertPool()
+		if !c.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %v", caFile)
+		}
+	} else if auth >= tls.VerifyClientCertIfGiven {
+		return nil, fmt.Errorf("-client-auth %v needs -client-ca", clientAuth)
+	}
+	return c, nil
+}
+
+// server runs the gateway on a listener, keeping track of open connections
+type server struct {
+	gateway     *proxyproto.Gateway
+	acceptProxy bool
+	conns       sync.WaitGroup
+
+	mu   sync.Mutex
+	open map[*trackedConn]struct{}
+}
+
+// serve runs the gateway on l until l is closed
+func (s *server) serve(l net.Listener) error {
+	var tl net.Listener = &trackingListener{Listener: l, s: s}
+	if s.acceptProxy {
+		tl = proxyproto.WrapListener(tl)
+	}
+	return s.gateway.Serve(tl)
+}
+
+// closeAll closes the open connections
+func (s *server) closeAll() {
+	s.mu.Lock()
+	open := make([]*trackedConn, 0, len(s.open))
+	for c := range s.open {
+		open = append(open, c)
+	}
+	s.mu.Unlock()
+	for _, c := range open {
+		c.Close()
+	}
+}
+
+// trackingListener counts the connections it accepts as open until they are closed
+type trackingListener struct {
+	net.Listener
+	s *server
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	c := &trackedConn{Conn: conn, s: l.s}
+	l.s.conns.Add(1)
+	l.s.mu.Lock()
+	if l.s.open == nil {
+		l.s.open = make(map[*trackedConn]struct{})
+	}
+	l.s.open[c] = struct{}{}
+	l.s.mu.Unlock()
+	return c, nil
+}
+
+type trackedConn struct {
+	net.Conn
+	s    *server
+	once sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		c.s.mu.Lock()
+		delete(c.s.open, c)
+		c.s.mu.Unlock()
+		c.s.conns.Done()
+	})
+	return err
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/everettcaleb/go-proxyproto"
+)
+
+// writeCertificate writes a self-signed certificate and its key as PEM files
+func writeCertificate(t *testing.T, dir, name, cn string) (certFile, keyFile string, cert *x509.Certificate, tlsCert tls.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		DNSNames:              []string{cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error = %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey() error = %v", err)
+	}
+	certFile = filepath.Join(dir, name+".pem")
+	keyFile = filepath.Join(dir, name+"-key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	cert, _ = x509.ParseCertificate(der)
+	tlsCert, err = tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("LoadX509KeyPair() error = %v", err)
+	}
+	return certFile, keyFile, cert, tlsCert
+}
+
+func Test_server(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, serverCert, _ := writeCertificate(t, dir, "server", "gw.example.com")
+	caFile, _, _, clientCert := writeCertificate(t, dir, "client", "client.example.com")
+
+	certs := &certStore{certFile: certFile, keyFile: keyFile}
+	if err := certs.reload(); err != nil {
+		t.Fatalf("reload() error = %v", err)
+	}
+	config, err := tlsConfig(certs, caFile, "require-and-verify", "h2,http/1.1")
+	if err != nil {
+		t.Fatalf("tlsConfig() error = %v", err)
+	}
+
+	backend, err := proxyproto.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer backend.Close()
+	got := make(chan *proxyproto.Data, 1)
+	go func() {
+		c, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		got <- c.(*proxyproto.Conn).ProxyData()
+		io.Copy(c, c)
+	}()
+	pool, err := proxyproto.NewPool("tcp", []string{backend.Addr().String()})
+	if err != nil {
+		t.Fatalf("NewPool() error = %v", err)
+	}
+	defer pool.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer l.Close()
+	s := &server{
+		gateway: proxyproto.NewGateway(config, pool.Dial,
+			proxyproto.WithGatewayHeaderTimeout(time.Second),
+			proxyproto.WithGatewayErrorLog(log.New(io.Discard, "", 0))),
+		acceptProxy: true,
+	}
+	go s.serve(l)
+
+	// a client that never sends its header does not hold up the others
+	idle, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer idle.Close()
+
+	raw, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer raw.Close()
+	raw.Write([]byte("PROXY TCP4 10.20.30.40 40.30.20.10 8000 443\r\n"))
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCert)
+	c := tls.Client(raw, &tls.Config{
+		ServerName:   "gw.example.com",
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{clientCert},
+	})
+	c.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("ReadFull() = %q, %v", buf, err)
+	}
+
+	d := <-got
+	if d.Source().String() != "10.20.30.40:8000" {
+		t.Fatalf("header source = %v, want the upstream client", d.Source())
+	}
+	ssl, ok := d.TLVGetSSLView()
+	if !ok || !ssl.Verified() || ssl.Client() != proxyproto.TLVSSLClientSSL|proxyproto.TLVSSLClientCertConn|proxyproto.TLVSSLClientCertSess {
+		t.Fatalf("TLVGetSSLView() = %v, %v", ssl.Data(), ok)
+	}
+	if cn, _ := ssl.SubTLV(proxyproto.TLVSubTypeSSLCN); string(cn) != "client.example.com" {
+		t.Fatalf("SSL CN = %q, want %q", cn, "client.example.com")
+	}
+	if ka, _ := ssl.SubTLV(proxyproto.TLVSubTypeSSLKeyAlg); string(ka) != "EC256" {
+		t.Fatalf("SSL key alg = %q, want %q", ka, "EC256")
+	}
+
+	// closing the open connections lets a shutdown finish
+	s.closeAll()
+	done := make(chan struct{})
+	go func() {
+		s.conns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("connections still open after closeAll()")
+	}
+}
+
+func Test_tlsConfig(t *testing.T) {
+	certs := &certStore{}
+	if _, err := tlsConfig(certs, "", "bogus", ""); err == nil {
+		t.Fatalf("tlsConfig() accepted an unknown -client-auth")
+	}
+	if _, err := tlsConfig(certs, "", "require-and-verify", ""); err == nil {
+		t.Fatalf("tlsConfig() accepted verification without -client-ca")
+	}
+	c, err := tlsConfig(certs, "", "request", "h2")
+	if err != nil || c.ClientAuth != tls.RequestClientCert || len(c.NextProtos) != 1 {
+		t.Fatalf("tlsConfig() = %+v, %v", c, err)
+	}
+	if err := (&certStore{certFile: "missing.pem", keyFile: "missing.pem"}).reload(); err == nil {
+		t.Fatalf("reload() succeeded without files")
+	}
+}
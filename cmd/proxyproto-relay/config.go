@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/everettcaleb/go-proxyproto"
+)
+
+const (
+	defaultDialTimeout        = 5 * time.Second
+	defaultHeaderTimeout      = 5 * time.Second
+	defaultHealthCheckTimeout = 2 * time.Second
+	defaultEjectAfter         = 3
+	defaultEjectFor           = 30 * time.Second
+)
+
+// Config is the JSON configuration file
+type Config struct {
+	Routes []*Route `json:"routes"`
+}
+
+// Route forwards connections accepted on its listen addresses to its backends
+type Route struct {
+	// Name identifies the route in logs
+	Name string `json:"name"`
+	// Listen is the list of TCP addresses to accept connections on
+	Listen []string `json:"listen"`
+	// AcceptProxy makes the route read a PROXY header from every inbound connection
+	// and describe the original client to the backend
+	AcceptProxy bool `json:"acceptProxy,omitempty"`
+	// Backends is the list of TCP addresses to forward connections to
+	Backends []string `json:"backends"`
+	// Strategy picks a backend for each connection: "round-robin" (the default),
+	// "least-connections" or "source-hash" on the client address from the header
+	Strategy proxyproto.PoolStrategy `json:"strategy,omitempty"`
+	// HealthCheck enables active health checks, which send v2 LOCAL headers
+	HealthCheck *HealthCheck `json:"healthCheck,omitempty"`
+	// EjectAfter is the number of consecutive failed dials that take a backend out of
+	// rotation for EjectFor, 3 and 30s by default. -1 disables ejection
+	EjectAfter int      `json:"ejectAfter,omitempty"`
+	EjectFor   duration `json:"ejectFor,omitempty"`
+	// Version is the PROXY header version sent to backends, 1 or 2 (the default)
+	Version proxyproto.Version `json:"version,omitempty"`
+	// TLVs are added to every v2 header, in the same format as Data's JSON "tlvs"
+	TLVs tlvSet `json:"tlvs,omitempty"`
+	// ForwardTLVs lists the TLV types that are copied from inbound headers, by name
+	// (e.g. "authority") or number (e.g. "0xe0"). Other inbound TLVs are dropped
+	ForwardTLVs []proxyproto.TLVType `json:"forwardTLVs,omitempty"`
+	// DialTimeout bounds connecting to a backend, 5s by default
+	DialTimeout duration `json:"dialTimeout,omitempty"`
+	// HeaderTimeout bounds reading inbound PROXY headers, 5s by default
+	HeaderTimeout duration `json:"headerTimeout,omitempty"`
+	// IdleTimeout closes connections without traffic for this long, disabled by default
+	IdleTimeout duration `json:"idleTimeout,omitempty"`
+	// Provenance makes the route add itself to the provenance TLV of v2 headers, keeping
+	// the hops of inbound headers
+	Provenance *Provenance `json:"provenance,omitempty"`
+
+	pool *proxyproto.Pool
+}
+
+// Provenance configures how a route records itself as a hop, see proxyproto.Hop
+type Provenance struct {
+	// ID identifies this proxy in the hops
+	ID string `json:"id,omitempty"`
+	// TLV is the custom TLV type carrying the hops, "0xe1" by default
+	TLV proxyproto.TLVType `json:"tlv,omitempty"`
+	// MaxHops is the number of hops after which connections are refused, 16 by default
+	MaxHops int `json:"maxHops,omitempty"`
+}
+
+// options gets the library options for the provenance TLV
+func (p *Provenance) options() []proxyproto.ProvenanceOption {
+	opts := []proxyproto.ProvenanceOption{proxyproto.WithProvenanceTLVType(p.TLV)}
+	if p.MaxHops > 0 {
+		opts = append(opts, proxyproto.WithProvenanceMaxHops(p.MaxHops))
+	}
+	return opts
+}
+
+// HealthCheck configures the active health checks of a route's backends
+type HealthCheck struct {
+	// Interval is the time between checks
+	Interval duration `json:"interval"`
+	// Timeout bounds each check, 2s by default
+	Timeout duration `json:"timeout,omitempty"`
+}
+
+// tlvSet decodes TLVs in the same format as the "tlvs" object of proxyproto.Data's JSON
+type tlvSet map[proxyproto.TLVType][]byte
+
+func (s *tlvSet) UnmarshalJSON(b []byte) error {
+	var d proxyproto.Data
+	if err := json.Unmarshal([]byte(`{"tlvs":`+string(b)+`}`), &d); err != nil {
+		return err
+	}
+	*s = d.TLVs
+	return nil
+}
+
+// duration decodes a time.Duration from a string such as "1m30s"
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("durations must be strings such as \"30s\": %v", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	if v < 0 {
+		return fmt.Errorf("durations cannot be negative, got %v", s)
+	}
+	*d = duration(v)
+	return nil
+}
+
+// loadConfig reads and validates a configuration file
+func loadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(b)
+}
+
+// parseConfig decodes and validates a configuration, filling in defaults
+func parseConfig(b []byte) (*Config, error) {
+	var c Config
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	if len(c.Routes) == 0 {
+		return nil, fmt.Errorf("invalid config: no routes")
+	}
+
+	seen := make(map[string]string)
+	for i, r := range c.Routes {
+		if r == nil {
+			return nil, fmt.Errorf("invalid config: route %d is null", i)
+		}
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("route%d", i)
+		}
+		if len(r.Listen) == 0 {
+			return nil, fmt.Errorf("invalid config: route %q has no listen addresses", r.Name)
+		}
+		for _, addr := range r.Listen {
+			if other, ok := seen[addr]; ok {
+				return nil, fmt.Errorf("invalid config: routes %q and %q both listen on %v", other, r.Name, addr)
+			}
+			seen[addr] = r.Name
+		}
+		if len(r.Backends) == 0 {
+			return nil, fmt.Errorf("invalid config: route %q has no backends", r.Name)
+		}
+		switch r.Version {
+		case 0:
+			r.Version = proxyproto.Version2
+		case proxyproto.Version1, proxyproto.Version2:
+		default:
+			return nil, fmt.Errorf("invalid config: route %q has unknown header version %d", r.Name, int(r.Version))
+		}
+		if hc := r.HealthCheck; hc != nil {
+			if hc.Interval == 0 {
+				return nil, fmt.Errorf("invalid config: route %q has a health check without an interval", r.Name)
+			}
+			if hc.Timeout == 0 {
+				hc.Timeout = duration(defaultHealthCheckTimeout)
+			}
+		}
+		if r.EjectAfter == 0 {
+			r.EjectAfter = defaultEjectAfter
+		}
+		if r.EjectFor == 0 {
+			r.EjectFor = duration(defaultEjectFor)
+		}
+		if r.DialTimeout == 0 {
+			r.DialTimeout = duration(defaultDialTimeout)
+		}
+		if r.HeaderTimeout == 0 {
+			r.HeaderTimeout = duration(defaultHeaderTimeout)
+		}
+		if p := r.Provenance; p != nil {
+			if r.Version != proxyproto.Version2 {
+				return nil, fmt.Errorf("invalid config: route %q records provenance, which needs version 2 headers", r.Name)
+			}
+			if p.TLV == 0 {
+				p.TLV = proxyproto.DefaultProvenanceTLVType
+			}
+			if p.TLV < proxyproto.TLVTypeMinCustom || p.TLV > proxyproto.TLVTypeMaxCustom {
+				return nil, fmt.Errorf("invalid config: route %q has provenance TLV %v outside the custom range", r.Name, p.TLV)
+			}
+			if len(p.ID) > 255 {
+				return nil, fmt.Errorf("invalid config: route %q has a provenance ID longer than 255 bytes", r.Name)
+			}
+			if p.MaxHops < 0 {
+				return nil, fmt.Errorf("invalid config: route %q has a negative provenance maxHops", r.Name)
+			}
+		}
+	}
+	return &c, nil
+}
@@ -0,0 +1,89 @@
+// Command proxyproto-relay is a TCP reverse proxy that sends PROXY protocol headers
+// to its backends.
+//
+// Routes are read from a JSON config file, for example:
+//
+//	{
+//	  "routes": [
+//	    {
+//	      "name": "web",
+//	      "listen": [":443"],
+//	      "backends": ["10.0.0.2:8443", "10.0.0.3:8443"],
+//	      "strategy": "least-connections",
+//	      "healthCheck": {"interval": "10s", "timeout": "2s"},
+//	      "version": 2,
+//	      "tlvs": {"netns": "blue"},
+//	      "idleTimeout": "5m"
+//	    },
+//	    {
+//	      "name": "chained",
+//	      "listen": ["127.0.0.1:8080"],
+//	      "acceptProxy": true,
+//	      "forwardTLVs": ["authority", "ssl"],
+//	      "backends": ["10.0.0.4:8080"],
+//	      "version": 1
+//	    },
+//	    {
+//	      "name": "tier2",
+//	      "listen": [":9443"],
+//	      "acceptProxy": true,
+//	      "backends": ["10.0.0.5:8443"],
+//	      "provenance": {"id": "tier2-a", "maxHops": 8}
+//	    }
+//	  ]
+//	}
+//
+// The config is reloaded on SIGHUP; connections that are already open keep using
+// the route they were accepted with. SIGINT and SIGTERM stop accepting connections
+// and wait up to -grace for open ones to finish.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	configPath := flag.String("config", "proxyproto-relay.json", "path to the JSON config file")
+	grace := flag.Duration("grace", 30*time.Second, "how long to wait for open connections on shutdown")
+	flag.Parse()
+
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	s := newServer(logger)
+	if err := s.apply(cfg); err != nil {
+		logger.Fatal(err)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range sigs {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		cfg, err := loadConfig(*configPath)
+		if err == nil {
+			err = s.apply(cfg)
+		}
+		if err != nil {
+			logger.Printf("reload failed, keeping the previous config: %v", err)
+			continue
+		}
+		logger.Printf("reloaded %v", *configPath)
+	}
+
+	logger.Printf("shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), *grace)
+	defer cancel()
+	if err := s.shutdown(ctx); err != nil {
+		logger.Printf("closed open connections: %v", err)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/everettcaleb/go-proxyproto"
+)
+
+// server runs the listeners of every route. Applying a new config keeps the
+// listeners whose address is unchanged, so reloads do not drop connections
+type server struct {
+	logger *log.Logger
+
+	// ctx is passed to every relay and cancelled to force connections closed
+	ctx    context.Context
+	cancel context.CancelFunc
+	conns  sync.WaitGroup
+
+	mu        sync.Mutex
+	listeners map[string]*routeListener // keyed by configured listen address
+	routes    []*Route                  // routes of the applied config, to close their pools
+	closed    bool
+}
+
+// routeListener accepts connections for the route currently assigned to its address
+type routeListener struct {
+	net.Listener
+	route atomic.Value // *Route
+	done  chan struct{}
+}
+
+func newServer(logger *log.Logger) *server {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &server{
+		logger:    logger,
+		ctx:       ctx,
+		cancel:    cancel,
+		listeners: make(map[string]*routeListener),
+	}
+}
+
+// apply switches the server to cfg. New addresses are opened before anything else
+// changes, so if one fails the previous config stays in effect. Listeners for addresses
+// no longer in cfg are closed, but their connections keep running
+func (s *server) apply(cfg *Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.New("server is shut down")
+	}
+
+	routes := make(map[string]*Route)
+	opened := make(map[string]*routeListener)
+	fail := func(err error) error {
+		for _, o := range opened {
+			o.Close()
+		}
+		closePools(cfg.Routes)
+		return err
+	}
+	for _, r := range cfg.Routes {
+		pool, err := newPool(r)
+		if err != nil {
+			return fail(err)
+		}
+		r.pool = pool
+		for _, addr := range r.Listen {
+			routes[addr] = r
+			if _, ok := s.listeners[addr]; ok {
+				continue
+			}
+			l, err := net.Listen("tcp", addr)
+			if err != nil {
+				return fail(err)
+			}
+			opened[addr] = &routeListener{Listener: l, done: make(chan struct{})}
+		}
+	}
+
+	for addr, rl := range s.listeners {
+		if _, ok := routes[addr]; !ok {
+			rl.Close()
+			<-rl.done
+			delete(s.listeners, addr)
+			s.logger.Printf("stopped listening on %v", rl.Addr())
+		}
+	}
+	for addr, r := range routes {
+		if rl, ok := s.listeners[addr]; ok {
+			rl.route.Store(r)
+			continue
+		}
+		rl := opened[addr]
+		rl.route.Store(r)
+		s.listeners[addr] = rl
+		go s.serve(rl)
+		s.logger.Printf("route %q listening on %v", r.Name, rl.Addr())
+	}
+	closePools(s.routes)
+	s.routes = cfg.Routes
+	return nil
+}
+
+// newPool creates the backend pool of a route
+func newPool(r *Route) (*proxyproto.Pool, error) {
+	d := net.Dialer{Timeout: time.Duration(r.DialTimeout)}
+	opts := []proxyproto.PoolOption{
+		proxyproto.WithPoolStrategy(r.Strategy),
+		proxyproto.WithPoolDialer(d.DialContext),
+		proxyproto.WithPoolEjection(r.EjectAfter, time.Duration(r.EjectFor)),
+	}
+	if hc := r.HealthCheck; hc != nil {
+		opts = append(opts, proxyproto.WithPoolHealthCheck(time.Duration(hc.Interval), time.Duration(hc.Timeout), nil))
+	}
+	return proxyproto.NewPool("tcp", r.Backends, opts...)
+}
+
+// closePools stops the health checks of routes that are no longer used. Their open
+// connections are not affected
+func closePools(routes []*Route) {
+	for _, r := range routes {
+		if r.pool != nil {
+			r.pool.Close()
+		}
+	}
+}
+
+// addrs returns the bound address of every listener, keyed by configured address
+func (s *server) addrs() map[string]net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := make(map[string]net.Addr, len(s.listeners))
+	for addr, rl := range s.listeners {
+		m[addr] = rl.Addr()
+	}
+	return m
+}
+
+// shutdown closes every listener and waits for open connections to finish. Once ctx
+// is done the remaining connections are closed
+func (s *server) shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	for addr, rl := range s.listeners {
+		rl.Close()
+		<-rl.done
+		delete(s.listeners, addr)
+	}
+	closePools(s.routes)
+	s.routes = nil
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.conns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		s.cancel()
+		return nil
+	case <-ctx.Done():
+		s.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (s *server) serve(rl *routeListener) {
+	defer close(rl.done)
+	var delay time.Duration
+	for {
+		conn, err := rl.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// like net/http, back off and keep the listener, which may recover
+			// (for example once file descriptors are freed)
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else {
+				delay *= 2
+			}
+			if delay > time.Second {
+				delay = time.Second
+			}
+			s.logger.Printf("accept on %v failed: %v; retrying in %v", rl.Addr(), err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		s.conns.Add(1)
+		go func() {
+			defer s.conns.Done()
+			s.handle(rl, conn)
+		}()
+	}
+}
+
+// handle relays one connection using the route assigned to its listener when it was accepted
+func (s *server) handle(rl *routeListener, conn net.Conn) {
+	r := rl.route.Load().(*Route)
+	defer conn.Close()
+
+	client := conn
+	if r.AcceptProxy {
+		ctx, cancel := context.WithTimeout(s.ctx, time.Duration(r.HeaderTimeout))
+		c, err := proxyproto.WrapConnContext(ctx, conn)
+		cancel()
+		if err != nil {
+			s.logger.Printf("route %q: %v: %v", r.Name, conn.RemoteAddr(), err)
+			return
+		}
+		client = c
+	}
+
+	opts := proxyproto.RelayOptions{
+		Version:     r.Version,
+		TLVs:        r.TLVs,
+		IdleTimeout: time.Duration(r.IdleTimeout),
+	}
+	if d, ok := proxyproto.DataFromConn(client); ok && d.Command == proxyproto.CommandProxy && d.AddressFamily != proxyproto.AddressFamilyLocal {
+		keep := r.ForwardTLVs
+		if r.Provenance != nil {
+			keep = append(keep[:len(keep):len(keep)], r.Provenance.TLV)
+		}
+		opts.Data = forwardData(d, keep)
+	}
+	if p := r.Provenance; p != nil {
+		if opts.Data == nil {
+			d, err := proxyproto.NewDataFromConn(client)
+			if err != nil {
+				s.logger.Printf("route %q: %v: %v", r.Name, client.RemoteAddr(), err)
+				return
+			}
+			opts.Data = d
+		}
+		hop := proxyproto.Hop{Time: time.Now(), ID: p.ID}
+		if a, ok := client.LocalAddr().(*net.TCPAddr); ok {
+			ap := a.AddrPort()
+			hop.Addr = netip.AddrPortFrom(ap.Addr().WithZone(""), ap.Port())
+		}
+		if err := opts.Data.AppendHop(hop, p.options()...); err != nil {
+			s.logger.Printf("route %q: %v: %v", r.Name, client.RemoteAddr(), err)
+			return
+		}
+	}
+
+	backend, err := r.pool.Dial(s.ctx, clientData(client, opts.Data))
+	if err != nil {
+		s.logger.Printf("route %q: %v: %v", r.Name, client.RemoteAddr(), err)
+		return
+	}
+	stats, err := proxyproto.Relay(s.ctx, client, backend, opts)
+	if err != nil {
+		s.logger.Printf("route %q: %v -> %v: %v (sent %d, received %d bytes)", r.Name, client.RemoteAddr(), backend.RemoteAddr(), err, stats.ClientToBackend, stats.BackendToClient)
+	}
+}
+
+// clientData describes the client for picking a backend: the inbound header if
+// there is one, or else the client's address
+func clientData(client net.Conn, inbound *proxyproto.Data) *proxyproto.Data {
+	if inbound != nil {
+		return inbound
+	}
+	src, ok1 := client.RemoteAddr().(*net.TCPAddr)
+	dest, ok2 := client.LocalAddr().(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return nil
+	}
+	d, err := proxyproto.NewData(proxyproto.TransportStream, src.AddrPort(), dest.AddrPort())
+	if err != nil {
+		return nil
+	}
+	return d
+}
+
+// forwardData copies an inbound header for the backend, keeping only the selected TLVs
+func forwardData(d *proxyproto.Data, keep []proxyproto.TLVType) *proxyproto.Data {
+	n := d.Clone()
+	n.Version = 0
+	// a set map replaces the received TLVs, even when it is empty
+	n.TLVs = make(map[proxyproto.TLVType][]byte, len(keep))
+	for _, t := range keep {
+		if v, ok := d.TLV(t); ok {
+			n.TLVs[t] = v
+		}
+	}
+	return n
+}
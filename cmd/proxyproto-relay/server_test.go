@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/everettcaleb/go-proxyproto"
+)
+
+// testBackend accepts PROXY protocol connections and sends every parsed header
+// on the returned channel, echoing the payload back
+func testBackend(t *testing.T) (string, <-chan *proxyproto.Data) {
+	t.Helper()
+	l, err := proxyproto.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	headers := make(chan *proxyproto.Data, 16)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			headers <- c.(*proxyproto.Conn).ProxyData()
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l.Addr().String(), headers
+}
+
+func testServer(t *testing.T, config string) *server {
+	t.Helper()
+	cfg, err := parseConfig([]byte(config))
+	if err != nil {
+		t.Fatalf("parseConfig() error = %v", err)
+	}
+	s := newServer(log.New(io.Discard, "", 0))
+	if err := s.apply(cfg); err != nil {
+		t.Fatalf("apply() error = %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.shutdown(ctx)
+	})
+	return s
+}
+
+// roundTrip sends msg through the relay at addr and checks that it is echoed back
+func roundTrip(t *testing.T, addr string, prefix, msg string) net.Conn {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	if _, err := c.Write([]byte(prefix + msg)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	c.(*net.TCPConn).CloseWrite()
+	got, err := io.ReadAll(c)
+	if err != nil || string(got) != msg {
+		t.Fatalf("ReadAll() = %q, %v, want %q", got, err, msg)
+	}
+	c.Close()
+	return c
+}
+
+func recvHeader(t *testing.T, headers <-chan *proxyproto.Data) *proxyproto.Data {
+	t.Helper()
+	select {
+	case d := <-headers:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatalf("backend did not receive a connection")
+		return nil
+	}
+}
+
+func Test_server(t *testing.T) {
+	backend, headers := testBackend(t)
+	s := testServer(t, `{"routes": [
+		{"name": "v2", "listen": ["127.0.0.1:0"], "backends": ["`+backend+`"], "tlvs": {"authority": "example.com"}},
+		{"name": "v1", "listen": ["localhost:0"], "backends": ["`+backend+`"], "version": 1}
+	]}`)
+	addrs := s.addrs()
+
+	c := roundTrip(t, addrs["127.0.0.1:0"].String(), "", "hello")
+	d := recvHeader(t, headers)
+	if d.Version != proxyproto.Version2 || d.Source().String() != c.LocalAddr().String() {
+		t.Fatalf("header = %v, want v2 from %v", d, c.LocalAddr())
+	}
+	if a, _ := d.TLVGetAuthority(); a != "example.com" {
+		t.Fatalf("TLVGetAuthority() = %q, want %q", a, "example.com")
+	}
+
+	c = roundTrip(t, addrs["localhost:0"].String(), "", "hello")
+	d = recvHeader(t, headers)
+	if d.Version != proxyproto.Version1 || d.Source().String() != c.LocalAddr().String() {
+		t.Fatalf("header = %v, want v1 from %v", d, c.LocalAddr())
+	}
+}
+
+// failOnceListener fails its first Accept with an error that is not a timeout
+type failOnceListener struct {
+	net.Listener
+	failed int32
+}
+
+func (l *failOnceListener) Accept() (net.Conn, error) {
+	if atomic.CompareAndSwapInt32(&l.failed, 0, 1) {
+		return nil, errors.New("accept: too many open files")
+	}
+	return l.Listener.Accept()
+}
+
+func Test_server_acceptError(t *testing.T) {
+	backend, headers := testBackend(t)
+	s := testServer(t, `{"routes": [{"name": "r", "listen": ["127.0.0.1:0"], "backends": ["`+backend+`"]}]}`)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	rl := &routeListener{Listener: &failOnceListener{Listener: l}, done: make(chan struct{})}
+	s.mu.Lock()
+	rl.route.Store(s.listeners["127.0.0.1:0"].route.Load())
+	s.mu.Unlock()
+	go s.serve(rl)
+	defer func() {
+		rl.Close()
+		<-rl.done
+	}()
+
+	// the listener keeps accepting after the failure
+	roundTrip(t, l.Addr().String(), "", "hello")
+	recvHeader(t, headers)
+}
+
+func Test_server_acceptProxy(t *testing.T) {
+	backend, headers := testBackend(t)
+	s := testServer(t, `{"routes": [
+		{"listen": ["127.0.0.1:0"], "acceptProxy": true, "forwardTLVs": ["authority"], "backends": ["`+backend+`"], "tlvs": {"netns": "blue"}}
+	]}`)
+	addr := s.addrs()["127.0.0.1:0"].String()
+
+	in := &proxyproto.Data{
+		AddressFamily: proxyproto.AddressFamilyIPv4,
+		Transport:     proxyproto.TransportStream,
+		SourceAddr:    []byte{10, 20, 30, 40},
+		SourcePort:    8000,
+		DestAddr:      []byte{40, 30, 20, 10},
+		DestPort:      9000,
+		TLVs: map[proxyproto.TLVType][]byte{
+			proxyproto.TLVTypeAuthority: []byte("example.com"),
+			proxyproto.TLVTypeALPN:      []byte("h2"),
+		},
+	}
+	hdr, err := in.AppendHeader(nil, proxyproto.Version2)
+	if err != nil {
+		t.Fatalf("AppendHeader() error = %v", err)
+	}
+	roundTrip(t, addr, string(hdr), "hello")
+
+	d := recvHeader(t, headers)
+	want := in.Clone()
+	want.Version = proxyproto.Version2
+	want.TLVs = map[proxyproto.TLVType][]byte{
+		proxyproto.TLVTypeAuthority: []byte("example.com"),
+		proxyproto.TLVTypeNetNS:     []byte("blue"),
+	}
+	if !d.Equal(want) {
+		t.Fatalf("header = %v, want %v", d, want)
+	}
+
+	// Connections without a header are dropped
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer c.Close()
+	c.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	if got, _ := io.ReadAll(c); len(got) != 0 {
+		t.Fatalf("ReadAll() = %q, want nothing", got)
+	}
+}
+
+func Test_server_provenance(t *testing.T) {
+	backend, headers := testBackend(t)
+	s := testServer(t, `{"routes": [
+		{"name": "edge", "listen": ["127.0.0.1:0"], "backends": ["`+backend+`"], "provenance": {"id": "edge-1"}},
+		{"name": "tier2", "listen": ["localhost:0"], "acceptProxy": true, "backends": ["`+backend+`"], "provenance": {"id": "tier2", "maxHops": 2}}
+	]}`)
+	addrs := s.addrs()
+
+	// the edge starts the list with itself
+	roundTrip(t, addrs["127.0.0.1:0"].String(), "", "hello")
+	d := recvHeader(t, headers)
+	hops, err := d.Hops()
+	if err != nil || len(hops) != 1 || hops[0].ID != "edge-1" || hops[0].Addr.String() != addrs["127.0.0.1:0"].String() || hops[0].Time.IsZero() {
+		t.Fatalf("Hops() = %v, %v, want the edge", hops, err)
+	}
+
+	// the second tier keeps the inbound hops, even though it forwards no other TLVs
+	hdr, err := d.AppendHeader(nil, proxyproto.Version2)
+	if err != nil {
+		t.Fatalf("AppendHeader() error = %v", err)
+	}
+	roundTrip(t, addrs["localhost:0"].String(), string(hdr), "hello")
+	d = recvHeader(t, headers)
+	if hops, err := d.Hops(); err != nil || len(hops) != 2 || hops[0].ID != "edge-1" || hops[1].ID != "tier2" {
+		t.Fatalf("Hops() = %v, %v, want the edge and the second tier", hops, err)
+	}
+
+	// and refuses connections that have been through too many hops
+	hdr, err = d.AppendHeader(nil, proxyproto.Version2)
+	if err != nil {
+		t.Fatalf("AppendHeader() error = %v", err)
+	}
+	c, err := net.Dial("tcp", addrs["localhost:0"].String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer c.Close()
+	c.Write(append(hdr, "hello"...))
+	if got, _ := io.ReadAll(c); len(got) != 0 {
+		t.Fatalf("ReadAll() = %q, want nothing", got)
+	}
+}
+
+func Test_server_reload(t *testing.T) {
+	backend, headers := testBackend(t)
+	s := testServer(t, `{"routes": [{"listen": ["127.0.0.1:0"], "backends": ["`+backend+`"]}]}`)
+	addr := s.addrs()["127.0.0.1:0"].String()
+
+	cfg, err := parseConfig([]byte(`{"routes": [{"listen": ["127.0.0.1:0"], "backends": ["` + backend + `"], "version": 1}]}`))
+	if err != nil {
+		t.Fatalf("parseConfig() error = %v", err)
+	}
+	if err := s.apply(cfg); err != nil {
+		t.Fatalf("apply() error = %v", err)
+	}
+	if got := s.addrs()["127.0.0.1:0"].String(); got != addr {
+		t.Fatalf("reload moved the listener from %v to %v", addr, got)
+	}
+	roundTrip(t, addr, "", "hello")
+	if d := recvHeader(t, headers); d.Version != proxyproto.Version1 {
+		t.Fatalf("header version = %v, want %v", d.Version, proxyproto.Version1)
+	}
+
+	// A config that cannot be applied leaves the old one running
+	cfg, _ = parseConfig([]byte(`{"routes": [{"listen": ["127.0.0.1:0", "256.0.0.1:0"], "backends": ["` + backend + `"]}]}`))
+	if err := s.apply(cfg); err == nil {
+		t.Fatalf("apply() succeeded with an invalid address")
+	}
+	roundTrip(t, addr, "", "hello")
+	recvHeader(t, headers)
+}
+
+func Test_server_shutdown(t *testing.T) {
+	backend, headers := testBackend(t)
+	s := testServer(t, `{"routes": [{"listen": ["127.0.0.1:0"], "backends": ["`+backend+`"]}]}`)
+	addr := s.addrs()["127.0.0.1:0"].String()
+
+	// An open connection holds shutdown until the grace period ends
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer c.Close()
+	recvHeader(t, headers)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("shutdown() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Fatalf("Dial() succeeded after shutdown")
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read() error = %v, want %v", err, io.EOF)
+	}
+}
+
+func Test_server_failover(t *testing.T) {
+	backend, headers := testBackend(t)
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	dead.Close()
+
+	s := testServer(t, `{"routes": [{"listen": ["127.0.0.1:0"], "backends": ["`+dead.Addr().String()+`", "`+backend+`"],
+		"strategy": "source-hash", "ejectAfter": 1, "ejectFor": "1h", "healthCheck": {"interval": "1h"}}]}`)
+	addr := s.addrs()["127.0.0.1:0"].String()
+	for i := 0; i < 3; i++ {
+		c := roundTrip(t, addr, "", "hello")
+		// skip the health checks
+		d := recvHeader(t, headers)
+		for d.Command == proxyproto.CommandLocal {
+			d = recvHeader(t, headers)
+		}
+		if d.Source().String() != c.LocalAddr().String() {
+			t.Fatalf("header = %v, want from %v", d, c.LocalAddr())
+		}
+	}
+}
+
+func Test_parseConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr bool
+	}{
+		{name: "valid", config: `{"routes": [{"listen": [":0"], "backends": ["b:1"], "idleTimeout": "1m", "tlvs": {"0xe0": "dead"}}]}`},
+		{name: "no routes", config: `{"routes": []}`, wantErr: true},
+		{name: "no listen", config: `{"routes": [{"backends": ["b:1"]}]}`, wantErr: true},
+		{name: "no backends", config: `{"routes": [{"listen": [":0"]}]}`, wantErr: true},
+		{name: "duplicate listen", config: `{"routes": [{"listen": [":0"], "backends": ["b:1"]}, {"listen": [":0"], "backends": ["b:1"]}]}`, wantErr: true},
+		{name: "bad version", config: `{"routes": [{"listen": [":0"], "backends": ["b:1"], "version": 3}]}`, wantErr: true},
+		{name: "bad duration", config: `{"routes": [{"listen": [":0"], "backends": ["b:1"], "idleTimeout": 5}]}`, wantErr: true},
+		{name: "bad tlv", config: `{"routes": [{"listen": [":0"], "backends": ["b:1"], "tlvs": {"0xe0": "zz"}}]}`, wantErr: true},
+		{name: "bad strategy", config: `{"routes": [{"listen": [":0"], "backends": ["b:1"], "strategy": "random"}]}`, wantErr: true},
+		{name: "health check without interval", config: `{"routes": [{"listen": [":0"], "backends": ["b:1"], "healthCheck": {"timeout": "1s"}}]}`, wantErr: true},
+		{name: "bad forward tlv", config: `{"routes": [{"listen": [":0"], "backends": ["b:1"], "forwardTLVs": ["nope"]}]}`, wantErr: true},
+		{name: "provenance", config: `{"routes": [{"listen": [":0"], "backends": ["b:1"], "provenance": {"id": "a", "tlv": "0xef", "maxHops": 4}}]}`},
+		{name: "provenance tlv", config: `{"routes": [{"listen": [":0"], "backends": ["b:1"], "provenance": {"tlv": "ssl"}}]}`, wantErr: true},
+		{name: "provenance max hops", config: `{"routes": [{"listen": [":0"], "backends": ["b:1"], "provenance": {"maxHops": -1}}]}`, wantErr: true},
+		{name: "provenance v1", config: `{"routes": [{"listen": [":0"], "backends": ["b:1"], "version": 1, "provenance": {}}]}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseConfig([]byte(tt.config))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,31 +1,116 @@
 package proxyproto
 
 import (
+	"context"
+	"errors"
+	"io"
 	"net"
+	"os"
+	"sync"
+	"syscall"
 	"time"
 )
 
+// ErrUnsupported is returned by the optional Conn methods (CloseWrite, File, SetKeepAlive,
+// etc.) when the underlying connection does not support the operation. Every *Conn has
+// these methods whatever it wraps, so an interface check on a *Conn always succeeds and
+// callers must treat ErrUnsupported as the method not being there
+var ErrUnsupported = errors.New("proxyproto: operation not supported by the underlying connection")
+
 // Conn is an implementation of net.Conn that provides Proxy Protocol v1/v2 support
 // The main feature is you can grab proxy information from Conn.ProxyData(). The expected usage is
 // that you call WrapConn to wrap this around an existing connection. This is already done in
 // Listener.Accept() if you're able to wrap an existing listener. See also, Listen, ListenTLS,
 // ListenAndServeHTTP, and ListenAndServeHTTPS which are likely more convenient to use.
 type Conn struct {
-	conn      net.Conn
-	protoData *Data
+	conn            net.Conn
+	protoData       *Data
+	headerLocalAddr bool
+
+	// bufMu guards buf, the application data that was read along with the header,
+	// and pooled, the parse buffer it points into
+	bufMu  sync.Mutex
+	buf    []byte
+	pooled *[]byte
+}
+
+// ProxyDataProvider is implemented by connections that carry Proxy Protocol data,
+// such as *Conn. Wrappers around a *Conn can implement it to expose the data directly
+type ProxyDataProvider interface {
+	ProxyData() *Data
+}
+
+// maxUnwrapDepth bounds how many wrappers DataFromConn looks through, in case of cycles
+const maxUnwrapDepth = 32
+
+// DataFromConn retrieves the proxy protocol data from conn or any connection it wraps.
+// Wrappers are looked through via a NetConn() net.Conn method (such as *tls.Conn's)
+// or an Unwrap() net.Conn method, so this works with the net.Conn handed to
+// tls.Config.GetConfigForClient callbacks, http.Server.ConnContext and similar hooks.
+// The second return value will be false if no proxy data was found
+func DataFromConn(conn net.Conn) (*Data, bool) {
+	for i := 0; conn != nil && i < maxUnwrapDepth; i++ {
+		if p, ok := conn.(ProxyDataProvider); ok {
+			d := p.ProxyData()
+			return d, d != nil
+		}
+		switch c := conn.(type) {
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		case interface{ Unwrap() net.Conn }:
+			conn = c.Unwrap()
+		default:
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// ConnOption configures optional behavior of a Conn. Options can be passed to WrapConn
+// or WrapListener
+type ConnOption func(*Conn)
+
+// WithHeaderLocalAddr makes Conn.LocalAddr() report the proxy-reported destination
+// address/port instead of the local address of the underlying connection. This is
+// the address the client originally connected to, e.g. the load balancer's virtual IP.
+// Headers without an address still fall back to the underlying connection
+func WithHeaderLocalAddr() ConnOption {
+	return func(c *Conn) {
+		c.headerLocalAddr = true
+	}
 }
 
 // WrapConn wraps the specified network connection in Proxy Protocol parsing logic.
 // The connection is immediately read to populate the proxy data.
-func WrapConn(conn net.Conn) (*Conn, error) {
-	d, err := Parse(conn)
+func WrapConn(conn net.Conn, opts ...ConnOption) (*Conn, error) {
+	return WrapConnContext(context.Background(), conn, opts...)
+}
+
+// WrapConnContext is like WrapConn, but reading the header is aborted when ctx is
+// cancelled or its deadline passes. See ParseContext for details
+func WrapConnContext(ctx context.Context, conn net.Conn, opts ...ConnOption) (*Conn, error) {
+	d, rest, pooled, err := parseContext(ctx, conn)
 	if err != nil {
 		return nil, err
 	}
-	return &Conn{conn: conn, protoData: d}, nil
+	// the leftover bytes belong to the connection, not to the shared proxy data
+	c := &Conn{conn: conn, protoData: d}
+	if len(rest) > 0 {
+		c.buf = rest
+		c.pooled = pooled
+	} else {
+		releaseParseBuf(pooled)
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
 }
 
-// ProxyData retrieves proxy protocol data for this connection
+// ProxyData retrieves proxy protocol data for this connection. The same *Data is
+// returned on every call and the connection never modifies it, so it is safe to
+// read from multiple goroutines. Callers must not modify it; use Data.Clone to get
+// a copy that can be changed
 func (c *Conn) ProxyData() *Data {
 	return c.protoData
 }
@@ -36,26 +121,61 @@ func (c *Conn) ProxyData() *Data {
 // Read can be made to time out and return an Error with Timeout() == true
 // after a fixed time limit; see SetDeadline and SetReadDeadline.
 func (c *Conn) Read(b []byte) (int, error) {
-	if c.protoData != nil && len(c.protoData.remainingData) > 0 {
-		n := len(c.protoData.remainingData)
-		bc := cap(b)
-		if bc > n {
-			b = b[:n]
-			for i := 0; i < n; i++ {
-				b[i] = c.protoData.remainingData[i]
-			}
-			return n, nil
+	c.bufMu.Lock()
+	if len(c.buf) > 0 {
+		n := copy(b, c.buf)
+		c.buf = c.buf[n:]
+		if len(c.buf) == 0 {
+			c.releaseBufLocked()
 		}
-		b = b[:bc]
-		for i := 0; i < bc; i++ {
-			b[i] = c.protoData.remainingData[i]
-		}
-		c.protoData.remainingData = c.protoData.remainingData[bc:]
-		return bc, nil
+		c.bufMu.Unlock()
+		return n, nil
 	}
+	c.bufMu.Unlock()
 	return c.conn.Read(b)
 }
 
+// takeBuf removes and returns the application data that was read along with the header.
+// The caller must pass the returned pooled buffer to releaseParseBuf when done with it
+func (c *Conn) takeBuf() ([]byte, *[]byte) {
+	c.bufMu.Lock()
+	defer c.bufMu.Unlock()
+	b, pooled := c.buf, c.pooled
+	c.buf, c.pooled = nil, nil
+	return b, pooled
+}
+
+// releaseBufLocked drops the buffered application data and returns the parse buffer to
+// the pool. bufMu must be held
+func (c *Conn) releaseBufLocked() {
+	releaseParseBuf(c.pooled)
+	c.buf, c.pooled = nil, nil
+}
+
+// WriteTo implements io.WriterTo. Any application data that was read along with
+// the header is written first, then the rest is copied from the underlying
+// connection so io.Copy can use the kernel's splice/sendfile fast path when both
+// sides support it
+func (c *Conn) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	if b, pooled := c.takeBuf(); len(b) > 0 {
+		wn, err := w.Write(b)
+		releaseParseBuf(pooled)
+		n += int64(wn)
+		if err != nil {
+			return n, err
+		}
+	}
+	cn, err := io.Copy(w, c.conn)
+	return n + cn, err
+}
+
+// ReadFrom implements io.ReaderFrom by delegating to the underlying connection,
+// so io.Copy can use the kernel's splice/sendfile fast path when it supports it
+func (c *Conn) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(c.conn, r)
+}
+
 // Write writes data to the connection.
 // Write can be made to time out and return an Error with Timeout() == true
 // after a fixed time limit; see SetDeadline and SetWriteDeadline.
@@ -66,21 +186,51 @@ func (c *Conn) Write(b []byte) (n int, err error) {
 // Close closes the connection.
 // Any blocked Read or Write operations will be unblocked and return errors.
 func (c *Conn) Close() error {
+	c.bufMu.Lock()
+	c.releaseBufLocked()
+	c.bufMu.Unlock()
 	return c.conn.Close()
 }
 
-// LocalAddr returns the local network address.
+// LocalAddr returns the local network address of the underlying connection. If the
+// Conn was created with WithHeaderLocalAddr, the proxy-reported destination
+// address/port is returned instead when the header carried one
 func (c *Conn) LocalAddr() net.Addr {
+	if c.headerLocalAddr && c.protoData != nil {
+		d := c.protoData
+		if a := dataNetAddr(d.AddressFamily, d.Transport, d.DestAddr, d.DestPort); a != nil {
+			return a
+		}
+	}
 	return c.conn.LocalAddr()
 }
 
+// UpstreamAddr returns the remote network address of the underlying connection, i.e.
+// the address of the proxy or load balancer that sent the Proxy Protocol header
+func (c *Conn) UpstreamAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// NetConn returns the underlying connection that is wrapped by c.
+// Note that reading from the underlying connection directly skips any
+// application data that was read along with the header
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
 // RemoteAddr returns the remote network address. This will return the proxy-reported
-// source address/port that can also be retrieved from Conn.ProxyData().Source()
+// source address/port that can also be retrieved from Conn.ProxyData().Source().
+// If the header carried no address (v2 LOCAL, v1 UNKNOWN or an unspecified address
+// family), the underlying connection's remote address is returned instead, as the spec requires
 func (c *Conn) RemoteAddr() net.Addr {
 	if c.protoData == nil {
 		return c.conn.RemoteAddr()
 	}
-	return c.protoData.Source()
+	d := c.protoData
+	if a := dataNetAddr(d.AddressFamily, d.Transport, d.SourceAddr, d.SourcePort); a != nil {
+		return a
+	}
+	return c.conn.RemoteAddr()
 }
 
 // SetDeadline sets the read and write deadlines associated
@@ -117,3 +267,64 @@ func (c *Conn) SetReadDeadline(t time.Time) error {
 func (c *Conn) SetWriteDeadline(t time.Time) error {
 	return c.conn.SetWriteDeadline(t)
 }
+
+// CloseRead shuts down the reading side of the connection.
+// It returns ErrUnsupported if the underlying connection is not
+// a *net.TCPConn, *net.UnixConn or another type with a CloseRead method
+func (c *Conn) CloseRead() error {
+	if cr, ok := c.conn.(interface{ CloseRead() error }); ok {
+		return cr.CloseRead()
+	}
+	return ErrUnsupported
+}
+
+// CloseWrite shuts down the writing side of the connection.
+// It returns ErrUnsupported if the underlying connection is not
+// a *net.TCPConn, *net.UnixConn or another type with a CloseWrite method
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return ErrUnsupported
+}
+
+// SyscallConn returns a raw network connection. This implements the syscall.Conn interface.
+// Reading from the raw connection directly skips any application data that was read
+// along with the header. It returns ErrUnsupported if the underlying connection
+// does not implement syscall.Conn
+func (c *Conn) SyscallConn() (syscall.RawConn, error) {
+	if sc, ok := c.conn.(syscall.Conn); ok {
+		return sc.SyscallConn()
+	}
+	return nil, ErrUnsupported
+}
+
+// File returns a copy of the underlying os.File. See net.TCPConn.File for details.
+// It returns ErrUnsupported if the underlying connection has no File method
+func (c *Conn) File() (*os.File, error) {
+	if f, ok := c.conn.(interface{ File() (*os.File, error) }); ok {
+		return f.File()
+	}
+	return nil, ErrUnsupported
+}
+
+// SetKeepAlive sets whether the operating system should send
+// keep-alive messages on the connection.
+// It returns ErrUnsupported if the underlying connection is not a *net.TCPConn
+// or another type with a SetKeepAlive method
+func (c *Conn) SetKeepAlive(keepalive bool) error {
+	if ka, ok := c.conn.(interface{ SetKeepAlive(bool) error }); ok {
+		return ka.SetKeepAlive(keepalive)
+	}
+	return ErrUnsupported
+}
+
+// SetKeepAlivePeriod sets period between keep-alives.
+// It returns ErrUnsupported if the underlying connection is not a *net.TCPConn
+// or another type with a SetKeepAlivePeriod method
+func (c *Conn) SetKeepAlivePeriod(d time.Duration) error {
+	if ka, ok := c.conn.(interface{ SetKeepAlivePeriod(time.Duration) error }); ok {
+		return ka.SetKeepAlivePeriod(d)
+	}
+	return ErrUnsupported
+}
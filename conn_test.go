@@ -0,0 +1,363 @@
+package proxyproto
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_Conn_RemoteAddr(t *testing.T) {
+	tests := []struct {
+		name        string
+		header      []byte
+		wantVersion Version
+		wantCommand Command
+		wantRemote  net.Addr // nil means the underlying connection's address
+	}{
+		{
+			name:        "v1 tcp4",
+			header:      []byte("PROXY TCP4 10.20.30.40 40.30.20.10 8000 9000\r\n"),
+			wantVersion: Version1,
+			wantCommand: CommandProxy,
+			wantRemote:  &net.TCPAddr{IP: net.IP{10, 20, 30, 40}, Port: 8000},
+		},
+		{
+			name:        "v1 unknown",
+			header:      []byte("PROXY UNKNOWN\r\n"),
+			wantVersion: Version1,
+			wantCommand: CommandProxy,
+		},
+		{
+			name: "v2 tcp4",
+			header: []byte{
+				0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A,
+				0x21, 0x11, 0x0, 0xc,
+				10, 20, 30, 40,
+				40, 30, 20, 10,
+				0x1f, 0x40,
+				0x23, 0x28,
+			},
+			wantVersion: Version2,
+			wantCommand: CommandProxy,
+			wantRemote:  &net.TCPAddr{IP: net.IP{10, 20, 30, 40}, Port: 8000},
+		},
+		{
+			name: "v2 local",
+			header: []byte{
+				0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A,
+				0x20, 0x11, 0x0, 0xc,
+				10, 20, 30, 40,
+				40, 30, 20, 10,
+				0x1f, 0x40,
+				0x23, 0x28,
+			},
+			wantVersion: Version2,
+			wantCommand: CommandLocal,
+		},
+		{
+			name: "v2 unspec",
+			header: []byte{
+				0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A,
+				0x21, 0x00, 0x0, 0x0,
+			},
+			wantVersion: Version2,
+			wantCommand: CommandProxy,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			go client.Write(tt.header)
+
+			c, err := WrapConn(server)
+			if err != nil {
+				t.Fatalf("WrapConn() err = %v", err)
+			}
+			d := c.ProxyData()
+			if d.Version != tt.wantVersion || d.Command != tt.wantCommand {
+				t.Fatalf("ProxyData() version/command = %v/%v, want %v/%v", d.Version, d.Command, tt.wantVersion, tt.wantCommand)
+			}
+
+			want := tt.wantRemote
+			if want == nil {
+				want = server.RemoteAddr()
+			}
+			if got := c.RemoteAddr(); !reflect.DeepEqual(got, want) {
+				t.Fatalf("RemoteAddr() = %v, want %v", got, want)
+			}
+			if got := c.LocalAddr(); !reflect.DeepEqual(got, server.LocalAddr()) {
+				t.Fatalf("LocalAddr() = %v, want %v", got, server.LocalAddr())
+			}
+		})
+	}
+}
+
+func Test_Conn_UpstreamAddr(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go client.Write([]byte("PROXY TCP4 10.20.30.40 40.30.20.10 8000 9000\r\n"))
+
+	c, err := WrapConn(server, WithHeaderLocalAddr())
+	if err != nil {
+		t.Fatalf("WrapConn() err = %v", err)
+	}
+	if got := c.UpstreamAddr(); !reflect.DeepEqual(got, server.RemoteAddr()) {
+		t.Fatalf("UpstreamAddr() = %v, want %v", got, server.RemoteAddr())
+	}
+	if got := c.NetConn(); got != server {
+		t.Fatalf("NetConn() = %v, want %v", got, server)
+	}
+	want := &net.TCPAddr{IP: net.IP{40, 30, 20, 10}, Port: 9000}
+	if got := c.LocalAddr(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("LocalAddr() = %v, want %v", got, want)
+	}
+}
+
+func Test_Conn_WriteTo(t *testing.T) {
+	lis, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() err = %v", err)
+	}
+	defer lis.Close()
+
+	go func() {
+		client, err := net.Dial("tcp", lis.Addr().String())
+		if err != nil {
+			return
+		}
+		defer client.Close()
+		client.Write([]byte("PROXY TCP4 10.20.30.40 40.30.20.10 8000 9000\r\nHELLO"))
+		client.Write([]byte(" WORLD"))
+		client.(*net.TCPConn).CloseWrite()
+
+		// the server half-closes after echoing everything back
+		io.Copy(io.Discard, client)
+	}()
+
+	conn, err := lis.Accept()
+	if err != nil {
+		t.Fatalf("Accept() err = %v", err)
+	}
+	defer conn.Close()
+
+	var buf bytes.Buffer
+	n, err := conn.(*Conn).WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("WriteTo() err = %v", err)
+	}
+	if n != 11 || buf.String() != "HELLO WORLD" {
+		t.Fatalf("WriteTo() = %v, %q, want 11, %q", n, buf.String(), "HELLO WORLD")
+	}
+	if err := conn.(*Conn).CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite() err = %v", err)
+	}
+	if err := conn.(*Conn).SetKeepAlive(true); err != nil {
+		t.Fatalf("SetKeepAlive() err = %v", err)
+	}
+}
+
+func Test_Conn_unsupported(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go client.Write([]byte("PROXY UNKNOWN\r\n"))
+
+	c, err := WrapConn(server)
+	if err != nil {
+		t.Fatalf("WrapConn() err = %v", err)
+	}
+	if err := c.CloseWrite(); err != ErrUnsupported {
+		t.Fatalf("CloseWrite() err = %v, want %v", err, ErrUnsupported)
+	}
+	if _, err := c.File(); err != ErrUnsupported {
+		t.Fatalf("File() err = %v, want %v", err, ErrUnsupported)
+	}
+}
+
+type unwrapConn struct {
+	net.Conn
+}
+
+func (c unwrapConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+func Test_DataFromConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go client.Write([]byte("PROXY TCP4 10.20.30.40 40.30.20.10 8000 9000\r\n"))
+
+	c, err := WrapConn(server)
+	if err != nil {
+		t.Fatalf("WrapConn() err = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		conn   net.Conn
+		wantOK bool
+	}{
+		{
+			name:   "conn",
+			conn:   c,
+			wantOK: true,
+		},
+		{
+			name:   "tls",
+			conn:   tls.Server(c, &tls.Config{}),
+			wantOK: true,
+		},
+		{
+			name:   "unwrap then tls",
+			conn:   tls.Server(unwrapConn{c}, &tls.Config{}),
+			wantOK: true,
+		},
+		{
+			name:   "plain",
+			conn:   server,
+			wantOK: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, ok := DataFromConn(tt.conn)
+			if ok != tt.wantOK {
+				t.Fatalf("DataFromConn() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && d != c.ProxyData() {
+				t.Fatalf("DataFromConn() = %v, want %v", d, c.ProxyData())
+			}
+		})
+	}
+}
+
+func Test_Conn_Read(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		client.Write([]byte("PROXY TCP4 10.20.30.40 40.30.20.10 8000 9000\r\nHELLO WORLD"))
+		client.Write([]byte("!"))
+		client.Close()
+	}()
+
+	c, err := WrapConn(server)
+	if err != nil {
+		t.Fatalf("WrapConn() err = %v", err)
+	}
+
+	// len(b) is smaller than cap(b), Read must not write past len(b)
+	b := make([]byte, 3, 64)
+	n, err := c.Read(b)
+	if err != nil || n != 3 || string(b[:n]) != "HEL" {
+		t.Fatalf("Read() = %v, %q, %v, want 3, %q, nil", n, b[:n], err, "HEL")
+	}
+	if b[:4][3] != 0 {
+		t.Fatalf("Read() wrote past len(b)")
+	}
+
+	got, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatalf("ReadAll() err = %v", err)
+	}
+	if string(got) != "LO WORLD!" {
+		t.Fatalf("ReadAll() = %q, want %q", got, "LO WORLD!")
+	}
+}
+
+func Test_Conn_concurrent(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	payload := bytes.Repeat([]byte("0123456789"), 100)
+	go func() {
+		client.Write(append([]byte("PROXY TCP4 10.20.30.40 40.30.20.10 8000 9000\r\n"), payload[:500]...))
+		client.Write(payload[500:])
+		client.Close()
+	}()
+
+	c, err := WrapConn(server)
+	if err != nil {
+		t.Fatalf("WrapConn() err = %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				d := c.ProxyData()
+				if d.SourcePort != 8000 || d.SourceAddrPort().String() != "10.20.30.40:8000" {
+					t.Errorf("ProxyData() = %v", d)
+					return
+				}
+				c.RemoteAddr()
+			}
+		}()
+	}
+
+	var mu sync.Mutex
+	var total int
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b := make([]byte, 7)
+			for {
+				n, err := c.Read(b)
+				mu.Lock()
+				total += n
+				mu.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if total != len(payload) {
+		t.Fatalf("Read() total = %v, want %v", total, len(payload))
+	}
+}
+
+func Test_Listener_Close(t *testing.T) {
+	lis, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() err = %v", err)
+	}
+
+	client, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() err = %v", err)
+	}
+	defer client.Close()
+
+	// the client never sends a header, so Accept blocks until the listener is closed
+	errc := make(chan error, 1)
+	go func() {
+		_, err := lis.Accept()
+		errc <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	lis.Close()
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Accept() err = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Accept() did not return after Close()")
+	}
+}
@@ -0,0 +1,343 @@
+package proxyproto
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+)
+
+const (
+	// 108 bytes is the size of a Unix socket address in proxy protocol v2
+	unixAddrSize = 108
+
+	// 65535 is the largest value (or whole header payload) a 16-bit length can describe
+	maxTLVLen = 0xffff
+)
+
+// Clone returns a deep copy of the data that shares no memory with the original.
+// Parsed data aliases the buffer it was read into, so Clone should be used before
+// handing it to another goroutine that may outlive the connection. The clone keeps
+// the received header and TLV bytes of parsed data, so it encodes its TLVs in the
+// order they were received
+func (d *Data) Clone() *Data {
+	if d == nil {
+		return nil
+	}
+	c := &Data{
+		Version:       d.Version,
+		Command:       d.Command,
+		AddressFamily: d.AddressFamily,
+		Transport:     d.Transport,
+		SourceAddr:    cloneBytes(d.SourceAddr),
+		DestAddr:      cloneBytes(d.DestAddr),
+		SourcePort:    d.SourcePort,
+		DestPort:      d.DestPort,
+		raw:           cloneBytes(d.raw),
+		rawTLVs:       cloneBytes(d.rawTLVs),
+	}
+	if d.TLVs != nil {
+		c.TLVs = make(map[TLVType][]byte, len(d.TLVs))
+		for t, v := range d.TLVs {
+			c.TLVs[t] = cloneBytes(v)
+		}
+	}
+	return c
+}
+
+// Equal reports whether d and o describe the same proxied connection. Addresses
+// are compared byte-for-byte (Unix addresses up to their null terminator), and a
+// nil TLV map is equal to an empty one
+func (d *Data) Equal(o *Data) bool {
+	if d == nil || o == nil {
+		return d == o
+	}
+	if d.Version != o.Version ||
+		d.Command != o.Command ||
+		d.AddressFamily != o.AddressFamily ||
+		d.Transport != o.Transport ||
+		d.SourcePort != o.SourcePort ||
+		d.DestPort != o.DestPort {
+		return false
+	}
+	if d.AddressFamily == AddressFamilyUnix {
+		if !bytes.Equal(trimUnixAddr(d.SourceAddr), trimUnixAddr(o.SourceAddr)) ||
+			!bytes.Equal(trimUnixAddr(d.DestAddr), trimUnixAddr(o.DestAddr)) {
+			return false
+		}
+	} else if !bytes.Equal(d.SourceAddr, o.SourceAddr) || !bytes.Equal(d.DestAddr, o.DestAddr) {
+		return false
+	}
+	if d.tlvsReceived() && o.tlvsReceived() && bytes.Equal(d.rawTLVs, o.rawTLVs) {
+		return true
+	}
+	return equalTLVs(d.TLVMap(), o.TLVMap())
+}
+
+// Validate checks that the data could be encoded as a proxy protocol header:
+// the version, command, address family and transport are known, the addresses have the size their
+// family requires, the ports fit in 16 bits and every TLV fits its length field.
+// The SSL TLV, if present, is validated as well
+func (d *Data) Validate() error {
+	switch d.Version {
+	case 0, Version1, Version2:
+	default:
+		return fmt.Errorf("invalid proxy protocol data: unknown version %d", int(d.Version))
+	}
+
+	switch d.Command {
+	case CommandLocal:
+		if d.Version == Version1 {
+			return fmt.Errorf("invalid proxy protocol data: the %v command does not exist in v1", d.Command)
+		}
+	case CommandProxy:
+	default:
+		return fmt.Errorf("invalid proxy protocol data: unknown command %v", d.Command)
+	}
+
+	switch d.AddressFamily {
+	case AddressFamilyLocal:
+	case AddressFamilyIPv4:
+		if len(d.SourceAddr) != net.IPv4len || len(d.DestAddr) != net.IPv4len {
+			return fmt.Errorf("invalid proxy protocol data: IPv4 addresses must be %v bytes, got %v and %v", net.IPv4len, len(d.SourceAddr), len(d.DestAddr))
+		}
+	case AddressFamilyIPv6:
+		if len(d.SourceAddr) != net.IPv6len || len(d.DestAddr) != net.IPv6len {
+			return fmt.Errorf("invalid proxy protocol data: IPv6 addresses must be %v bytes, got %v and %v", net.IPv6len, len(d.SourceAddr), len(d.DestAddr))
+		}
+	case AddressFamilyUnix:
+		if len(d.SourceAddr) > unixAddrSize || len(d.DestAddr) > unixAddrSize {
+			return fmt.Errorf("invalid proxy protocol data: Unix addresses must be at most %v bytes, got %v and %v", unixAddrSize, len(d.SourceAddr), len(d.DestAddr))
+		}
+	default:
+		return fmt.Errorf("invalid proxy protocol data: unknown address family %v", d.AddressFamily)
+	}
+
+	switch d.Transport {
+	case TransportUnspec, TransportStream, TransportDgram:
+	default:
+		return fmt.Errorf("invalid proxy protocol data: unknown transport %v", d.Transport)
+	}
+
+	if d.SourcePort < 0 || d.SourcePort > 0xffff || d.DestPort < 0 || d.DestPort > 0xffff {
+		return fmt.Errorf("invalid proxy protocol data: ports must be between 0 and 65535, got %v and %v", d.SourcePort, d.DestPort)
+	}
+
+	size := 0
+	received := d.tlvsReceived()
+	if received {
+		// received TLVs are encoded as they are, repeats included
+		size = len(d.rawTLVs)
+	}
+	for t, v := range d.TLVMap() {
+		if len(v) > maxTLVLen {
+			return fmt.Errorf("invalid proxy protocol data: %v TLV is %v bytes, max is %v", t, len(v), maxTLVLen)
+		}
+		if !received {
+			size += 3 + len(v)
+		}
+
+		switch t {
+		case TLVTypeCRC32C:
+			if len(v) != 4 {
+				return fmt.Errorf("invalid proxy protocol data: %v TLV must be 4 bytes, got %v", t, len(v))
+			}
+		case TLVTypeSSL:
+			ssl, ok := d.TLVGetSSL()
+			if !ok {
+				return fmt.Errorf("invalid proxy protocol data: %v TLV must be at least 5 bytes, got %v", t, len(v))
+			}
+			if err := ssl.Validate(); err != nil {
+				return err
+			}
+		}
+	}
+	size += dataAddrSize(d.AddressFamily) * 2
+	if d.AddressFamily == AddressFamilyIPv4 || d.AddressFamily == AddressFamilyIPv6 {
+		size += 4
+	}
+	if size > maxTLVLen {
+		return fmt.Errorf("invalid proxy protocol data: header payload is %v bytes, max is %v", size, maxTLVLen)
+	}
+	return nil
+}
+
+// Clone returns a deep copy of the SSL TLV data
+func (d *SSLTLVData) Clone() *SSLTLVData {
+	if d == nil {
+		return nil
+	}
+	c := &SSLTLVData{
+		Client:   d.Client,
+		Verified: d.Verified,
+	}
+	if d.SubTLVs != nil {
+		c.SubTLVs = make(map[SSLTLVSubType][]byte, len(d.SubTLVs))
+		for t, v := range d.SubTLVs {
+			c.SubTLVs[t] = cloneBytes(v)
+		}
+	}
+	return c
+}
+
+// Equal reports whether d and o carry the same client flags, verify result and sub-TLVs
+func (d *SSLTLVData) Equal(o *SSLTLVData) bool {
+	if d == nil || o == nil {
+		return d == o
+	}
+	if d.Client != o.Client || d.Verified != o.Verified || len(d.SubTLVs) != len(o.SubTLVs) {
+		return false
+	}
+	for t, v := range d.SubTLVs {
+		ov, ok := o.SubTLVs[t]
+		if !ok || !bytes.Equal(v, ov) {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate checks that the SSL TLV data could be encoded, i.e. that every sub-TLV
+// fits its length field and the whole value fits in the enclosing TLV
+func (d *SSLTLVData) Validate() error {
+	size := 5
+	for t, v := range d.SubTLVs {
+		if len(v) > maxTLVLen {
+			return fmt.Errorf("invalid proxy protocol data: SSL %v sub-TLV is %v bytes, max is %v", t, len(v), maxTLVLen)
+		}
+		size += 3 + len(v)
+	}
+	if size > maxTLVLen {
+		return fmt.Errorf("invalid proxy protocol data: SSL TLV is %v bytes, max is %v", size, maxTLVLen)
+	}
+	return nil
+}
+
+// appendTLV appends a single type-length-value entry to b
+func appendTLV(b []byte, t byte, v []byte) []byte {
+	b = append(b, t, byte(len(v)>>8), byte(len(v)))
+	return append(b, v...)
+}
+
+// SetTLV sets a TLV, or removes it if v is nil. Parsed data keeps the order its TLVs
+// were received in, with the value replaced where the type first appeared (dropping any
+// repeats) or added at the end. Once the TLVs map has been set, the received order no
+// longer applies and the map is edited like for any other data
+func (d *Data) SetTLV(t TLVType, v []byte) error {
+	if len(v) > maxTLVLen {
+		return fmt.Errorf("proxyproto: %v TLV is %v bytes, max is %v", t, len(v), maxTLVLen)
+	}
+	d.setTLV(t, v)
+	return nil
+}
+
+// setTLV is SetTLV for values known to fit in a TLV
+func (d *Data) setTLV(t TLVType, v []byte) {
+	if !d.tlvsReceived() {
+		d.rawTLVs = nil
+		if v == nil {
+			delete(d.TLVs, t)
+			return
+		}
+		if d.TLVs == nil {
+			d.TLVs = make(map[TLVType][]byte, 1)
+		}
+		d.TLVs[t] = v
+		return
+	}
+
+	var b []byte
+	found := false
+	it := NewTLVIterator(d.rawTLVs)
+	for it.Next() {
+		if it.Type() != t {
+			b = appendTLV(b, byte(it.Type()), it.Value())
+			continue
+		}
+		if !found && v != nil {
+			b = appendTLV(b, byte(t), v)
+		}
+		found = true
+	}
+	if !found && v != nil {
+		b = appendTLV(b, byte(t), v)
+	}
+	if b == nil {
+		b = []byte{}
+	}
+	d.rawTLVs = b
+}
+
+// appendSSLTLV appends the value of an SSL TLV (not including its own type and length)
+// to b. Sub-TLVs are written in ascending type order so the output is deterministic
+func appendSSLTLV(b []byte, d *SSLTLVData) []byte {
+	var verify byte
+	if !d.Verified {
+		verify = 1
+	}
+	b = append(b, byte(d.Client), 0, 0, 0, verify)
+	types := make([]int, 0, len(d.SubTLVs))
+	for t := range d.SubTLVs {
+		types = append(types, int(t))
+	}
+	sort.Ints(types)
+	for _, t := range types {
+		b = appendTLV(b, byte(t), d.SubTLVs[SSLTLVSubType(t)])
+	}
+	return b
+}
+
+// appendTLVs appends the TLVs in ascending type order to b
+func appendTLVs(b []byte, tlvs map[TLVType][]byte) []byte {
+	types := make([]int, 0, len(tlvs))
+	for t := range tlvs {
+		types = append(types, int(t))
+	}
+	sort.Ints(types)
+	for _, t := range types {
+		b = appendTLV(b, byte(t), tlvs[TLVType(t)])
+	}
+	return b
+}
+
+// dataAddrSize gets the size of each address field for an address family in proxy protocol v2
+func dataAddrSize(af AddressFamily) int {
+	switch af {
+	case AddressFamilyIPv4:
+		return net.IPv4len
+	case AddressFamilyIPv6:
+		return net.IPv6len
+	case AddressFamilyUnix:
+		return unixAddrSize
+	default:
+		return 0
+	}
+}
+
+func equalTLVs(a, b map[TLVType][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for t, v := range a {
+		bv, ok := b[t]
+		if !ok || !bytes.Equal(v, bv) {
+			return false
+		}
+	}
+	return true
+}
+
+// trimUnixAddr strips the null terminator and anything after it from a Unix address
+func trimUnixAddr(b []byte) []byte {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return b[:i]
+	}
+	return b
+}
+
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append(make([]byte, 0, len(b)), b...)
+}
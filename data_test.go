@@ -0,0 +1,235 @@
+package proxyproto
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+)
+
+func testSSLData() *Data {
+	return &Data{
+		AddressFamily: AddressFamilyIPv4,
+		Transport:     TransportStream,
+		SourceAddr:    []byte{10, 20, 30, 40},
+		SourcePort:    8000,
+		DestAddr:      []byte{40, 30, 20, 10},
+		DestPort:      9000,
+		TLVs: map[TLVType][]byte{
+			TLVTypeAuthority: []byte("example.com"),
+			TLVTypeSSL: appendSSLTLV(nil, &SSLTLVData{
+				Client:   TLVSSLClientSSL | TLVSSLClientCertConn,
+				Verified: true,
+				SubTLVs: map[SSLTLVSubType][]byte{
+					TLVSubTypeSSLVersion: []byte("TLSv1.3"),
+					TLVSubTypeSSLCN:      []byte("client.example.com"),
+				},
+			}),
+			TLVType(0xe0): {0xde, 0xad, 0xbe, 0xef},
+		},
+	}
+}
+
+func Test_Data_Clone(t *testing.T) {
+	d := testSSLData()
+	c := d.Clone()
+
+	if !c.Equal(d) {
+		t.Fatalf("Clone() = %v, want %v", c, d)
+	}
+
+	c.SourceAddr[0] = 99
+	c.TLVs[TLVTypeAuthority][0] = 'X'
+	if d.SourceAddr[0] != 10 || d.TLVs[TLVTypeAuthority][0] != 'e' {
+		t.Fatalf("Clone() shares memory with the original")
+	}
+	if c.Equal(d) {
+		t.Fatalf("Equal() = true after modifying the clone")
+	}
+}
+
+func Test_Data_Clone_parsed(t *testing.T) {
+	b := v2TestHeader(false,
+		appendTLV(nil, byte(TLVTypeNoop), nil),
+		appendTLV(nil, byte(TLVTypeAuthority), []byte("example.com")))
+	d, _, err := ParseBytes(b)
+	if err != nil {
+		t.Fatalf("ParseBytes() error = %v", err)
+	}
+
+	got, err := d.Clone().AppendHeader(nil, Version2)
+	if err != nil {
+		t.Fatalf("AppendHeader() error = %v", err)
+	}
+	if !bytes.Equal(got, b) {
+		t.Fatalf("AppendHeader() of the clone = %x, want %x", got, b)
+	}
+}
+
+func Test_Data_Equal(t *testing.T) {
+	tests := []struct {
+		name string
+		a    *Data
+		b    *Data
+		want bool
+	}{
+		{
+			name: "nil",
+			a:    nil,
+			b:    nil,
+			want: true,
+		},
+		{
+			name: "nil and empty",
+			a:    nil,
+			b:    &Data{},
+			want: false,
+		},
+		{
+			name: "nil and empty TLVs",
+			a:    &Data{TLVs: map[TLVType][]byte{}},
+			b:    &Data{},
+			want: true,
+		},
+		{
+			name: "different port",
+			a:    &Data{AddressFamily: AddressFamilyIPv4, SourceAddr: []byte{1, 2, 3, 4}, SourcePort: 1},
+			b:    &Data{AddressFamily: AddressFamilyIPv4, SourceAddr: []byte{1, 2, 3, 4}, SourcePort: 2},
+			want: false,
+		},
+		{
+			name: "unix padding",
+			a:    &Data{AddressFamily: AddressFamilyUnix, SourceAddr: []byte("/a\x00\x00")},
+			b:    &Data{AddressFamily: AddressFamilyUnix, SourceAddr: []byte("/a")},
+			want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.a.Equal(tt.b); got != tt.want {
+				t.Fatalf("Equal() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_Data_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    *Data
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			data: testSSLData(),
+		},
+		{
+			name: "local",
+			data: &Data{},
+		},
+		{
+			name:    "ipv4 with 16 byte address",
+			data:    &Data{AddressFamily: AddressFamilyIPv4, SourceAddr: make([]byte, 16), DestAddr: make([]byte, 4)},
+			wantErr: true,
+		},
+		{
+			name:    "port out of range",
+			data:    &Data{AddressFamily: AddressFamilyIPv4, SourceAddr: make([]byte, 4), DestAddr: make([]byte, 4), SourcePort: 70000},
+			wantErr: true,
+		},
+		{
+			name:    "unknown transport",
+			data:    &Data{Transport: Transport(7)},
+			wantErr: true,
+		},
+		{
+			name: "unix at the size limit",
+			data: &Data{
+				AddressFamily: AddressFamilyUnix,
+				SourceAddr:    make([]byte, unixAddrSize),
+				DestAddr:      make([]byte, unixAddrSize),
+				TLVs:          map[TLVType][]byte{TLVTypeNoop: make([]byte, maxTLVLen-2*unixAddrSize-3)},
+			},
+		},
+		{
+			name: "ipv4 over the size limit",
+			data: &Data{
+				AddressFamily: AddressFamilyIPv4,
+				SourceAddr:    make([]byte, 4),
+				DestAddr:      make([]byte, 4),
+				TLVs:          map[TLVType][]byte{TLVTypeNoop: make([]byte, maxTLVLen-2*4-3)},
+			},
+			wantErr: true,
+		},
+		{
+			name:    "short crc32c",
+			data:    &Data{TLVs: map[TLVType][]byte{TLVTypeCRC32C: {1, 2}}},
+			wantErr: true,
+		},
+		{
+			name:    "short ssl",
+			data:    &Data{TLVs: map[TLVType][]byte{TLVTypeSSL: {1}}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.data.Validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_Data_setTLV_editedMap(t *testing.T) {
+	chain, _ := clientChain(t, x509.ExtKeyUsageClientAuth)
+	tests := []struct {
+		name string
+		set  func(d *Data) error
+		// want is the TLV the setter adds
+		want TLVType
+	}{
+		{name: "AppendHop", set: func(d *Data) error { return d.AppendHop(Hop{ID: "edge"}) }, want: DefaultProvenanceTLVType},
+		{name: "SetClientCertChain", set: func(d *Data) error { return d.SetClientCertChain(chain) }, want: DefaultClientCertChainTLVType},
+		{name: "SetTLSConnectionState", set: func(d *Data) error {
+			d.SetTLSConnectionState(&tls.ConnectionState{Version: tls.VersionTLS13, ServerName: "example.com"})
+			return nil
+		}, want: TLVTypeSSL},
+		{name: "SetSSL", set: func(d *Data) error { return d.SetSSL(&SSLTLVData{Client: TLVSSLClientSSL}) }, want: TLVTypeSSL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _, err := ParseBytes(v2TestHeader(false,
+				appendTLV(nil, byte(TLVTypeAuthority), []byte("example.com")),
+				appendTLV(nil, byte(TLVTypeNoop), nil)))
+			if err != nil {
+				t.Fatalf("ParseBytes() error = %v", err)
+			}
+			// the map is set and edited before the setter is called
+			d.TLVs = d.TLVMap()
+			delete(d.TLVs, TLVTypeNoop)
+			d.TLVs[0xE5] = []byte("x")
+			if err := tt.set(d); err != nil {
+				t.Fatalf("%v() error = %v", tt.name, err)
+			}
+			if _, ok := d.TLVs[TLVTypeNoop]; ok {
+				t.Fatalf("%v() restored the deleted NOOP TLV", tt.name)
+			}
+			if string(d.TLVs[0xE5]) != "x" || string(d.TLVs[TLVTypeAuthority]) != "example.com" {
+				t.Fatalf("%v() dropped TLVs from the map: %q", tt.name, d.TLVs)
+			}
+			if _, ok := d.TLVs[tt.want]; !ok {
+				t.Fatalf("%v() did not set TLV %v", tt.name, tt.want)
+			}
+
+			b, err := d.AppendHeader(nil, Version2)
+			if err != nil {
+				t.Fatalf("AppendHeader() error = %v", err)
+			}
+			parsed, _, err := ParseBytes(b)
+			if err != nil || !equalTLVs(parsed.TLVMap(), d.TLVs) {
+				t.Fatalf("ParseBytes() TLVs = %q, %v, want %q", parsed.TLVMap(), err, d.TLVs)
+			}
+		})
+	}
+}
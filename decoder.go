@@ -0,0 +1,119 @@
+package proxyproto
+
+import (
+	"errors"
+	"strconv"
+)
+
+// DecoderState is the state of a Decoder after it has been fed some bytes
+type DecoderState int
+
+const (
+	// DecoderNeedMore means the bytes fed so far are the beginning of a valid header
+	// and more are needed
+	DecoderNeedMore DecoderState = iota
+	// DecoderDone means a complete header was decoded. Data and Remaining are available
+	DecoderDone
+	// DecoderError means the bytes fed are not a valid header. Err is available
+	DecoderError
+)
+
+// String gets the name of the state, e.g. "need more"
+func (s DecoderState) String() string {
+	switch s {
+	case DecoderNeedMore:
+		return "need more"
+	case DecoderDone:
+		return "done"
+	case DecoderError:
+		return "error"
+	default:
+		return "DecoderState(" + strconv.Itoa(int(s)) + ")"
+	}
+}
+
+// Decoder is an incremental, push-style header decoder for non-blocking I/O. Feed it
+// chunks of bytes as they arrive, in any size and split at any boundary, until it
+// reports DecoderDone or DecoderError. It uses the same parsing logic as Parse and
+// ParseBytes, so it accepts and rejects exactly the same headers.
+// The zero value is ready to use. A Decoder is not safe for concurrent use
+type Decoder struct {
+	buf   []byte
+	need  int
+	state DecoderState
+	data  *Data
+	rest  []byte
+	err   error
+}
+
+// Feed appends b to the decoder's buffer and tries to decode a header. b is copied,
+// so the caller may reuse it after Feed returns. Bytes fed after DecoderDone are
+// appended to Remaining, and bytes fed after DecoderError are ignored
+func (dec *Decoder) Feed(b []byte) DecoderState {
+	switch dec.state {
+	case DecoderDone:
+		dec.rest = append(dec.rest, b...)
+		return dec.state
+	case DecoderError:
+		return dec.state
+	}
+
+	dec.buf = append(dec.buf, b...)
+	if len(dec.buf) < dec.need {
+		return dec.state
+	}
+
+	d, n, err := ParseBytes(dec.buf)
+	var ie *IncompleteError
+	switch {
+	case err == nil:
+		dec.state = DecoderDone
+		dec.data = d
+		dec.rest = dec.buf[n:]
+	case errors.As(err, &ie):
+		dec.need = len(dec.buf) + ie.Needed
+	default:
+		dec.state = DecoderError
+		dec.err = err
+	}
+	return dec.state
+}
+
+// State gets the current state of the decoder
+func (dec *Decoder) State() DecoderState {
+	return dec.state
+}
+
+// Needed gets the minimum number of additional bytes needed before decoding can make
+// progress. It is only meaningful in the DecoderNeedMore state
+func (dec *Decoder) Needed() int {
+	if dec.state != DecoderNeedMore {
+		return 0
+	}
+	if dec.need <= len(dec.buf) {
+		return 1
+	}
+	return dec.need - len(dec.buf)
+}
+
+// Data gets the decoded header data, or nil if the state is not DecoderDone
+func (dec *Decoder) Data() *Data {
+	return dec.data
+}
+
+// Remaining gets the application bytes that were fed after the end of the header,
+// or nil if the state is not DecoderDone
+func (dec *Decoder) Remaining() []byte {
+	return dec.rest
+}
+
+// Err gets the parse error, or nil if the state is not DecoderError
+func (dec *Decoder) Err() error {
+	return dec.err
+}
+
+// Reset clears the decoder so it can decode another header. Data and byte slices
+// returned before Reset remain valid
+func (dec *Decoder) Reset() {
+	*dec = Decoder{}
+}
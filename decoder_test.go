@@ -0,0 +1,69 @@
+package proxyproto
+
+import (
+	"testing"
+)
+
+func Test_Decoder_Feed(t *testing.T) {
+	headers := map[string][]byte{
+		"v1 tcp6": []byte("PROXY TCP6 2607:f8b0:4008:80e::200e 2606:4700:4700::1111 8000 9000\r\n"),
+		"v2 tcp4 w TLVs": {
+			0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A,
+			0x21, 0x11, 0x0, 0x13,
+			10, 20, 30, 40,
+			40, 30, 20, 10,
+			0x1f, 0x40,
+			0x23, 0x28,
+			0x2, 0x0, 0x4, 'a', 'b', 'c', 'd',
+		},
+	}
+	for name, header := range headers {
+		want, _, err := ParseBytes(header)
+		if err != nil {
+			t.Fatalf("%v: ParseBytes() err = %v", name, err)
+		}
+		buf := append(append([]byte{}, header...), "TEST"...)
+
+		// split into two chunks at every boundary
+		for i := 0; i <= len(buf); i++ {
+			var dec Decoder
+			state := dec.Feed(buf[:i])
+			if i < len(header) && state != DecoderNeedMore {
+				t.Fatalf("%v: Feed(buf[:%v]) = %v, want DecoderNeedMore", name, i, state)
+			}
+			if state = dec.Feed(buf[i:]); state != DecoderDone {
+				t.Fatalf("%v: Feed(buf[%v:]) = %v, want DecoderDone (err = %v)", name, i, state, dec.Err())
+			}
+			if !dec.Data().Equal(want) || string(dec.Remaining()) != "TEST" {
+				t.Fatalf("%v: split at %v: Data() = %v, Remaining() = %q", name, i, dec.Data(), dec.Remaining())
+			}
+		}
+
+		// one byte at a time
+		var dec Decoder
+		for i := range buf {
+			dec.Feed(buf[i : i+1])
+		}
+		if dec.State() != DecoderDone || !dec.Data().Equal(want) || string(dec.Remaining()) != "TEST" {
+			t.Fatalf("%v: byte by byte: State() = %v, Data() = %v, Remaining() = %q", name, dec.State(), dec.Data(), dec.Remaining())
+		}
+	}
+}
+
+func Test_Decoder_error(t *testing.T) {
+	var dec Decoder
+	if state := dec.Feed([]byte("PRO")); state != DecoderNeedMore {
+		t.Fatalf("Feed() = %v, want DecoderNeedMore", state)
+	}
+	if state := dec.Feed([]byte("XY TCP5 ")); state != DecoderError {
+		t.Fatalf("Feed() = %v, want DecoderError", state)
+	}
+	if _, ok := dec.Err().(ParseError); !ok {
+		t.Fatalf("Err() = %v, want ParseError", dec.Err())
+	}
+
+	dec.Reset()
+	if state := dec.Feed([]byte("PROXY UNKNOWN\r\n")); state != DecoderDone {
+		t.Fatalf("Feed() after Reset() = %v, want DecoderDone", state)
+	}
+}
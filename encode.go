@@ -0,0 +1,178 @@
+package proxyproto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// AppendHeader appends the data encoded as a Proxy Protocol header of version v to b
+// and returns the extended buffer. If v is zero, d.Version is used, or v2 if that is
+// zero too. The data is validated first (see Validate).
+//
+// v1 headers can only describe TCP over IPv4 or IPv6. Data without an address is
+// encoded as "PROXY UNKNOWN" and TLVs are dropped; LOCAL data, Unix addresses and
+// datagram transports cannot be encoded.
+//
+// v2 headers also carry the TLVs. Parsed data keeps them in the order they were
+// received, other data writes them in ascending type order. If a CRC32C TLV is
+// present, its value is recomputed over the encoded header, so a zero placeholder
+// can be used to request a checksum.
+func (d *Data) AppendHeader(b []byte, v Version) ([]byte, error) {
+	if err := d.Validate(); err != nil {
+		return nil, err
+	}
+	if v == 0 {
+		v = d.Version
+	}
+	switch v {
+	case Version1:
+		return d.appendV1(b)
+	case 0, Version2:
+		return d.appendV2(b), nil
+	default:
+		return nil, fmt.Errorf("failed to encode proxy protocol header: unknown version %d", int(v))
+	}
+}
+
+// WriteHeader writes the data encoded as a Proxy Protocol header of version v to w.
+// See AppendHeader for how the data is encoded
+func (d *Data) WriteHeader(w io.Writer, v Version) (int, error) {
+	b, err := d.AppendHeader(make([]byte, 0, 232), v)
+	if err != nil {
+		return 0, err
+	}
+	return w.Write(b)
+}
+
+func (d *Data) appendV1(b []byte) ([]byte, error) {
+	if d.Command == CommandLocal {
+		return nil, fmt.Errorf("failed to encode proxy protocol v1 header: the %v command does not exist in v1", d.Command)
+	}
+	b = append(b, protov1[:]...)
+	switch d.AddressFamily {
+	case AddressFamilyLocal:
+		b = append(b, inetProtoUnknown[:]...)
+		return append(b, lineCrLf[:]...), nil
+	case AddressFamilyIPv4:
+		b = append(b, inetProtoTCP4[:]...)
+	case AddressFamilyIPv6:
+		b = append(b, inetProtoTCP6[:]...)
+	default:
+		return nil, fmt.Errorf("failed to encode proxy protocol v1 header: %v addresses are not supported", d.AddressFamily)
+	}
+	if d.Transport != TransportStream && d.Transport != TransportUnspec {
+		return nil, fmt.Errorf("failed to encode proxy protocol v1 header: %v transport is not supported", d.Transport)
+	}
+
+	sa := net.IP(d.SourceAddr)
+	da := net.IP(d.DestAddr)
+	if d.AddressFamily == AddressFamilyIPv6 {
+		b = appendIPv6Text(b, sa)
+		b = append(b, ' ')
+		b = appendIPv6Text(b, da)
+	} else {
+		b = append(b, sa.String()...)
+		b = append(b, ' ')
+		b = append(b, da.String()...)
+	}
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, int64(d.SourcePort), 10)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, int64(d.DestPort), 10)
+	return append(b, lineCrLf[:]...), nil
+}
+
+// appendIPv6Text appends the textual form of a 16-byte address. net.IP formats
+// IPv4-mapped addresses as dotted decimal, which TCP6 lines should not contain
+func appendIPv6Text(b []byte, ip net.IP) []byte {
+	s := ip.String()
+	if ip.To4() == nil {
+		return append(b, s...)
+	}
+	// IPv4-mapped, spell out the last 32 bits in hex
+	b = append(b, "::ffff:"...)
+	b = strconv.AppendUint(b, uint64(ip[12])<<8|uint64(ip[13]), 16)
+	b = append(b, ':')
+	return strconv.AppendUint(b, uint64(ip[14])<<8|uint64(ip[15]), 16)
+}
+
+func (d *Data) appendV2(b []byte) []byte {
+	start := len(b)
+	b = append(b, protov2[:]...)
+
+	if d.Command == CommandLocal {
+		b = append(b, verCmdUpper4+verCmdLowerLocal, afpUpperUnspec|afpLowerUnspec)
+	} else {
+		b = append(b, verCmdUpper4+verCmdLowerProxy, v2AddressFamilyByte(d.AddressFamily)|v2TransportByte(d.Transport))
+	}
+	lenAt := len(b)
+	b = append(b, 0, 0)
+
+	if d.Command != CommandLocal {
+		switch d.AddressFamily {
+		case AddressFamilyIPv4, AddressFamilyIPv6:
+			b = append(b, d.SourceAddr...)
+			b = append(b, d.DestAddr...)
+			b = append(b, byte(d.SourcePort>>8), byte(d.SourcePort), byte(d.DestPort>>8), byte(d.DestPort))
+		case AddressFamilyUnix:
+			b = appendPadded(b, d.SourceAddr, unixAddrSize)
+			b = appendPadded(b, d.DestAddr, unixAddrSize)
+		}
+	}
+
+	crcAt := -1
+	it := d.TLVIterator()
+	for it.Next() {
+		if it.Type() == TLVTypeCRC32C && len(it.Value()) == 4 && crcAt < 0 {
+			crcAt = len(b) + 3
+			b = appendTLV(b, byte(TLVTypeCRC32C), []byte{0, 0, 0, 0})
+			continue
+		}
+		b = appendTLV(b, byte(it.Type()), it.Value())
+	}
+
+	binary.BigEndian.PutUint16(b[lenAt:], uint16(len(b)-lenAt-2))
+	if crcAt >= 0 {
+		binary.BigEndian.PutUint32(b[crcAt:], crc32.Checksum(b[start:], crc32cTable))
+	}
+	return b
+}
+
+func v2AddressFamilyByte(af AddressFamily) byte {
+	switch af {
+	case AddressFamilyIPv4:
+		return afpUpperIPv4
+	case AddressFamilyIPv6:
+		return afpUpperIPv6
+	case AddressFamilyUnix:
+		return afpUpperUnix
+	default:
+		return afpUpperUnspec
+	}
+}
+
+func v2TransportByte(tr Transport) byte {
+	switch tr {
+	case TransportStream:
+		return afpLowerStream
+	case TransportDgram:
+		return afpLowerDgram
+	default:
+		return afpLowerUnspec
+	}
+}
+
+// appendPadded appends v followed by enough null bytes to make it size bytes long
+func appendPadded(b []byte, v []byte, size int) []byte {
+	b = append(b, v...)
+	for i := len(v); i < size; i++ {
+		b = append(b, 0)
+	}
+	return b
+}
@@ -0,0 +1,232 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+	"testing"
+)
+
+func Test_Data_AppendHeader_v1(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    *Data
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "tcp4",
+			data: testSSLData(),
+			want: "PROXY TCP4 10.20.30.40 40.30.20.10 8000 9000\r\n",
+		},
+		{
+			name: "tcp6",
+			data: &Data{
+				AddressFamily: AddressFamilyIPv6,
+				Transport:     TransportStream,
+				SourceAddr:    net.ParseIP("2607:f8b0:4008:80e::200e"),
+				SourcePort:    8000,
+				DestAddr:      net.ParseIP("::1"),
+				DestPort:      9000,
+			},
+			want: "PROXY TCP6 2607:f8b0:4008:80e::200e ::1 8000 9000\r\n",
+		},
+		{
+			name: "tcp6 mapped",
+			data: &Data{
+				AddressFamily: AddressFamilyIPv6,
+				Transport:     TransportStream,
+				SourceAddr:    net.ParseIP("::ffff:10.20.30.40"),
+				SourcePort:    8000,
+				DestAddr:      net.ParseIP("::ffff:40.30.20.10"),
+				DestPort:      9000,
+			},
+			want: "PROXY TCP6 ::ffff:a14:1e28 ::ffff:281e:140a 8000 9000\r\n",
+		},
+		{
+			name: "unknown",
+			data: &Data{},
+			want: "PROXY UNKNOWN\r\n",
+		},
+		{
+			name:    "local",
+			data:    &Data{Version: Version2, Command: CommandLocal},
+			wantErr: true,
+		},
+		{
+			name: "udp",
+			data: &Data{
+				AddressFamily: AddressFamilyIPv4,
+				Transport:     TransportDgram,
+				SourceAddr:    []byte{10, 20, 30, 40},
+				DestAddr:      []byte{40, 30, 20, 10},
+			},
+			wantErr: true,
+		},
+		{
+			name: "unix",
+			data: &Data{
+				AddressFamily: AddressFamilyUnix,
+				Transport:     TransportStream,
+				SourceAddr:    []byte("/tmp/a"),
+				DestAddr:      []byte("/tmp/b"),
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.data.AppendHeader(nil, Version1)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AppendHeader() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if string(got) != tt.want {
+				t.Fatalf("AppendHeader() = %q, want %q", got, tt.want)
+			}
+
+			d, n, err := ParseBytes(got)
+			if err != nil || n != len(got) {
+				t.Fatalf("ParseBytes() = %v, %v, %v", d, n, err)
+			}
+		})
+	}
+}
+
+func Test_Data_AppendHeader_v2(t *testing.T) {
+	tests := []struct {
+		name string
+		data *Data
+	}{
+		{
+			name: "tcp4 tlvs",
+			data: testSSLData(),
+		},
+		{
+			name: "udp6",
+			data: &Data{
+				AddressFamily: AddressFamilyIPv6,
+				Transport:     TransportDgram,
+				SourceAddr:    net.ParseIP("2607:f8b0:4008:80e::200e"),
+				SourcePort:    8000,
+				DestAddr:      net.ParseIP("::1"),
+				DestPort:      9000,
+			},
+		},
+		{
+			name: "unix",
+			data: &Data{
+				AddressFamily: AddressFamilyUnix,
+				Transport:     TransportStream,
+				SourceAddr:    []byte("/tmp/a"),
+				DestAddr:      []byte("/tmp/b"),
+			},
+		},
+		{
+			name: "unspec",
+			data: &Data{TLVs: map[TLVType][]byte{TLVTypeNoop: nil}},
+		},
+		{
+			name: "local",
+			data: &Data{Command: CommandLocal},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.data.AppendHeader([]byte("prefix"), 0)
+			if err != nil {
+				t.Fatalf("AppendHeader() error = %v", err)
+			}
+			if !bytes.HasPrefix(got, []byte("prefix")) {
+				t.Fatalf("AppendHeader() = %x, lost the prefix", got)
+			}
+			got = got[len("prefix"):]
+
+			d, n, err := ParseBytes(got)
+			if err != nil || n != len(got) {
+				t.Fatalf("ParseBytes() = %v, %v, %v", d, n, err)
+			}
+			want := tt.data.Clone()
+			want.Version = Version2
+			if want.Command == CommandLocal {
+				want = &Data{Version: Version2, Command: CommandLocal}
+			}
+			if !d.Equal(want) {
+				t.Fatalf("ParseBytes() = %v, want %v", d, want)
+			}
+
+			// Parsed data is written back unchanged
+			again, err := d.AppendHeader(nil, 0)
+			if err != nil || !bytes.Equal(again, got) {
+				t.Fatalf("AppendHeader() of parsed data = %x, %v, want %x", again, err, got)
+			}
+		})
+	}
+}
+
+func Test_Data_AppendHeader_crc32c(t *testing.T) {
+	d := testSSLData()
+	d.TLVs[TLVTypeCRC32C] = make([]byte, 4)
+
+	b, err := d.AppendHeader(nil, Version2)
+	if err != nil {
+		t.Fatalf("AppendHeader() error = %v", err)
+	}
+	p, _, err := ParseBytes(b)
+	if err != nil {
+		t.Fatalf("ParseBytes() error = %v", err)
+	}
+	sum, ok := p.TLVGetCRC32Checksum()
+	if !ok {
+		t.Fatalf("TLVGetCRC32Checksum() = _, false")
+	}
+
+	v, _ := p.TLV(TLVTypeCRC32C)
+	zeroed := append([]byte(nil), b...)
+	i := bytes.Index(zeroed, v)
+	binary.BigEndian.PutUint32(zeroed[i:], 0)
+	if want := crc32.Checksum(zeroed, crc32.MakeTable(crc32.Castagnoli)); sum != want {
+		t.Fatalf("TLVGetCRC32Checksum() = %#x, want %#x", sum, want)
+	}
+}
+
+func Test_Data_AppendHeader_parsedTLVsEdited(t *testing.T) {
+	d, n, err := ParseBytes(benchV2SSL)
+	if err != nil {
+		t.Fatalf("ParseBytes() error = %v", err)
+	}
+	// unchanged parsed data is encoded as it was received
+	if b, err := d.AppendHeader(nil, Version2); err != nil || !bytes.Equal(b, benchV2SSL[:n]) {
+		t.Fatalf("AppendHeader() = %x, %v, want %x", b, err, benchV2SSL[:n])
+	}
+
+	d.TLVs = d.TLVMap()
+	delete(d.TLVs, TLVTypeAuthority)
+	d.TLVs[TLVTypeALPN] = []byte("h2")
+	b, err := d.AppendHeader(nil, Version2)
+	if err != nil {
+		t.Fatalf("AppendHeader() error = %v", err)
+	}
+	p, _, err := ParseBytes(b)
+	if err != nil {
+		t.Fatalf("ParseBytes() error = %v", err)
+	}
+	if !equalTLVs(p.TLVMap(), d.TLVs) {
+		t.Fatalf("AppendHeader() TLVs = %q, want %q", p.TLVMap(), d.TLVs)
+	}
+}
+
+func Test_Data_WriteHeader(t *testing.T) {
+	var buf bytes.Buffer
+	n, err := testSSLData().WriteHeader(&buf, Version1)
+	if err != nil || n != buf.Len() || buf.String() != "PROXY TCP4 10.20.30.40 40.30.20.10 8000 9000\r\n" {
+		t.Fatalf("WriteHeader() = %v, %v, wrote %q", n, err, buf.String())
+	}
+
+	if _, err := (&Data{Version: 3}).WriteHeader(&buf, 0); err == nil {
+		t.Fatalf("WriteHeader() of invalid data succeeded")
+	}
+}
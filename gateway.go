@@ -0,0 +1,221 @@
+package proxyproto
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	defaultGatewayHandshakeTimeout = 10 * time.Second
+	defaultGatewayHeaderTimeout    = 10 * time.Second
+)
+
+// GatewayOption configures optional behavior of a Gateway
+type GatewayOption func(*Gateway)
+
+// WithGatewayHandshakeTimeout bounds the TLS handshake with clients, 10 seconds by default
+func WithGatewayHandshakeTimeout(d time.Duration) GatewayOption {
+	return func(g *Gateway) {
+		g.handshakeTimeout = d
+	}
+}
+
+// WithGatewayHeaderTimeout bounds reading the PROXY header of connections that Serve
+// accepts from a *Listener, 10 seconds by default
+func WithGatewayHeaderTimeout(d time.Duration) GatewayOption {
+	return func(g *Gateway) {
+		g.headerTimeout = d
+	}
+}
+
+// WithGatewayErrorLog makes Serve log Accept errors and connections that fail to l,
+// which are otherwise dropped silently
+func WithGatewayErrorLog(l *log.Logger) GatewayOption {
+	return func(g *Gateway) {
+		g.errorLog = l
+	}
+}
+
+// WithGatewayIdleTimeout sets the idle timeout of relayed connections, see RelayOptions
+func WithGatewayIdleTimeout(d time.Duration) GatewayOption {
+	return func(g *Gateway) {
+		g.idleTimeout = d
+	}
+}
+
+// WithGatewayClientCertChain makes the gateway send the client certificate chain in a
+// custom TLV as well, see Data.SetClientCertChain. opts must match the backends'
+func WithGatewayClientCertChain(opts ...ClientCertChainOption) GatewayOption {
+	return func(g *Gateway) {
+		g.certChain = append([]ClientCertChainOption{}, opts...)
+	}
+}
+
+// Gateway terminates TLS and forwards the plaintext to a backend, which receives a v2
+// header describing the client like HAProxy's send-proxy-v2-ssl-cn: a TLVTypeSSL entry
+// with the client flags, the verify result and the version, client certificate CN,
+// cipher, and the signature and key algorithms of the gateway's certificate as sub-TLVs,
+// plus TLVTypeAuthority with the server name and TLVTypeALPN with the negotiated
+// protocol when there are any. It is safe for concurrent use
+type Gateway struct {
+	config           *tls.Config
+	dial             DialFunc
+	handshakeTimeout time.Duration
+	headerTimeout    time.Duration
+	idleTimeout      time.Duration
+	certChain        []ClientCertChainOption // nil unless the chain is sent
+	errorLog         *log.Logger
+}
+
+// NewGateway creates a gateway terminating TLS with config and connecting to backends
+// with dial, for example Pool.Dial. Client certificates are requested or verified as
+// config.ClientAuth says
+func NewGateway(config *tls.Config, dial DialFunc, opts ...GatewayOption) *Gateway {
+	g := &Gateway{
+		config:           config,
+		dial:             dial,
+		handshakeTimeout: defaultGatewayHandshakeTimeout,
+		headerTimeout:    defaultGatewayHeaderTimeout,
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	return g
+}
+
+// ServeConn performs the TLS handshake on conn, connects to a backend and relays the
+// connection until it is done, like Relay. If conn carries proxy data (see
+// DataFromConn), the header repeats it so headers chain correctly. conn is always closed
+func (g *Gateway) ServeConn(ctx context.Context, conn net.Conn) (RelayStats, error) {
+	var cert *tls.Certificate
+	tc := tls.Server(conn, g.serverConfig(&cert))
+
+	hctx := ctx
+	if g.handshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		hctx, cancel = context.WithTimeout(ctx, g.handshakeTimeout)
+		defer cancel()
+	}
+	if err := tc.HandshakeContext(hctx); err != nil {
+		conn.Close()
+		return RelayStats{}, fmt.Errorf("TLS handshake with %v failed: %w", conn.RemoteAddr(), err)
+	}
+
+	cs := tc.ConnectionState()
+	if cert == nil && len(g.config.Certificates) > 0 {
+		// resumed sessions skip certificate selection
+		cert = &g.config.Certificates[0]
+	}
+	var leaf *x509.Certificate
+	if cert != nil {
+		leaf = certificateLeaf(cert)
+	}
+	d := relayData(conn).Clone()
+	d.setTLV(TLVTypeSSL, appendSSLTLV(nil, sslTLVFromState(&cs, leaf)))
+	if cs.ServerName != "" {
+		d.setTLV(TLVTypeAuthority, []byte(cs.ServerName))
+	}
+	if cs.NegotiatedProtocol != "" {
+		d.setTLV(TLVTypeALPN, []byte(cs.NegotiatedProtocol))
+	}
+	if g.certChain != nil {
+		if err := d.SetClientCertChain(cs.PeerCertificates, g.certChain...); err != nil {
+			tc.Close()
+			return RelayStats{}, err
+		}
+	}
+
+	backend, err := g.dial(ctx, d)
+	if err != nil {
+		tc.Close()
+		return RelayStats{}, err
+	}
+	return Relay(ctx, tc, backend, RelayOptions{
+		Version:     Version2,
+		Data:        d,
+		IdleTimeout: g.idleTimeout,
+	})
+}
+
+// Serve accepts connections on l and handles each with ServeConn until l is closed,
+// and returns the error from Accept. Other Accept errors are retried after a short
+// backoff. When l is a *Listener, each connection's header is read in its own goroutine
+// within the header timeout, and connections whose header cannot be read are skipped,
+// so one slow or bad client does not stop the others
+func (g *Gateway) Serve(l net.Listener) error {
+	var logf func(string, ...interface{})
+	if g.errorLog != nil {
+		logf = g.errorLog.Printf
+	}
+	return serveListener(l, g.headerTimeout, logf, func(conn net.Conn) {
+		if _, err := g.ServeConn(context.Background(), conn); err != nil && logf != nil {
+			logf("proxyproto: %v: %v", conn.RemoteAddr(), err)
+		}
+	})
+}
+
+// serverConfig copies the gateway's config for one connection, recording the
+// certificate presented to the client in *cert since the connection state lacks it
+func (g *Gateway) serverConfig(cert **tls.Certificate) *tls.Config {
+	c := g.config.Clone()
+	c.GetCertificate = recordCertificate(c.GetCertificate, c.Certificates, cert)
+	if getConfig := c.GetConfigForClient; getConfig != nil {
+		c.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			cc, err := getConfig(hello)
+			if err != nil || cc == nil {
+				return cc, err
+			}
+			cc = cc.Clone()
+			cc.GetCertificate = recordCertificate(cc.GetCertificate, cc.Certificates, cert)
+			return cc, nil
+		}
+	}
+	return c
+}
+
+// recordCertificate picks a certificate like crypto/tls does, with get first and then
+// the first of certs the client supports, and stores it in *cert
+func recordCertificate(get func(*tls.ClientHelloInfo) (*tls.Certificate, error), certs []tls.Certificate, cert **tls.Certificate) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if get != nil {
+			c, err := get(hello)
+			if err != nil || c != nil {
+				*cert = c
+				return c, err
+			}
+		}
+		if len(certs) == 0 {
+			return nil, errors.New("proxyproto: gateway has no certificates")
+		}
+		c := &certs[0]
+		for i := range certs {
+			if hello.SupportsCertificate(&certs[i]) == nil {
+				c = &certs[i]
+				break
+			}
+		}
+		*cert = c
+		return c, nil
+	}
+}
+
+// certificateLeaf gets the parsed leaf of a certificate chain
+func certificateLeaf(c *tls.Certificate) *x509.Certificate {
+	if c.Leaf != nil {
+		return c.Leaf
+	}
+	if len(c.Certificate) == 0 {
+		return nil
+	}
+	leaf, err := x509.ParseCertificate(c.Certificate[0])
+	if err != nil {
+		return nil
+	}
+	return leaf
+}
@@ -0,0 +1,265 @@
+package proxyproto
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_Gateway(t *testing.T) {
+	serverCert, serverCA := testCertificate(t, "gateway", "gw.example.com")
+	clientCert, clientCA := testCertificate(t, "client.example.com")
+	serverPool := x509.NewCertPool()
+	serverPool.AddCert(serverCA)
+	clientPool := x509.NewCertPool()
+	clientPool.AddCert(clientCA)
+
+	tests := []struct {
+		name         string
+		clientAuth   tls.ClientAuthType
+		clientCerts  []tls.Certificate
+		wantClient   SSLTLVClientField
+		wantVerified bool
+		wantCN       string
+	}{
+		{
+			name:         "verified client cert",
+			clientAuth:   tls.RequireAndVerifyClientCert,
+			clientCerts:  []tls.Certificate{clientCert},
+			wantClient:   TLVSSLClientSSL | TLVSSLClientCertConn | TLVSSLClientCertSess,
+			wantVerified: true,
+			wantCN:       "client.example.com",
+		},
+		{
+			name:         "unverified client cert",
+			clientAuth:   tls.RequireAnyClientCert,
+			clientCerts:  []tls.Certificate{clientCert},
+			wantClient:   TLVSSLClientSSL | TLVSSLClientCertConn | TLVSSLClientCertSess,
+			wantVerified: false,
+			wantCN:       "client.example.com",
+		},
+		{
+			name:         "no client cert",
+			clientAuth:   tls.NoClientCert,
+			wantClient:   TLVSSLClientSSL,
+			wantVerified: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend, err := Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Listen() error = %v", err)
+			}
+			defer backend.Close()
+			got := make(chan *Data, 1)
+			go func() {
+				c, err := backend.Accept()
+				if err != nil {
+					return
+				}
+				defer c.Close()
+				got <- c.(*Conn).ProxyData()
+				io.Copy(c, c)
+			}()
+
+			g := NewGateway(&tls.Config{
+				Certificates: []tls.Certificate{serverCert},
+				ClientAuth:   tt.clientAuth,
+				ClientCAs:    clientPool,
+				NextProtos:   []string{"h2", "http/1.1"},
+			}, dialTo(backend.Addr().String(), make(chan *Data, 1)), WithGatewayClientCertChain())
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Listen() error = %v", err)
+			}
+			defer l.Close()
+			go g.Serve(l)
+
+			c, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+				ServerName:   "gw.example.com",
+				RootCAs:      serverPool,
+				Certificates: tt.clientCerts,
+				NextProtos:   []string{"http/1.1"},
+			})
+			if err != nil {
+				t.Fatalf("Dial() error = %v", err)
+			}
+			defer c.Close()
+			c.Write([]byte("ping"))
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+				t.Fatalf("ReadFull() = %q, %v", buf, err)
+			}
+			cs := c.ConnectionState()
+
+			d := <-got
+			if d.Source().String() != c.LocalAddr().String() {
+				t.Fatalf("header source = %v, want %v", d.Source(), c.LocalAddr())
+			}
+			if a, _ := d.TLVGetAuthority(); a != "gw.example.com" {
+				t.Fatalf("TLVGetAuthority() = %q", a)
+			}
+			if p, _ := d.TLVGetALPN(); p != "http/1.1" {
+				t.Fatalf("TLVGetALPN() = %q", p)
+			}
+			ssl, ok := d.TLVGetSSL()
+			if !ok {
+				t.Fatalf("TLVGetSSL() = _, false")
+			}
+			want := &SSLTLVData{
+				Client:   tt.wantClient,
+				Verified: tt.wantVerified,
+				SubTLVs: map[SSLTLVSubType][]byte{
+					TLVSubTypeSSLVersion: []byte(tlsVersionName(cs.Version)),
+					TLVSubTypeSSLCipher:  []byte(cipherSuiteName(cs.CipherSuite)),
+					TLVSubTypeSSLSigAlg:  []byte("ecdsa-with-SHA256"),
+					TLVSubTypeSSLKeyAlg:  []byte("EC256"),
+				},
+			}
+			if tt.wantCN != "" {
+				want.SubTLVs[TLVSubTypeSSLCN] = []byte(tt.wantCN)
+			}
+			if !ssl.Equal(want) {
+				t.Fatalf("TLVGetSSL() = %v, want %v", ssl, want)
+			}
+			if chain, err := d.ClientCertChain(); err != nil || len(chain) != len(tt.clientCerts) {
+				t.Fatalf("ClientCertChain() = %v, %v, want %v certificates", chain, err, len(tt.clientCerts))
+			}
+		})
+	}
+}
+
+func Test_Gateway_handshakeFailure(t *testing.T) {
+	cert, _ := testCertificate(t, "gateway")
+	dialed := make(chan *Data, 1)
+	g := NewGateway(&tls.Config{Certificates: []tls.Certificate{cert}}, dialTo("127.0.0.1:1", dialed))
+
+	client, server := tcpPair(t)
+	client.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	if _, err := g.ServeConn(context.Background(), server); err == nil {
+		t.Fatalf("ServeConn() succeeded without a TLS client")
+	}
+	if len(dialed) != 0 {
+		t.Fatalf("ServeConn() dialed a backend after a failed handshake")
+	}
+}
+
+func Test_Gateway_getConfigForClient(t *testing.T) {
+	cert, _ := testCertificate(t, "gateway")
+	var got *tls.Certificate
+	g := NewGateway(&tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+		},
+	}, nil)
+	c := g.serverConfig(&got)
+	cc, err := c.GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatalf("GetConfigForClient() error = %v", err)
+	}
+	if _, err := cc.GetCertificate(&tls.ClientHelloInfo{}); err != nil || got == nil || got.Leaf != cert.Leaf {
+		t.Fatalf("GetCertificate() did not record the certificate: %v", err)
+	}
+}
+
+func Test_Gateway_Serve(t *testing.T) {
+	cert, _ := testCertificate(t, "gateway", "gw.example.com")
+	dialed := make(chan *Data, 1)
+	g := NewGateway(&tls.Config{Certificates: []tls.Certificate{cert}}, dialTo("127.0.0.1:1", dialed))
+	l, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- g.Serve(l) }()
+
+	// a client that never sends its header does not hold up the others
+	idle, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer idle.Close()
+
+	// a client with a bad header does not stop the gateway
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	c.Write([]byte("PROXY TCP4 nope\r\n"))
+	c.Close()
+
+	c, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer c.Close()
+	c.Write([]byte("PROXY TCP4 10.20.30.40 40.30.20.10 8000 443\r\n"))
+	go tls.Client(c, &tls.Config{ServerName: "gw.example.com", InsecureSkipVerify: true}).Handshake()
+	select {
+	case d := <-dialed:
+		if d.Source().String() != "10.20.30.40:8000" {
+			t.Fatalf("header = %v, want the good client", d)
+		}
+	case err := <-served:
+		t.Fatalf("Serve() = %v after a bad header", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("good connection not served")
+	}
+
+	l.Close()
+	if err := <-served; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Serve() = %v, want %v", err, net.ErrClosed)
+	}
+}
+
+// failOnceListener fails its first Accept with an error that is not a timeout
+type failOnceListener struct {
+	net.Listener
+	failed int32
+}
+
+func (l *failOnceListener) Accept() (net.Conn, error) {
+	if atomic.CompareAndSwapInt32(&l.failed, 0, 1) {
+		return nil, errors.New("accept: too many open files")
+	}
+	return l.Listener.Accept()
+}
+
+func Test_Gateway_Serve_acceptError(t *testing.T) {
+	cert, _ := testCertificate(t, "gateway", "gw.example.com")
+	dialed := make(chan *Data, 1)
+	g := NewGateway(&tls.Config{Certificates: []tls.Certificate{cert}}, dialTo("127.0.0.1:1", dialed))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- g.Serve(&failOnceListener{Listener: l}) }()
+
+	// the gateway keeps accepting after the failure
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer c.Close()
+	go tls.Client(c, &tls.Config{ServerName: "gw.example.com", InsecureSkipVerify: true}).Handshake()
+	select {
+	case <-dialed:
+	case err := <-served:
+		t.Fatalf("Serve() = %v after an Accept error", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("connection not served")
+	}
+
+	l.Close()
+	if err := <-served; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Serve() = %v, want %v", err, net.ErrClosed)
+	}
+}
@@ -0,0 +1,166 @@
+package proxyproto
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+)
+
+// contextKey is the type of the context keys used by this package
+type contextKey int
+
+const (
+	dataContextKey contextKey = iota
+	upstreamTLSContextKey
+)
+
+// ConnContext stores the proxy data of c, if any (see DataFromConn), in ctx. Set it as
+// http.Server.ConnContext to make the data available to handlers with
+// DataFromContext; ListenAndServeHTTP and ListenAndServeHTTPS do so
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	if d, ok := DataFromConn(c); ok {
+		return context.WithValue(ctx, dataContextKey, d)
+	}
+	return ctx
+}
+
+// DataFromContext gets the proxy data stored by ConnContext, for example from
+// http.Request.Context().
+// The second return value will be false if there is none
+func DataFromContext(ctx context.Context) (*Data, bool) {
+	d, ok := ctx.Value(dataContextKey).(*Data)
+	return d, ok
+}
+
+// UpstreamTLS describes the TLS connection between a client and the proxy that
+// terminated it, as reported by the SSL, authority and ALPN TLVs of the proxy's header
+type UpstreamTLS struct {
+	// Version is the TLS version, such as tls.VersionTLS13, or zero if VersionName is
+	// missing or not known
+	Version uint16
+	// VersionName is the version as sent by the proxy, such as "TLSv1.3"
+	VersionName string
+	// CipherSuite is the cipher suite ID, or zero if CipherSuiteName is missing or not
+	// implemented by crypto/tls
+	CipherSuite uint16
+	// CipherSuiteName is the cipher as sent by the proxy, such as
+	// "ECDHE-RSA-AES128-GCM-SHA256"
+	CipherSuiteName string
+	// Client has the client flags, which tell whether the client presented a
+	// certificate on this connection or in the resumed session
+	Client SSLTLVClientField
+	// Verify is the verify result, zero if the client did not present a certificate or
+	// it was verified
+	Verify uint32
+	// CommonName is the CN of the client certificate, if any
+	CommonName string
+	// ServerName is the server name the client requested, from the authority TLV
+	ServerName string
+	// NegotiatedProtocol is the ALPN protocol, from the ALPN TLV
+	NegotiatedProtocol string
+}
+
+// UpstreamTLSFromData decodes the TLS details of a header from a TLS-terminating proxy.
+// The second return value will be false if there is no SSL TLV or its client flags do
+// not have TLVSSLClientSSL set
+func UpstreamTLSFromData(d *Data) (*UpstreamTLS, bool) {
+	// the view keeps the raw verify result, which SSLTLVData reduces to a bool
+	v, ok := d.TLVGetSSLView()
+	if !ok || v.Client()&TLVSSLClientSSL == 0 {
+		return nil, false
+	}
+	ssl := v.Data()
+	u := &UpstreamTLS{
+		Client: ssl.Client,
+		Verify: v.Verify(),
+	}
+	u.VersionName, _ = ssl.TLVSSLVersion()
+	u.Version, _ = TLSVersionFromName(u.VersionName)
+	u.CipherSuiteName, _ = ssl.TLVSSLCipher()
+	u.CipherSuite, _ = CipherSuiteFromName(u.CipherSuiteName)
+	u.CommonName, _ = ssl.TLVSSLCommonName()
+	u.ServerName, _ = d.TLVGetAuthority()
+	u.NegotiatedProtocol, _ = d.TLVGetALPN()
+	return u, true
+}
+
+// Verified reports whether the verify result is zero
+func (u *UpstreamTLS) Verified() bool {
+	return u.Verify == 0
+}
+
+// HasClientCertificate reports whether the client presented a certificate, on this
+// connection or in the session it resumed
+func (u *UpstreamTLS) HasClientCertificate() bool {
+	return u.Client&(TLVSSLClientCertConn|TLVSSLClientCertSess) != 0
+}
+
+// ConnectionState builds a tls.ConnectionState with the fields the header describes.
+// It has no certificates, so code that checks PeerCertificates must use CommonName
+// and Verified instead
+func (u *UpstreamTLS) ConnectionState() *tls.ConnectionState {
+	return &tls.ConnectionState{
+		Version:            u.Version,
+		HandshakeComplete:  true,
+		CipherSuite:        u.CipherSuite,
+		NegotiatedProtocol: u.NegotiatedProtocol,
+		ServerName:         u.ServerName,
+	}
+}
+
+// UpstreamTLSOption configures optional behavior of UpstreamTLSHandler
+type UpstreamTLSOption func(*upstreamTLSHandler)
+
+// WithUpstreamTLSScheme makes UpstreamTLSHandler mark requests that arrived over TLS
+// at the proxy as https: the URL scheme is set to "https" and http.Request.TLS to
+// UpstreamTLS.ConnectionState(), so handlers checking r.TLS do not redirect to https
+func WithUpstreamTLSScheme() UpstreamTLSOption {
+	return func(h *upstreamTLSHandler) {
+		h.scheme = true
+	}
+}
+
+// upstreamTLSHandler is the http.Handler returned by UpstreamTLSHandler
+type upstreamTLSHandler struct {
+	next   http.Handler
+	scheme bool
+}
+
+// UpstreamTLSHandler wraps next so that requests whose connection carries a header
+// from a TLS-terminating proxy have its UpstreamTLS in their context, for
+// UpstreamTLSFromContext. The server must store the proxy data with ConnContext.
+// Requests that were not proxied, or that the server decrypted itself, are passed on
+// unchanged
+func UpstreamTLSHandler(next http.Handler, opts ...UpstreamTLSOption) http.Handler {
+	h := &upstreamTLSHandler{next: next}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+func (h *upstreamTLSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil {
+		if d, ok := DataFromContext(r.Context()); ok {
+			if u, ok := UpstreamTLSFromData(d); ok {
+				r = r.WithContext(context.WithValue(r.Context(), upstreamTLSContextKey, u))
+				if h.scheme {
+					url := *r.URL
+					url.Scheme = "https"
+					r.URL = &url
+					r.TLS = u.ConnectionState()
+				}
+			}
+		}
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+// UpstreamTLSFromContext gets the UpstreamTLS stored by UpstreamTLSHandler, for example
+// from http.Request.Context().
+// The second return value will be false if there is none
+func UpstreamTLSFromContext(ctx context.Context) (*UpstreamTLS, bool) {
+	u, ok := ctx.Value(upstreamTLSContextKey).(*UpstreamTLS)
+	return u, ok
+}
@@ -0,0 +1,170 @@
+package proxyproto
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+)
+
+func Test_TLSVersionFromName(t *testing.T) {
+	for v, name := range tlsVersionNames {
+		if got, ok := TLSVersionFromName(name); !ok || got != v {
+			t.Fatalf("TLSVersionFromName(%q) = %#x, %v, want %#x", name, got, ok, v)
+		}
+	}
+	if _, ok := TLSVersionFromName("TLSv2"); ok {
+		t.Fatalf("TLSVersionFromName() found an unknown version")
+	}
+}
+
+func Test_CipherSuiteFromName(t *testing.T) {
+	// every suite crypto/tls implements maps back from both of its names
+	for _, suites := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+		for _, s := range suites {
+			if got, ok := CipherSuiteFromName(cipherSuiteName(s.ID)); !ok || got != s.ID {
+				t.Fatalf("CipherSuiteFromName(%q) = %#x, %v, want %#x", cipherSuiteName(s.ID), got, ok, s.ID)
+			}
+			if got, ok := CipherSuiteFromName(s.Name); !ok || got != s.ID {
+				t.Fatalf("CipherSuiteFromName(%q) = %#x, %v, want %#x", s.Name, got, ok, s.ID)
+			}
+		}
+	}
+
+	tests := []struct {
+		name string
+		want uint16
+		ok   bool
+	}{
+		{"ECDHE-RSA-AES128-GCM-SHA256", tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, true},
+		{"ECDHE-ECDSA-CHACHA20-POLY1305", tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256, true},
+		{"TLS_AES_256_GCM_SHA384", tls.TLS_AES_256_GCM_SHA384, true},
+		{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384", tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, true},
+		{"DHE-RSA-AES256-GCM-SHA384", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		if got, ok := CipherSuiteFromName(tt.name); got != tt.want || ok != tt.ok {
+			t.Fatalf("CipherSuiteFromName(%q) = %#x, %v, want %#x, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// upstreamTLSData builds data like a TLS-terminating proxy sends
+func upstreamTLSData(t *testing.T) *Data {
+	t.Helper()
+	d, err := NewData(TransportStream, netip.MustParseAddrPort("10.20.30.40:8000"), netip.MustParseAddrPort("40.30.20.10:443"))
+	if err != nil {
+		t.Fatalf("NewData() error = %v", err)
+	}
+	d.TLVs = map[TLVType][]byte{
+		TLVTypeSSL: appendSSLTLV(nil, &SSLTLVData{
+			Client:   TLVSSLClientSSL | TLVSSLClientCertConn | TLVSSLClientCertSess,
+			Verified: true,
+			SubTLVs: map[SSLTLVSubType][]byte{
+				TLVSubTypeSSLVersion: []byte("TLSv1.2"),
+				TLVSubTypeSSLCipher:  []byte("ECDHE-RSA-AES128-GCM-SHA256"),
+				TLVSubTypeSSLCN:      []byte("client.example.com"),
+			},
+		}),
+		TLVTypeAuthority: []byte("example.com"),
+		TLVTypeALPN:      []byte("http/1.1"),
+	}
+	return d
+}
+
+func Test_UpstreamTLSFromData(t *testing.T) {
+	u, ok := UpstreamTLSFromData(upstreamTLSData(t))
+	want := UpstreamTLS{
+		Version:            tls.VersionTLS12,
+		VersionName:        "TLSv1.2",
+		CipherSuite:        tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		CipherSuiteName:    "ECDHE-RSA-AES128-GCM-SHA256",
+		Client:             TLVSSLClientSSL | TLVSSLClientCertConn | TLVSSLClientCertSess,
+		CommonName:         "client.example.com",
+		ServerName:         "example.com",
+		NegotiatedProtocol: "http/1.1",
+	}
+	if !ok || *u != want {
+		t.Fatalf("UpstreamTLSFromData() = %+v, %v, want %+v", u, ok, want)
+	}
+	if !u.Verified() || !u.HasClientCertificate() {
+		t.Fatalf("Verified() = %v, HasClientCertificate() = %v", u.Verified(), u.HasClientCertificate())
+	}
+	cs := u.ConnectionState()
+	if cs.Version != tls.VersionTLS12 || cs.CipherSuite != want.CipherSuite || !cs.HandshakeComplete || cs.ServerName != "example.com" {
+		t.Fatalf("ConnectionState() = %+v", cs)
+	}
+
+	// a plaintext client, and no SSL TLV at all
+	plain := &Data{TLVs: map[TLVType][]byte{TLVTypeSSL: {0, 0, 0, 0, 0}}}
+	if _, ok := UpstreamTLSFromData(plain); ok {
+		t.Fatalf("UpstreamTLSFromData() succeeded without TLVSSLClientSSL")
+	}
+	if _, ok := UpstreamTLSFromData(&Data{}); ok {
+		t.Fatalf("UpstreamTLSFromData() succeeded without an SSL TLV")
+	}
+}
+
+func Test_UpstreamTLSHandler(t *testing.T) {
+	type result struct {
+		scheme string
+		tls    *tls.ConnectionState
+		u      *UpstreamTLS
+	}
+	tests := []struct {
+		name   string
+		data   *Data
+		opts   []UpstreamTLSOption
+		scheme string
+		tls    bool
+	}{
+		{name: "scheme", data: upstreamTLSData(t), opts: []UpstreamTLSOption{WithUpstreamTLSScheme()}, scheme: "https", tls: true},
+		{name: "view only", data: upstreamTLSData(t)},
+		{name: "plaintext", data: &Data{Command: CommandLocal}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := make(chan result, 1)
+			h := UpstreamTLSHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				u, _ := UpstreamTLSFromContext(r.Context())
+				results <- result{r.URL.Scheme, r.TLS, u}
+			}), tt.opts...)
+
+			l, err := Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Listen() error = %v", err)
+			}
+			srv := &http.Server{Handler: h, ConnContext: ConnContext}
+			go srv.Serve(l)
+			defer srv.Shutdown(context.Background())
+
+			c, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatalf("Dial() error = %v", err)
+			}
+			defer c.Close()
+			if _, err := tt.data.WriteHeader(c, Version2); err != nil {
+				t.Fatalf("WriteHeader() error = %v", err)
+			}
+			c.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+			if _, err := http.ReadResponse(bufio.NewReader(c), nil); err != nil {
+				t.Fatalf("ReadResponse() error = %v", err)
+			}
+
+			r := <-results
+			if r.scheme != tt.scheme || (r.tls != nil) != tt.tls {
+				t.Fatalf("request scheme = %q, TLS = %v, want %q, %v", r.scheme, r.tls, tt.scheme, tt.tls)
+			}
+			if (r.u != nil) != (tt.data.TLVs != nil) {
+				t.Fatalf("UpstreamTLSFromContext() = %+v", r.u)
+			}
+			if r.tls != nil && r.tls.CipherSuite != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+				t.Fatalf("request TLS = %+v", r.tls)
+			}
+		})
+	}
+}
@@ -15,30 +15,36 @@ func Listen(network, addr string) (net.Listener, error) {
 	return WrapListener(lis), nil
 }
 
-// ListenTLS is a shortcut equivalent to wrapping tls.Listen() with Proxy Protocol v1/v2
+// ListenTLS is a shortcut equivalent to wrapping tls.Listen() with Proxy Protocol v1/v2.
+// The Proxy Protocol header is read before the TLS handshake, so accepted connections
+// are *tls.Conn values wrapping a *Conn; use DataFromConn to get the proxy data
 func ListenTLS(network, addr string, config *tls.Config) (net.Listener, error) {
-	lis, err := tls.Listen(network, addr, config)
+	lis, err := Listen(network, addr)
 	if err != nil {
 		return nil, err
 	}
-	return WrapListener(lis), nil
+	return tls.NewListener(lis, config), nil
 }
 
-// ListenAndServeHTTP is a shortcut equivalent to wrapping http.ListenAndServe with Proxy Protocol v1/v2
+// ListenAndServeHTTP is a shortcut equivalent to wrapping http.ListenAndServe with Proxy Protocol v1/v2.
+// Handlers can get the proxy data with DataFromContext(r.Context())
 func ListenAndServeHTTP(addr string, handler http.Handler) error {
 	lis, err := Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
-	return http.Serve(lis, handler)
+	srv := &http.Server{Handler: handler, ConnContext: ConnContext}
+	return srv.Serve(lis)
 }
 
-// ListenAndServeHTTPS is a shortcut equivalent to wrapping http.ListenAndServeTLS with Proxy Protocol v1/v2
+// ListenAndServeHTTPS is a shortcut equivalent to wrapping http.ListenAndServeTLS with Proxy Protocol v1/v2.
+// Handlers can get the proxy data with DataFromContext(r.Context())
 func ListenAndServeHTTPS(addr string, config *tls.Config, handler http.Handler) error {
 	lis, err := ListenTLS("tcp", addr, config)
 	if err != nil {
 		return err
 	}
 
-	return http.Serve(lis, handler)
+	srv := &http.Server{Handler: handler, ConnContext: ConnContext}
+	return srv.Serve(lis)
 }
@@ -1,7 +1,12 @@
 package proxyproto
 
 import (
+	"context"
+	"errors"
+	"io"
 	"net"
+	"syscall"
+	"time"
 )
 
 // Listener is an implementation of net.Listener that supports
@@ -9,28 +14,58 @@ import (
 // ListenAndServeHTTP, and ListenAndServeHTTPS which are likely more convenient to use.
 type Listener struct {
 	listener net.Listener
+	connOpts []ConnOption
+
+	// ctx is cancelled by Close to abort header reads in Accept
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // WrapListener takes an existing listener and wraps proxy protocol
 // functionality around it. Any accepted connections will expect
-// proxy protocol.
-func WrapListener(l net.Listener) *Listener {
-	return &Listener{listener: l}
+// proxy protocol. The options are applied to every accepted Conn
+func WrapListener(l net.Listener, opts ...ConnOption) *Listener {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Listener{listener: l, connOpts: opts, ctx: ctx, cancel: cancel}
 }
 
 // Accept waits for and returns the next connection to the listener.
-// The connection will be wrapped automatically as a proxyproto.Conn using WrapConn()
+// The connection will be wrapped automatically as a proxyproto.Conn using WrapConnContext(),
+// and closed if the header cannot be read
 func (l *Listener) Accept() (net.Conn, error) {
 	conn, err := l.listener.Accept()
 	if err != nil {
 		return nil, err
 	}
-	return WrapConn(conn)
+	c, err := l.wrap(conn, 0)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// wrap reads the header of a connection accepted from the underlying listener and
+// closes the connection if that fails. A positive timeout bounds the read
+func (l *Listener) wrap(conn net.Conn, timeout time.Duration) (*Conn, error) {
+	ctx := l.ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	c, err := WrapConnContext(ctx, conn, l.connOpts...)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
 }
 
 // Close closes the listener.
-// Any blocked Accept operations will be unblocked and return errors.
+// Any blocked Accept operations will be unblocked and return errors, including
+// those waiting for a connection's Proxy Protocol header.
 func (l *Listener) Close() error {
+	l.cancel()
 	return l.listener.Close()
 }
 
@@ -38,3 +73,78 @@ func (l *Listener) Close() error {
 func (l *Listener) Addr() net.Addr {
 	return l.listener.Addr()
 }
+
+// serveListener accepts connections on l and runs handle for each in a new goroutine
+// until l is closed, returning the error from Accept. Errors about a single connection
+// are skipped, and after any other error it backs off like net/http (up to a second)
+// and tries again, since the listener may recover, for example once file descriptors
+// are freed. If l is a *Listener, each header is read in the connection's own goroutine,
+// bounded by headerTimeout if it is positive, so a client that never sends one does not
+// hold up the others. Errors are passed to logf if it is not nil
+func serveListener(l net.Listener, headerTimeout time.Duration, logf func(format string, v ...interface{}), handle func(net.Conn)) error {
+	pl, _ := l.(*Listener)
+	var delay time.Duration
+	for {
+		var conn net.Conn
+		var err error
+		if pl != nil {
+			conn, err = pl.listener.Accept()
+		} else {
+			conn, err = l.Accept()
+		}
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			if isConnError(err) {
+				if logf != nil {
+					logf("proxyproto: %v", err)
+				}
+				continue
+			}
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else {
+				delay *= 2
+			}
+			if delay > time.Second {
+				delay = time.Second
+			}
+			if logf != nil {
+				logf("proxyproto: accept failed: %v; retrying in %v", err, delay)
+			}
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		if pl == nil {
+			go handle(conn)
+			continue
+		}
+		go func() {
+			c, err := pl.wrap(conn, headerTimeout)
+			if err != nil {
+				if logf != nil {
+					logf("proxyproto: %v: %v", conn.RemoteAddr(), err)
+				}
+				return
+			}
+			handle(c)
+		}()
+	}
+}
+
+// isConnError reports whether an error from Accept is about one connection rather
+// than the listener: an invalid or incomplete header, a header read that was cancelled
+// or timed out, or a client that went away before sending it
+func isConnError(err error) bool {
+	var pe ParseError
+	return errors.As(err, &pe) ||
+		errors.Is(err, ErrIncomplete) ||
+		errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED)
+}
@@ -0,0 +1,605 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	commandNames = map[Command]string{
+		CommandLocal: "local",
+		CommandProxy: "proxy",
+	}
+	addressFamilyNames = map[AddressFamily]string{
+		AddressFamilyLocal: "local",
+		AddressFamilyIPv4:  "ipv4",
+		AddressFamilyIPv6:  "ipv6",
+		AddressFamilyUnix:  "unix",
+	}
+	transportNames = map[Transport]string{
+		TransportUnspec: "unspec",
+		TransportStream: "stream",
+		TransportDgram:  "dgram",
+	}
+	tlvTypeNames = map[TLVType]string{
+		TLVTypeALPN:      "alpn",
+		TLVTypeAuthority: "authority",
+		TLVTypeCRC32C:    "crc32c",
+		TLVTypeNoop:      "noop",
+		TLVTypeSSL:       "ssl",
+		TLVTypeNetNS:     "netns",
+	}
+	sslSubTypeNames = map[SSLTLVSubType]string{
+		TLVSubTypeSSLVersion: "version",
+		TLVSubTypeSSLCN:      "cn",
+		TLVSubTypeSSLCipher:  "cipher",
+		TLVSubTypeSSLSigAlg:  "sig_alg",
+		TLVSubTypeSSLKeyAlg:  "key_alg",
+	}
+	sslClientNames = []struct {
+		f    SSLTLVClientField
+		name string
+	}{
+		{TLVSSLClientSSL, "ssl"},
+		{TLVSSLClientCertConn, "cert_conn"},
+		{TLVSSLClientCertSess, "cert_sess"},
+	}
+
+	// TLVs whose values are defined as strings by the spec are rendered as strings,
+	// everything else is rendered as hex
+	textTLVTypes = map[TLVType]bool{
+		TLVTypeALPN:      true,
+		TLVTypeAuthority: true,
+		TLVTypeNetNS:     true,
+	}
+)
+
+// String gets the version as "v1" or "v2", or "v0" for data not parsed from a header
+func (v Version) String() string {
+	return "v" + strconv.Itoa(int(v))
+}
+
+// String gets the lower case name of the command, e.g. "proxy"
+func (c Command) String() string {
+	if n, ok := commandNames[c]; ok {
+		return n
+	}
+	return "Command(" + strconv.Itoa(int(c)) + ")"
+}
+
+// MarshalText implements encoding.TextMarshaler using the name from String
+func (c Command) MarshalText() ([]byte, error) {
+	if _, ok := commandNames[c]; !ok {
+		return nil, fmt.Errorf("unknown command %d", int(c))
+	}
+	return []byte(c.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, accepting the names produced by MarshalText
+func (c *Command) UnmarshalText(b []byte) error {
+	for k, n := range commandNames {
+		if n == string(b) {
+			*c = k
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown command %q", b)
+}
+
+// String gets the lower case name of the address family, e.g. "ipv4"
+func (af AddressFamily) String() string {
+	if n, ok := addressFamilyNames[af]; ok {
+		return n
+	}
+	return "AddressFamily(" + strconv.Itoa(int(af)) + ")"
+}
+
+// MarshalText implements encoding.TextMarshaler using the name from String
+func (af AddressFamily) MarshalText() ([]byte, error) {
+	if _, ok := addressFamilyNames[af]; !ok {
+		return nil, fmt.Errorf("unknown address family %d", int(af))
+	}
+	return []byte(af.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, accepting the names produced by MarshalText
+func (af *AddressFamily) UnmarshalText(b []byte) error {
+	for k, n := range addressFamilyNames {
+		if n == string(b) {
+			*af = k
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown address family %q", b)
+}
+
+// String gets the lower case name of the transport, e.g. "stream"
+func (tr Transport) String() string {
+	if n, ok := transportNames[tr]; ok {
+		return n
+	}
+	return "Transport(" + strconv.Itoa(int(tr)) + ")"
+}
+
+// MarshalText implements encoding.TextMarshaler using the name from String
+func (tr Transport) MarshalText() ([]byte, error) {
+	if _, ok := transportNames[tr]; !ok {
+		return nil, fmt.Errorf("unknown transport %d", int(tr))
+	}
+	return []byte(tr.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, accepting the names produced by MarshalText
+func (tr *Transport) UnmarshalText(b []byte) error {
+	for k, n := range transportNames {
+		if n == string(b) {
+			*tr = k
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown transport %q", b)
+}
+
+// String gets the lower case name of a TLV type defined by the spec (e.g. "alpn"),
+// or its value in hex (e.g. "0xe0") for any other type
+func (t TLVType) String() string {
+	if n, ok := tlvTypeNames[t]; ok {
+		return n
+	}
+	return fmt.Sprintf("0x%02x", byte(t))
+}
+
+// MarshalText implements encoding.TextMarshaler using the name from String
+func (t TLVType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, accepting a name or hex value
+// as produced by MarshalText
+func (t *TLVType) UnmarshalText(b []byte) error {
+	for k, n := range tlvTypeNames {
+		if n == string(b) {
+			*t = k
+			return nil
+		}
+	}
+	v, err := parseHexByte(b)
+	if err != nil {
+		return fmt.Errorf("unknown TLV type %q", b)
+	}
+	*t = TLVType(v)
+	return nil
+}
+
+// String gets the lower case name of an SSL sub-TLV type defined by the spec
+// (e.g. "cn"), or its value in hex for any other type
+func (t SSLTLVSubType) String() string {
+	if n, ok := sslSubTypeNames[t]; ok {
+		return n
+	}
+	return fmt.Sprintf("0x%02x", byte(t))
+}
+
+// MarshalText implements encoding.TextMarshaler using the name from String
+func (t SSLTLVSubType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, accepting a name or hex value
+// as produced by MarshalText
+func (t *SSLTLVSubType) UnmarshalText(b []byte) error {
+	for k, n := range sslSubTypeNames {
+		if n == string(b) {
+			*t = k
+			return nil
+		}
+	}
+	v, err := parseHexByte(b)
+	if err != nil {
+		return fmt.Errorf("unknown SSL sub-TLV type %q", b)
+	}
+	*t = SSLTLVSubType(v)
+	return nil
+}
+
+// String gets the set flags joined by "|", e.g. "ssl|cert_conn". Unknown bits are
+// rendered in hex
+func (f SSLTLVClientField) String() string {
+	var parts []string
+	for _, c := range sslClientNames {
+		if f&c.f != 0 {
+			parts = append(parts, c.name)
+			f &^= c.f
+		}
+	}
+	if f != 0 {
+		parts = append(parts, fmt.Sprintf("0x%02x", byte(f)))
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, "|")
+}
+
+// MarshalText implements encoding.TextMarshaler using the names from String
+func (f SSLTLVClientField) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, accepting flag names or hex
+// values joined by "|" (or "none") as produced by MarshalText
+func (f *SSLTLVClientField) UnmarshalText(b []byte) error {
+	if string(b) == "none" {
+		*f = 0
+		return nil
+	}
+	var n SSLTLVClientField
+	for _, name := range strings.Split(string(b), "|") {
+		c, ok := sslClientFlag(name)
+		if !ok {
+			return fmt.Errorf("unknown SSL client flag %q", name)
+		}
+		n |= c
+	}
+	*f = n
+	return nil
+}
+
+type dataJSON struct {
+	Version       Version                     `json:"version,omitempty"`
+	Command       Command                     `json:"command,omitempty"`
+	AddressFamily AddressFamily               `json:"addressFamily"`
+	Transport     Transport                   `json:"transport"`
+	SourceAddr    string                      `json:"sourceAddr,omitempty"`
+	SourcePort    int                         `json:"sourcePort,omitempty"`
+	DestAddr      string                      `json:"destAddr,omitempty"`
+	DestPort      int                         `json:"destPort,omitempty"`
+	TLVs          map[TLVType]json.RawMessage `json:"tlvs,omitempty"`
+}
+
+type sslJSON struct {
+	Client   []string                 `json:"client"`
+	Verified bool                     `json:"verified"`
+	SubTLVs  map[SSLTLVSubType]string `json:"subTLVs,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler. Addresses are rendered as strings and TLVs
+// as an object keyed by TLV name (or hex type). ALPN, authority and network namespace
+// values are strings, the SSL TLV is a nested object (see SSLTLVData.MarshalJSON)
+// and all other values are hex encoded
+func (d *Data) MarshalJSON() ([]byte, error) {
+	if err := d.Validate(); err != nil {
+		return nil, err
+	}
+	j := dataJSON{
+		Version:       d.Version,
+		Command:       d.Command,
+		AddressFamily: d.AddressFamily,
+		Transport:     d.Transport,
+	}
+	if d.AddressFamily != AddressFamilyLocal {
+		j.SourceAddr = formatDataAddr(d.AddressFamily, d.SourceAddr)
+		j.DestAddr = formatDataAddr(d.AddressFamily, d.DestAddr)
+		j.SourcePort = d.SourcePort
+		j.DestPort = d.DestPort
+	}
+	if tlvs := d.TLVMap(); len(tlvs) > 0 {
+		j.TLVs = make(map[TLVType]json.RawMessage, len(tlvs))
+		for t, v := range tlvs {
+			var raw []byte
+			var err error
+			switch {
+			case t == TLVTypeSSL:
+				ssl, _ := d.TLVGetSSL()
+				raw, err = json.Marshal(ssl)
+			case textTLVTypes[t]:
+				raw, err = json.Marshal(string(v))
+			default:
+				raw, err = json.Marshal(hex.EncodeToString(v))
+			}
+			if err != nil {
+				return nil, err
+			}
+			j.TLVs[t] = raw
+		}
+	}
+	return json.Marshal(&j)
+}
+
+// UnmarshalJSON implements json.Unmarshaler, accepting the format produced by MarshalJSON.
+// The result is validated before it is stored in d
+func (d *Data) UnmarshalJSON(b []byte) error {
+	var j dataJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	n := Data{
+		Version:       j.Version,
+		Command:       j.Command,
+		AddressFamily: j.AddressFamily,
+		Transport:     j.Transport,
+		SourcePort:    j.SourcePort,
+		DestPort:      j.DestPort,
+	}
+	if j.AddressFamily != AddressFamilyLocal {
+		var err error
+		if n.SourceAddr, err = parseDataAddr(j.AddressFamily, j.SourceAddr); err != nil {
+			return err
+		}
+		if n.DestAddr, err = parseDataAddr(j.AddressFamily, j.DestAddr); err != nil {
+			return err
+		}
+	}
+	if len(j.TLVs) > 0 {
+		n.TLVs = make(map[TLVType][]byte, len(j.TLVs))
+		for t, raw := range j.TLVs {
+			switch {
+			case t == TLVTypeSSL:
+				var ssl SSLTLVData
+				if err := json.Unmarshal(raw, &ssl); err != nil {
+					return err
+				}
+				n.TLVs[t] = appendSSLTLV(nil, &ssl)
+			case textTLVTypes[t]:
+				var s string
+				if err := json.Unmarshal(raw, &s); err != nil {
+					return fmt.Errorf("invalid %v TLV: %v", t, err)
+				}
+				n.TLVs[t] = []byte(s)
+			default:
+				var s string
+				if err := json.Unmarshal(raw, &s); err != nil {
+					return fmt.Errorf("invalid %v TLV: %v", t, err)
+				}
+				v, err := hex.DecodeString(s)
+				if err != nil {
+					return fmt.Errorf("invalid %v TLV: %v", t, err)
+				}
+				n.TLVs[t] = v
+			}
+		}
+	}
+	if err := n.Validate(); err != nil {
+		return err
+	}
+	*d = n
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler with a human-readable one-line summary, e.g.
+//
+//	v2 tcp4 10.20.30.40:8000 -> 40.30.20.10:9000 authority="example.com" ssl={client=ssl verified=true version="TLSv1.3"}
+//
+// It is meant for logs and debugging and cannot be unmarshaled
+func (d *Data) MarshalText() ([]byte, error) {
+	var b bytes.Buffer
+	if d.Version != 0 {
+		b.WriteString(d.Version.String())
+		b.WriteByte(' ')
+	}
+	switch {
+	case d.Command == CommandLocal:
+		b.WriteString("local")
+	case d.AddressFamily == AddressFamilyLocal:
+		b.WriteString("unspec")
+	default:
+		b.WriteString(dataNetwork(d.AddressFamily, d.Transport))
+		b.WriteByte(' ')
+		b.WriteString(formatDataAddrPort(d.AddressFamily, d.SourceAddr, d.SourcePort))
+		b.WriteString(" -> ")
+		b.WriteString(formatDataAddrPort(d.AddressFamily, d.DestAddr, d.DestPort))
+	}
+
+	tlvs := d.TLVMap()
+	types := make([]int, 0, len(tlvs))
+	for t := range tlvs {
+		types = append(types, int(t))
+	}
+	sort.Ints(types)
+	for _, ti := range types {
+		t := TLVType(ti)
+		v := tlvs[t]
+		b.WriteByte(' ')
+		b.WriteString(t.String())
+		b.WriteByte('=')
+		switch {
+		case t == TLVTypeSSL && len(v) >= 5:
+			ssl, _ := d.TLVGetSSL()
+			st, _ := ssl.MarshalText()
+			b.WriteByte('{')
+			b.Write(st)
+			b.WriteByte('}')
+		case t == TLVTypeCRC32C && len(v) == 4:
+			fmt.Fprintf(&b, "0x%08x", binary.BigEndian.Uint32(v))
+		case textTLVTypes[t]:
+			b.WriteString(strconv.Quote(string(v)))
+		default:
+			b.WriteString(hex.EncodeToString(v))
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// MarshalJSON implements json.Marshaler. Client flags are rendered as a list of names
+// and sub-TLVs as an object keyed by sub-TLV name (or hex type). Sub-TLVs defined by
+// the spec are strings, all other values are hex encoded
+func (d *SSLTLVData) MarshalJSON() ([]byte, error) {
+	j := sslJSON{
+		Client:   []string{},
+		Verified: d.Verified,
+	}
+	for _, c := range sslClientNames {
+		if d.Client&c.f != 0 {
+			j.Client = append(j.Client, c.name)
+		}
+	}
+	if rest := d.Client &^ (TLVSSLClientSSL | TLVSSLClientCertConn | TLVSSLClientCertSess); rest != 0 {
+		j.Client = append(j.Client, fmt.Sprintf("0x%02x", byte(rest)))
+	}
+	if len(d.SubTLVs) > 0 {
+		j.SubTLVs = make(map[SSLTLVSubType]string, len(d.SubTLVs))
+		for t, v := range d.SubTLVs {
+			if _, ok := sslSubTypeNames[t]; ok {
+				j.SubTLVs[t] = string(v)
+			} else {
+				j.SubTLVs[t] = hex.EncodeToString(v)
+			}
+		}
+	}
+	return json.Marshal(&j)
+}
+
+// UnmarshalJSON implements json.Unmarshaler, accepting the format produced by MarshalJSON
+func (d *SSLTLVData) UnmarshalJSON(b []byte) error {
+	var j sslJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	n := SSLTLVData{Verified: j.Verified}
+	for _, name := range j.Client {
+		f, ok := sslClientFlag(name)
+		if !ok {
+			return fmt.Errorf("unknown SSL client flag %q", name)
+		}
+		n.Client |= f
+	}
+	if len(j.SubTLVs) > 0 {
+		n.SubTLVs = make(map[SSLTLVSubType][]byte, len(j.SubTLVs))
+		for t, v := range j.SubTLVs {
+			if _, ok := sslSubTypeNames[t]; ok {
+				n.SubTLVs[t] = []byte(v)
+				continue
+			}
+			hv, err := hex.DecodeString(v)
+			if err != nil {
+				return fmt.Errorf("invalid SSL %v sub-TLV: %v", t, err)
+			}
+			n.SubTLVs[t] = hv
+		}
+	}
+	if err := n.Validate(); err != nil {
+		return err
+	}
+	*d = n
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler with a human-readable one-line summary, e.g.
+//
+//	client=ssl|cert_conn verified=true version="TLSv1.3" cn="client.example.com"
+func (d *SSLTLVData) MarshalText() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteString("client=")
+	b.WriteString(d.Client.String())
+	b.WriteString(" verified=")
+	b.WriteString(strconv.FormatBool(d.Verified))
+
+	types := make([]int, 0, len(d.SubTLVs))
+	for t := range d.SubTLVs {
+		types = append(types, int(t))
+	}
+	sort.Ints(types)
+	for _, ti := range types {
+		t := SSLTLVSubType(ti)
+		b.WriteByte(' ')
+		b.WriteString(t.String())
+		b.WriteByte('=')
+		if _, ok := sslSubTypeNames[t]; ok {
+			b.WriteString(strconv.Quote(string(d.SubTLVs[t])))
+		} else {
+			b.WriteString(hex.EncodeToString(d.SubTLVs[t]))
+		}
+	}
+	return b.Bytes(), nil
+}
+
+func sslClientFlag(name string) (SSLTLVClientField, bool) {
+	for _, c := range sslClientNames {
+		if c.name == name {
+			return c.f, true
+		}
+	}
+	v, err := parseHexByte([]byte(name))
+	if err != nil {
+		return 0, false
+	}
+	return SSLTLVClientField(v), true
+}
+
+// dataNetwork gets a family-specific network name such as "tcp4" or "unixgram"
+func dataNetwork(af AddressFamily, tr Transport) string {
+	switch af {
+	case AddressFamilyIPv4, AddressFamilyIPv6:
+		n := "ip"
+		switch tr {
+		case TransportStream:
+			n = "tcp"
+		case TransportDgram:
+			n = "udp"
+		}
+		if af == AddressFamilyIPv4 {
+			return n + "4"
+		}
+		return n + "6"
+	case AddressFamilyUnix:
+		if tr == TransportDgram {
+			return "unixgram"
+		}
+		return "unix"
+	default:
+		return af.String()
+	}
+}
+
+// formatDataAddr renders an address field as an IP string or Unix socket path
+func formatDataAddr(af AddressFamily, addr []byte) string {
+	if af == AddressFamilyUnix {
+		return string(trimUnixAddr(addr))
+	}
+	return net.IP(addr).String()
+}
+
+// formatDataAddrPort renders an address field and port the way net.Addr.String would
+func formatDataAddrPort(af AddressFamily, addr []byte, port int) string {
+	if af == AddressFamilyUnix {
+		return strconv.Quote(formatDataAddr(af, addr))
+	}
+	return net.JoinHostPort(formatDataAddr(af, addr), strconv.Itoa(port))
+}
+
+// parseDataAddr is the inverse of formatDataAddr. Unix paths are padded with nulls to
+// the full v2 address size, matching what Parse produces
+func parseDataAddr(af AddressFamily, s string) ([]byte, error) {
+	if af == AddressFamilyUnix {
+		if len(s) > unixAddrSize {
+			return nil, fmt.Errorf("Unix address %q is longer than %v bytes", s, unixAddrSize)
+		}
+		b := make([]byte, unixAddrSize)
+		copy(b, s)
+		return b, nil
+	}
+	b, ok := parseV1IP([]byte(s), af, make([]byte, net.IPv6len))
+	if !ok {
+		return nil, fmt.Errorf("invalid %v address %q", af, s)
+	}
+	return b, nil
+}
+
+// parseHexByte parses a value formatted as "0x%02x"
+func parseHexByte(b []byte) (byte, error) {
+	if len(b) != 4 || b[0] != '0' || b[1] != 'x' {
+		return 0, fmt.Errorf("expected 0x followed by 2 hex digits, got %q", b)
+	}
+	v, err := hex.DecodeString(string(b[2:]))
+	if err != nil {
+		return 0, err
+	}
+	return v[0], nil
+}
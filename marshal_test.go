@@ -0,0 +1,122 @@
+package proxyproto
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func Test_Data_MarshalJSON(t *testing.T) {
+	d := testSSLData()
+
+	b, err := json.Marshal(d)
+	if err != nil {
+		t.Fatalf("MarshalJSON() err = %v", err)
+	}
+	want := `{"addressFamily":"ipv4","transport":"stream","sourceAddr":"10.20.30.40","sourcePort":8000,"destAddr":"40.30.20.10","destPort":9000,"tlvs":{"0xe0":"deadbeef","authority":"example.com","ssl":{"client":["ssl","cert_conn"],"verified":true,"subTLVs":{"cn":"client.example.com","version":"TLSv1.3"}}}}`
+	if string(b) != want {
+		t.Fatalf("MarshalJSON() = %s, want %s", b, want)
+	}
+
+	var got Data
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("UnmarshalJSON() err = %v", err)
+	}
+	if !got.Equal(d) {
+		t.Fatalf("UnmarshalJSON() = %v, want %v", &got, d)
+	}
+}
+
+func Test_Data_UnmarshalJSON_invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+	}{
+		{
+			name: "unknown family",
+			json: `{"addressFamily":"ipx","transport":"stream"}`,
+		},
+		{
+			name: "ipv6 address in ipv4 family",
+			json: `{"addressFamily":"ipv4","transport":"stream","sourceAddr":"::1","destAddr":"1.2.3.4"}`,
+		},
+		{
+			name: "bad hex",
+			json: `{"addressFamily":"local","transport":"unspec","tlvs":{"0xe0":"xyz"}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var d Data
+			if err := json.Unmarshal([]byte(tt.json), &d); err == nil {
+				t.Fatalf("UnmarshalJSON() err = nil, want error")
+			}
+		})
+	}
+}
+
+func Test_Data_MarshalText(t *testing.T) {
+	tests := []struct {
+		name string
+		data *Data
+		want string
+	}{
+		{
+			name: "ssl",
+			data: testSSLData(),
+			want: `tcp4 10.20.30.40:8000 -> 40.30.20.10:9000 authority="example.com" ssl={client=ssl|cert_conn verified=true version="TLSv1.3" cn="client.example.com"} 0xe0=deadbeef`,
+		},
+		{
+			name: "local",
+			data: &Data{},
+			want: "unspec",
+		},
+		{
+			name: "v2 local",
+			data: &Data{Version: Version2, Command: CommandLocal},
+			want: "v2 local",
+		},
+		{
+			name: "ipv6 with crc",
+			data: &Data{
+				AddressFamily: AddressFamilyIPv6,
+				Transport:     TransportDgram,
+				SourceAddr:    []byte{0x26, 0x7, 0xf8, 0xb0, 0x40, 0x8, 0x8, 0xe, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x20, 0x0e},
+				SourcePort:    8000,
+				DestAddr:      []byte{0x26, 0x6, 0x47, 0x0, 0x47, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x11, 0x11},
+				DestPort:      9000,
+				TLVs:          map[TLVType][]byte{TLVTypeCRC32C: {1, 2, 3, 4}},
+			},
+			want: "udp6 [2607:f8b0:4008:80e::200e]:8000 -> [2606:4700:4700::1111]:9000 crc32c=0x01020304",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.data.MarshalText()
+			if err != nil {
+				t.Fatalf("MarshalText() err = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("MarshalText() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_SSLTLVClientField_UnmarshalText(t *testing.T) {
+	for _, f := range []SSLTLVClientField{0, TLVSSLClientSSL, TLVSSLClientSSL | TLVSSLClientCertConn | TLVSSLClientCertSess, TLVSSLClientCertSess | 0x80} {
+		b, _ := f.MarshalText()
+		var got SSLTLVClientField
+		if err := got.UnmarshalText(b); err != nil || got != f {
+			t.Fatalf("UnmarshalText(%q) = %v, %v, want %v", b, got, err, f)
+		}
+	}
+	var f SSLTLVClientField
+	if err := f.UnmarshalText([]byte("0x09")); err != nil || f != TLVSSLClientSSL|0x08 {
+		t.Fatalf("UnmarshalText(0x09) = %v, %v", f, err)
+	}
+	for _, s := range []string{"", "ssl|", "tls", "ssl|none"} {
+		if err := f.UnmarshalText([]byte(s)); err == nil {
+			t.Errorf("UnmarshalText(%q) accepted an unknown flag", s)
+		}
+	}
+}
@@ -2,34 +2,267 @@ package proxyproto
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
 )
 
-const parseReadSize = 4096
+const (
+	parseReadSize = 4096
+
+	// headers up to this size share a single allocation with their Data when read by Parse
+	inlineHeaderSize = 256
+)
+
+// parseBufPool holds read buffers for Parse, so parsing does not allocate them per connection
+var parseBufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, parseReadSize)
+		return &b
+	},
+}
+
+// parsedData lets a parsed Data share a single allocation with the addresses decoded
+// from a v1 header
+type parsedData struct {
+	Data
+	addrs [2 * net.IPv6len]byte
+}
+
+// bufferedData additionally holds a private copy of a header read by Parse, so the
+// Data does not keep the pooled read buffer alive
+type bufferedData struct {
+	parsedData
+	hdr [inlineHeaderSize]byte
+}
+
+// ErrIncomplete is matched (using errors.Is) by the error ParseBytes returns when the
+// buffer holds the beginning of a valid header but not all of it
+var ErrIncomplete = errors.New("proxy protocol header is incomplete")
+
+// IncompleteError is returned by ParseBytes when the buffer holds the beginning of a
+// valid header but not all of it. Needed is the minimum number of additional bytes
+// required before parsing can make progress; for v1 headers the total length is not
+// known up front, so more bytes may be needed after those arrive
+type IncompleteError struct {
+	Needed int
+}
+
+func (e *IncompleteError) Error() string {
+	return fmt.Sprintf("proxy protocol header is incomplete, need at least %v more bytes", e.Needed)
+}
+
+// Is reports whether target is ErrIncomplete
+func (e *IncompleteError) Is(target error) bool {
+	return target == ErrIncomplete
+}
 
 // Parse takes an io.Reader and attempts to parse it as Proxy Protocol v1 or v2
-// If parsing fails, error will be a ParseError
+// If parsing fails, error will be a ParseError.
+// Parse reads in large chunks, so it will usually consume application data that
+// follows the header. Use WrapConn to keep that data, or ParseBytes if the bytes
+// are already in memory
 func Parse(r io.Reader) (*Data, error) {
-	buf := make([]byte, parseReadSize)
-	n, err := r.Read(buf)
+	d, _, pooled, err := parse(r)
+	releaseParseBuf(pooled)
+	return d, err
+}
+
+// parse reads a header from r into a pooled buffer. rest is the application data read
+// past the header; it aliases *pooled, which must be passed to releaseParseBuf once
+// rest is no longer needed. The returned Data does not alias the pooled buffer
+func parse(r io.Reader) (d *Data, rest []byte, pooled *[]byte, err error) {
+	pooled = parseBufPool.Get().(*[]byte)
+	buf := *pooled
+	have := 0
+	for {
+		n, rerr := r.Read(buf[have:])
+		have += n
+		if have > 0 {
+			hn, herr := headerLen(buf[:have])
+			if herr == nil {
+				bd := new(bufferedData)
+				hdr := bd.hdr[:0]
+				if hn > len(bd.hdr) {
+					hdr = make([]byte, 0, hn)
+				}
+				hdr = append(hdr, buf[:hn]...)
+				if _, err := parseInto(&bd.parsedData, hdr); err != nil {
+					releaseParseBuf(pooled)
+					return nil, nil, nil, unlocated(err)
+				}
+				return &bd.Data, buf[hn:have], pooled, nil
+			}
+			var ie *IncompleteError
+			if !errors.As(herr, &ie) {
+				releaseParseBuf(pooled)
+				return nil, nil, nil, unlocated(herr)
+			}
+			if have+ie.Needed > len(buf) {
+				// only v2 headers with large TLVs get here, the bigger buffer is not pooled
+				nb := make([]byte, have+ie.Needed)
+				copy(nb, buf[:have])
+				releaseParseBuf(pooled)
+				buf = nb
+				pooled = &nb
+			}
+		}
+		if rerr != nil {
+			releaseParseBuf(pooled)
+			return nil, nil, nil, fmt.Errorf("failed to read parser buffer for proxy protocol: %w", rerr)
+		}
+	}
+}
+
+// releaseParseBuf returns a buffer from parse to the pool
+func releaseParseBuf(pooled *[]byte) {
+	if pooled != nil && cap(*pooled) == parseReadSize {
+		parseBufPool.Put(pooled)
+	}
+}
+
+// ParseContext is like Parse, but gives up when ctx is cancelled or its deadline passes.
+// If r has a SetReadDeadline method (as every net.Conn does), the context's deadline
+// is applied as the read deadline and cancellation interrupts a blocked Read by moving
+// the read deadline into the past. The read deadline is cleared before returning.
+// Other readers cannot be interrupted, so ctx is only checked before reading starts.
+// If ctx ends the parse, the returned error wraps ctx.Err()
+func ParseContext(ctx context.Context, r io.Reader) (*Data, error) {
+	d, _, pooled, err := parseContext(ctx, r)
+	releaseParseBuf(pooled)
+	return d, err
+}
+
+// parseContext is the context-aware version of parse, with the same buffer ownership rules
+func parseContext(ctx context.Context, r io.Reader) (d *Data, rest []byte, pooled *[]byte, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to parse proxy protocol: %w", err)
+	}
+	dr, ok := r.(interface{ SetReadDeadline(time.Time) error })
+	if !ok {
+		return parse(r)
+	}
+
+	// the context's deadline becomes the read deadline, the watcher is only needed
+	// for a context that can be cancelled (context.Background() never is)
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		if err := dr.SetReadDeadline(deadline); err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to set read deadline for proxy protocol: %w", err)
+		}
+	}
+	var stop chan struct{}
+	if ctx.Done() != nil {
+		// stop is unbuffered, so the send below waits out a watcher that is
+		// interrupting the read
+		stop = make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				dr.SetReadDeadline(aLongTimeAgo)
+				<-stop
+			case <-stop:
+			}
+		}()
+	}
+
+	d, rest, pooled, err = parse(r)
+	if stop != nil {
+		stop <- struct{}{}
+	}
+	if hasDeadline || stop != nil {
+		dr.SetReadDeadline(time.Time{})
+	}
+
+	if err != nil {
+		if cerr := ctx.Err(); cerr != nil {
+			return nil, nil, nil, fmt.Errorf("failed to parse proxy protocol: %w", cerr)
+		}
+		// the read deadline can fire just before the context notices its own deadline
+		if hasDeadline && errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, nil, nil, fmt.Errorf("failed to parse proxy protocol: %w", context.DeadlineExceeded)
+		}
+		return nil, nil, nil, err
+	}
+	return d, rest, pooled, nil
+}
+
+// aLongTimeAgo is a non-zero time in the past, used to interrupt blocked reads
+var aLongTimeAgo = time.Unix(1, 0)
+
+// ParseBytes attempts to parse the start of b as Proxy Protocol v1 or v2. On success
+// it returns the data and the length of the header, so b[n:] is the application data
+// that follows it. The returned data may alias b.
+// If b holds only part of a header, the error is an *IncompleteError (matching
+// ErrIncomplete) telling how many more bytes are needed. Any other failure is a ParseError;
+// use LocateError to find the bytes that caused it
+func ParseBytes(b []byte) (d *Data, n int, err error) {
+	p := new(parsedData)
+	n, err = parseInto(p, b)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read parser buffer for proxy protocol: %v", err)
+		return nil, 0, unlocated(err)
 	}
-	c := buf[:n]
+	return &p.Data, n, nil
+}
+
+var errNotProxyProto = ParseError("failed to parse proxy protocol, expected \"PROXY\" or v2 binary header")
 
-	// v1 or v2
+// parseInto parses the header at the start of b into p and returns its length
+func parseInto(p *parsedData, b []byte) (int, error) {
+	var n int
+	var err error
 	switch {
-	case bytes.HasPrefix(c, protov1[:]):
-		return parseV1(c[len(protov1):])
-	case bytes.HasPrefix(c, protov2[:]):
-		if n < 16 {
-			return nil, ParseError("failed to parse proxy protocol v2: header must be at least 16 bytes")
-		}
-		return parseV2(c[len(protov2):], r)
+	case bytes.HasPrefix(b, protov1[:]):
+		n, err = parseV1(&p.Data, b[len(protov1):], &p.addrs)
+		n, err = n+len(protov1), shiftError(err, len(protov1))
+	case bytes.HasPrefix(b, protov2[:]):
+		n, err = parseV2(&p.Data, b[len(protov2):])
+		n, err = n+len(protov2), shiftError(err, len(protov2))
 	default:
-		return nil, ParseError("failed to parse proxy protocol, expected \"PROXY\" or v2 binary header")
+		_, err = headerLen(b)
+	}
+	if err != nil {
+		return 0, err
+	}
+	p.Data.raw = b[:n:n]
+	return n, nil
+}
+
+// headerLen gets the length of the header at the start of b without fully parsing it.
+// It fails with the same errors as ParseBytes for incomplete or unrecognized headers
+func headerLen(b []byte) (int, error) {
+	switch {
+	case bytes.HasPrefix(b, protov1[:]):
+		n, err := v1LineLen(b[len(protov1):])
+		return len(protov1) + n, shiftError(err, len(protov1))
+	case bytes.HasPrefix(b, protov2[:]):
+		n, err := v2HeaderLen(b[len(protov2):])
+		return len(protov2) + n, shiftError(err, len(protov2))
+	case bytes.HasPrefix(protov1[:], b):
+		return 0, &IncompleteError{Needed: len(protov1) - len(b)}
+	case bytes.HasPrefix(protov2[:], b):
+		return 0, &IncompleteError{Needed: len(protov2) - len(b)}
+	default:
+		off := commonPrefixLen(b, protov1[:])
+		if n := commonPrefixLen(b, protov2[:]); n > off {
+			off = n
+		}
+		return 0, syntaxError(off, 1, errNotProxyProto)
+	}
+}
+
+// commonPrefixLen gets the length of the longest common prefix of a and b
+func commonPrefixLen(a, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
 	}
+	return n
 }
 
 // ParseError is a type of error for parsing errors
@@ -42,3 +275,61 @@ func (e ParseError) Error() string {
 func fmtParseError(format string, a ...interface{}) ParseError {
 	return ParseError(fmt.Sprintf(format, a...))
 }
+
+// SyntaxError tells where a header is invalid or incomplete, see LocateError
+type SyntaxError struct {
+	// Offset is where the invalid bytes start, counted from the start of the header.
+	// For an incomplete header it is the end of the buffer
+	Offset int
+	// Length is the number of invalid bytes, 0 for an incomplete header
+	Length int
+	// Err is the error ParseBytes returns for the header: a ParseError, or an
+	// *IncompleteError
+	Err error
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%v (at byte %v)", e.Err, e.Offset)
+}
+
+// Unwrap returns Err
+func (e *SyntaxError) Unwrap() error {
+	return e.Err
+}
+
+// LocateError parses the header at the start of b like ParseBytes and, if that fails,
+// reports which bytes made it fail. It returns nil if b starts with a valid header
+func LocateError(b []byte) *SyntaxError {
+	_, err := parseInto(new(parsedData), b)
+	if err == nil {
+		return nil
+	}
+	if se, ok := err.(*SyntaxError); ok {
+		return se
+	}
+	return &SyntaxError{Offset: len(b), Err: err}
+}
+
+// syntaxError makes the error for n invalid bytes at off. While parsing, off is relative
+// to the part of the header being parsed, and shiftError moves it as the error is
+// returned to the caller that parses the enclosing part
+func syntaxError(off, n int, err ParseError) error {
+	return &SyntaxError{Offset: off, Length: n, Err: err}
+}
+
+// shiftError moves the location of err, if it is a *SyntaxError, by n bytes
+func shiftError(err error, n int) error {
+	if se, ok := err.(*SyntaxError); ok {
+		se.Offset += n
+	}
+	return err
+}
+
+// unlocated drops the location from a parser error, as ParseBytes and Parse return
+// plain ParseErrors
+func unlocated(err error) error {
+	if se, ok := err.(*SyntaxError); ok {
+		return se.Err
+	}
+	return err
+}
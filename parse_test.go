@@ -2,36 +2,44 @@ package proxyproto
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"io"
 	"net"
-	"reflect"
 	"testing"
+	"time"
 )
 
 func Test_parse(t *testing.T) {
 	tests := []struct {
-		name    string
-		buf     []byte
-		want    *Data
-		wantErr error
+		name     string
+		buf      []byte
+		want     *Data
+		wantRest []byte
+		wantErr  error
 	}{
 		{
-			name: "valid 4",
-			buf:  []byte("PROXY TCP4 10.20.30.40 40.30.20.10 8000 9000\r\nTEST"),
+			name:     "valid 4",
+			buf:      []byte("PROXY TCP4 10.20.30.40 40.30.20.10 8000 9000\r\nTEST"),
+			wantRest: []byte("TEST"),
 			want: &Data{
-				remainingData: []byte("TEST"),
+				Version:       Version1,
+				Command:       CommandProxy,
 				AddressFamily: AddressFamilyIPv4,
 				Transport:     TransportStream,
-				SourceAddr:    net.IPv4(10, 20, 30, 40),
+				SourceAddr:    []byte{10, 20, 30, 40},
 				SourcePort:    8000,
-				DestAddr:      net.IPv4(40, 30, 20, 10),
+				DestAddr:      []byte{40, 30, 20, 10},
 				DestPort:      9000,
 			},
 		},
 		{
-			name: "valid 6",
-			buf:  []byte("PROXY TCP6 2607:f8b0:4008:80e::200e 2606:4700:4700::1111 8000 9000\r\nTEST"),
+			name:     "valid 6",
+			buf:      []byte("PROXY TCP6 2607:f8b0:4008:80e::200e 2606:4700:4700::1111 8000 9000\r\nTEST"),
+			wantRest: []byte("TEST"),
 			want: &Data{
-				remainingData: []byte("TEST"),
+				Version:       Version1,
+				Command:       CommandProxy,
 				AddressFamily: AddressFamilyIPv6,
 				Transport:     TransportStream,
 				SourceAddr:    []byte{0x26, 0x7, 0xf8, 0xb0, 0x40, 0x8, 0x8, 0xe, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x20, 0x0e},
@@ -63,8 +71,10 @@ func Test_parse(t *testing.T) {
 				// random data
 				0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8,
 			},
+			wantRest: []byte{0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8},
 			want: &Data{
-				remainingData: []byte{0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8},
+				Version:       Version2,
+				Command:       CommandProxy,
 				AddressFamily: AddressFamilyIPv4,
 				Transport:     TransportStream,
 				SourceAddr:    []byte{10, 20, 30, 40},
@@ -105,8 +115,10 @@ func Test_parse(t *testing.T) {
 				// random data
 				0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8,
 			},
+			wantRest: []byte{0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8},
 			want: &Data{
-				remainingData: []byte{0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8},
+				Version:       Version2,
+				Command:       CommandProxy,
 				AddressFamily: AddressFamilyIPv4,
 				Transport:     TransportStream,
 				SourceAddr:    []byte{10, 20, 30, 40},
@@ -142,8 +154,10 @@ func Test_parse(t *testing.T) {
 				// random data
 				0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8,
 			},
+			wantRest: []byte{0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8},
 			want: &Data{
-				remainingData: []byte{0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8},
+				Version:       Version2,
+				Command:       CommandProxy,
 				AddressFamily: AddressFamilyIPv6,
 				Transport:     TransportStream,
 				SourceAddr:    []byte{0x26, 0x7, 0xf8, 0xb0, 0x40, 0x8, 0x8, 0xe, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x20, 0x0e},
@@ -167,8 +181,10 @@ func Test_parse(t *testing.T) {
 				// random data
 				0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8,
 			},
+			wantRest: []byte{0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8},
 			want: &Data{
-				remainingData: []byte{0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8},
+				Version:       Version2,
+				Command:       CommandLocal,
 				AddressFamily: AddressFamilyLocal,
 				Transport:     TransportUnspec,
 			},
@@ -176,14 +192,219 @@ func Test_parse(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := Parse(bytes.NewBuffer(tt.buf))
+			got, rest, pooled, err := parse(bytes.NewBuffer(tt.buf))
+			defer releaseParseBuf(pooled)
 
 			if tt.wantErr != err {
 				t.Fatalf("Parse() err = %v, want %v", err, tt.wantErr)
 			}
-			if !reflect.DeepEqual(got, tt.want) {
-				t.Fatalf("Parse() = %v, want %v", got, tt.want)
+			if !got.Equal(tt.want) || !bytes.Equal(rest, tt.wantRest) {
+				t.Fatalf("Parse() = %v, %q, want %v, %q", got, rest, tt.want, tt.wantRest)
+			}
+		})
+	}
+}
+
+func Test_ParseBytes(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+	}{
+		{
+			name:   "v1 tcp4",
+			header: []byte("PROXY TCP4 10.20.30.40 40.30.20.10 8000 9000\r\n"),
+		},
+		{
+			name:   "v1 unknown",
+			header: []byte("PROXY UNKNOWN\r\n"),
+		},
+		{
+			name: "v2 tcp4 w TLVs",
+			header: []byte{
+				0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A,
+				0x21, 0x11, 0x0, 0x13,
+				10, 20, 30, 40,
+				40, 30, 20, 10,
+				0x1f, 0x40,
+				0x23, 0x28,
+				0x2, 0x0, 0x4, 'a', 'b', 'c', 'd',
+			},
+		},
+		{
+			name: "v2 local",
+			header: []byte{
+				0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A,
+				0x20, 0x00, 0x0, 0x0,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := append(append([]byte{}, tt.header...), "TEST"...)
+			d, n, err := ParseBytes(buf)
+			if err != nil {
+				t.Fatalf("ParseBytes() err = %v", err)
+			}
+			if d == nil || n != len(tt.header) {
+				t.Fatalf("ParseBytes() = %v, %v, want %v bytes consumed", d, n, len(tt.header))
+			}
+
+			// every strict prefix of the header is incomplete
+			for i := 0; i < len(tt.header); i++ {
+				_, _, err := ParseBytes(tt.header[:i])
+				var ie *IncompleteError
+				if !errors.Is(err, ErrIncomplete) || !errors.As(err, &ie) || ie.Needed <= 0 || i+ie.Needed > len(tt.header) {
+					t.Fatalf("ParseBytes(header[:%v]) err = %v, want ErrIncomplete", i, err)
+				}
+			}
+		})
+	}
+}
+
+func Test_ParseBytes_invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		buf  []byte
+	}{
+		{
+			name: "not proxy protocol",
+			buf:  []byte("GET / HTTP/1.1\r\n"),
+		},
+		{
+			name: "bad v1 protocol before CR/LF",
+			buf:  []byte("PROXY UDP4 "),
+		},
+		{
+			name: "v1 too long",
+			buf:  append([]byte("PROXY UNKNOWN "), bytes.Repeat([]byte("x"), 100)...),
+		},
+		{
+			name: "bad v2 version",
+			buf:  []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A, 0x11},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := ParseBytes(tt.buf)
+			if _, ok := err.(ParseError); !ok {
+				t.Fatalf("ParseBytes() err = %v, want ParseError", err)
+			}
+		})
+	}
+}
+
+func Test_LocateError(t *testing.T) {
+	v2 := func(b ...byte) []byte { return append(protov2[:], b...) }
+	tests := []struct {
+		name       string
+		buf        []byte
+		wantOffset int
+		wantLength int
+	}{
+		{name: "not proxy protocol", buf: []byte("GET / HTTP/1.1\r\n"), wantOffset: 0, wantLength: 1},
+		{name: "bad v1 signature", buf: []byte("PROXX TCP4"), wantOffset: 4, wantLength: 1},
+		{name: "incomplete", buf: []byte("PROXY TCP4 1.2.3.4"), wantOffset: 18},
+		{name: "v1 protocol", buf: []byte("PROXY TCP5 1.2.3.4 5.6.7.8 1 2\r\n"), wantOffset: 9, wantLength: 1},
+		{name: "v1 protocol before CR/LF", buf: []byte("PROXY UDP4 "), wantOffset: 7, wantLength: 1},
+		{name: "v1 too long", buf: append([]byte("PROXY UNKNOWN "), bytes.Repeat([]byte("x"), 100)...), wantOffset: 105, wantLength: 2},
+		{name: "v1 source IP", buf: []byte("PROXY TCP4 1.2.3 5.6.7.8 1 2\r\n"), wantOffset: 11, wantLength: 5},
+		{name: "v1 dest IP", buf: []byte("PROXY TCP6 ::1 fe80::1%eth0 1 2\r\n"), wantOffset: 15, wantLength: 12},
+		{name: "v1 source port", buf: []byte("PROXY TCP6 ::1 ::2 +1 2\r\n"), wantOffset: 19, wantLength: 2},
+		{name: "v1 dest port", buf: []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1 65536\r\n"), wantOffset: 29, wantLength: 5},
+		{name: "v1 empty field", buf: []byte("PROXY TCP4 1.2.3.4  5.6.7.8 1 2\r\n"), wantOffset: 19, wantLength: 1},
+		{name: "v1 missing field", buf: []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1\r\n"), wantOffset: 28, wantLength: 1},
+		{name: "v1 missing dest port", buf: []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1 \r\n"), wantOffset: 29, wantLength: 1},
+		{name: "v2 version", buf: v2(0x11, 0x11, 0, 0), wantOffset: 12, wantLength: 1},
+		{name: "v2 family", buf: v2(0x21, 0x41, 0, 0), wantOffset: 13, wantLength: 1},
+		{name: "v2 transport", buf: v2(0x21, 0x13, 0, 0), wantOffset: 13, wantLength: 1},
+		{name: "v2 length", buf: v2(0x21, 0x11, 0, 4, 0, 0, 0, 0), wantOffset: 14, wantLength: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := LocateError(tt.buf)
+			if e == nil {
+				t.Fatalf("LocateError() = nil")
+			}
+			if e.Offset != tt.wantOffset || e.Length != tt.wantLength {
+				t.Fatalf("LocateError() = %v (length %v), want offset %v length %v", e, e.Length, tt.wantOffset, tt.wantLength)
+			}
+			// the error is the one ParseBytes returns, which has no location
+			if _, _, err := ParseBytes(tt.buf); err.Error() != e.Err.Error() {
+				t.Fatalf("LocateError() error = %v, ParseBytes() error = %v", e.Err, err)
 			}
 		})
 	}
+
+	if e := LocateError([]byte("PROXY UNKNOWN\r\n")); e != nil {
+		t.Fatalf("LocateError() = %v for a valid header", e)
+	}
+}
+
+// chunkReader returns at most one byte per Read to exercise header reassembly
+type chunkReader struct {
+	b []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	p[0] = r.b[0]
+	r.b = r.b[1:]
+	return 1, nil
+}
+
+func Test_Parse_shortReads(t *testing.T) {
+	buf := []byte("PROXY TCP6 2607:f8b0:4008:80e::200e 2606:4700:4700::1111 8000 9000\r\n")
+	d, err := Parse(&chunkReader{b: buf})
+	if err != nil {
+		t.Fatalf("Parse() err = %v", err)
+	}
+	if d.SourcePort != 8000 || d.DestPort != 9000 {
+		t.Fatalf("Parse() = %v", d)
+	}
+}
+
+func Test_ParseContext(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go client.Write([]byte("PROXY TCP4 10.20.30.40"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	_, err := ParseContext(ctx, server)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("ParseContext() err = %v, want %v", err, context.Canceled)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = ParseContext(ctx, server)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("ParseContext() err = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// the read deadline is cleared afterwards
+	go client.Write([]byte(" 40.30.20.10 8000 9000\r\n"))
+	b := make([]byte, 8)
+	if _, err := server.Read(b); err != nil {
+		t.Fatalf("Read() after ParseContext() err = %v", err)
+	}
+}
+
+func Test_ParseContext_backgroundAllocs(t *testing.T) {
+	r := deadlineReader{bytes.NewReader(benchV2)}
+	parse := testing.AllocsPerRun(100, func() {
+		r.Reset(benchV2)
+		Parse(r)
+	})
+	withContext := testing.AllocsPerRun(100, func() {
+		r.Reset(benchV2)
+		ParseContext(context.Background(), r)
+	})
+	if withContext != parse {
+		t.Fatalf("ParseContext(context.Background()) allocs = %v, want %v like Parse", withContext, parse)
+	}
 }
@@ -1,6 +1,8 @@
 package proxyproto
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+)
 
 // parseTLVs processes the Type-Length-Value bits for Proxy Protocol V2
 // the buffer is expected to only include the TLV portion of the payload
@@ -8,31 +10,121 @@ import "encoding/binary"
 // into this function
 func parseTLVs(buf []byte) map[TLVType][]byte {
 	m := make(map[TLVType][]byte)
-	i := 0
-	for i+2 < len(buf) {
-		t := buf[i]
-		l := int(binary.BigEndian.Uint16(buf[i+1 : i+3]))
-
-		i += 3
-		if i+l <= len(buf) {
-			m[TLVType(t)] = buf[i : i+l]
-		}
-		i += l
+	it := NewTLVIterator(buf)
+	for it.Next() {
+		m[it.Type()] = it.Value()
 	}
 	return m
 }
 
+// TLVIterator walks raw type-length-value entries in order without allocating.
+// A truncated final entry ends the iteration, the same way the parser treats it.
+// Use it like this:
+//
+//	it := d.TLVIterator()
+//	for it.Next() {
+//		fmt.Println(it.Type(), it.Value())
+//	}
+type TLVIterator struct {
+	buf []byte
+	t   TLVType
+	v   []byte
+}
+
+// NewTLVIterator creates an iterator over raw TLV bytes, such as the TLV portion of a
+// v2 header or the sub-TLVs of an SSL TLV (see SSLTLVView.SubTLVs)
+func NewTLVIterator(buf []byte) TLVIterator {
+	return TLVIterator{buf: buf}
+}
+
+// Next advances to the next entry and reports whether there was one
+func (it *TLVIterator) Next() bool {
+	if len(it.buf) < 3 {
+		it.buf = nil
+		return false
+	}
+	l := int(binary.BigEndian.Uint16(it.buf[1:3]))
+	if 3+l > len(it.buf) {
+		it.buf = nil
+		return false
+	}
+	it.t = TLVType(it.buf[0])
+	it.v = it.buf[3 : 3+l]
+	it.buf = it.buf[3+l:]
+	return true
+}
+
+// Type gets the type of the current entry
+func (it *TLVIterator) Type() TLVType {
+	return it.t
+}
+
+// Value gets the value of the current entry. It aliases the iterated bytes
+func (it *TLVIterator) Value() []byte {
+	return it.v
+}
+
+// TLVIterator gets an iterator over the TLVs. For parsed data whose TLVs map has not
+// been set it walks the header bytes in the order they were received (including
+// duplicates) without allocating. For any other data the TLVs map is walked in
+// ascending type order
+func (d *Data) TLVIterator() TLVIterator {
+	if d.tlvsReceived() {
+		return NewTLVIterator(d.rawTLVs)
+	}
+	return NewTLVIterator(appendTLVs(nil, d.TLVs))
+}
+
+// tlvsReceived reports whether the TLVs of d are the bytes of a parsed header (or
+// edits of them made with SetTLV), as they are until the TLVs map is set
+func (d *Data) tlvsReceived() bool {
+	return d.TLVs == nil && d.rawTLVs != nil
+}
+
+// hasTLVs reports whether d has any TLVs
+func (d *Data) hasTLVs() bool {
+	if d.tlvsReceived() {
+		it := NewTLVIterator(d.rawTLVs)
+		return it.Next()
+	}
+	return len(d.TLVs) > 0
+}
+
+// TLV gets the value of any TLV type. If a received header repeats the type, the
+// last value wins. The second return value will be false if the TLV is not provided
+func (d *Data) TLV(t TLVType) ([]byte, bool) {
+	if !d.tlvsReceived() {
+		v, ok := d.TLVs[t]
+		return v, ok
+	}
+	var v []byte
+	found := false
+	for it := NewTLVIterator(d.rawTLVs); it.Next(); {
+		if it.Type() == t {
+			v = it.Value()
+			found = true
+		}
+	}
+	return v, found
+}
+
+// TLVMap gets the TLVs as a map. That is the TLVs field if it is set, or else for
+// parsed data a new map of the received TLVs (the last value wins for a repeated
+// type), which d does not keep. The values may alias the parsed buffer
+func (d *Data) TLVMap() map[TLVType][]byte {
+	if d.tlvsReceived() {
+		return parseTLVs(d.rawTLVs)
+	}
+	return d.TLVs
+}
+
 // TLVGetALPN gets the ALPN TLV from the data.
 // It is for Application-Layer Protocol Negotiation (ALPN). It is a byte sequence defining
-// the upper layer protocol in use over the connection. The most common use case
-// will be to pass the exact copy of the ALPN extension of the Transport Layer
-// Security (TLS) protocol as defined by RFC7301.
+// the upper layer protocol in use over the connection, usually a protocol name such
+// as "h2" (see TLVTypeALPN).
 // The second return value will be false if the TLV is not provided
 func (d *Data) TLVGetALPN() (string, bool) {
-	if d.TLVs == nil {
-		return "", false
-	}
-	if d, ok := d.TLVs[TLVTypeALPN]; ok {
+	if d, ok := d.TLV(TLVTypeALPN); ok {
 		return string(d), true
 	}
 	return "", false
@@ -43,10 +135,7 @@ func (d *Data) TLVGetALPN() (string, bool) {
 // the "server_name" extension as defined by RFC3546
 // The second return value will be false if the TLV is not provided
 func (d *Data) TLVGetAuthority() (string, bool) {
-	if d.TLVs == nil {
-		return "", false
-	}
-	if d, ok := d.TLVs[TLVTypeAuthority]; ok {
+	if d, ok := d.TLV(TLVTypeAuthority); ok {
 		return string(d), true
 	}
 	return "", false
@@ -55,45 +144,93 @@ func (d *Data) TLVGetAuthority() (string, bool) {
 // TLVGetCRC32Checksum gets a 32-bit number storing the CRC32c checksum of the PROXY protocol header
 // The second return value will be false if the TLV is not provided
 func (d *Data) TLVGetCRC32Checksum() (uint32, bool) {
-	if d.TLVs == nil {
-		return 0, false
-	}
-	if d, ok := d.TLVs[TLVTypeCRC32C]; ok && len(d) == 4 {
+	if d, ok := d.TLV(TLVTypeCRC32C); ok && len(d) == 4 {
 		return binary.BigEndian.Uint32(d), true
 	}
 	return 0, false
 }
 
-// TLVGetSSL gets the SSL TLV
+// TLVGetSSL gets the SSL TLV, decoding all of its sub-TLVs.
+// TLVGetSSLView reads the same fields without allocating.
 // The second return value will be false if the TLV is not provided
 func (d *Data) TLVGetSSL() (*SSLTLVData, bool) {
-	if d.TLVs == nil {
+	v, ok := d.TLVGetSSLView()
+	if !ok {
 		return nil, false
 	}
-	if d, ok := d.TLVs[TLVTypeSSL]; ok && len(d) > 5 {
-		subs := parseTLVs(d[5:])
-		dest := make(map[SSLTLVSubType][]byte)
-		for k := range subs {
-			dest[SSLTLVSubType(k)] = subs[k]
-		}
+	return v.Data(), true
+}
 
-		return &SSLTLVData{
-			Client:   SSLTLVClientField(d[0]),
-			Verified: binary.BigEndian.Uint32(d[1:5]) == 0,
-			SubTLVs:  dest,
-		}, true
+// TLVGetSSLView gets a read-only view of the SSL TLV that decodes fields on demand
+// without allocating.
+// The second return value will be false if the TLV is not provided
+func (d *Data) TLVGetSSLView() (SSLTLVView, bool) {
+	if d, ok := d.TLV(TLVTypeSSL); ok && len(d) >= 5 {
+		return SSLTLVView(d), true
 	}
 	return nil, false
 }
 
+// SSLTLVView is a read-only view of the raw value of an SSL TLV. It must be at least
+// 5 bytes long, as returned by Data.TLVGetSSLView
+type SSLTLVView []byte
+
+// Client gets the client bit-field
+func (v SSLTLVView) Client() SSLTLVClientField {
+	return SSLTLVClientField(v[0])
+}
+
+// Verify gets the raw verify result, which is zero if the client presented a
+// certificate and it was successfully verified
+func (v SSLTLVView) Verify() uint32 {
+	return binary.BigEndian.Uint32(v[1:5])
+}
+
+// Verified reports whether the verify result is zero
+func (v SSLTLVView) Verified() bool {
+	return v.Verify() == 0
+}
+
+// SubTLVs gets an iterator over the sub-TLVs. Convert Type() to SSLTLVSubType
+func (v SSLTLVView) SubTLVs() TLVIterator {
+	return NewTLVIterator(v[5:])
+}
+
+// SubTLV gets the value of a sub-TLV without allocating. If the type is repeated the
+// last value wins, like in SSLTLVData.
+// The second return value will be false if the sub-TLV is not present
+func (v SSLTLVView) SubTLV(t SSLTLVSubType) ([]byte, bool) {
+	var val []byte
+	found := false
+	it := v.SubTLVs()
+	for it.Next() {
+		if SSLTLVSubType(it.Type()) == t {
+			val = it.Value()
+			found = true
+		}
+	}
+	return val, found
+}
+
+// Data decodes the view into an SSLTLVData
+func (v SSLTLVView) Data() *SSLTLVData {
+	dest := make(map[SSLTLVSubType][]byte)
+	it := v.SubTLVs()
+	for it.Next() {
+		dest[SSLTLVSubType(it.Type())] = it.Value()
+	}
+	return &SSLTLVData{
+		Client:   v.Client(),
+		Verified: v.Verified(),
+		SubTLVs:  dest,
+	}
+}
+
 // TLVGetNetworkNamespace gets the value as the US-ASCII string representation
 // of the namespace's name.
 // The second return value will be false if the TLV is not provided
 func (d *Data) TLVGetNetworkNamespace() (string, bool) {
-	if d.TLVs == nil {
-		return "", false
-	}
-	if d, ok := d.TLVs[TLVTypeNetNS]; ok {
+	if d, ok := d.TLV(TLVTypeNetNS); ok {
 		return string(d), true
 	}
 	return "", false
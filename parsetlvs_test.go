@@ -0,0 +1,147 @@
+package proxyproto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_TLVIterator(t *testing.T) {
+	buf := []byte{
+		0x4, 0x0, 0x0,
+		0x2, 0x0, 0x3, 'a', 'b', 'c',
+		0x2, 0x0, 0x1, 'd',
+		// truncated
+		0x30, 0x0, 0x5, 'x',
+	}
+	type tlv struct {
+		t TLVType
+		v string
+	}
+	want := []tlv{{TLVTypeNoop, ""}, {TLVTypeAuthority, "abc"}, {TLVTypeAuthority, "d"}}
+
+	var got []tlv
+	it := NewTLVIterator(buf)
+	for it.Next() {
+		got = append(got, tlv{it.Type(), string(it.Value())})
+	}
+	if len(got) != len(want) {
+		t.Fatalf("TLVIterator = %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("TLVIterator = %v, want %v", got, want)
+		}
+	}
+}
+
+func Test_Data_TLVIterator(t *testing.T) {
+	d, _, err := ParseBytes(benchV2SSL)
+	if err != nil {
+		t.Fatalf("ParseBytes() err = %v", err)
+	}
+
+	// parsed data keeps the order from the header, built data is sorted by type
+	for _, d := range []*Data{d, d.Clone()} {
+		var types []TLVType
+		it := d.TLVIterator()
+		for it.Next() {
+			types = append(types, it.Type())
+			if v, _ := d.TLV(it.Type()); !bytes.Equal(it.Value(), v) {
+				t.Fatalf("TLVIterator() %v = %q, want %q", it.Type(), it.Value(), v)
+			}
+		}
+		if len(types) != 2 || types[0] != TLVTypeAuthority || types[1] != TLVTypeSSL {
+			t.Fatalf("TLVIterator() types = %v", types)
+		}
+	}
+}
+
+func Test_Data_TLVGetSSLView(t *testing.T) {
+	d := testSSLData()
+	v, ok := d.TLVGetSSLView()
+	if !ok {
+		t.Fatalf("TLVGetSSLView() ok = false")
+	}
+	if v.Client() != TLVSSLClientSSL|TLVSSLClientCertConn || !v.Verified() {
+		t.Fatalf("TLVGetSSLView() = %v, %v", v.Client(), v.Verified())
+	}
+	if cn, ok := v.SubTLV(TLVSubTypeSSLCN); !ok || string(cn) != "client.example.com" {
+		t.Fatalf("SubTLV(CN) = %q, %v", cn, ok)
+	}
+	if _, ok := v.SubTLV(TLVSubTypeSSLCipher); ok {
+		t.Fatalf("SubTLV(Cipher) ok = true, want false")
+	}
+
+	ssl, _ := d.TLVGetSSL()
+	if !v.Data().Equal(ssl) {
+		t.Fatalf("Data() = %v, want %v", v.Data(), ssl)
+	}
+}
+
+func Test_Data_TLVMap_parsed(t *testing.T) {
+	d, _, err := ParseBytes(v2TestHeader(false,
+		appendTLV(nil, byte(TLVTypeAuthority), []byte("a.example.com")),
+		appendTLV(nil, byte(TLVTypeNoop), nil),
+		appendTLV(nil, byte(TLVTypeAuthority), []byte("b.example.com"))))
+	if err != nil {
+		t.Fatalf("ParseBytes() error = %v", err)
+	}
+	if d.TLVs != nil {
+		t.Fatalf("ParseBytes() built the TLVs map %q", d.TLVs)
+	}
+
+	// a repeated type reads as its last value
+	if v, ok := d.TLV(TLVTypeAuthority); !ok || string(v) != "b.example.com" {
+		t.Fatalf("TLV() = %q, %v, want %q", v, ok, "b.example.com")
+	}
+	want := map[TLVType][]byte{TLVTypeAuthority: []byte("b.example.com"), TLVTypeNoop: {}}
+	if got := d.TLVMap(); !equalTLVs(got, want) {
+		t.Fatalf("TLVMap() = %q, want %q", got, want)
+	}
+	if d.TLVs != nil {
+		t.Fatalf("TLVMap() set the TLVs map")
+	}
+
+	// a set map replaces the received TLVs, an empty one drops them
+	d.TLVs = map[TLVType][]byte{}
+	if _, ok := d.TLV(TLVTypeAuthority); ok {
+		t.Fatalf("TLV() found a received TLV after the map was set")
+	}
+	b, err := d.AppendHeader(nil, Version2)
+	if err != nil {
+		t.Fatalf("AppendHeader() error = %v", err)
+	}
+	if p, _, err := ParseBytes(b); err != nil || len(p.TLVMap()) != 0 {
+		t.Fatalf("ParseBytes() = %v, %v, want no TLVs", p, err)
+	}
+}
+
+func Test_Data_SetTLV(t *testing.T) {
+	d, _, err := ParseBytes(v2TestHeader(false,
+		appendTLV(nil, byte(TLVTypeNoop), nil),
+		appendTLV(nil, byte(TLVTypeAuthority), []byte("example.com"))))
+	if err != nil {
+		t.Fatalf("ParseBytes() error = %v", err)
+	}
+	if err := d.SetTLV(TLVTypeNoop, []byte("x")); err != nil {
+		t.Fatalf("SetTLV() error = %v", err)
+	}
+	if err := d.SetTLV(TLVTypeALPN, []byte("h2")); err != nil {
+		t.Fatalf("SetTLV() error = %v", err)
+	}
+	if err := d.SetTLV(TLVTypeCRC32C, make([]byte, maxTLVLen+1)); err == nil {
+		t.Fatalf("SetTLV() of an oversized value succeeded")
+	}
+
+	// the received order is kept, the new TLV goes last
+	var types []TLVType
+	for it := d.TLVIterator(); it.Next(); {
+		types = append(types, it.Type())
+	}
+	if len(types) != 3 || types[0] != TLVTypeNoop || types[1] != TLVTypeAuthority || types[2] != TLVTypeALPN {
+		t.Fatalf("TLVIterator() types = %v", types)
+	}
+	if v, _ := d.TLV(TLVTypeNoop); string(v) != "x" || d.TLVs != nil {
+		t.Fatalf("TLV() = %q with TLVs map %q, want %q and no map", v, d.TLVs, "x")
+	}
+}
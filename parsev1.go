@@ -3,118 +3,311 @@ package proxyproto
 import (
 	"bytes"
 	"net"
-	"strconv"
 )
 
-func parseV1(c []byte) (*Data, error) {
-	switch {
-	case bytes.HasPrefix(c, inetProtoTCP4[:]):
-		return parseV1TCP(c[len(inetProtoTCP4):], AddressFamilyIPv4, v1Tcp4MaxSize)
-	case bytes.HasPrefix(c, inetProtoTCP6[:]):
-		return parseV1TCP(c[len(inetProtoTCP6):], AddressFamilyIPv6, v1BufSize)
-	case bytes.HasPrefix(c, inetProtoUnknown[:]):
-		c = c[len(inetProtoUnknown):]
-		crlf := bytes.Index(c, lineCrLf[:])
-		if crlf < 0 {
-			return nil, ParseError("failed to parse proxy protocol v1: expected CR/LF in buffer")
+var errV1Proto = ParseError("failed to parse proxy protocol v1: expected \"TCP4\", \"TCP6\", or \"UNKNOWN\" after \"PROXY\"")
+
+// v1LineLen finds the end of a v1 header line. c starts after "PROXY ", which error
+// offsets do not include, and the returned length includes the CR/LF
+func v1LineLen(c []byte) (int, error) {
+	// the whole line, including "PROXY " and CR/LF, is at most 107 bytes
+	line := c
+	if len(line) > v1MaxLineSize-len(protov1) {
+		line = line[:v1MaxLineSize-len(protov1)]
+	}
+	crlf := bytes.Index(line, lineCrLf[:])
+	if crlf >= 0 {
+		return crlf + len(lineCrLf), nil
+	}
+	if err := checkV1Proto(c); err != nil {
+		return 0, err
+	}
+	if len(c) < v1MaxLineSize-len(protov1) {
+		// the line ends with CR/LF, so at least one more byte (LF) is needed
+		need := 2
+		if len(c) > 0 && c[len(c)-1] == lineCrLf[0] {
+			need = 1
 		}
-		return &Data{
-			remainingData: c[len(inetProtoUnknown)+crlf:],
-		}, nil
-	default:
-		return nil, ParseError("failed to parse proxy protocol v1: expected \"TCP4\", \"TCP6\", or \"UNKNOWN\" after \"PROXY\"")
+		return 0, &IncompleteError{Needed: need}
 	}
+	// the CR/LF must be in the last two bytes of the longest line
+	return 0, syntaxError(v1MaxLineSize-len(protov1)-len(lineCrLf), len(lineCrLf), "failed to parse proxy protocol v1: expected CR/LF in buffer")
 }
 
-func parseV1TCP(buf []byte, af AddressFamily, maxSize int) (*Data, error) {
-	// read until next space for source IP
-	srcIPStart := 0
-	srcIPEnd := srcIPStart // this will be the space after the source IP
-	for i := srcIPStart; i < len(buf) && i < maxSize; i++ {
-		if buf[i] == 0x20 {
-			srcIPEnd = i
-			break
+// v1Protos are the protocols a v1 line can start with
+var v1Protos = [...][]byte{inetProtoTCP4[:], inetProtoTCP6[:], inetProtoUnknown[:]}
+
+// checkV1Proto fails early if an incomplete line can no longer start with a known protocol
+func checkV1Proto(c []byte) error {
+	for _, p := range v1Protos {
+		if bytes.HasPrefix(c, p) || bytes.HasPrefix(p, c) {
+			return nil
 		}
 	}
-	if srcIPStart == srcIPEnd {
-		return nil, ParseError("failed to parse proxy protocol v1: expected space after source IP")
-	}
+	return v1ProtoError(c)
+}
 
-	// read until next space for dest IP
-	destIPStart := srcIPEnd + 1
-	destIPEnd := destIPStart // this will be the space after the dest IP
-	for i := destIPStart; i < len(buf) && i < maxSize; i++ {
-		if buf[i] == 0x20 {
-			destIPEnd = i
-			break
+// v1ProtoError locates the first byte of line that no known protocol matches
+func v1ProtoError(line []byte) error {
+	off := 0
+	for _, p := range v1Protos {
+		if n := commonPrefixLen(line, p); n > off {
+			off = n
 		}
 	}
-	if destIPStart == destIPEnd {
-		return nil, ParseError("failed to parse proxy protocol v1: expected space after dest IP")
+	return syntaxError(off, 1, errV1Proto)
+}
+
+// parseV1 parses a v1 header into d. c starts after "PROXY ", which error offsets do
+// not include, and the returned length includes the CR/LF. Textual addresses are
+// decoded into addrs so parsing does not allocate
+func parseV1(d *Data, c []byte, addrs *[2 * net.IPv6len]byte) (int, error) {
+	n, err := v1LineLen(c)
+	if err != nil {
+		return 0, err
 	}
+	line := c[:n-len(lineCrLf)]
 
-	// read until next space for source port
-	srcPortStart := destIPEnd + 1
-	srcPortEnd := srcPortStart
-	for i := srcPortStart; i < len(buf) && i < maxSize; i++ {
-		if buf[i] == 0x20 {
-			srcPortEnd = i
-			break
-		}
+	d.Version = Version1
+	d.Command = CommandProxy
+	switch {
+	case bytes.HasPrefix(line, inetProtoTCP4[:]):
+		err = shiftError(parseV1TCP(d, line[len(inetProtoTCP4):], AddressFamilyIPv4, addrs), len(inetProtoTCP4))
+	case bytes.HasPrefix(line, inetProtoTCP6[:]):
+		err = shiftError(parseV1TCP(d, line[len(inetProtoTCP6):], AddressFamilyIPv6, addrs), len(inetProtoTCP6))
+	case bytes.HasPrefix(line, inetProtoUnknown[:]):
+		// the rest of the line must be ignored
+	default:
+		err = v1ProtoError(line)
 	}
-	if srcPortStart == srcPortEnd {
-		return nil, ParseError("failed to parse proxy protocol v1: expected space after source port")
+	if err != nil {
+		return 0, err
 	}
+	return n, nil
+}
 
-	// read until CR for dest port
-	destPortStart := srcPortEnd + 1
-	destPortEnd := destPortStart
-	for i := destPortStart; i < len(buf) && i < maxSize; i++ {
-		if buf[i] == 0x0D {
-			destPortEnd = i
-			break
-		}
+// parseV1TCP parses the addresses and ports of a TCP4 or TCP6 line. line starts after
+// the protocol and its space, and ends before the CR/LF
+func parseV1TCP(d *Data, line []byte, af AddressFamily, addrs *[2 * net.IPv6len]byte) error {
+	// fields are separated by single spaces
+	srcIP, afterSrcIP, ok := cutV1Field(line)
+	if !ok {
+		return v1FieldError(line, 0, "failed to parse proxy protocol v1: expected space after source IP")
 	}
-	if destPortStart == destPortEnd {
-		return nil, ParseError("failed to parse proxy protocol v1: expected CR after dest port")
+	destIP, afterDestIP, ok := cutV1Field(afterSrcIP)
+	if !ok {
+		return v1FieldError(afterSrcIP, len(srcIP)+1, "failed to parse proxy protocol v1: expected space after dest IP")
 	}
-
-	// check LF
-	if buf[destPortEnd+1] != 0x0A {
-		return nil, ParseError("failed to parse proxy protocol v1: expected LF after CR")
+	srcPort, destPort, ok := cutV1Field(afterDestIP)
+	if !ok {
+		return v1FieldError(afterDestIP, len(srcIP)+len(destIP)+2, "failed to parse proxy protocol v1: expected space after source port")
+	}
+	if len(destPort) == 0 {
+		return syntaxError(len(line), 1, "failed to parse proxy protocol v1: expected CR after dest port")
 	}
 
 	// parse source IP
-	sip := net.ParseIP(string(buf[srcIPStart:srcIPEnd]))
-	if sip == nil {
-		return nil, fmtParseError("failed to parse proxy protocol v1: failed to parse source IP %q", string(buf[srcIPStart:srcIPEnd]))
+	sip, ok := parseV1IP(srcIP, af, addrs[:net.IPv6len])
+	if !ok {
+		return syntaxError(0, len(srcIP), fmtParseError("failed to parse proxy protocol v1: failed to parse source IP %q", string(srcIP)))
 	}
 
 	// parse dest IP
-	dip := net.ParseIP(string(buf[destIPStart:destIPEnd]))
-	if dip == nil {
-		return nil, fmtParseError("failed to parse proxy protocol v1: failed to parse dest IP %q", string(buf[destIPStart:destIPEnd]))
+	dip, ok := parseV1IP(destIP, af, addrs[net.IPv6len:])
+	if !ok {
+		return syntaxError(len(srcIP)+1, len(destIP), fmtParseError("failed to parse proxy protocol v1: failed to parse dest IP %q", string(destIP)))
 	}
 
 	// parse source port
-	sp, err := strconv.Atoi(string(buf[srcPortStart:srcPortEnd]))
-	if err != nil {
-		return nil, fmtParseError("failed to parse proxy protocol v1: failed to parse source port %q: %v", string(buf[srcPortStart:srcPortEnd]), err)
+	sp, ok := parseV1Port(srcPort)
+	if !ok {
+		return syntaxError(len(srcIP)+len(destIP)+2, len(srcPort), fmtParseError("failed to parse proxy protocol v1: failed to parse source port %q", string(srcPort)))
 	}
 
 	// parse dest port
-	dp, err := strconv.Atoi(string(buf[destPortStart:destPortEnd]))
-	if err != nil {
-		return nil, fmtParseError("failed to parse proxy protocol v1: failed to parse dest port %q: %v", string(buf[destPortStart:destPortEnd]), err)
-	}
-
-	return &Data{
-		AddressFamily: af,
-		Transport:     TransportStream,
-		remainingData: buf[destPortEnd+2:],
-		SourceAddr:    []byte(sip),
-		DestAddr:      []byte(dip),
-		SourcePort:    sp,
-		DestPort:      dp,
-	}, nil
+	dp, ok := parseV1Port(destPort)
+	if !ok {
+		return syntaxError(len(line)-len(destPort), len(destPort), fmtParseError("failed to parse proxy protocol v1: failed to parse dest port %q", string(destPort)))
+	}
+
+	d.AddressFamily = af
+	d.Transport = TransportStream
+	d.SourceAddr = sip
+	d.DestAddr = dip
+	d.SourcePort = sp
+	d.DestPort = dp
+	return nil
+}
+
+// v1FieldError locates a field missing from the start of rest, which is at off in the
+// line: the space that leaves it empty, or the end of the line if there is no space
+func v1FieldError(rest []byte, off int, err ParseError) error {
+	if bytes.IndexByte(rest, ' ') < 0 {
+		off += len(rest)
+	}
+	return syntaxError(off, 1, err)
+}
+
+// cutV1Field splits b around the first space. ok is false if there is no space
+// or the field before it is empty
+func cutV1Field(b []byte) (field, rest []byte, ok bool) {
+	i := bytes.IndexByte(b, ' ')
+	if i <= 0 {
+		return nil, nil, false
+	}
+	return b[:i], b[i+1:], true
+}
+
+// parseV1IP parses a textual IP address into out and returns it in the same normalized
+// form that v2 headers use: 4 bytes for TCP4 and 16 bytes for TCP6 (IPv4 addresses are
+// IPv4-mapped). out must have room for 16 bytes
+func parseV1IP(b []byte, af AddressFamily, out []byte) ([]byte, bool) {
+	if af == AddressFamilyIPv4 {
+		return out[:net.IPv4len], parseIPv4(b, out[:net.IPv4len])
+	}
+	out = out[:net.IPv6len]
+	if bytes.IndexByte(b, ':') >= 0 {
+		return out, parseIPv6(b, out)
+	}
+	copy(out, v4InV6Prefix[:])
+	return out, parseIPv4(b, out[12:])
+}
+
+// value is the prefix of an IPv4-mapped IPv6 address
+var v4InV6Prefix = [12]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff}
+
+// parseIPv4 parses a dotted decimal IPv4 address into out (4 bytes). Like net/netip,
+// it rejects octets with leading zeros
+func parseIPv4(b []byte, out []byte) bool {
+	field := 0
+	digits := 0
+	val := 0
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		switch {
+		case c >= '0' && c <= '9':
+			if digits == 1 && val == 0 {
+				return false
+			}
+			val = val*10 + int(c-'0')
+			digits++
+			if val > 255 {
+				return false
+			}
+		case c == '.':
+			if digits == 0 || field == 3 {
+				return false
+			}
+			out[field] = byte(val)
+			field++
+			digits = 0
+			val = 0
+		default:
+			return false
+		}
+	}
+	if digits == 0 || field != 3 {
+		return false
+	}
+	out[3] = byte(val)
+	return true
+}
+
+// parseIPv6 parses a textual IPv6 address (RFC 4291 section 2.2, including an optional
+// trailing dotted decimal IPv4 address) into out (16 bytes). Zones are not accepted
+func parseIPv6(b []byte, out []byte) bool {
+	ellipsis := -1 // byte offset in out where "::" was found
+	i := 0
+
+	if len(b) >= 2 && b[0] == ':' && b[1] == ':' {
+		ellipsis = 0
+		b = b[2:]
+	}
+	for i < net.IPv6len && len(b) > 0 {
+		// read up to 4 hex digits
+		val := 0
+		off := 0
+	hex:
+		for ; off < len(b) && off < 5; off++ {
+			c := b[off]
+			switch {
+			case c >= '0' && c <= '9':
+				val = val<<4 + int(c-'0')
+			case c >= 'a' && c <= 'f':
+				val = val<<4 + int(c-'a'+10)
+			case c >= 'A' && c <= 'F':
+				val = val<<4 + int(c-'A'+10)
+			default:
+				break hex
+			}
+		}
+		if off == 0 || off > 4 {
+			return false
+		}
+
+		// an IPv4 address can be embedded in the last 32 bits
+		if off < len(b) && b[off] == '.' {
+			if ellipsis < 0 && i != net.IPv6len-net.IPv4len {
+				return false
+			}
+			if i+net.IPv4len > net.IPv6len || !parseIPv4(b, out[i:i+net.IPv4len]) {
+				return false
+			}
+			i += net.IPv4len
+			b = nil
+			break
+		}
+
+		out[i] = byte(val >> 8)
+		out[i+1] = byte(val)
+		i += 2
+		b = b[off:]
+		if len(b) == 0 {
+			break
+		}
+		if b[0] != ':' || len(b) == 1 {
+			return false
+		}
+		b = b[1:]
+		if b[0] == ':' {
+			if ellipsis >= 0 {
+				return false
+			}
+			ellipsis = i
+			b = b[1:]
+		}
+	}
+	if len(b) != 0 {
+		return false
+	}
+
+	// expand the ellipsis, it must stand for at least one group of zeros
+	if i < net.IPv6len {
+		if ellipsis < 0 {
+			return false
+		}
+		n := net.IPv6len - i
+		copy(out[ellipsis+n:], out[ellipsis:i])
+		for j := ellipsis; j < ellipsis+n; j++ {
+			out[j] = 0
+		}
+	} else if ellipsis >= 0 {
+		return false
+	}
+	return true
+}
+
+// parseV1Port parses a decimal port number between 0 and 65535
+func parseV1Port(b []byte) (int, bool) {
+	if len(b) == 0 || len(b) > 5 {
+		return 0, false
+	}
+	p := 0
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		p = p*10 + int(c-'0')
+	}
+	return p, p <= 0xffff
 }
@@ -1,37 +1,42 @@
 package proxyproto
 
 import (
-	"net"
-	"reflect"
+	"bytes"
+	"net/netip"
 	"testing"
 )
 
 func Test_parseV1(t *testing.T) {
 	tests := []struct {
-		name    string
-		buf     []byte
-		want    *Data
-		wantErr error
+		name     string
+		buf      []byte
+		want     *Data
+		wantRest []byte
+		wantErr  error
 	}{
 		{
-			name: "valid 4",
-			buf:  []byte("TCP4 10.20.30.40 40.30.20.10 8000 9000\r\nTEST"), // Removed "PROXY "
+			name:     "valid 4",
+			buf:      []byte("TCP4 10.20.30.40 40.30.20.10 8000 9000\r\nTEST"), // Removed "PROXY "
+			wantRest: []byte("TEST"),
 			want: &Data{
-				remainingData: []byte("TEST"),
+				Version:       Version1,
+				Command:       CommandProxy,
 				AddressFamily: AddressFamilyIPv4,
 				Transport:     TransportStream,
-				SourceAddr:    net.IPv4(10, 20, 30, 40),
+				SourceAddr:    []byte{10, 20, 30, 40},
 				SourcePort:    8000,
-				DestAddr:      net.IPv4(40, 30, 20, 10),
+				DestAddr:      []byte{40, 30, 20, 10},
 				DestPort:      9000,
 			},
 			wantErr: nil,
 		},
 		{
-			name: "valid 6",
-			buf:  []byte("TCP6 2607:f8b0:4008:80e::200e 2606:4700:4700::1111 8000 9000\r\nTEST"), // Removed "PROXY "
+			name:     "valid 6",
+			buf:      []byte("TCP6 2607:f8b0:4008:80e::200e 2606:4700:4700::1111 8000 9000\r\nTEST"), // Removed "PROXY "
+			wantRest: []byte("TEST"),
 			want: &Data{
-				remainingData: []byte("TEST"),
+				Version:       Version1,
+				Command:       CommandProxy,
 				AddressFamily: AddressFamilyIPv6,
 				Transport:     TransportStream,
 				SourceAddr:    []byte{0x26, 0x7, 0xf8, 0xb0, 0x40, 0x8, 0x8, 0xe, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x20, 0x0e},
@@ -41,17 +46,137 @@ func Test_parseV1(t *testing.T) {
 			},
 			wantErr: nil,
 		},
+		{
+			name:     "unknown",
+			buf:      []byte("UNKNOWN\r\nTEST"), // Removed "PROXY "
+			wantRest: []byte("TEST"),
+			want: &Data{
+				Version: Version1,
+				Command: CommandProxy,
+			},
+			wantErr: nil,
+		},
+		{
+			name:     "unknown with addresses",
+			buf:      []byte("UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\nTEST"), // Removed "PROXY "
+			wantRest: []byte("TEST"),
+			want: &Data{
+				Version: Version1,
+				Command: CommandProxy,
+			},
+			wantErr: nil,
+		},
+		{
+			name:    "tcp4 with ipv6 source",
+			buf:     []byte("TCP4 ::1 40.30.20.10 8000 9000\r\nTEST"), // Removed "PROXY "
+			want:    nil,
+			wantErr: ParseError("failed to parse proxy protocol v1: failed to parse source IP \"::1\""),
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := parseV1(tt.buf)
+			p := new(parsedData)
+			n, err := parseV1(&p.Data, tt.buf, &p.addrs)
+			var got *Data
+			var rest []byte
+			if err == nil {
+				got = &p.Data
+				rest = tt.buf[n:]
+			}
 
-			if tt.wantErr != err {
+			if err := unlocated(err); tt.wantErr != err {
 				t.Fatalf("parseV1() err = %v, want %v", err, tt.wantErr)
 			}
-			if !reflect.DeepEqual(got, tt.want) {
-				t.Fatalf("parseV1() = %v, want %v", got, tt.want)
+			if !got.Equal(tt.want) || !bytes.Equal(rest, tt.wantRest) {
+				t.Fatalf("parseV1() = %v, %q, want %v, %q", got, rest, tt.want, tt.wantRest)
 			}
 		})
 	}
 }
+
+func Test_parseV1IP(t *testing.T) {
+	addrs := []string{
+		"0.0.0.0",
+		"255.255.255.255",
+		"10.20.30.40",
+		"256.1.1.1",
+		"1.2.3",
+		"1.2.3.4.5",
+		"01.2.3.4",
+		"1..2.3",
+		"1.2.3.",
+		"::",
+		"::1",
+		"1::",
+		"1::2",
+		"2607:f8b0:4008:80e::200e",
+		"2606:4700:4700::1111",
+		"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff",
+		"1:2:3:4:5:6:7:8",
+		"1:2:3:4:5:6:7::",
+		"1:2:3:4:5:6:7:8:9",
+		"1:2:3:4:5:6:7",
+		"1::2::3",
+		":1::",
+		"1:",
+		":::",
+		"12345::",
+		"::ffff:10.20.30.40",
+		"::10.20.30.40",
+		"1:2:3:4:5:6:1.2.3.4",
+		"1:2:3:4:5:6:7:1.2.3.4",
+		"::ffff:1.2.3",
+		"fe80::1%eth0",
+		"ABCD::EF",
+		"g::1",
+		"",
+	}
+	for _, s := range addrs {
+		want, err := netip.ParseAddr(s)
+		wantOK := err == nil && want.Zone() == ""
+
+		for _, af := range []AddressFamily{AddressFamilyIPv4, AddressFamilyIPv6} {
+			got, ok := parseV1IP([]byte(s), af, make([]byte, 16))
+			afOK := wantOK && (af == AddressFamilyIPv6 || want.Is4())
+			if ok != afOK {
+				t.Fatalf("parseV1IP(%q, %v) ok = %v, want %v", s, af, ok, afOK)
+			}
+			if !ok {
+				continue
+			}
+			var wantBytes []byte
+			if af == AddressFamilyIPv4 {
+				wantBytes = want.AsSlice()
+			} else {
+				a16 := want.As16()
+				wantBytes = a16[:]
+			}
+			if !bytes.Equal(got, wantBytes) {
+				t.Fatalf("parseV1IP(%q, %v) = %v, want %v", s, af, got, wantBytes)
+			}
+		}
+	}
+}
+
+func Test_parseV1Port(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"8000", 8000, true},
+		{"65535", 65535, true},
+		{"65536", 0, false},
+		{"-1", 0, false},
+		{"+80", 0, false},
+		{"123456", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseV1Port([]byte(tt.s))
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Fatalf("parseV1Port(%q) = %v, %v, want %v, %v", tt.s, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -1,39 +1,47 @@
 package proxyproto
 
 import (
-	"bytes"
 	"encoding/binary"
-	"fmt"
-	"io"
+	"net"
 )
 
-func parseV2(buf []byte, r io.Reader) (*Data, error) {
-	// Check version and proxy/local
-	payloadSize := int(binary.BigEndian.Uint16(buf[2:4]))
-	switch buf[0] {
-	case verCmdUpper4 + verCmdLowerLocal:
-		return &Data{
-			remainingData: buf[payloadSize+4:],
-		}, nil
-	case verCmdUpper4 + verCmdLowerProxy:
-	default:
-		return nil, ParseError("failed to parse proxy protocol v2: invalid version/command byte")
+// v2HeaderLen gets the length of a v2 header from its fixed part. buf starts after
+// the signature and neither the returned length nor error offsets include it
+func v2HeaderLen(buf []byte) (int, error) {
+	if len(buf) == 0 {
+		return 0, &IncompleteError{Needed: 4}
 	}
-	aftp := buf[1]
-	buf = buf[4:]
+	if buf[0] != verCmdUpper4+verCmdLowerLocal && buf[0] != verCmdUpper4+verCmdLowerProxy {
+		return 0, syntaxError(0, 1, "failed to parse proxy protocol v2: invalid version/command byte")
+	}
+	if len(buf) < 4 {
+		return 0, &IncompleteError{Needed: 4 - len(buf)}
+	}
+	n := 4 + int(binary.BigEndian.Uint16(buf[2:4]))
+	if len(buf) < n {
+		return 0, &IncompleteError{Needed: n - len(buf)}
+	}
+	return n, nil
+}
 
-	// Check length for sanity, attempt to read more if we need more data
-	var rb []byte
-	for len(buf) < payloadSize {
-		if rb == nil {
-			rb = make([]byte, parseReadSize)
-		}
-		n, err := r.Read(rb)
-		if err != nil {
-			return nil, fmt.Errorf("payload size (%v) exceeded buffer length (%v) but failed to read more data: %v", payloadSize, len(buf), err)
-		}
-		buf = bytes.Join([][]byte{buf, rb[:n]}, nil)
+// parseV2 parses a v2 header into d. buf starts after the signature and neither the
+// returned length nor error offsets include it. Addresses and TLVs alias buf
+func parseV2(d *Data, buf []byte) (int, error) {
+	// Check version and proxy/local, the whole payload must be in the buffer
+	n, err := v2HeaderLen(buf)
+	if err != nil {
+		return 0, err
 	}
+	d.Version = Version2
+	if buf[0] == verCmdUpper4+verCmdLowerLocal {
+		// LOCAL connections must ignore the address and TLV data entirely
+		d.Command = CommandLocal
+		return n, nil
+	}
+	d.Command = CommandProxy
+	aftp := buf[1]
+	payloadSize := n - 4
+	buf = buf[4:n]
 
 	// Check address family
 	var af AddressFamily
@@ -43,15 +51,15 @@ func parseV2(buf []byte, r io.Reader) (*Data, error) {
 	case afpUpperUnspec:
 	case afpUpperIPv4:
 		af = AddressFamilyIPv4
-		addrSize = 4
+		addrSize = net.IPv4len
 	case afpUpperIPv6:
 		af = AddressFamilyIPv6
-		addrSize = 16
+		addrSize = net.IPv6len
 	case afpUpperUnix:
 		af = AddressFamilyUnix
-		addrSize = 108
+		addrSize = unixAddrSize
 	default:
-		return nil, ParseError("failed to parse proxy protocol v2: invalid Address Family nibble")
+		return 0, syntaxError(1, 1, "failed to parse proxy protocol v2: invalid Address Family nibble")
 	}
 
 	// Check transport
@@ -64,7 +72,16 @@ func parseV2(buf []byte, r io.Reader) (*Data, error) {
 	case afpLowerDgram:
 		tr = TransportDgram
 	default:
-		return nil, ParseError("failed to parse proxy protocol v2: invalid Transport nibble")
+		return 0, syntaxError(1, 1, "failed to parse proxy protocol v2: invalid Transport nibble")
+	}
+
+	// Unix addresses have no ports
+	addrLen := addrSize * 2
+	if af == AddressFamilyIPv4 || af == AddressFamilyIPv6 {
+		addrLen += 4
+	}
+	if payloadSize < addrLen {
+		return 0, syntaxError(2, 2, fmtParseError("failed to parse proxy protocol v2: payload size (%v) is too small for %v addresses (%v)", payloadSize, af, addrLen))
 	}
 
 	// Extract port values
@@ -75,20 +92,16 @@ func parseV2(buf []byte, r io.Reader) (*Data, error) {
 		dp = int(binary.BigEndian.Uint16(buf[addrSize*2+2 : addrSize*2+4]))
 	}
 
-	// Check for TLVs
-	var tlvs map[TLVType][]byte
-	if payloadSize > addrSize*2+4 {
-		tlvs = parseTLVs(buf[addrSize*2+4 : payloadSize])
+	// Check for TLVs, they are kept as the raw bytes and only decoded when read
+	if payloadSize > addrLen {
+		d.rawTLVs = buf[addrLen:payloadSize]
 	}
 
-	return &Data{
-		AddressFamily: af,
-		Transport:     tr,
-		remainingData: buf[payloadSize:],
-		SourceAddr:    buf[:addrSize],
-		DestAddr:      buf[addrSize : addrSize*2],
-		SourcePort:    sp,
-		DestPort:      dp,
-		TLVs:          tlvs,
-	}, nil
+	d.AddressFamily = af
+	d.Transport = tr
+	d.SourceAddr = buf[:addrSize]
+	d.DestAddr = buf[addrSize : addrSize*2]
+	d.SourcePort = sp
+	d.DestPort = dp
+	return n, nil
 }
@@ -1,16 +1,17 @@
 package proxyproto
 
 import (
-	"reflect"
+	"bytes"
 	"testing"
 )
 
 func Test_parseV2(t *testing.T) {
 	tests := []struct {
-		name    string
-		buf     []byte
-		want    *Data
-		wantErr error
+		name     string
+		buf      []byte
+		want     *Data
+		wantRest []byte
+		wantErr  error
 	}{
 		{
 			name: "valid tcp4 proxy",
@@ -35,8 +36,10 @@ func Test_parseV2(t *testing.T) {
 				// random data
 				0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8,
 			},
+			wantRest: []byte{0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8},
 			want: &Data{
-				remainingData: []byte{0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8},
+				Version:       Version2,
+				Command:       CommandProxy,
 				AddressFamily: AddressFamilyIPv4,
 				Transport:     TransportStream,
 				SourceAddr:    []byte{10, 20, 30, 40},
@@ -78,8 +81,10 @@ func Test_parseV2(t *testing.T) {
 				// random data
 				0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8,
 			},
+			wantRest: []byte{0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8},
 			want: &Data{
-				remainingData: []byte{0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8},
+				Version:       Version2,
+				Command:       CommandProxy,
 				AddressFamily: AddressFamilyIPv4,
 				Transport:     TransportStream,
 				SourceAddr:    []byte{10, 20, 30, 40},
@@ -116,8 +121,10 @@ func Test_parseV2(t *testing.T) {
 				// random data
 				0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8,
 			},
+			wantRest: []byte{0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8},
 			want: &Data{
-				remainingData: []byte{0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8},
+				Version:       Version2,
+				Command:       CommandProxy,
 				AddressFamily: AddressFamilyIPv6,
 				Transport:     TransportStream,
 				SourceAddr:    []byte{0x26, 0x7, 0xf8, 0xb0, 0x40, 0x8, 0x8, 0xe, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x20, 0x0e},
@@ -142,8 +149,10 @@ func Test_parseV2(t *testing.T) {
 				// random data
 				0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8,
 			},
+			wantRest: []byte{0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8},
 			want: &Data{
-				remainingData: []byte{0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8},
+				Version:       Version2,
+				Command:       CommandLocal,
 				AddressFamily: AddressFamilyLocal,
 				Transport:     TransportUnspec,
 			},
@@ -172,8 +181,10 @@ func Test_parseV2(t *testing.T) {
 				// random data
 				0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8,
 			},
+			wantRest: []byte{0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8},
 			want: &Data{
-				remainingData: []byte{0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8},
+				Version:       Version2,
+				Command:       CommandProxy,
 				AddressFamily: AddressFamilyIPv4,
 				Transport:     TransportUnspec,
 				SourceAddr:    []byte{10, 20, 30, 40},
@@ -183,16 +194,38 @@ func Test_parseV2(t *testing.T) {
 			},
 			wantErr: nil,
 		},
+		{
+			name: "payload too small for addresses",
+			buf: []byte{
+				// version/command
+				0x21,
+				// address family / transport
+				0x11,
+				// length
+				0x0, 0x4,
+				// source addr
+				10, 20, 30, 40,
+			},
+			want:    nil,
+			wantErr: ParseError("failed to parse proxy protocol v2: payload size (4) is too small for ipv4 addresses (12)"),
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := parseV2(tt.buf, nil)
+			p := new(parsedData)
+			n, err := parseV2(&p.Data, tt.buf)
+			var got *Data
+			var rest []byte
+			if err == nil {
+				got = &p.Data
+				rest = tt.buf[n:]
+			}
 
-			if tt.wantErr != err {
+			if err := unlocated(err); tt.wantErr != err {
 				t.Fatalf("parseV2() err = %v, want %v", err, tt.wantErr)
 			}
-			if !reflect.DeepEqual(got, tt.want) {
-				t.Fatalf("parseV2() = %v, want %v", got, tt.want)
+			if !got.Equal(tt.want) || !bytes.Equal(rest, tt.wantRest) {
+				t.Fatalf("parseV2() = %v, %q, want %v, %q", got, rest, tt.want, tt.wantRest)
 			}
 		})
 	}
@@ -0,0 +1,202 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	etherTypeVLAN = 0x8100
+	etherTypeQinQ = 0x88a8
+
+	ipProtoTCP = 6
+	ipProtoUDP = 17
+
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagACK = 0x10
+)
+
+// segment is a captured TCP segment or UDP datagram
+type segment struct {
+	proto    byte
+	src, dst netip.AddrPort
+	// flags and seq are only set for TCP
+	flags byte
+	seq   uint32
+	// payload is what was captured of the payload, and truncated is set if that is not
+	// all of it
+	payload   []byte
+	truncated bool
+}
+
+// decodePacket decodes the TCP segment or UDP datagram in p. It returns false for other
+// packets, including IP fragments after the first
+func decodePacket(p *Packet) (segment, bool) {
+	ip, ok := linkPayload(p.LinkType, p.Data)
+	if !ok || len(ip) == 0 {
+		return segment{}, false
+	}
+	var s segment
+	var transport []byte
+	switch ip[0] >> 4 {
+	case 4:
+		transport, ok = decodeIPv4(&s, ip)
+	case 6:
+		transport, ok = decodeIPv6(&s, ip)
+	default:
+		return segment{}, false
+	}
+	if !ok {
+		return segment{}, false
+	}
+
+	switch s.proto {
+	case ipProtoTCP:
+		if len(transport) < 20 {
+			return segment{}, false
+		}
+		hlen := int(transport[12]>>4) * 4
+		if hlen < 20 || hlen > len(transport) {
+			return segment{}, false
+		}
+		s.src = netip.AddrPortFrom(s.src.Addr(), binary.BigEndian.Uint16(transport[0:]))
+		s.dst = netip.AddrPortFrom(s.dst.Addr(), binary.BigEndian.Uint16(transport[2:]))
+		s.seq = binary.BigEndian.Uint32(transport[4:])
+		s.flags = transport[13]
+		s.payload = transport[hlen:]
+	case ipProtoUDP:
+		if len(transport) < 8 {
+			return segment{}, false
+		}
+		s.src = netip.AddrPortFrom(s.src.Addr(), binary.BigEndian.Uint16(transport[0:]))
+		s.dst = netip.AddrPortFrom(s.dst.Addr(), binary.BigEndian.Uint16(transport[2:]))
+		s.payload = transport[8:]
+		if n := int(binary.BigEndian.Uint16(transport[4:])) - 8; n >= 0 && n < len(s.payload) {
+			s.payload = s.payload[:n]
+		}
+	default:
+		return segment{}, false
+	}
+	return s, true
+}
+
+// linkPayload gets the IP packet from a frame with link-layer header type lt
+func linkPayload(lt LinkType, b []byte) ([]byte, bool) {
+	switch lt {
+	case LinkTypeRaw, LinkTypeIPv4, LinkTypeIPv6, 12, 14:
+		// 12 and 14 are used for raw IP on some systems
+		return b, true
+	case LinkTypeNull, LinkTypeLoop:
+		// the address family is AF_INET or one of the AF_INET6 values of the BSDs and
+		// Linux, in either byte order, which tells the IP versions apart as well as the
+		// version nibble does
+		if len(b) < 4 {
+			return nil, false
+		}
+		return b[4:], true
+	case LinkTypeEthernet:
+		if len(b) < 14 {
+			return nil, false
+		}
+		et, b := binary.BigEndian.Uint16(b[12:]), b[14:]
+		for et == etherTypeVLAN || et == etherTypeQinQ {
+			if len(b) < 4 {
+				return nil, false
+			}
+			et, b = binary.BigEndian.Uint16(b[2:]), b[4:]
+		}
+		return b, et == etherTypeIPv4 || et == etherTypeIPv6
+	case LinkTypeLinuxSLL:
+		if len(b) < 16 {
+			return nil, false
+		}
+		et := binary.BigEndian.Uint16(b[14:])
+		return b[16:], et == etherTypeIPv4 || et == etherTypeIPv6
+	case LinkTypeLinuxSLL2:
+		if len(b) < 20 {
+			return nil, false
+		}
+		et := binary.BigEndian.Uint16(b[0:])
+		return b[20:], et == etherTypeIPv4 || et == etherTypeIPv6
+	default:
+		return nil, false
+	}
+}
+
+// decodeIPv4 decodes the IPv4 header of b into s and returns the transport layer
+func decodeIPv4(s *segment, b []byte) ([]byte, bool) {
+	if len(b) < 20 {
+		return nil, false
+	}
+	hlen := int(b[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(b[2:]))
+	if hlen < 20 || total < hlen || len(b) < hlen {
+		return nil, false
+	}
+	frag := binary.BigEndian.Uint16(b[6:])
+	if frag&0x1fff != 0 {
+		// only the first fragment has the transport header
+		return nil, false
+	}
+	s.proto = b[9]
+	src, _ := netip.AddrFromSlice(b[12:16])
+	dst, _ := netip.AddrFromSlice(b[16:20])
+	s.src, s.dst = netip.AddrPortFrom(src, 0), netip.AddrPortFrom(dst, 0)
+	// more fragments follow, or the capture was cut short
+	s.truncated = frag&0x2000 != 0 || len(b) < total
+	if len(b) > total {
+		// Ethernet pads short frames
+		b = b[:total]
+	}
+	return b[hlen:], true
+}
+
+// decodeIPv6 decodes the IPv6 header and extension headers of b into s and returns the
+// transport layer
+func decodeIPv6(s *segment, b []byte) ([]byte, bool) {
+	if len(b) < 40 {
+		return nil, false
+	}
+	total := 40 + int(binary.BigEndian.Uint16(b[4:]))
+	src, _ := netip.AddrFromSlice(b[8:24])
+	dst, _ := netip.AddrFromSlice(b[24:40])
+	s.src, s.dst = netip.AddrPortFrom(src, 0), netip.AddrPortFrom(dst, 0)
+	s.truncated = len(b) < total
+	if len(b) > total {
+		b = b[:total]
+	}
+
+	next, b := b[6], b[40:]
+	for {
+		switch next {
+		case ipProtoTCP, ipProtoUDP:
+			s.proto = next
+			return b, true
+		case 0, 43, 60:
+			// hop-by-hop, routing and destination options
+			if len(b) < 8 || len(b) < (int(b[1])+1)*8 {
+				return nil, false
+			}
+			next, b = b[0], b[(int(b[1])+1)*8:]
+		case 44:
+			// fragment, only the first has the transport header
+			if len(b) < 8 || binary.BigEndian.Uint16(b[2:])&0xfff8 != 0 {
+				return nil, false
+			}
+			s.truncated = s.truncated || b[3]&1 != 0
+			next, b = b[0], b[8:]
+		case 51:
+			// authentication header
+			if len(b) < 8 || len(b) < (int(b[1])+2)*4 {
+				return nil, false
+			}
+			next, b = b[0], b[(int(b[1])+2)*4:]
+		default:
+			return nil, false
+		}
+	}
+}
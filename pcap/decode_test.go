@@ -0,0 +1,149 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+// ipPacket builds an IPv4 or IPv6 packet (depending on the source address) carrying a
+// TCP segment with the given flags and sequence number, or a UDP datagram if proto is
+// ipProtoUDP
+func ipPacket(proto byte, src, dst netip.AddrPort, flags byte, seq uint32, payload []byte) []byte {
+	var transport []byte
+	if proto == ipProtoTCP {
+		transport = make([]byte, 20)
+		transport[12] = 5 << 4
+		transport[13] = flags
+		binary.BigEndian.PutUint32(transport[4:], seq)
+	} else {
+		transport = make([]byte, 8)
+		binary.BigEndian.PutUint16(transport[4:], uint16(8+len(payload)))
+	}
+	binary.BigEndian.PutUint16(transport[0:], src.Port())
+	binary.BigEndian.PutUint16(transport[2:], dst.Port())
+	transport = append(transport, payload...)
+
+	if src.Addr().Is4() {
+		ip := make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(transport)))
+		ip[9] = proto
+		copy(ip[12:], src.Addr().AsSlice())
+		copy(ip[16:], dst.Addr().AsSlice())
+		return append(ip, transport...)
+	}
+	ip := make([]byte, 40)
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(transport)))
+	ip[6] = proto
+	copy(ip[8:], src.Addr().AsSlice())
+	copy(ip[24:], dst.Addr().AsSlice())
+	return append(ip, transport...)
+}
+
+// ethernetFrame wraps an IP packet in an Ethernet frame
+func ethernetFrame(ip []byte) []byte {
+	et := []byte{0x08, 0x00}
+	if ip[0]>>4 == 6 {
+		et = []byte{0x86, 0xdd}
+	}
+	return append(append(make([]byte, 12), et...), ip...)
+}
+
+func Test_decodePacket(t *testing.T) {
+	src4, dst4 := netip.MustParseAddrPort("10.0.0.1:40000"), netip.MustParseAddrPort("10.0.0.2:8080")
+	src6, dst6 := netip.MustParseAddrPort("[2001:db8::1]:40000"), netip.MustParseAddrPort("[2001:db8::2]:8080")
+	tcp4 := ipPacket(ipProtoTCP, src4, dst4, tcpFlagACK, 1000, []byte("data"))
+	udp6 := ipPacket(ipProtoUDP, src6, dst6, 0, 0, []byte("data"))
+
+	vlan := append(append(make([]byte, 12), 0x81, 0x00, 0, 5, 0x08, 0x00), tcp4...)
+	sll := append(append(make([]byte, 14), 0x08, 0x00), tcp4...)
+	sll2 := append(append([]byte{0x86, 0xdd}, make([]byte, 18)...), udp6...)
+	null := append([]byte{2, 0, 0, 0}, tcp4...)
+	padded := append(ethernetFrame(tcp4), 0, 0, 0, 0)
+	// a hop-by-hop options header in front of the UDP header
+	ext := append([]byte{}, udp6[:40]...)
+	ext[6] = 0
+	binary.BigEndian.PutUint16(ext[4:], uint16(len(udp6)-40+8))
+	ext = append(append(ext, ipProtoUDP, 0, 1, 4, 0, 0, 0, 0), udp6[40:]...)
+	firstFragment := append([]byte{}, tcp4...)
+	firstFragment[6] = 0x20
+	laterFragment := append([]byte{}, tcp4...)
+	laterFragment[7] = 0x10
+	icmp := append([]byte{}, tcp4...)
+	icmp[9] = 1
+
+	tests := []struct {
+		name   string
+		packet Packet
+		want   *segment
+	}{
+		{
+			name:   "Ethernet",
+			packet: Packet{LinkType: LinkTypeEthernet, Data: ethernetFrame(tcp4)},
+			want:   &segment{proto: ipProtoTCP, src: src4, dst: dst4, flags: tcpFlagACK, seq: 1000, payload: []byte("data")},
+		},
+		{
+			name:   "Ethernet padding",
+			packet: Packet{LinkType: LinkTypeEthernet, Data: padded},
+			want:   &segment{proto: ipProtoTCP, src: src4, dst: dst4, flags: tcpFlagACK, seq: 1000, payload: []byte("data")},
+		},
+		{
+			name:   "VLAN",
+			packet: Packet{LinkType: LinkTypeEthernet, Data: vlan},
+			want:   &segment{proto: ipProtoTCP, src: src4, dst: dst4, flags: tcpFlagACK, seq: 1000, payload: []byte("data")},
+		},
+		{
+			name:   "Linux cooked",
+			packet: Packet{LinkType: LinkTypeLinuxSLL, Data: sll},
+			want:   &segment{proto: ipProtoTCP, src: src4, dst: dst4, flags: tcpFlagACK, seq: 1000, payload: []byte("data")},
+		},
+		{
+			name:   "Linux cooked v2",
+			packet: Packet{LinkType: LinkTypeLinuxSLL2, Data: sll2},
+			want:   &segment{proto: ipProtoUDP, src: src6, dst: dst6, payload: []byte("data")},
+		},
+		{
+			name:   "loopback",
+			packet: Packet{LinkType: LinkTypeNull, Data: null},
+			want:   &segment{proto: ipProtoTCP, src: src4, dst: dst4, flags: tcpFlagACK, seq: 1000, payload: []byte("data")},
+		},
+		{
+			name:   "raw IPv6 with extension header",
+			packet: Packet{LinkType: LinkTypeRaw, Data: ext},
+			want:   &segment{proto: ipProtoUDP, src: src6, dst: dst6, payload: []byte("data")},
+		},
+		{
+			name:   "truncated",
+			packet: Packet{LinkType: LinkTypeRaw, Data: tcp4[:len(tcp4)-2]},
+			want:   &segment{proto: ipProtoTCP, src: src4, dst: dst4, flags: tcpFlagACK, seq: 1000, payload: []byte("da"), truncated: true},
+		},
+		{
+			name:   "first fragment",
+			packet: Packet{LinkType: LinkTypeRaw, Data: firstFragment},
+			want:   &segment{proto: ipProtoTCP, src: src4, dst: dst4, flags: tcpFlagACK, seq: 1000, payload: []byte("data"), truncated: true},
+		},
+		{name: "later fragment", packet: Packet{LinkType: LinkTypeRaw, Data: laterFragment}},
+		{name: "ICMP", packet: Packet{LinkType: LinkTypeRaw, Data: icmp}},
+		{name: "ARP", packet: Packet{LinkType: LinkTypeEthernet, Data: append(make([]byte, 12), 0x08, 0x06, 0, 1)}},
+		{name: "unknown link type", packet: Packet{LinkType: 147, Data: tcp4}},
+		{name: "short TCP header", packet: Packet{LinkType: LinkTypeRaw, Data: tcp4[:30]}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := decodePacket(&tt.packet)
+			if ok != (tt.want != nil) {
+				t.Fatalf("decodePacket() = %+v, %v", got, ok)
+			}
+			if !ok {
+				return
+			}
+			if got.proto != tt.want.proto || got.src != tt.want.src || got.dst != tt.want.dst || got.flags != tt.want.flags ||
+				got.seq != tt.want.seq || !bytes.Equal(got.payload, tt.want.payload) || got.truncated != tt.want.truncated {
+				t.Fatalf("decodePacket() = %+v, want %+v", got, *tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,355 @@
+// Package pcap finds PROXY protocol headers in packet captures, such as captures of the
+// traffic between a load balancer and its backends. It reads pcap and pcapng files
+// with only the standard library, reassembles the start of each TCP connection and
+// parses the header there, and parses UDP datagrams as v2 headers.
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"time"
+)
+
+// LinkType is the link-layer header type of captured packets, as registered for
+// pcap and pcapng at https://www.tcpdump.org/linktypes.html
+type LinkType uint16
+
+const (
+	// LinkTypeNull is BSD loopback, a 4-byte address family in host byte order
+	LinkTypeNull LinkType = 0
+	// LinkTypeEthernet is Ethernet, possibly with 802.1Q VLAN tags
+	LinkTypeEthernet LinkType = 1
+	// LinkTypeRaw is a raw IPv4 or IPv6 packet
+	LinkTypeRaw LinkType = 101
+	// LinkTypeLoop is OpenBSD loopback, a 4-byte address family in network byte order
+	LinkTypeLoop LinkType = 108
+	// LinkTypeLinuxSLL is the Linux "cooked" capture used for the "any" device
+	LinkTypeLinuxSLL LinkType = 113
+	// LinkTypeIPv4 is a raw IPv4 packet
+	LinkTypeIPv4 LinkType = 228
+	// LinkTypeIPv6 is a raw IPv6 packet
+	LinkTypeIPv6 LinkType = 229
+	// LinkTypeLinuxSLL2 is the second version of the Linux "cooked" capture
+	LinkTypeLinuxSLL2 LinkType = 276
+)
+
+const (
+	pcapMagicMicro = 0xa1b2c3d4
+	pcapMagicNano  = 0xa1b23c4d
+
+	pcapngSectionHeader      = 0x0a0d0d0a
+	pcapngByteOrderMagic     = 0x1a2b3c4d
+	pcapngInterface          = 0x00000001
+	pcapngPacket             = 0x00000002
+	pcapngSimplePacket       = 0x00000003
+	pcapngEnhancedPacket     = 0x00000006
+	pcapngOptionEnd          = 0
+	pcapngOptionTSResolution = 9
+
+	// maxBlockSize limits the memory a corrupt length can make the reader allocate
+	maxBlockSize = 1 << 24
+)
+
+// ErrFormat is matched (using errors.Is) by the errors returned for input that is not a
+// valid pcap or pcapng file
+var ErrFormat = errors.New("pcap: invalid capture file")
+
+// Packet is a captured packet
+type Packet struct {
+	// Time is when the packet was captured
+	Time time.Time
+	// LinkType is the link-layer header type of Data
+	LinkType LinkType
+	// Data is the captured bytes, starting with the link-layer header. It may be
+	// shorter than the packet if the capture was limited by a snapshot length
+	Data []byte
+	// Length is the length of the packet on the wire
+	Length int
+}
+
+// Truncated reports whether the capture holds only part of the packet
+func (p *Packet) Truncated() bool {
+	return len(p.Data) < p.Length
+}
+
+// Reader reads packets from a pcap or pcapng file
+type Reader struct {
+	r      io.Reader
+	order  binary.ByteOrder
+	ng     bool
+	offset int64
+
+	// pcap files have a single link type and timestamp resolution
+	linkType LinkType
+	nano     bool
+
+	// pcapng files have them per interface, in the current section
+	interfaces []pcapngInterfaceInfo
+}
+
+// pcapngInterfaceInfo is what an interface description block says about the packets
+// captured on the interface
+type pcapngInterfaceInfo struct {
+	linkType LinkType
+	snapLen  uint32
+	// units is the number of timestamp units per second
+	units uint64
+}
+
+// NewReader reads the file header from r and returns a reader for the packets that
+// follow. The format (pcap with either byte order and microsecond or nanosecond
+// timestamps, or pcapng) is detected from the header
+func NewReader(r io.Reader) (*Reader, error) {
+	rd := &Reader{r: r}
+	var hdr [24]byte
+	if err := rd.readFull(hdr[:4]); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: the file is empty", ErrFormat)
+		}
+		return nil, err
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(hdr[:4]) {
+		case pcapMagicMicro, pcapMagicNano:
+			if err := rd.readFull(hdr[4:]); err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			rd.order = order
+			rd.nano = order.Uint32(hdr[:4]) == pcapMagicNano
+			rd.linkType = LinkType(order.Uint32(hdr[20:]))
+			return rd, nil
+		case pcapngSectionHeader:
+			rd.ng = true
+			if err := rd.readFull(hdr[4:8]); err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			if err := rd.readSectionHeader(hdr[4:8]); err != nil {
+				return nil, err
+			}
+			return rd, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: unknown file magic %x", ErrFormat, hdr[:4])
+}
+
+// Next reads the next packet. It returns io.EOF at the end of the file
+func (rd *Reader) Next() (*Packet, error) {
+	if rd.ng {
+		return rd.nextPcapng()
+	}
+	var hdr [16]byte
+	if err := rd.readFull(hdr[:1]); err != nil {
+		return nil, err
+	}
+	if err := rd.readFull(hdr[1:]); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	sec := rd.order.Uint32(hdr[0:])
+	frac := rd.order.Uint32(hdr[4:])
+	capLen := rd.order.Uint32(hdr[8:])
+	origLen := rd.order.Uint32(hdr[12:])
+	if capLen > maxBlockSize {
+		return nil, rd.formatError("packet length %v is too large", capLen)
+	}
+	data := make([]byte, capLen)
+	if err := rd.readFull(data); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if !rd.nano {
+		frac *= 1000
+	}
+	return &Packet{
+		Time:     time.Unix(int64(sec), int64(frac)).UTC(),
+		LinkType: rd.linkType,
+		Data:     data,
+		Length:   int(origLen),
+	}, nil
+}
+
+// nextPcapng reads blocks until the next packet block
+func (rd *Reader) nextPcapng() (*Packet, error) {
+	for {
+		var hdr [8]byte
+		if err := rd.readFull(hdr[:1]); err != nil {
+			return nil, err
+		}
+		if err := rd.readFull(hdr[1:]); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		typ := rd.order.Uint32(hdr[:])
+		if typ == pcapngSectionHeader {
+			// a new section may have another byte order and new interfaces
+			if err := rd.readSectionHeader(hdr[4:]); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		body, err := rd.readBlockBody(rd.order.Uint32(hdr[4:]))
+		if err != nil {
+			return nil, err
+		}
+
+		switch typ {
+		case pcapngInterface:
+			if err := rd.readInterface(body); err != nil {
+				return nil, err
+			}
+		case pcapngEnhancedPacket:
+			if len(body) < 20 {
+				return nil, rd.formatError("enhanced packet block is too short")
+			}
+			ts := uint64(rd.order.Uint32(body[4:]))<<32 | uint64(rd.order.Uint32(body[8:]))
+			return rd.pcapngPacket(rd.order.Uint32(body[0:]), ts, body[20:], rd.order.Uint32(body[12:]), rd.order.Uint32(body[16:]))
+		case pcapngPacket:
+			if len(body) < 20 {
+				return nil, rd.formatError("packet block is too short")
+			}
+			ts := uint64(rd.order.Uint32(body[4:]))<<32 | uint64(rd.order.Uint32(body[8:]))
+			return rd.pcapngPacket(uint32(rd.order.Uint16(body[0:])), ts, body[20:], rd.order.Uint32(body[12:]), rd.order.Uint32(body[16:]))
+		case pcapngSimplePacket:
+			if len(body) < 4 {
+				return nil, rd.formatError("simple packet block is too short")
+			}
+			// the captured length is the packet length, up to the snapshot length
+			if len(rd.interfaces) == 0 {
+				return nil, rd.formatError("packet for undescribed interface 0")
+			}
+			origLen := rd.order.Uint32(body[0:])
+			capLen := origLen
+			if snapLen := rd.interfaces[0].snapLen; snapLen != 0 && snapLen < capLen {
+				capLen = snapLen
+			}
+			return rd.pcapngPacket(0, 0, body[4:], capLen, origLen)
+		}
+		// other blocks, such as statistics and name resolution, are skipped
+	}
+}
+
+// pcapngPacket builds a packet from a packet block captured on interface id
+func (rd *Reader) pcapngPacket(id uint32, ts uint64, data []byte, capLen, origLen uint32) (*Packet, error) {
+	if int(id) >= len(rd.interfaces) {
+		return nil, rd.formatError("packet for undescribed interface %v", id)
+	}
+	if int(capLen) > len(data) {
+		return nil, rd.formatError("packet length %v is larger than its block", capLen)
+	}
+	ifc := rd.interfaces[id]
+	var t time.Time
+	if ts != 0 {
+		sec := ts / ifc.units
+		hi, lo := bits.Mul64(ts%ifc.units, uint64(time.Second))
+		nsec, _ := bits.Div64(hi, lo, ifc.units)
+		t = time.Unix(int64(sec), int64(nsec)).UTC()
+	}
+	return &Packet{
+		Time:     t,
+		LinkType: ifc.linkType,
+		Data:     data[:capLen],
+		Length:   int(origLen),
+	}, nil
+}
+
+// readSectionHeader reads a section header block whose type and total length (in the
+// byte order the block is about to declare) have already been read
+func (rd *Reader) readSectionHeader(total []byte) error {
+	var bom [4]byte
+	if err := rd.readFull(bom[:]); err != nil {
+		return unexpectedEOF(err)
+	}
+	switch {
+	case binary.LittleEndian.Uint32(bom[:]) == pcapngByteOrderMagic:
+		rd.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(bom[:]) == pcapngByteOrderMagic:
+		rd.order = binary.BigEndian
+	default:
+		return rd.formatError("unknown byte-order magic %x", bom)
+	}
+	// the byte-order magic is part of the body
+	if _, err := rd.readBlockBodyAfter(rd.order.Uint32(total), 4); err != nil {
+		return err
+	}
+	rd.interfaces = rd.interfaces[:0]
+	return nil
+}
+
+// readInterface reads the body of an interface description block
+func (rd *Reader) readInterface(body []byte) error {
+	if len(body) < 8 {
+		return rd.formatError("interface description block is too short")
+	}
+	ifc := pcapngInterfaceInfo{
+		linkType: LinkType(rd.order.Uint16(body[0:])),
+		snapLen:  rd.order.Uint32(body[4:]),
+		units:    uint64(time.Second / time.Microsecond),
+	}
+	for opts := body[8:]; len(opts) >= 4; {
+		code := rd.order.Uint16(opts[0:])
+		n := int(rd.order.Uint16(opts[2:]))
+		if code == pcapngOptionEnd || 4+n > len(opts) {
+			break
+		}
+		if code == pcapngOptionTSResolution && n >= 1 {
+			res := opts[4]
+			base := uint64(10)
+			if res&0x80 != 0 {
+				base = 2
+			}
+			units := uint64(1)
+			for i := 0; i < int(res&0x7f); i++ {
+				if units > 1<<63/base {
+					return rd.formatError("timestamp resolution %#x is too fine", res)
+				}
+				units *= base
+			}
+			ifc.units = units
+		}
+		opts = opts[4+(n+3)&^3:]
+	}
+	rd.interfaces = append(rd.interfaces, ifc)
+	return nil
+}
+
+// readBlockBody reads the rest of a block whose type and total length have been read.
+// It returns the body without the trailing total length
+func (rd *Reader) readBlockBody(total uint32) ([]byte, error) {
+	return rd.readBlockBodyAfter(total, 0)
+}
+
+// readBlockBodyAfter is like readBlockBody when the first skip bytes of the body have
+// already been read
+func (rd *Reader) readBlockBodyAfter(total uint32, skip int) ([]byte, error) {
+	if total%4 != 0 || total < uint32(12+skip) || total > maxBlockSize {
+		return nil, rd.formatError("invalid block length %v", total)
+	}
+	b := make([]byte, int(total)-8-skip)
+	if err := rd.readFull(b); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if trailer := rd.order.Uint32(b[len(b)-4:]); trailer != total {
+		return nil, rd.formatError("block length %v does not match its trailer %v", total, trailer)
+	}
+	return b[:len(b)-4], nil
+}
+
+// readFull reads exactly len(b) bytes, keeping track of the offset in the file
+func (rd *Reader) readFull(b []byte) error {
+	n, err := io.ReadFull(rd.r, b)
+	rd.offset += int64(n)
+	return err
+}
+
+// formatError reports invalid input at the current offset in the file
+func (rd *Reader) formatError(format string, a ...interface{}) error {
+	return fmt.Errorf("%w: at offset %v: %v", ErrFormat, rd.offset, fmt.Sprintf(format, a...))
+}
+
+// unexpectedEOF turns the end of the file in the middle of a record into an error
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,217 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// testPacket is a packet to write to a test capture
+type testPacket struct {
+	time time.Time
+	data []byte
+	// length is the length on the wire, len(data) if zero
+	length int
+}
+
+// writePcap builds a pcap file with microsecond (or nanosecond) timestamps
+func writePcap(order binary.ByteOrder, nano bool, lt LinkType, packets ...testPacket) []byte {
+	var b bytes.Buffer
+	magic := uint32(pcapMagicMicro)
+	if nano {
+		magic = pcapMagicNano
+	}
+	binary.Write(&b, order, []uint32{magic, 0x00040002, 0, 0, 0xffff, uint32(lt)})
+	for _, p := range packets {
+		frac := uint32(p.time.Nanosecond())
+		if !nano {
+			frac /= 1000
+		}
+		length := p.length
+		if length == 0 {
+			length = len(p.data)
+		}
+		binary.Write(&b, order, []uint32{uint32(p.time.Unix()), frac, uint32(len(p.data)), uint32(length)})
+		b.Write(p.data)
+	}
+	return b.Bytes()
+}
+
+// pcapngBlock builds a pcapng block of type typ with the given body
+func pcapngBlock(order binary.ByteOrder, typ uint32, body []byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	var b bytes.Buffer
+	total := uint32(12 + len(body))
+	binary.Write(&b, order, []uint32{typ, total})
+	b.Write(body)
+	binary.Write(&b, order, total)
+	return b.Bytes()
+}
+
+// pcapngSection builds a section header block
+func pcapngSection(order binary.ByteOrder) []byte {
+	var body bytes.Buffer
+	binary.Write(&body, order, uint32(pcapngByteOrderMagic))
+	binary.Write(&body, order, []uint16{1, 0})
+	binary.Write(&body, order, int64(-1))
+	return pcapngBlock(order, pcapngSectionHeader, body.Bytes())
+}
+
+// pcapngInterfaceBlock builds an interface description block, with an if_tsresol
+// option if tsresol is not zero
+func pcapngInterfaceBlock(order binary.ByteOrder, lt LinkType, tsresol byte) []byte {
+	var body bytes.Buffer
+	binary.Write(&body, order, []uint16{uint16(lt), 0})
+	binary.Write(&body, order, uint32(0xffff))
+	if tsresol != 0 {
+		binary.Write(&body, order, []uint16{pcapngOptionTSResolution, 1})
+		body.Write([]byte{tsresol, 0, 0, 0})
+		binary.Write(&body, order, []uint16{pcapngOptionEnd, 0})
+	}
+	return pcapngBlock(order, pcapngInterface, body.Bytes())
+}
+
+// pcapngEnhancedPacketBlock builds an enhanced packet block with a timestamp in units
+// of the interface's resolution
+func pcapngEnhancedPacketBlock(order binary.ByteOrder, id uint32, ts uint64, p testPacket) []byte {
+	var body bytes.Buffer
+	length := p.length
+	if length == 0 {
+		length = len(p.data)
+	}
+	binary.Write(&body, order, []uint32{id, uint32(ts >> 32), uint32(ts), uint32(len(p.data)), uint32(length)})
+	body.Write(p.data)
+	return pcapngBlock(order, pcapngEnhancedPacket, body.Bytes())
+}
+
+func Test_Reader(t *testing.T) {
+	t0 := time.Date(2026, 10, 18, 12, 0, 0, 123456000, time.UTC)
+	t1 := time.Date(2026, 10, 18, 12, 0, 1, 987654321, time.UTC)
+	p0 := testPacket{time: t0, data: []byte("first")}
+	p1 := testPacket{time: t1, data: []byte("second"), length: 1500}
+
+	le, be := binary.ByteOrder(binary.LittleEndian), binary.ByteOrder(binary.BigEndian)
+	ng := func(order binary.ByteOrder, blocks ...[]byte) []byte {
+		return bytes.Join(append([][]byte{pcapngSection(order)}, blocks...), nil)
+	}
+	var simple bytes.Buffer
+	binary.Write(&simple, be, uint32(6))
+	simple.WriteString("simple")
+
+	tests := []struct {
+		name string
+		file []byte
+		want []Packet
+	}{
+		{
+			name: "pcap",
+			file: writePcap(le, false, LinkTypeEthernet, p0, p1),
+			want: []Packet{
+				{Time: t0, LinkType: LinkTypeEthernet, Data: []byte("first"), Length: 5},
+				{Time: t1.Truncate(time.Microsecond), LinkType: LinkTypeEthernet, Data: []byte("second"), Length: 1500},
+			},
+		},
+		{
+			name: "big-endian pcap with nanoseconds",
+			file: writePcap(be, true, LinkTypeRaw, p1),
+			want: []Packet{{Time: t1, LinkType: LinkTypeRaw, Data: []byte("second"), Length: 1500}},
+		},
+		{
+			name: "pcapng",
+			file: ng(le,
+				pcapngInterfaceBlock(le, LinkTypeEthernet, 0),
+				pcapngInterfaceBlock(le, LinkTypeLinuxSLL, 9),
+				pcapngBlock(le, 5, []byte("statistics are skipped")),
+				pcapngEnhancedPacketBlock(le, 0, uint64(t0.UnixNano()/1000), p0),
+				pcapngEnhancedPacketBlock(le, 1, uint64(t1.UnixNano()), p1),
+			),
+			want: []Packet{
+				{Time: t0, LinkType: LinkTypeEthernet, Data: []byte("first"), Length: 5},
+				{Time: t1, LinkType: LinkTypeLinuxSLL, Data: []byte("second"), Length: 1500},
+			},
+		},
+		{
+			name: "pcapng sections",
+			file: bytes.Join([][]byte{
+				ng(le, pcapngInterfaceBlock(le, LinkTypeEthernet, 0x80|10), pcapngEnhancedPacketBlock(le, 0, uint64(t0.Unix())<<10, p0)),
+				ng(be, pcapngInterfaceBlock(be, LinkTypeRaw, 0), pcapngBlock(be, pcapngSimplePacket, simple.Bytes())),
+			}, nil),
+			want: []Packet{
+				{Time: t0.Truncate(time.Second), LinkType: LinkTypeEthernet, Data: []byte("first"), Length: 5},
+				{LinkType: LinkTypeRaw, Data: []byte("simple"), Length: 6},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rd, err := NewReader(bytes.NewReader(tt.file))
+			if err != nil {
+				t.Fatalf("NewReader() error = %v", err)
+			}
+			for i, want := range tt.want {
+				p, err := rd.Next()
+				if err != nil {
+					t.Fatalf("Next() %v error = %v", i, err)
+				}
+				if !p.Time.Equal(want.Time) || p.LinkType != want.LinkType || !bytes.Equal(p.Data, want.Data) || p.Length != want.Length {
+					t.Fatalf("Next() %v = %+v, want %+v", i, p, want)
+				}
+				if p.Truncated() != (want.Length > len(want.Data)) {
+					t.Fatalf("Truncated() = %v", p.Truncated())
+				}
+			}
+			if p, err := rd.Next(); err != io.EOF {
+				t.Fatalf("Next() = %+v, %v, want io.EOF", p, err)
+			}
+		})
+	}
+}
+
+func Test_Reader_errors(t *testing.T) {
+	le := binary.LittleEndian
+	good := writePcap(le, false, LinkTypeEthernet, testPacket{data: []byte("packet")})
+	section := pcapngSection(le)
+	badTrailer := pcapngInterfaceBlock(le, LinkTypeEthernet, 0)
+	badTrailer[len(badTrailer)-1] = 1
+
+	tests := []struct {
+		name    string
+		file    []byte
+		wantNew error
+		wantErr error
+	}{
+		{name: "empty", file: nil, wantNew: ErrFormat},
+		{name: "unknown magic", file: []byte("GET / HTTP/1.1\r\n\r\n"), wantNew: ErrFormat},
+		{name: "short pcap header", file: good[:10], wantNew: io.ErrUnexpectedEOF},
+		{name: "short record header", file: good[:30], wantErr: io.ErrUnexpectedEOF},
+		{name: "short packet", file: good[:len(good)-1], wantErr: io.ErrUnexpectedEOF},
+		{name: "huge packet", file: append(good[:24:24], 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2, 0, 0, 0, 2), wantErr: ErrFormat},
+		{name: "bad byte-order magic", file: append(section[:8:8], 1, 2, 3, 4), wantNew: ErrFormat},
+		{name: "bad block length", file: append(section[:4:4], 13, 0, 0, 0, 0x4d, 0x3c, 0x2b, 0x1a), wantNew: ErrFormat},
+		{name: "bad trailer", file: bytes.Join([][]byte{section, badTrailer}, nil), wantErr: ErrFormat},
+		{
+			name:    "undescribed interface",
+			file:    bytes.Join([][]byte{section, pcapngEnhancedPacketBlock(le, 0, 0, testPacket{data: []byte("x")})}, nil),
+			wantErr: ErrFormat,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rd, err := NewReader(bytes.NewReader(tt.file))
+			if !errors.Is(err, tt.wantNew) || (err == nil) != (tt.wantNew == nil) {
+				t.Fatalf("NewReader() error = %v, want %v", err, tt.wantNew)
+			}
+			if err != nil {
+				return
+			}
+			if _, err := rd.Next(); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Next() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,340 @@
+package pcap
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+	"time"
+
+	"github.com/everettcaleb/go-proxyproto"
+)
+
+// maxHeaderSize is the largest header, a v2 header with 65535 bytes of addresses and
+// TLVs. Bytes further into a connection are never needed
+const maxHeaderSize = 16 + 0xffff
+
+var (
+	v1Signature = []byte("PROXY")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// Result is the PROXY header found at the start of a TCP connection or in a UDP
+// datagram, or the reason it could not be parsed
+type Result struct {
+	// Time is when the connection was opened (its SYN was captured) or the datagram
+	// was captured
+	Time time.Time
+	// Transport is TransportStream for TCP connections and TransportDgram for UDP
+	// datagrams
+	Transport proxyproto.Transport
+	// Src and Dst are the addresses of the packets that carried the header, such as
+	// a load balancer and its backend, rather than the addresses in the header
+	Src, Dst netip.AddrPort
+	// Data is the parsed header, or nil if Err is set
+	Data *proxyproto.Data
+	// Header is the header, or as much of the start of the connection or datagram as
+	// was captured if Err is set
+	Header []byte
+	// Err is why no header could be parsed: a proxyproto.ParseError for a malformed
+	// header, or an error matching proxyproto.ErrIncomplete if the connection closed,
+	// the capture ended or packets were not captured before the whole header was seen
+	Err error
+}
+
+// ScannerOption configures a Scanner
+type ScannerOption func(*Scanner)
+
+// WithPorts makes the scanner report every TCP connection and UDP datagram sent to one
+// of ports, flagging those that do not start with a PROXY header, and ignore all other
+// traffic. By default connections and datagrams to any port are reported, but only if
+// they start with the signature of a PROXY header
+func WithPorts(ports ...uint16) ScannerOption {
+	return func(s *Scanner) {
+		if s.ports == nil {
+			s.ports = make(map[uint16]bool, len(ports))
+		}
+		for _, p := range ports {
+			s.ports[p] = true
+		}
+	}
+}
+
+// Scanner finds the PROXY headers in a capture
+type Scanner struct {
+	rd    *Reader
+	ports map[uint16]bool
+
+	// conns are the TCP connections whose header is not complete yet, keyed by the
+	// direction that opened them
+	conns map[flow]*tcpConn
+	ready []*Result
+	eof   bool
+}
+
+// flow is one direction of a TCP connection
+type flow struct {
+	src, dst netip.AddrPort
+}
+
+// tcpConn reassembles the start of the stream of a TCP connection
+type tcpConn struct {
+	res *Result
+	// isn is the initial sequence number, so the stream starts at isn+1
+	isn uint32
+	// buf is the start of the stream, and segs the segments that arrived after a
+	// gap, keyed by their offset in the stream
+	buf       []byte
+	segs      map[uint32][]byte
+	truncated bool
+}
+
+// NewScanner reads the capture header from r and returns a scanner for the capture
+func NewScanner(r io.Reader, opts ...ScannerOption) (*Scanner, error) {
+	rd, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	s := &Scanner{rd: rd, conns: make(map[flow]*tcpConn)}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
+}
+
+// Next gets the next result. Results for TCP connections come when the header is
+// complete or the connection closes; connections still open at the end of the capture
+// come last, in the order they were opened. It returns io.EOF after the last result
+func (s *Scanner) Next() (*Result, error) {
+	for len(s.ready) == 0 {
+		if s.eof {
+			return nil, io.EOF
+		}
+		p, err := s.rd.Next()
+		if err == io.EOF {
+			s.eof = true
+			s.flush()
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		seg, ok := decodePacket(p)
+		switch {
+		case !ok:
+		case seg.proto == ipProtoUDP:
+			s.datagram(p, &seg)
+		default:
+			s.segment(p, &seg)
+		}
+	}
+	res := s.ready[0]
+	s.ready = s.ready[1:]
+	return res, nil
+}
+
+// datagram parses the header of a UDP datagram
+func (s *Scanner) datagram(p *Packet, seg *segment) {
+	b := seg.payload
+	if !s.wanted(seg.dst, b) {
+		return
+	}
+	res := &Result{Time: p.Time, Transport: proxyproto.TransportDgram, Src: seg.src, Dst: seg.dst}
+	d, n, err := proxyproto.ParseBytes(b)
+	switch {
+	case err == nil && d.Version != proxyproto.Version2:
+		res.Err = errors.New("pcap: v1 header in a UDP datagram, only v2 headers can be sent over UDP")
+	case err == nil:
+		res.Data = d
+	case errors.Is(err, proxyproto.ErrIncomplete) && seg.truncated:
+		res.Err = fmt.Errorf("pcap: the datagram was not captured in full: %w", err)
+	default:
+		res.Err = err
+	}
+	if err != nil {
+		n = len(b)
+	}
+	res.Header = append([]byte{}, b[:n]...)
+	s.ready = append(s.ready, res)
+}
+
+// segment adds a TCP segment to the connection it belongs to
+func (s *Scanner) segment(p *Packet, seg *segment) {
+	f := flow{seg.src, seg.dst}
+	c := s.conns[f]
+	if seg.flags&tcpFlagRST != 0 {
+		// either side can reset the connection
+		if rc := s.conns[flow{seg.dst, seg.src}]; rc != nil {
+			s.finish(flow{seg.dst, seg.src}, rc, "the connection was reset before the header was complete")
+		}
+	}
+	if seg.flags&(tcpFlagSYN|tcpFlagACK) == tcpFlagSYN && (s.ports == nil || s.ports[seg.dst.Port()]) {
+		if c != nil && c.isn == seg.seq {
+			// retransmitted SYN
+			return
+		}
+		if c != nil {
+			// the ports were reused before the header was complete
+			s.finish(f, c, "the connection was reopened before the header was complete")
+		}
+		c = &tcpConn{
+			res: &Result{Time: p.Time, Transport: proxyproto.TransportStream, Src: seg.src, Dst: seg.dst},
+			isn: seg.seq,
+		}
+		s.conns[f] = c
+		// SYNs may carry data with TCP Fast Open
+		seg.seq++
+	}
+	if c == nil {
+		// the connection was opened before the capture started, by the other side, or
+		// its header is already complete
+		return
+	}
+
+	if len(seg.payload) > 0 {
+		c.truncated = c.truncated || seg.truncated
+		if c.add(seg.seq-(c.isn+1), seg.payload) && c.parse() {
+			s.done(f, c)
+			return
+		}
+	}
+	switch {
+	case seg.flags&tcpFlagRST != 0:
+		s.finish(f, c, "the connection was reset before the header was complete")
+	case seg.flags&tcpFlagFIN != 0:
+		s.finish(f, c, "the connection closed before the header was complete")
+	}
+}
+
+// add adds the payload of a segment at offset off in the stream and reports whether
+// the start of the stream grew
+func (c *tcpConn) add(off uint32, payload []byte) bool {
+	if off >= maxHeaderSize {
+		// a segment from before the SYN, or far into the stream
+		return false
+	}
+	if int(off) > len(c.buf) {
+		if c.segs == nil {
+			c.segs = make(map[uint32][]byte)
+		}
+		if len(payload) > len(c.segs[off]) {
+			c.segs[off] = append([]byte{}, payload...)
+		}
+		return false
+	}
+	n := len(c.buf)
+	c.buf = appendAt(c.buf, int(off), payload)
+	for grew := true; grew; {
+		grew = false
+		for o, b := range c.segs {
+			if int(o) <= len(c.buf) {
+				c.buf = appendAt(c.buf, int(o), b)
+				delete(c.segs, o)
+				grew = true
+			}
+		}
+	}
+	return len(c.buf) > n
+}
+
+// appendAt appends the part of b, which starts at offset off in the stream, that is
+// past the end of buf. Retransmitted bytes that buf already has are ignored
+func appendAt(buf []byte, off int, b []byte) []byte {
+	if off+len(b) <= len(buf) {
+		return buf
+	}
+	b = b[len(buf)-off:]
+	if len(buf)+len(b) > maxHeaderSize {
+		b = b[:maxHeaderSize-len(buf)]
+	}
+	return append(buf, b...)
+}
+
+// parse parses the start of the stream and reports whether the result is known
+func (c *tcpConn) parse() bool {
+	d, n, err := proxyproto.ParseBytes(c.buf)
+	if errors.Is(err, proxyproto.ErrIncomplete) {
+		return false
+	}
+	if err != nil {
+		c.res.Err = err
+		c.res.Header = c.buf
+		return true
+	}
+	c.res.Data = d
+	c.res.Header = c.buf[:n:n]
+	return true
+}
+
+// done reports the result of a connection whose header is complete or malformed
+func (s *Scanner) done(f flow, c *tcpConn) {
+	delete(s.conns, f)
+	if s.wanted(c.res.Dst, c.buf) {
+		s.ready = append(s.ready, c.res)
+	}
+}
+
+// finish reports a connection whose header will never be complete, for the reason why
+func (s *Scanner) finish(f flow, c *tcpConn, why string) {
+	_, _, err := proxyproto.ParseBytes(c.buf)
+	switch {
+	case len(c.segs) > 0:
+		c.res.Err = fmt.Errorf("pcap: %v bytes at offset %v of the stream were not captured: %w", firstGap(c.segs)-len(c.buf), len(c.buf), err)
+	case c.truncated:
+		c.res.Err = fmt.Errorf("pcap: packets were not captured in full: %w", err)
+	default:
+		c.res.Err = fmt.Errorf("pcap: %v: %w", why, err)
+	}
+	c.res.Header = c.buf
+	s.done(f, c)
+}
+
+// flush reports the connections still open at the end of the capture, in the order
+// they were opened
+func (s *Scanner) flush() {
+	open := make([]flow, 0, len(s.conns))
+	for f := range s.conns {
+		open = append(open, f)
+	}
+	sort.Slice(open, func(i, j int) bool {
+		return s.conns[open[i]].res.Time.Before(s.conns[open[j]].res.Time)
+	})
+	for _, f := range open {
+		s.finish(f, s.conns[f], "the capture ended before the header was complete")
+	}
+}
+
+// firstGap gets the offset of the first segment after a gap
+func firstGap(segs map[uint32][]byte) int {
+	first := -1
+	for o := range segs {
+		if first < 0 || int(o) < first {
+			first = int(o)
+		}
+	}
+	return first
+}
+
+// wanted reports whether to report the connection or datagram to dst that starts with b
+func (s *Scanner) wanted(dst netip.AddrPort, b []byte) bool {
+	if s.ports != nil {
+		return s.ports[dst.Port()]
+	}
+	return hasSignature(b)
+}
+
+// hasSignature reports whether b starts like a PROXY header, which may be malformed
+// after the signature
+func hasSignature(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	for _, sig := range [][]byte{v1Signature, v2Signature} {
+		if bytes.HasPrefix(b, sig) || bytes.HasPrefix(sig, b) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,330 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/everettcaleb/go-proxyproto"
+)
+
+// testConn sends the packets of a TCP connection from a client to a server
+type testConn struct {
+	client, server netip.AddrPort
+	isn            uint32
+}
+
+// syn builds the client's SYN
+func (c testConn) syn() []byte {
+	return ipPacket(ipProtoTCP, c.client, c.server, tcpFlagSYN, c.isn, nil)
+}
+
+// data builds a segment with the client's bytes starting at offset off in the stream
+func (c testConn) data(off int, b string) []byte {
+	return ipPacket(ipProtoTCP, c.client, c.server, tcpFlagACK, c.isn+1+uint32(off), []byte(b))
+}
+
+// reply builds a segment the server sends with the given flags
+func (c testConn) reply(flags byte, b string) []byte {
+	return ipPacket(ipProtoTCP, c.server, c.client, flags, 7000, []byte(b))
+}
+
+// fin builds the client's FIN after off bytes of the stream
+func (c testConn) fin(off int) []byte {
+	return ipPacket(ipProtoTCP, c.client, c.server, tcpFlagFIN|tcpFlagACK, c.isn+1+uint32(off), nil)
+}
+
+// scanAll scans a pcap file of raw IP packets, captured a millisecond apart
+func scanAll(t *testing.T, packets [][]byte, opts ...ScannerOption) []*Result {
+	t.Helper()
+	t0 := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	var tps []testPacket
+	for i, p := range packets {
+		tps = append(tps, testPacket{time: t0.Add(time.Duration(i) * time.Millisecond), data: p})
+	}
+	s, err := NewScanner(bytes.NewReader(writePcap(binary.LittleEndian, false, LinkTypeRaw, tps...)), opts...)
+	if err != nil {
+		t.Fatalf("NewScanner() error = %v", err)
+	}
+	var results []*Result
+	for {
+		r, err := s.Next()
+		if err == io.EOF {
+			return results
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		results = append(results, r)
+	}
+}
+
+func Test_Scanner(t *testing.T) {
+	v2, err := (&proxyproto.Data{
+		Command:       proxyproto.CommandProxy,
+		AddressFamily: proxyproto.AddressFamilyIPv4,
+		Transport:     proxyproto.TransportStream,
+		SourceAddr:    []byte{192, 0, 2, 1},
+		DestAddr:      []byte{192, 0, 2, 2},
+		SourcePort:    5000,
+		DestPort:      443,
+		TLVs:          map[proxyproto.TLVType][]byte{proxyproto.TLVTypeAuthority: []byte("example.com")},
+	}).AppendHeader(nil, proxyproto.Version2)
+	if err != nil {
+		t.Fatalf("AppendHeader() error = %v", err)
+	}
+	h := string(v2)
+	v1 := "PROXY TCP4 192.0.2.1 192.0.2.2 5000 443\r\n"
+	lb := netip.MustParseAddr("10.0.0.1")
+	backend := netip.MustParseAddrPort("10.0.0.2:8080")
+	conn := func(port uint16, isn uint32) testConn {
+		return testConn{client: netip.AddrPortFrom(lb, port), server: backend, isn: isn}
+	}
+	a, b, c, d := conn(40001, 100), conn(40002, 0xffffff00), conn(40003, 300), conn(40004, 400)
+
+	tests := []struct {
+		name    string
+		packets [][]byte
+		opts    []ScannerOption
+		// want lists the client port of each result and its summary, or the start of
+		// its error
+		want []string
+	}{
+		{
+			name: "in order",
+			packets: [][]byte{
+				a.syn(), a.reply(tcpFlagSYN|tcpFlagACK, ""), a.data(0, h+"GET / HTTP/1.1\r\n"),
+				b.syn(), b.data(0, v1), b.reply(tcpFlagACK, "HTTP/1.1 200 OK\r\n"),
+			},
+			want: []string{
+				`40001 v2 tcp4 192.0.2.1:5000 -> 192.0.2.2:443 authority="example.com"`,
+				`40002 v1 tcp4 192.0.2.1:5000 -> 192.0.2.2:443`,
+			},
+		},
+		{
+			name: "split, out of order and retransmitted across a sequence number wrap",
+			packets: [][]byte{
+				b.syn(), b.syn(), b.data(20, h[20:40]), b.data(0, h[:10]), b.data(5, h[5:25]), b.data(40, h[40:]+"data"),
+				b.data(0, h[:10]),
+			},
+			want: []string{`40002 v2 tcp4 192.0.2.1:5000 -> 192.0.2.2:443 authority="example.com"`},
+		},
+		{
+			name:    "data in the SYN",
+			packets: [][]byte{ipPacket(ipProtoTCP, c.client, c.server, tcpFlagSYN, c.isn, []byte(v1))},
+			want:    []string{`40003 v1 tcp4 192.0.2.1:5000 -> 192.0.2.2:443`},
+		},
+		{
+			name: "interleaved connections complete in order",
+			packets: [][]byte{
+				a.syn(), b.syn(), a.data(0, h[:20]), b.data(0, v1[:10]), b.data(10, v1[10:]), a.data(20, h[20:]),
+			},
+			want: []string{
+				`40002 v1 tcp4 192.0.2.1:5000 -> 192.0.2.2:443`,
+				`40001 v2 tcp4 192.0.2.1:5000 -> 192.0.2.2:443 authority="example.com"`,
+			},
+		},
+		{
+			name:    "malformed",
+			packets: [][]byte{a.syn(), a.data(0, "PROXY TCP4 192.0.2.1 192.0.2.256 5000 443\r\n")},
+			want:    []string{`40001 failed to parse proxy protocol v1: failed to parse dest IP "192.0.2.256"`},
+		},
+		{
+			name:    "closed",
+			packets: [][]byte{a.syn(), a.data(0, h[:20]), a.fin(20)},
+			want:    []string{`40001 pcap: the connection closed before the header was complete`},
+		},
+		{
+			name:    "reset by the server",
+			packets: [][]byte{a.syn(), a.data(0, h[:20]), a.reply(tcpFlagRST, "")},
+			want:    []string{`40001 pcap: the connection was reset before the header was complete`},
+		},
+		{
+			name:    "reopened",
+			packets: [][]byte{a.syn(), a.data(0, h[:20]), conn(40001, 900).syn(), conn(40001, 900).data(0, v1)},
+			want: []string{
+				`40001 pcap: the connection was reopened before the header was complete`,
+				`40001 v1 tcp4 192.0.2.1:5000 -> 192.0.2.2:443`,
+			},
+		},
+		{
+			name:    "capture ended",
+			packets: [][]byte{b.syn(), a.syn(), a.data(0, v1[:10]), b.data(0, h[:10])},
+			want: []string{
+				`40002 pcap: the capture ended before the header was complete`,
+				`40001 pcap: the capture ended before the header was complete`,
+			},
+		},
+		{
+			name:    "missing packets",
+			packets: [][]byte{a.syn(), a.data(0, h[:10]), a.data(20, h[20:])},
+			want:    []string{`40001 pcap: 10 bytes at offset 10 of the stream were not captured`},
+		},
+		{
+			name: "ignored",
+			packets: [][]byte{
+				// opened before the capture started
+				d.data(0, h),
+				// not PROXY protocol
+				c.syn(), c.data(0, "GET / HTTP/1.1\r\n"), a.syn(), a.fin(0),
+			},
+		},
+		{
+			name:    "ports",
+			packets: [][]byte{c.syn(), c.data(0, "GET / HTTP/1.1\r\n"), a.syn(), a.fin(0), d.syn(), d.data(0, h)},
+			opts:    []ScannerOption{WithPorts(8080)},
+			want: []string{
+				`40003 failed to parse proxy protocol, expected "PROXY" or v2 binary header`,
+				`40001 pcap: the connection closed before the header was complete`,
+				`40004 v2 tcp4 192.0.2.1:5000 -> 192.0.2.2:443 authority="example.com"`,
+			},
+		},
+		{
+			name:    "other ports",
+			packets: [][]byte{a.syn(), a.data(0, h)},
+			opts:    []ScannerOption{WithPorts(443)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := scanAll(t, tt.packets, tt.opts...)
+			var got []string
+			for _, r := range results {
+				if r.Transport != proxyproto.TransportStream || r.Dst != backend || r.Src.Addr() != lb {
+					t.Errorf("result %+v has the wrong connection", r)
+				}
+				var s string
+				if r.Err != nil {
+					s = r.Err.Error()
+					if r.Data != nil {
+						t.Errorf("result %+v has both data and an error", r)
+					}
+				} else {
+					text, _ := r.Data.MarshalText()
+					s = string(text)
+				}
+				got = append(got, strconv.Itoa(int(r.Src.Port()))+" "+s)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("results = %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if !strings.HasPrefix(got[i], tt.want[i]) {
+					t.Fatalf("results = %q, want %q", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func Test_Scanner_headers(t *testing.T) {
+	a := testConn{client: netip.MustParseAddrPort("10.0.0.1:40001"), server: netip.MustParseAddrPort("10.0.0.2:8080"), isn: 1}
+	v1 := "PROXY TCP4 192.0.2.1 192.0.2.2 5000 443\r\n"
+	results := scanAll(t, [][]byte{a.syn(), a.data(0, v1+"GET /"), a.data(len(v1)+5, " HTTP/1.1\r\n")})
+	if len(results) != 1 || string(results[0].Header) != v1 || results[0].Data == nil {
+		t.Fatalf("results = %+v, want the header", results)
+	}
+	if want := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC); !results[0].Time.Equal(want) {
+		t.Fatalf("Time = %v, want the time of the SYN %v", results[0].Time, want)
+	}
+
+	bad := "PROXY TCP4 192.0.2.1 192.0.2.2 5000 99999\r\n"
+	results = scanAll(t, [][]byte{a.syn(), a.data(0, bad+"GET /")})
+	var pe proxyproto.ParseError
+	if len(results) != 1 || !strings.HasPrefix(string(results[0].Header), bad) || !errors.As(results[0].Err, &pe) {
+		t.Fatalf("results = %+v, want a parse error with the captured bytes", results)
+	}
+
+	results = scanAll(t, [][]byte{a.syn(), a.data(0, v1[:10])})
+	if len(results) != 1 || string(results[0].Header) != v1[:10] || !errors.Is(results[0].Err, proxyproto.ErrIncomplete) {
+		t.Fatalf("results = %+v, want the incomplete header", results)
+	}
+}
+
+func Test_Scanner_datagrams(t *testing.T) {
+	d, err := proxyproto.NewData(proxyproto.TransportDgram, netip.MustParseAddrPort("[2001:db8::1]:5000"), netip.MustParseAddrPort("[2001:db8::2]:53"))
+	if err != nil {
+		t.Fatalf("NewData() error = %v", err)
+	}
+	v2, err := d.AppendHeader(nil, proxyproto.Version2)
+	if err != nil {
+		t.Fatalf("AppendHeader() error = %v", err)
+	}
+	lb := netip.MustParseAddrPort("[fd00::1]:40000")
+	backend := netip.MustParseAddrPort("[fd00::2]:5353")
+	udp := func(src, dst netip.AddrPort, payload []byte) []byte {
+		return ipPacket(ipProtoUDP, src, dst, 0, 0, payload)
+	}
+	malformed := append([]byte{}, v2...)
+	malformed[13] = 0x52
+	truncated := udp(lb, backend, v2)
+	truncated = truncated[:len(truncated)-4]
+
+	tests := []struct {
+		name    string
+		packets [][]byte
+		opts    []ScannerOption
+		want    []string
+	}{
+		{
+			name: "headers",
+			packets: [][]byte{
+				udp(lb, backend, append(v2, "query"...)),
+				udp(backend, lb, []byte("response")),
+				udp(lb, backend, v2),
+			},
+			want: []string{"v2 udp6 [2001:db8::1]:5000 -> [2001:db8::2]:53", "v2 udp6 [2001:db8::1]:5000 -> [2001:db8::2]:53"},
+		},
+		{
+			name: "malformed",
+			packets: [][]byte{
+				udp(lb, backend, malformed),
+				udp(lb, backend, []byte("PROXY TCP4 192.0.2.1 192.0.2.2 5000 443\r\n")),
+				truncated,
+			},
+			want: []string{
+				"failed to parse proxy protocol v2: invalid Address Family nibble",
+				"pcap: v1 header in a UDP datagram",
+				"pcap: the datagram was not captured in full",
+			},
+		},
+		{
+			name:    "ports",
+			packets: [][]byte{udp(lb, backend, []byte("query")), udp(backend, lb, v2)},
+			opts:    []ScannerOption{WithPorts(5353)},
+			want:    []string{`failed to parse proxy protocol, expected "PROXY" or v2 binary header`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := scanAll(t, tt.packets, tt.opts...)
+			if len(results) != len(tt.want) {
+				t.Fatalf("results = %+v, want %q", results, tt.want)
+			}
+			for i, r := range results {
+				if r.Transport != proxyproto.TransportDgram || r.Src != lb || r.Dst != backend {
+					t.Fatalf("result %+v has the wrong addresses", r)
+				}
+				var got string
+				if r.Err != nil {
+					got = r.Err.Error()
+				} else {
+					text, _ := r.Data.MarshalText()
+					got = string(text)
+					if !bytes.Equal(r.Header, v2) {
+						t.Fatalf("Header = %q, want %q", r.Header, v2)
+					}
+				}
+				if !strings.HasPrefix(got, tt.want[i]) {
+					t.Fatalf("result %v = %q, want %q", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
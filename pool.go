@@ -0,0 +1,456 @@
+package proxyproto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// PoolRoundRobin hands connections to the available backends in turn
+	PoolRoundRobin PoolStrategy = 0
+	// PoolLeastConnections picks the available backend with the fewest open connections
+	PoolLeastConnections PoolStrategy = 1
+	// PoolSourceHash picks a backend by consistent hashing of the proxied client's
+	// address (Data.SourceAddr), so a client keeps reaching the same backend while it
+	// is available and only the clients of a failed backend move elsewhere
+	PoolSourceHash PoolStrategy = 2
+
+	// poolHashReplicas is the number of points each backend has on the hash ring
+	poolHashReplicas = 128
+
+	defaultPoolEjectAfter         = 3
+	defaultPoolEjectFor           = 30 * time.Second
+	defaultPoolHealthCheckTimeout = 2 * time.Second
+)
+
+// ErrNoBackends is returned by Pool.Dial when no backend is available
+var ErrNoBackends = errors.New("proxyproto: no backend available")
+
+// PoolStrategy selects how a Pool picks a backend for each connection
+type PoolStrategy int
+
+var poolStrategyNames = map[PoolStrategy]string{
+	PoolRoundRobin:       "round-robin",
+	PoolLeastConnections: "least-connections",
+	PoolSourceHash:       "source-hash",
+}
+
+// String gets the strategy's name, e.g. "least-connections"
+func (s PoolStrategy) String() string {
+	if n, ok := poolStrategyNames[s]; ok {
+		return n
+	}
+	return "PoolStrategy(" + strconv.Itoa(int(s)) + ")"
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (s PoolStrategy) MarshalText() ([]byte, error) {
+	if _, ok := poolStrategyNames[s]; !ok {
+		return nil, fmt.Errorf("unknown pool strategy %d", int(s))
+	}
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. It accepts the names returned by String
+func (s *PoolStrategy) UnmarshalText(b []byte) error {
+	for k, n := range poolStrategyNames {
+		if n == string(b) {
+			*s = k
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown pool strategy %q", b)
+}
+
+// PoolOption configures optional behavior of a Pool
+type PoolOption func(*Pool)
+
+// WithPoolStrategy sets how backends are picked, PoolRoundRobin by default
+func WithPoolStrategy(s PoolStrategy) PoolOption {
+	return func(p *Pool) {
+		p.strategy = s
+	}
+}
+
+// WithPoolDialer sets the function used to connect to backends and run health checks,
+// (*net.Dialer).DialContext by default
+func WithPoolDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) PoolOption {
+	return func(p *Pool) {
+		p.dial = dial
+	}
+}
+
+// WithPoolHealthCheck enables active health checks every interval. Each check
+// connects to the backend and sends a v2 LOCAL header, which the spec intends for
+// health checks, and the backend is healthy if that succeeds within timeout. If check
+// is not nil it is then called with the connection for a protocol-level check (for
+// example sending a request and reading the reply), and the backend is healthy if it
+// returns nil. Backends start out healthy and are checked right away
+func WithPoolHealthCheck(interval, timeout time.Duration, check func(ctx context.Context, conn net.Conn) error) PoolOption {
+	return func(p *Pool) {
+		p.checkInterval = interval
+		p.checkTimeout = timeout
+		p.check = check
+	}
+}
+
+// WithPoolEjection sets passive ejection: after failures consecutive failed dials a
+// backend is skipped for d. The default is 3 failures and 30 seconds; failures < 1
+// disables ejection
+func WithPoolEjection(failures int, d time.Duration) PoolOption {
+	return func(p *Pool) {
+		p.ejectAfter = failures
+		p.ejectFor = d
+	}
+}
+
+// Pool spreads connections over a set of backends, skipping those that fail health
+// checks or were ejected after failed dials. It is safe for concurrent use
+type Pool struct {
+	network  string
+	backends []*poolBackend
+	ring     []poolHashPoint // sorted by hash, only for PoolSourceHash
+	next     uint32          // round-robin counter, atomic
+
+	strategy      PoolStrategy
+	dial          func(ctx context.Context, network, addr string) (net.Conn, error)
+	checkInterval time.Duration
+	checkTimeout  time.Duration
+	check         func(ctx context.Context, conn net.Conn) error
+	ejectAfter    int
+	ejectFor      time.Duration
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// poolBackend is the state of one backend address
+type poolBackend struct {
+	addr   string
+	active int64 // open connections, atomic
+
+	mu           sync.Mutex
+	healthy      bool
+	failures     int
+	ejectedUntil time.Time
+	lastErr      error
+}
+
+type poolHashPoint struct {
+	hash    uint32
+	backend int
+}
+
+// PoolBackendStatus describes one backend of a Pool, see Pool.Status
+type PoolBackendStatus struct {
+	Addr string
+	// Healthy is false if the last active health check failed
+	Healthy bool
+	// EjectedUntil is set while the backend is ejected after failed dials
+	EjectedUntil time.Time
+	// ActiveConns is the number of connections dialed by the pool that are still open
+	ActiveConns int
+	// LastError is the error of the last failed dial or health check, if any
+	LastError error
+}
+
+// NewPool creates a pool of backends reached over network (e.g. "tcp") at addrs.
+// If health checks are enabled, call Close to stop them
+func NewPool(network string, addrs []string, opts ...PoolOption) (*Pool, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("proxyproto: pool needs at least one backend")
+	}
+	var d net.Dialer
+	p := &Pool{
+		network:      network,
+		dial:         d.DialContext,
+		checkTimeout: defaultPoolHealthCheckTimeout,
+		ejectAfter:   defaultPoolEjectAfter,
+		ejectFor:     defaultPoolEjectFor,
+		done:         make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if _, ok := poolStrategyNames[p.strategy]; !ok {
+		return nil, fmt.Errorf("proxyproto: unknown pool strategy %d", int(p.strategy))
+	}
+
+	seen := make(map[string]bool, len(addrs))
+	for i, addr := range addrs {
+		if seen[addr] {
+			return nil, fmt.Errorf("proxyproto: duplicate pool backend %v", addr)
+		}
+		seen[addr] = true
+		p.backends = append(p.backends, &poolBackend{addr: addr, healthy: true})
+
+		if p.strategy == PoolSourceHash {
+			// points depend only on the address, so adding or removing a backend
+			// leaves the others where they were
+			for r := 0; r < poolHashReplicas; r++ {
+				h := crc32.ChecksumIEEE([]byte(addr + "#" + strconv.Itoa(r)))
+				p.ring = append(p.ring, poolHashPoint{hash: h, backend: i})
+			}
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+
+	if p.checkInterval > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		p.cancel = cancel
+		go p.healthCheckLoop(ctx)
+	} else {
+		close(p.done)
+	}
+	return p, nil
+}
+
+// Close stops the health checks. Connections dialed by the pool are not affected
+func (p *Pool) Close() error {
+	if p.cancel != nil {
+		p.cancel()
+	}
+	<-p.done
+	return nil
+}
+
+// Status returns the state of every backend, in the order they were given to NewPool
+func (p *Pool) Status() []PoolBackendStatus {
+	s := make([]PoolBackendStatus, len(p.backends))
+	for i, b := range p.backends {
+		b.mu.Lock()
+		s[i] = PoolBackendStatus{
+			Addr:         b.addr,
+			Healthy:      b.healthy,
+			EjectedUntil: b.ejectedUntil,
+			ActiveConns:  int(atomic.LoadInt64(&b.active)),
+			LastError:    b.lastErr,
+		}
+		b.mu.Unlock()
+	}
+	return s
+}
+
+// Dial connects to a backend picked for the client described by d, which may be nil
+// (PoolSourceHash then falls back to round-robin). If the dial fails, the other
+// available backends are tried in the order the strategy prefers them. The returned
+// connection must be closed to be counted out of PoolLeastConnections; it supports
+// CloseWrite and CloseRead when the underlying connection does, and returns
+// ErrUnsupported from them otherwise
+func (p *Pool) Dial(ctx context.Context, d *Data) (net.Conn, error) {
+	now := time.Now()
+	var err error
+	for _, i := range p.order(d, now) {
+		b := p.backends[i]
+		atomic.AddInt64(&b.active, 1)
+		c, derr := p.dial(ctx, p.network, b.addr)
+		if derr == nil {
+			b.dialed()
+			return &poolConn{Conn: c, b: b}, nil
+		}
+		atomic.AddInt64(&b.active, -1)
+		if cerr := ctx.Err(); cerr != nil {
+			return nil, cerr
+		}
+		b.dialFailed(derr, p.ejectAfter, p.ejectFor)
+		err = derr
+	}
+	if err == nil {
+		return nil, ErrNoBackends
+	}
+	return nil, fmt.Errorf("%w: %v", ErrNoBackends, err)
+}
+
+// order lists the available backends, preferred first
+func (p *Pool) order(d *Data, now time.Time) []int {
+	avail := make([]bool, len(p.backends))
+	n := 0
+	for i, b := range p.backends {
+		if avail[i] = b.available(now); avail[i] {
+			n++
+		}
+	}
+	order := make([]int, 0, n)
+	if n == 0 {
+		return order
+	}
+
+	if p.strategy == PoolSourceHash {
+		if key, ok := sourceHashKey(d); ok {
+			h := crc32.ChecksumIEEE(key)
+			start := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+			for i := 0; i < len(p.ring) && len(order) < n; i++ {
+				b := p.ring[(start+i)%len(p.ring)].backend
+				if avail[b] {
+					order = append(order, b)
+					avail[b] = false
+				}
+			}
+			return order
+		}
+	}
+
+	start := int(atomic.AddUint32(&p.next, 1) - 1)
+	for i := range p.backends {
+		if b := (start + i) % len(p.backends); avail[b] {
+			order = append(order, b)
+		}
+	}
+	if p.strategy == PoolLeastConnections {
+		// stable, so ties keep the round-robin order
+		sort.SliceStable(order, func(i, j int) bool {
+			return atomic.LoadInt64(&p.backends[order[i]].active) < atomic.LoadInt64(&p.backends[order[j]].active)
+		})
+	}
+	return order
+}
+
+// sourceHashKey gets the bytes of the client address to hash, IPv4-mapped addresses
+// hash like IPv4 ones
+func sourceHashKey(d *Data) ([]byte, bool) {
+	if d == nil {
+		return nil, false
+	}
+	if ap := d.SourceAddrPort(); ap.IsValid() {
+		return ap.Addr().AsSlice(), true
+	}
+	if d.AddressFamily == AddressFamilyUnix {
+		return trimUnixAddr(d.SourceAddr), true
+	}
+	return nil, false
+}
+
+func (p *Pool) healthCheckLoop(ctx context.Context) {
+	defer close(p.done)
+	t := time.NewTicker(p.checkInterval)
+	defer t.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, b := range p.backends {
+			wg.Add(1)
+			go func(b *poolBackend) {
+				defer wg.Done()
+				err := p.healthCheck(ctx, b)
+				if ctx.Err() == nil {
+					b.checked(err)
+				}
+			}(b)
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// healthCheck connects to b and sends a v2 LOCAL header
+func (p *Pool) healthCheck(ctx context.Context, b *poolBackend) error {
+	ctx, cancel := context.WithTimeout(ctx, p.checkTimeout)
+	defer cancel()
+	c, err := p.dial(ctx, p.network, b.addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		c.SetDeadline(dl)
+	}
+	if _, err := (&Data{Command: CommandLocal}).WriteHeader(c, Version2); err != nil {
+		return err
+	}
+	if p.check != nil {
+		return p.check(ctx, c)
+	}
+	return nil
+}
+
+func (b *poolBackend) available(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.healthy && !now.Before(b.ejectedUntil)
+}
+
+func (b *poolBackend) dialed() {
+	b.mu.Lock()
+	b.failures = 0
+	b.mu.Unlock()
+}
+
+func (b *poolBackend) dialFailed(err error, ejectAfter int, ejectFor time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastErr = err
+	b.failures++
+	if ejectAfter > 0 && b.failures >= ejectAfter {
+		b.failures = 0
+		b.ejectedUntil = time.Now().Add(ejectFor)
+	}
+}
+
+func (b *poolBackend) checked(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.healthy = err == nil
+	if err != nil {
+		b.lastErr = err
+		return
+	}
+	// a passing check ends an ejection early
+	b.failures = 0
+	b.ejectedUntil = time.Time{}
+}
+
+// poolConn counts itself out of its backend's open connections when closed
+type poolConn struct {
+	net.Conn
+	b      *poolBackend
+	closed int32 // atomic
+}
+
+func (c *poolConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		atomic.AddInt64(&c.b.active, -1)
+	}
+	return c.Conn.Close()
+}
+
+// NetConn returns the underlying connection
+func (c *poolConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// ReadFrom lets io.Copy use the underlying connection's optimizations (e.g. splice)
+func (c *poolConn) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(c.Conn, r)
+}
+
+// WriteTo lets io.Copy use the underlying connection's optimizations in the other direction
+func (c *poolConn) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, c.Conn)
+}
+
+func (c *poolConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return ErrUnsupported
+}
+
+func (c *poolConn) CloseRead() error {
+	if cr, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return cr.CloseRead()
+	}
+	return ErrUnsupported
+}
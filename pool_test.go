@@ -0,0 +1,307 @@
+package proxyproto
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDialer returns pipes instead of connecting, recording which address was dialed.
+// Addresses in down fail to dial
+type fakeDialer struct {
+	mu     sync.Mutex
+	dialed []string
+	down   map[string]bool
+}
+
+func (f *fakeDialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down[addr] {
+		return nil, fmt.Errorf("dial %v: connection refused", addr)
+	}
+	f.dialed = append(f.dialed, addr)
+	c1, c2 := net.Pipe()
+	c2.Close()
+	return c1, nil
+}
+
+func (f *fakeDialer) last() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.dialed[len(f.dialed)-1]
+}
+
+func sourceData(a, b, c, d byte) *Data {
+	return &Data{
+		AddressFamily: AddressFamilyIPv4,
+		Transport:     TransportStream,
+		SourceAddr:    []byte{a, b, c, d},
+		SourcePort:    1234,
+		DestAddr:      []byte{127, 0, 0, 1},
+		DestPort:      80,
+	}
+}
+
+func Test_Pool_roundRobin(t *testing.T) {
+	f := &fakeDialer{}
+	p, err := NewPool("tcp", []string{"a", "b", "c"}, WithPoolDialer(f.dial))
+	if err != nil {
+		t.Fatalf("NewPool() error = %v", err)
+	}
+	defer p.Close()
+
+	for i := 0; i < 6; i++ {
+		c, err := p.Dial(context.Background(), nil)
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		c.Close()
+	}
+	want := []string{"a", "b", "c", "a", "b", "c"}
+	if fmt.Sprint(f.dialed) != fmt.Sprint(want) {
+		t.Fatalf("dialed %v, want %v", f.dialed, want)
+	}
+}
+
+func Test_Pool_leastConnections(t *testing.T) {
+	f := &fakeDialer{}
+	p, err := NewPool("tcp", []string{"a", "b", "c"}, WithPoolDialer(f.dial), WithPoolStrategy(PoolLeastConnections))
+	if err != nil {
+		t.Fatalf("NewPool() error = %v", err)
+	}
+	defer p.Close()
+
+	var open []net.Conn
+	for i := 0; i < 3; i++ {
+		c, err := p.Dial(context.Background(), nil)
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		open = append(open, c)
+	}
+	// close the connection to b twice, it must only be counted out once
+	open[1].Close()
+	open[1].Close()
+
+	c, err := p.Dial(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer c.Close()
+	if got := f.last(); got != "b" {
+		t.Fatalf("dialed %v, want %v", got, "b")
+	}
+	if s := p.Status(); s[0].ActiveConns != 1 || s[1].ActiveConns != 1 || s[2].ActiveConns != 1 {
+		t.Fatalf("Status() = %+v", s)
+	}
+}
+
+func Test_Pool_sourceHash(t *testing.T) {
+	f := &fakeDialer{down: map[string]bool{}}
+	addrs := []string{"a", "b", "c", "d"}
+	p, err := NewPool("tcp", addrs, WithPoolDialer(f.dial), WithPoolStrategy(PoolSourceHash), WithPoolEjection(1, time.Hour))
+	if err != nil {
+		t.Fatalf("NewPool() error = %v", err)
+	}
+	defer p.Close()
+
+	pick := func(d *Data) string {
+		t.Helper()
+		c, err := p.Dial(context.Background(), d)
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		c.Close()
+		return f.last()
+	}
+
+	before := make(map[int]string)
+	used := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		d := sourceData(10, 0, byte(i), 1)
+		before[i] = pick(d)
+		used[before[i]] = true
+		if again := pick(d); again != before[i] {
+			t.Fatalf("client %d moved from %v to %v", i, before[i], again)
+		}
+	}
+	if len(used) != len(addrs) {
+		t.Fatalf("only backends %v were used", used)
+	}
+
+	// IPv4-mapped addresses are the same client
+	mapped := sourceData(10, 0, 7, 1)
+	mapped.AddressFamily = AddressFamilyIPv6
+	mapped.SourceAddr = append(v4InV6Prefix[:], 10, 0, 7, 1)
+	mapped.DestAddr = make([]byte, 16)
+	if got := pick(mapped); got != before[7] {
+		t.Fatalf("mapped client picked %v, want %v", got, before[7])
+	}
+
+	// Only the clients of an ejected backend move
+	f.down["b"] = true
+	for i := 0; i < 200; i++ {
+		got := pick(sourceData(10, 0, byte(i), 1))
+		if got == "b" || (before[i] != "b" && got != before[i]) {
+			t.Fatalf("client %d moved from %v to %v", i, before[i], got)
+		}
+	}
+	if s := p.Status(); s[1].EjectedUntil.IsZero() || s[1].LastError == nil {
+		t.Fatalf("Status() = %+v, want b ejected", s[1])
+	}
+}
+
+func Test_Pool_ejection(t *testing.T) {
+	f := &fakeDialer{down: map[string]bool{"a": true}}
+	p, err := NewPool("tcp", []string{"a", "b"}, WithPoolDialer(f.dial), WithPoolEjection(2, time.Hour))
+	if err != nil {
+		t.Fatalf("NewPool() error = %v", err)
+	}
+	defer p.Close()
+
+	// Failed dials move on to the next backend
+	for i := 0; i < 4; i++ {
+		c, err := p.Dial(context.Background(), nil)
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		c.Close()
+	}
+	if s := p.Status(); s[0].EjectedUntil.IsZero() {
+		t.Fatalf("Status() = %+v, want a ejected", s[0])
+	}
+
+	f.down["b"] = true
+	if _, err := p.Dial(context.Background(), nil); !errors.Is(err, ErrNoBackends) {
+		t.Fatalf("Dial() error = %v, want %v", err, ErrNoBackends)
+	}
+}
+
+func Test_Pool_healthCheck(t *testing.T) {
+	l, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer l.Close()
+	checks := make(chan *Data, 8)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			checks <- c.(*Conn).ProxyData()
+			c.Close()
+		}
+	}()
+
+	// Nothing listens on a closed listener's address
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	dead.Close()
+
+	p, err := NewPool("tcp", []string{l.Addr().String(), dead.Addr().String()}, WithPoolHealthCheck(20*time.Millisecond, time.Second, nil))
+	if err != nil {
+		t.Fatalf("NewPool() error = %v", err)
+	}
+	defer p.Close()
+
+	select {
+	case d := <-checks:
+		if d.Version != Version2 || d.Command != CommandLocal {
+			t.Fatalf("health check sent %v, want a v2 LOCAL header", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no health check received")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Status()[1].Healthy {
+		if time.Now().After(deadline) {
+			t.Fatalf("Status() = %+v, want the closed address unhealthy", p.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 3; i++ {
+		c, err := p.Dial(context.Background(), nil)
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		if got := c.RemoteAddr().String(); got != l.Addr().String() {
+			t.Fatalf("Dial() connected to %v, want %v", got, l.Addr())
+		}
+		c.Close()
+	}
+}
+
+func Test_Pool_connCopy(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+
+	p, err := NewPool("tcp", []string{l.Addr().String()})
+	if err != nil {
+		t.Fatalf("NewPool() error = %v", err)
+	}
+	defer p.Close()
+	c, err := p.Dial(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer c.Close()
+
+	// both directions reach the underlying connection, so io.Copy can splice
+	n, err := c.(io.ReaderFrom).ReadFrom(strings.NewReader("hello"))
+	if err != nil || n != 5 {
+		t.Fatalf("ReadFrom() = %v, %v, want 5", n, err)
+	}
+	c.(interface{ CloseWrite() error }).CloseWrite()
+	var buf bytes.Buffer
+	n, err = c.(io.WriterTo).WriteTo(&buf)
+	if err != nil || n != 5 || buf.String() != "hello" {
+		t.Fatalf("WriteTo() = %v, %q, %v, want 5, %q", n, buf.String(), err, "hello")
+	}
+}
+
+func Test_PoolStrategy_text(t *testing.T) {
+	for _, s := range []PoolStrategy{PoolRoundRobin, PoolLeastConnections, PoolSourceHash} {
+		b, err := s.MarshalText()
+		if err != nil {
+			t.Fatalf("MarshalText() error = %v", err)
+		}
+		var got PoolStrategy
+		if err := got.UnmarshalText(b); err != nil || got != s {
+			t.Fatalf("UnmarshalText(%q) = %v, %v, want %v", b, got, err, s)
+		}
+	}
+	var s PoolStrategy
+	if err := s.UnmarshalText([]byte("random")); err == nil {
+		t.Fatalf("UnmarshalText() accepted an unknown strategy")
+	}
+	if _, err := NewPool("tcp", []string{"a"}, WithPoolStrategy(7)); err == nil {
+		t.Fatalf("NewPool() accepted an unknown strategy")
+	}
+	if _, err := NewPool("tcp", nil); err == nil {
+		t.Fatalf("NewPool() accepted no backends")
+	}
+}
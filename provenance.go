@@ -0,0 +1,207 @@
+package proxyproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultProvenanceTLVType is the custom TLV type that carries the hops unless
+	// WithProvenanceTLVType says otherwise
+	DefaultProvenanceTLVType = TLVTypeMinCustom + 1
+
+	defaultProvenanceMaxHops = 16
+	maxHopIDLen              = 0xff
+)
+
+// ErrTooManyHops is matched (using errors.Is) by the error Data.AppendHop and Data.Hops
+// return when the provenance TLV holds more hops than the maximum, which may mean
+// proxies are forwarding in a loop
+var ErrTooManyHops = errors.New("proxyproto: too many hops")
+
+// Hop is a proxy that a connection passed through, as recorded in the provenance TLV.
+// Each proxy appends itself, so the hops of a header list the proxies between the
+// client (the header's source) and the last proxy, in order, much like the Forwarded
+// header does for HTTP.
+//
+// The TLV value is a sequence of hops, each encoded as the length of the address (0, 4
+// or 16), the address, the port (only if there is an address) as 2 bytes, the time in
+// nanoseconds since the Unix epoch (0 if unknown) as 8 bytes, the length of the ID and
+// the ID. Numbers are big-endian
+type Hop struct {
+	// Addr is the address the proxy accepted the connection on, if known
+	Addr netip.AddrPort
+	// Time is when the proxy accepted the connection, if known
+	Time time.Time
+	// ID optionally identifies the proxy, in at most 255 bytes
+	ID string
+}
+
+// String formats the hop for logs as its address, ID and time, leaving out those that
+// are not known, e.g. "10.0.0.1:443 edge-1 2006-01-02T15:04:05.999Z"
+func (h Hop) String() string {
+	var parts []string
+	if h.Addr.IsValid() {
+		parts = append(parts, h.Addr.String())
+	}
+	if h.ID != "" {
+		parts = append(parts, h.ID)
+	}
+	if !h.Time.IsZero() {
+		parts = append(parts, h.Time.UTC().Format(time.RFC3339Nano))
+	}
+	return strings.Join(parts, " ")
+}
+
+// ProvenanceOption configures the provenance TLV
+type ProvenanceOption func(*provenanceConfig)
+
+type provenanceConfig struct {
+	tlvType TLVType
+	maxHops int
+}
+
+// WithProvenanceTLVType sets the TLV type carrying the hops, which must be in the custom
+// range TLVTypeMinCustom to TLVTypeMaxCustom. Every proxy and backend must agree on it.
+// It is DefaultProvenanceTLVType by default
+func WithProvenanceTLVType(t TLVType) ProvenanceOption {
+	return func(c *provenanceConfig) {
+		c.tlvType = t
+	}
+}
+
+// WithProvenanceMaxHops sets the maximum number of hops, which must be at least 1. It
+// is 16 by default
+func WithProvenanceMaxHops(n int) ProvenanceOption {
+	return func(c *provenanceConfig) {
+		c.maxHops = n
+	}
+}
+
+// newProvenanceConfig applies opts to the defaults and checks the result
+func newProvenanceConfig(opts []ProvenanceOption) (*provenanceConfig, error) {
+	c := &provenanceConfig{
+		tlvType: DefaultProvenanceTLVType,
+		maxHops: defaultProvenanceMaxHops,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.tlvType < TLVTypeMinCustom || c.tlvType > TLVTypeMaxCustom {
+		return nil, fmt.Errorf("proxyproto: provenance TLV type must be in the custom range %v-%v, got %v", TLVTypeMinCustom, TLVTypeMaxCustom, c.tlvType)
+	}
+	if c.maxHops < 1 {
+		return nil, fmt.Errorf("proxyproto: maximum number of hops must be at least 1, got %v", c.maxHops)
+	}
+	return c, nil
+}
+
+// AppendHop adds a hop to the end of the provenance TLV, creating the TLV if needed.
+// A proxy calls it with its own address and ID before forwarding a header it received.
+// It fails with ErrTooManyHops if the TLV already holds the maximum number of hops
+func (d *Data) AppendHop(h Hop, opts ...ProvenanceOption) error {
+	c, err := newProvenanceConfig(opts)
+	if err != nil {
+		return err
+	}
+	if len(h.ID) > maxHopIDLen {
+		return fmt.Errorf("proxyproto: hop ID must be at most %v bytes, got %v", maxHopIDLen, len(h.ID))
+	}
+	if h.Addr.Addr().Zone() != "" {
+		return fmt.Errorf("proxyproto: hop address cannot carry an IPv6 zone, got %v", h.Addr)
+	}
+	v, _ := d.TLV(c.tlvType)
+	hops, err := decodeHops(v, c.maxHops)
+	if err != nil {
+		return err
+	}
+	if len(hops) == c.maxHops {
+		return fmt.Errorf("%w: the provenance TLV already has the maximum of %v", ErrTooManyHops, c.maxHops)
+	}
+
+	nv := appendHop(append([]byte{}, v...), h)
+	if len(nv) > maxTLVLen {
+		return fmt.Errorf("proxyproto: provenance TLV would be %v bytes, max is %v", len(nv), maxTLVLen)
+	}
+	d.setTLV(c.tlvType, nv)
+	return nil
+}
+
+// Hops decodes the provenance TLV, oldest hop first. It returns nil and no error if the
+// TLV is not present, and fails with ErrTooManyHops if there are more hops than the
+// maximum
+func (d *Data) Hops(opts ...ProvenanceOption) ([]Hop, error) {
+	c, err := newProvenanceConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := d.TLV(c.tlvType)
+	if !ok {
+		return nil, nil
+	}
+	return decodeHops(v, c.maxHops)
+}
+
+// appendHop appends the encoding of a hop to b
+func appendHop(b []byte, h Hop) []byte {
+	if h.Addr.IsValid() {
+		a := h.Addr.Addr().Unmap().AsSlice()
+		b = append(b, byte(len(a)))
+		b = append(b, a...)
+		b = append(b, byte(h.Addr.Port()>>8), byte(h.Addr.Port()))
+	} else {
+		b = append(b, 0)
+	}
+	var ns int64
+	if !h.Time.IsZero() {
+		ns = h.Time.UnixNano()
+	}
+	var t [8]byte
+	binary.BigEndian.PutUint64(t[:], uint64(ns))
+	b = append(b, t[:]...)
+	b = append(b, byte(len(h.ID)))
+	return append(b, h.ID...)
+}
+
+// decodeHops decodes the value of a provenance TLV holding at most max hops
+func decodeHops(v []byte, max int) ([]Hop, error) {
+	var hops []Hop
+	for len(v) > 0 {
+		if len(hops) == max {
+			return nil, fmt.Errorf("%w: the provenance TLV has more than the maximum of %v", ErrTooManyHops, max)
+		}
+		var h Hop
+		alen := int(v[0])
+		if alen != 0 && alen != 4 && alen != 16 {
+			return nil, fmt.Errorf("proxyproto: invalid provenance TLV: hop %v has a %v byte address", len(hops), alen)
+		}
+		v = v[1:]
+		if alen > 0 {
+			if len(v) < alen+2 {
+				return nil, fmt.Errorf("proxyproto: invalid provenance TLV: hop %v is truncated", len(hops))
+			}
+			a, _ := netip.AddrFromSlice(v[:alen])
+			h.Addr = netip.AddrPortFrom(a, binary.BigEndian.Uint16(v[alen:]))
+			v = v[alen+2:]
+		}
+		if len(v) < 9 {
+			return nil, fmt.Errorf("proxyproto: invalid provenance TLV: hop %v is truncated", len(hops))
+		}
+		if ns := int64(binary.BigEndian.Uint64(v)); ns != 0 {
+			h.Time = time.Unix(0, ns).UTC()
+		}
+		idLen := int(v[8])
+		v = v[9:]
+		if len(v) < idLen {
+			return nil, fmt.Errorf("proxyproto: invalid provenance TLV: hop %v is truncated", len(hops))
+		}
+		h.ID = string(v[:idLen])
+		v = v[idLen:]
+		hops = append(hops, h)
+	}
+	return hops, nil
+}
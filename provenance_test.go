@@ -0,0 +1,122 @@
+package proxyproto
+
+import (
+	"errors"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Data_Hops(t *testing.T) {
+	// a header received from the first hop, which already added itself
+	first := Hop{
+		Addr: netip.MustParseAddrPort("[::ffff:10.0.0.1]:443"),
+		Time: time.Date(2026, 10, 18, 12, 0, 0, 123456789, time.UTC),
+		ID:   "edge-1",
+	}
+	b := v2TestHeader(true,
+		appendTLV(nil, byte(DefaultProvenanceTLVType), appendHop(nil, first)),
+		appendTLV(nil, byte(TLVTypeAuthority), []byte("example.com")))
+	received, _, err := ParseBytes(b)
+	if err != nil {
+		t.Fatalf("ParseBytes() error = %v", err)
+	}
+
+	// the second hop adds itself and forwards the header
+	second := Hop{Addr: netip.MustParseAddrPort("[2001:db8::2]:8443")}
+	if err := received.AppendHop(second); err != nil {
+		t.Fatalf("AppendHop() error = %v", err)
+	}
+	third := Hop{ID: "internal"}
+	if err := received.AppendHop(third); err != nil {
+		t.Fatalf("AppendHop() error = %v", err)
+	}
+	b, err = received.AppendHeader(nil, Version2)
+	if err != nil {
+		t.Fatalf("AppendHeader() error = %v", err)
+	}
+	backend, _, err := ParseBytes(b)
+	if err != nil {
+		t.Fatalf("ParseBytes() error = %v", err)
+	}
+
+	hops, err := backend.Hops()
+	first.Addr = netip.MustParseAddrPort("10.0.0.1:443")
+	want := []Hop{first, second, third}
+	if err != nil || !reflect.DeepEqual(hops, want) {
+		t.Fatalf("Hops() = %v, %v, want %v", hops, err, want)
+	}
+	var types []TLVType
+	for it := backend.TLVIterator(); it.Next(); {
+		types = append(types, it.Type())
+	}
+	if !reflect.DeepEqual(types, []TLVType{DefaultProvenanceTLVType, TLVTypeAuthority}) {
+		t.Fatalf("TLV order = %v, want the received order", types)
+	}
+	if got := hops[0].String(); got != "10.0.0.1:443 edge-1 2026-10-18T12:00:00.123456789Z" {
+		t.Fatalf("String() = %q", got)
+	}
+
+	if hops, err := backend.Hops(WithProvenanceTLVType(0xef)); hops != nil || err != nil {
+		t.Fatalf("Hops() of another type = %v, %v, want nothing", hops, err)
+	}
+}
+
+func Test_Data_Hops_limits(t *testing.T) {
+	d := &Data{}
+	for i := 0; i < 3; i++ {
+		if err := d.AppendHop(Hop{ID: "hop"}, WithProvenanceMaxHops(3)); err != nil {
+			t.Fatalf("AppendHop() error = %v", err)
+		}
+	}
+	if err := d.AppendHop(Hop{ID: "hop"}, WithProvenanceMaxHops(3)); !errors.Is(err, ErrTooManyHops) {
+		t.Fatalf("AppendHop() error = %v, want %v", err, ErrTooManyHops)
+	}
+	if _, err := d.Hops(WithProvenanceMaxHops(2)); !errors.Is(err, ErrTooManyHops) {
+		t.Fatalf("Hops() error = %v, want %v", err, ErrTooManyHops)
+	}
+	if hops, err := d.Hops(); err != nil || len(hops) != 3 {
+		t.Fatalf("Hops() = %v, %v", hops, err)
+	}
+
+	invalid := []struct {
+		name  string
+		value []byte
+	}{
+		{name: "address length", value: []byte{5, 1, 2, 3, 4, 5, 0, 0}},
+		{name: "truncated address", value: []byte{4, 1, 2, 3, 4, 0}},
+		{name: "truncated time", value: []byte{0, 0, 0, 0, 0, 0, 0, 0}},
+		{name: "truncated ID", value: []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 2, 'a'}},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Data{TLVs: map[TLVType][]byte{DefaultProvenanceTLVType: tt.value}}
+			if hops, err := d.Hops(); err == nil {
+				t.Fatalf("Hops() = %v, want an error", hops)
+			}
+			if err := d.AppendHop(Hop{}); err == nil {
+				t.Fatalf("AppendHop() succeeded")
+			}
+		})
+	}
+
+	if err := d.AppendHop(Hop{ID: strings.Repeat("x", 256)}); err == nil {
+		t.Fatalf("AppendHop() accepted a long ID")
+	}
+	if err := d.AppendHop(Hop{Addr: netip.MustParseAddrPort("[fe80::1%eth0]:443")}); err == nil {
+		t.Fatalf("AppendHop() accepted a zone")
+	}
+	if err := d.AppendHop(Hop{}, WithProvenanceTLVType(TLVTypeSSL)); err == nil {
+		t.Fatalf("AppendHop() accepted a type outside the custom range")
+	}
+	for _, n := range []int{0, -1} {
+		if err := d.AppendHop(Hop{}, WithProvenanceMaxHops(n)); err == nil || errors.Is(err, ErrTooManyHops) {
+			t.Fatalf("AppendHop() with a maximum of %v hops error = %v, want an invalid option", n, err)
+		}
+		if _, err := d.Hops(WithProvenanceMaxHops(n)); err == nil || errors.Is(err, ErrTooManyHops) {
+			t.Fatalf("Hops() with a maximum of %v hops error = %v, want an invalid option", n, err)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package proxyproto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// relayBufSize is the size of the copy buffers used when an idle timeout is set
+const relayBufSize = 32 * 1024
+
+// RelayOptions configures Relay
+type RelayOptions struct {
+	// Version is the header version sent to the backend, v2 if zero
+	Version Version
+	// Data overrides the header sent to the backend. If nil, the header describes the
+	// client connection (see Relay)
+	Data *Data
+	// TLVs are added to the header, replacing any TLV of the same type. They are
+	// dropped for v1 headers
+	TLVs map[TLVType][]byte
+	// IdleTimeout ends the relay once neither direction has transferred any data for
+	// this long. Zero means no timeout
+	IdleTimeout time.Duration
+}
+
+// RelayStats reports how much data Relay transferred
+type RelayStats struct {
+	// HeaderBytes is the size of the header written to the backend
+	HeaderBytes int
+	// ClientToBackend is the number of bytes copied from the client to the backend,
+	// not including the header
+	ClientToBackend int64
+	// BackendToClient is the number of bytes copied from the backend to the client
+	BackendToClient int64
+}
+
+// Relay writes a Proxy Protocol header describing client to backend, then copies data
+// in both directions until both sides are done, and closes both connections.
+//
+// If client carries proxy data (see DataFromConn) with an address, such as a *Conn
+// accepted from an upstream proxy, the header repeats its source, destination and
+// TLVs so that headers chain correctly. Otherwise the header is built from the client's
+// remote (source) and local (destination) addresses, falling back to an unspec/UNKNOWN
+// header if those are not TCP, UDP or Unix addresses.
+//
+// When one side finishes sending, the write half of the other connection is closed
+// (if it has a CloseWrite method that does not return ErrUnsupported) so the half-close
+// is passed on, otherwise that connection is closed. If a copy fails, both
+// connections are closed. If IdleTimeout passes without traffic, the returned error
+// matches os.ErrDeadlineExceeded. If ctx is cancelled, both connections are closed
+// and ctx.Err() is returned. A clean shutdown returns a nil error
+func Relay(ctx context.Context, client, backend net.Conn, opts RelayOptions) (RelayStats, error) {
+	var stats RelayStats
+	defer client.Close()
+	defer backend.Close()
+
+	d := opts.Data
+	if d == nil {
+		d = relayData(client)
+	}
+	if len(opts.TLVs) > 0 {
+		d = d.Clone()
+		for t, v := range opts.TLVs {
+			if err := d.SetTLV(t, v); err != nil {
+				return stats, err
+			}
+		}
+	}
+	v := opts.Version
+	if v == 0 {
+		v = Version2
+	}
+
+	// Closing both connections unblocks every pending read and write
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			client.Close()
+			backend.Close()
+		case <-stop:
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	n, err := d.WriteHeader(backend, v)
+	stats.HeaderBytes = n
+	if err != nil {
+		if cerr := ctx.Err(); cerr != nil {
+			return stats, cerr
+		}
+		return stats, fmt.Errorf("failed to write proxy protocol header: %w", err)
+	}
+
+	r := relay{idle: opts.IdleTimeout, last: time.Now().UnixNano()}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		stats.ClientToBackend = r.copy(backend, client)
+	}()
+	go func() {
+		defer wg.Done()
+		stats.BackendToClient = r.copy(client, backend)
+	}()
+	wg.Wait()
+
+	if cerr := ctx.Err(); cerr != nil {
+		return stats, cerr
+	}
+	return stats, r.err
+}
+
+// relayData builds the header for a relayed connection, see Relay
+func relayData(client net.Conn) *Data {
+	if d, ok := DataFromConn(client); ok && d.Command == CommandProxy && d.AddressFamily != AddressFamilyLocal {
+		d = d.Clone()
+		d.Version = 0
+		return d
+	}
+	d, err := dataFromAddrs(client.RemoteAddr(), client.LocalAddr())
+	if err != nil {
+		return &Data{}
+	}
+	return d
+}
+
+// relay holds the state shared by both copy directions of Relay
+type relay struct {
+	idle time.Duration
+	last int64 // unix nanoseconds of the last transfer in either direction, atomic
+
+	mu     sync.Mutex
+	closed bool  // a connection was closed for lack of half-close, later errors are expected
+	err    error // first copy error
+}
+
+// copy copies src to dst and passes the end of the stream on as a half-close.
+// On failure both connections are closed and the first error is kept
+func (r *relay) copy(dst, src net.Conn) int64 {
+	var n int64
+	var err error
+	if r.idle > 0 {
+		n, err = r.copyIdle(dst, src)
+	} else {
+		n, err = io.Copy(dst, src)
+	}
+
+	if err == nil {
+		if err := closeWrite(dst); err == nil {
+			return n
+		}
+		// no half-close, the other direction cannot be finished cleanly
+		r.mu.Lock()
+		r.closed = true
+		r.mu.Unlock()
+		dst.Close()
+		return n
+	}
+
+	r.mu.Lock()
+	if r.err == nil && !r.closed {
+		r.err = err
+	}
+	r.mu.Unlock()
+	src.Close()
+	dst.Close()
+	return n
+}
+
+// closeWrite closes the write half of c, returning ErrUnsupported if c cannot
+// half-close. A *Conn or pooled connection always has CloseWrite, so the method
+// alone does not tell whether the connection it wraps supports it
+func closeWrite(c net.Conn) error {
+	cw, ok := c.(interface{ CloseWrite() error })
+	if !ok {
+		return ErrUnsupported
+	}
+	return cw.CloseWrite()
+}
+
+// copyIdle copies src to dst, failing once neither direction has transferred data
+// for the idle timeout
+func (r *relay) copyIdle(dst, src net.Conn) (int64, error) {
+	buf := make([]byte, relayBufSize)
+	var written int64
+	for {
+		src.SetReadDeadline(time.Now().Add(r.idle))
+		nr, rerr := src.Read(buf)
+		if nr > 0 {
+			atomic.StoreInt64(&r.last, time.Now().UnixNano())
+			dst.SetWriteDeadline(time.Now().Add(r.idle))
+			nw, werr := dst.Write(buf[:nr])
+			written += int64(nw)
+			if werr != nil {
+				return written, r.idleErr(werr)
+			}
+			atomic.StoreInt64(&r.last, time.Now().UnixNano())
+		}
+		if rerr == io.EOF {
+			return written, nil
+		}
+		if rerr != nil {
+			// the other direction may still be busy
+			if errors.Is(rerr, os.ErrDeadlineExceeded) && time.Since(time.Unix(0, atomic.LoadInt64(&r.last))) < r.idle {
+				continue
+			}
+			return written, r.idleErr(rerr)
+		}
+	}
+}
+
+func (r *relay) idleErr(err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return fmt.Errorf("proxy protocol relay was idle for %v: %w", r.idle, os.ErrDeadlineExceeded)
+	}
+	return err
+}
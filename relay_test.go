@@ -0,0 +1,247 @@
+package proxyproto
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	dialed, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	c := <-accepted
+	if c == nil {
+		t.Fatalf("Accept() failed")
+	}
+	t.Cleanup(func() {
+		dialed.Close()
+		c.Close()
+	})
+	return dialed, c
+}
+
+type relayResult struct {
+	stats RelayStats
+	err   error
+}
+
+func startRelay(ctx context.Context, client, backend net.Conn, opts RelayOptions) <-chan relayResult {
+	ch := make(chan relayResult, 1)
+	go func() {
+		stats, err := Relay(ctx, client, backend, opts)
+		ch <- relayResult{stats, err}
+	}()
+	return ch
+}
+
+func Test_Relay(t *testing.T) {
+	client, proxyIn := tcpPair(t)
+	proxyOut, backend := tcpPair(t)
+
+	res := startRelay(context.Background(), proxyIn, proxyOut, RelayOptions{
+		TLVs: map[TLVType][]byte{TLVTypeAuthority: []byte("example.com")},
+	})
+
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	client.(*net.TCPConn).CloseWrite()
+
+	bc, err := WrapConn(backend)
+	if err != nil {
+		t.Fatalf("WrapConn() error = %v", err)
+	}
+	d := bc.ProxyData()
+	if d.Version != Version2 || d.Source().String() != client.LocalAddr().String() || d.Dest().String() != proxyIn.LocalAddr().String() {
+		t.Fatalf("ProxyData() = %v, want %v -> %v", d, client.LocalAddr(), proxyIn.LocalAddr())
+	}
+	if a, _ := d.TLVGetAuthority(); a != "example.com" {
+		t.Fatalf("TLVGetAuthority() = %q, want %q", a, "example.com")
+	}
+
+	// The client's half-close reaches the backend, which can still answer
+	got, err := io.ReadAll(bc)
+	if err != nil || string(got) != "hello" {
+		t.Fatalf("backend ReadAll() = %q, %v, want %q", got, err, "hello")
+	}
+	bc.Write([]byte("world!"))
+	bc.Close()
+
+	got, err = io.ReadAll(client)
+	if err != nil || string(got) != "world!" {
+		t.Fatalf("client ReadAll() = %q, %v, want %q", got, err, "world!")
+	}
+
+	r := <-res
+	if r.err != nil {
+		t.Fatalf("Relay() error = %v", r.err)
+	}
+	if r.stats.ClientToBackend != 5 || r.stats.BackendToClient != 6 || r.stats.HeaderBytes != 16+12+3+len("example.com") {
+		t.Fatalf("Relay() stats = %+v", r.stats)
+	}
+}
+
+func Test_Relay_noHalfClose(t *testing.T) {
+	client, proxyIn := tcpPair(t)
+	backend, server := net.Pipe()
+	go backend.Write([]byte("PROXY UNKNOWN\r\n"))
+	// a *Conn over a pipe has CloseWrite but returns ErrUnsupported
+	proxyOut, err := WrapConn(server)
+	if err != nil {
+		t.Fatalf("WrapConn() error = %v", err)
+	}
+
+	res := startRelay(context.Background(), proxyIn, proxyOut, RelayOptions{Version: Version1})
+	client.Write([]byte("hello"))
+	client.(*net.TCPConn).CloseWrite()
+
+	got, err := io.ReadAll(backend)
+	if err != nil || !strings.HasSuffix(string(got), "hello") {
+		t.Fatalf("backend ReadAll() = %q, %v, want a header and %q", got, err, "hello")
+	}
+	r := <-res
+	if r.err != nil {
+		t.Fatalf("Relay() error = %v", r.err)
+	}
+}
+
+func Test_Relay_chained(t *testing.T) {
+	client, proxyIn := tcpPair(t)
+	proxyOut, backend := tcpPair(t)
+
+	go func() {
+		client.Write([]byte("PROXY TCP4 10.20.30.40 40.30.20.10 8000 9000\r\nping"))
+		client.(*net.TCPConn).CloseWrite()
+	}()
+	in, err := WrapConn(proxyIn)
+	if err != nil {
+		t.Fatalf("WrapConn() error = %v", err)
+	}
+	res := startRelay(context.Background(), in, proxyOut, RelayOptions{Version: Version1})
+
+	bc, err := WrapConn(backend)
+	if err != nil {
+		t.Fatalf("WrapConn() error = %v", err)
+	}
+	if !bc.ProxyData().Equal(in.ProxyData()) {
+		t.Fatalf("ProxyData() = %v, want %v", bc.ProxyData(), in.ProxyData())
+	}
+	got, _ := io.ReadAll(bc)
+	if string(got) != "ping" {
+		t.Fatalf("ReadAll() = %q, want %q", got, "ping")
+	}
+	bc.Close()
+
+	if r := <-res; r.err != nil || r.stats.ClientToBackend != 4 {
+		t.Fatalf("Relay() = %+v, %v", r.stats, r.err)
+	}
+}
+
+func Test_Relay_idleTimeout(t *testing.T) {
+	_, proxyIn := tcpPair(t)
+	proxyOut, backend := tcpPair(t)
+	go io.Copy(io.Discard, backend)
+
+	res := startRelay(context.Background(), proxyIn, proxyOut, RelayOptions{IdleTimeout: 50 * time.Millisecond})
+	select {
+	case r := <-res:
+		if !errors.Is(r.err, os.ErrDeadlineExceeded) {
+			t.Fatalf("Relay() error = %v, want %v", r.err, os.ErrDeadlineExceeded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Relay() did not time out")
+	}
+}
+
+func Test_Relay_cancel(t *testing.T) {
+	_, proxyIn := tcpPair(t)
+	proxyOut, backend := tcpPair(t)
+	go io.Copy(io.Discard, backend)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	res := startRelay(ctx, proxyIn, proxyOut, RelayOptions{})
+	cancel()
+	select {
+	case r := <-res:
+		if !errors.Is(r.err, context.Canceled) {
+			t.Fatalf("Relay() error = %v, want %v", r.err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Relay() did not stop")
+	}
+}
+
+func Test_dataFromAddrs(t *testing.T) {
+	tests := []struct {
+		name string
+		src  net.Addr
+		dest net.Addr
+		want *Data
+	}{
+		{
+			name: "tcp4",
+			src:  &net.TCPAddr{IP: net.IPv4(10, 20, 30, 40), Port: 8000},
+			dest: &net.TCPAddr{IP: net.IPv4(40, 30, 20, 10), Port: 9000},
+			want: &Data{
+				AddressFamily: AddressFamilyIPv4,
+				Transport:     TransportStream,
+				SourceAddr:    []byte{10, 20, 30, 40},
+				SourcePort:    8000,
+				DestAddr:      []byte{40, 30, 20, 10},
+				DestPort:      9000,
+			},
+		},
+		{
+			name: "unixgram",
+			src:  &net.UnixAddr{Name: "/tmp/a", Net: "unixgram"},
+			dest: &net.UnixAddr{Name: "/tmp/b", Net: "unixgram"},
+			want: &Data{
+				AddressFamily: AddressFamilyUnix,
+				Transport:     TransportDgram,
+				SourceAddr:    []byte("/tmp/a"),
+				DestAddr:      []byte("/tmp/b"),
+			},
+		},
+		{
+			name: "zone",
+			src:  &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 8000, Zone: "eth0"},
+			dest: &net.TCPAddr{IP: net.ParseIP("fe80::2"), Port: 9000},
+		},
+		{
+			name: "mixed",
+			src:  &net.TCPAddr{IP: net.IPv4(10, 20, 30, 40), Port: 8000},
+			dest: &net.UDPAddr{IP: net.IPv4(40, 30, 20, 10), Port: 9000},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := dataFromAddrs(tt.src, tt.dest)
+			if (err != nil) != (tt.want == nil) {
+				t.Fatalf("dataFromAddrs() error = %v, want error %v", err, tt.want == nil)
+			}
+			if tt.want != nil && !got.Equal(tt.want) {
+				t.Fatalf("dataFromAddrs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package proxyproto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+)
+
+// Rewrite holds the rules a proxy applies to the header it received before sending it
+// on to the next hop, for example to translate v1 to v2, add its own TLVs or strip
+// untrusted ones. The zero value passes headers through unchanged
+type Rewrite struct {
+	// Version forces the version of the outbound header. Zero keeps the inbound version
+	// (v2 for data that was not parsed). v1 headers cannot carry TLVs, so forcing v1
+	// drops the inbound ones
+	Version Version
+	// Dest overrides the destination address and port, if valid. The header must be a
+	// PROXY header for IPv4 or IPv6
+	Dest netip.AddrPort
+	// AllowTLVs, if not nil, lists the inbound TLV types to keep; all others are removed
+	AllowTLVs []TLVType
+	// RemoveTLVs lists inbound TLV types to remove
+	RemoveTLVs []TLVType
+	// SetTLVs adds TLVs. Inbound TLVs of the same type are replaced where they were,
+	// and the others are added after the inbound TLVs in ascending type order. The
+	// checksum of a CRC32C TLV is computed when encoding, so set it to any 4 bytes
+	SetTLVs map[TLVType][]byte
+}
+
+// Apply applies the rules to the inbound data d. Kept TLVs stay in the order they were
+// received in unless the TLVs map of d was changed after parsing, in which case they
+// are taken from the map, see Data.TLVIterator. A CRC32C TLV is recomputed when the
+// header is encoded. If the rules change nothing, d itself is returned
+func (r *Rewrite) Apply(d *Data) (*Data, error) {
+	changed := false
+
+	v := d.Version
+	if r.Version != 0 && r.Version != v {
+		v = r.Version
+		changed = true
+	}
+	if v == Version1 && len(r.SetTLVs) > 0 {
+		return nil, errors.New("proxyproto: v1 headers cannot carry TLVs")
+	}
+
+	var dest *Data
+	if r.Dest.IsValid() {
+		if d.Command != CommandProxy || (d.AddressFamily != AddressFamilyIPv4 && d.AddressFamily != AddressFamilyIPv6) {
+			return nil, fmt.Errorf("proxyproto: cannot override the destination of a %v header for %v addresses", d.Command, d.AddressFamily)
+		}
+		if cur := d.DestAddrPort(); cur.Addr().Unmap() != r.Dest.Addr().Unmap() || cur.Port() != r.Dest.Port() {
+			var err error
+			if dest, err = NewData(d.Transport, d.SourceAddrPort(), r.Dest); err != nil {
+				return nil, err
+			}
+			changed = true
+		}
+	}
+
+	var tlvs []byte
+	if v != Version1 {
+		var tlvsChanged bool
+		tlvs, tlvsChanged = r.rewriteTLVs(d)
+		changed = changed || tlvsChanged
+	} else if d.hasTLVs() {
+		changed = true
+	}
+	if !changed {
+		return d, nil
+	}
+
+	out := d.Clone()
+	out.Version = v
+	if dest != nil {
+		out.AddressFamily = dest.AddressFamily
+		out.SourceAddr = dest.SourceAddr
+		out.DestAddr = dest.DestAddr
+		out.DestPort = dest.DestPort
+	}
+	out.raw = nil
+	out.rawTLVs = nil
+	out.TLVs = nil
+	if len(tlvs) > 0 {
+		out.rawTLVs = tlvs
+	}
+	return out, nil
+}
+
+// rewriteTLVs builds the outbound TLVs of d from its current TLVs, as Data.TLVIterator
+// walks them, and reports whether they differ
+func (r *Rewrite) rewriteTLVs(d *Data) ([]byte, bool) {
+	var b []byte
+	changed := false
+	set := make(map[TLVType]bool, len(r.SetTLVs))
+	it := d.TLVIterator()
+	for it.Next() {
+		t := it.Type()
+		if v, ok := r.SetTLVs[t]; ok {
+			if set[t] {
+				// only the first of repeated TLVs is replaced
+				changed = true
+				continue
+			}
+			set[t] = true
+			changed = changed || !bytes.Equal(v, it.Value())
+			b = appendTLV(b, byte(t), v)
+			continue
+		}
+		if (r.AllowTLVs != nil && !containsTLVType(r.AllowTLVs, t)) || containsTLVType(r.RemoveTLVs, t) {
+			changed = true
+			continue
+		}
+		b = appendTLV(b, byte(t), it.Value())
+	}
+
+	var added []TLVType
+	for t := range r.SetTLVs {
+		if !set[t] {
+			added = append(added, t)
+		}
+	}
+	sort.Slice(added, func(i, j int) bool { return added[i] < added[j] })
+	for _, t := range added {
+		b = appendTLV(b, byte(t), r.SetTLVs[t])
+		changed = true
+	}
+	return b, changed
+}
+
+// containsTLVType reports whether ts contains t
+func containsTLVType(ts []TLVType, t TLVType) bool {
+	for _, x := range ts {
+		if x == t {
+			return true
+		}
+	}
+	return false
+}
+
+// AppendHeader applies the rules to the inbound data d and appends the outbound header
+// to b. If the rules change nothing and d was parsed (and not modified since), the
+// header is appended exactly as it was received
+func (r *Rewrite) AppendHeader(b []byte, d *Data) ([]byte, error) {
+	out, err := r.Apply(d)
+	if err != nil {
+		return nil, err
+	}
+	if out == d && d.unmodified() {
+		return append(b, d.raw...), nil
+	}
+	return out.AppendHeader(b, out.Version)
+}
+
+// WriteHeader writes the outbound header for the inbound data d to w, see AppendHeader
+func (r *Rewrite) WriteHeader(w io.Writer, d *Data) (int, error) {
+	b, err := r.AppendHeader(make([]byte, 0, 232), d)
+	if err != nil {
+		return 0, err
+	}
+	return w.Write(b)
+}
+
+// unmodified reports whether d was parsed and still describes the header it was parsed
+// from
+func (d *Data) unmodified() bool {
+	if d.raw == nil {
+		return false
+	}
+	p, _, err := ParseBytes(d.raw)
+	return err == nil && p.Equal(d)
+}
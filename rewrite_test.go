@@ -0,0 +1,246 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"net/netip"
+	"testing"
+)
+
+// v2TestHeader builds a v2 PROXY header for TCP over IPv4 with tlvs in the given order.
+// If fixCRC is set, the value of a CRC32C TLV is replaced with the right checksum
+func v2TestHeader(fixCRC bool, tlvs ...[]byte) []byte {
+	b := append([]byte{}, protov2[:]...)
+	b = append(b, 0x21, 0x11, 0, 0, 10, 20, 30, 40, 40, 30, 20, 10, 0x1f, 0x40, 0x01, 0xbb)
+	crcAt := -1
+	for _, tlv := range tlvs {
+		if tlv[0] == byte(TLVTypeCRC32C) {
+			crcAt = len(b) + 3
+		}
+		b = append(b, tlv...)
+	}
+	binary.BigEndian.PutUint16(b[14:], uint16(len(b)-16))
+	if fixCRC && crcAt >= 0 {
+		copy(b[crcAt:], []byte{0, 0, 0, 0})
+		binary.BigEndian.PutUint32(b[crcAt:], crc32.Checksum(b, crc32cTable))
+	}
+	return b
+}
+
+// checkCRC32C fails unless the CRC32C TLV of header b, if any, is right
+func checkCRC32C(t *testing.T, b []byte) {
+	t.Helper()
+	d, n, err := ParseBytes(b)
+	if err != nil {
+		t.Fatalf("ParseBytes() error = %v", err)
+	}
+	want, ok := d.TLVGetCRC32Checksum()
+	if !ok {
+		return
+	}
+	zeroed := append([]byte{}, b[:n]...)
+	crcAt := n - len(d.rawTLVs)
+	for it := NewTLVIterator(zeroed[crcAt:n]); it.Next(); {
+		if it.Type() == TLVTypeCRC32C {
+			copy(it.Value(), []byte{0, 0, 0, 0})
+		}
+	}
+	if got := crc32.Checksum(zeroed, crc32cTable); got != want {
+		t.Fatalf("CRC32C = %#x, want %#x", want, got)
+	}
+}
+
+func Test_Rewrite(t *testing.T) {
+	alpn := []byte{0x01, 0x00, 0x02, 'h', '2'}
+	authority := []byte{0x02, 0x00, 0x03, 'a', '.', 'b'}
+	crc := []byte{0x03, 0x00, 0x04, 0, 0, 0, 0}
+	custom := []byte{0xe1, 0x00, 0x01, 'x'}
+	noop := []byte{0x04, 0x00, 0x00}
+
+	tests := []struct {
+		name    string
+		in      []byte
+		rewrite Rewrite
+		want    []byte
+		wantErr bool
+	}{
+		{
+			name: "passthrough",
+			in:   v2TestHeader(true, custom, alpn, crc, authority),
+			want: v2TestHeader(true, custom, alpn, crc, authority),
+		},
+		{
+			name: "passthrough keeps a bad checksum",
+			in:   append(v2TestHeader(false, alpn, []byte{0x03, 0x00, 0x04, 1, 2, 3, 4}), "data"...),
+			want: v2TestHeader(false, alpn, []byte{0x03, 0x00, 0x04, 1, 2, 3, 4}),
+		},
+		{
+			name: "passthrough v1",
+			in:   []byte("PROXY UNKNOWN 10.20.30.40 40.30.20.10 8000 443\r\n"),
+			want: []byte("PROXY UNKNOWN 10.20.30.40 40.30.20.10 8000 443\r\n"),
+		},
+		{
+			name: "rules without effect",
+			in:   v2TestHeader(true, custom, alpn, crc),
+			rewrite: Rewrite{
+				Version:    Version2,
+				Dest:       netip.MustParseAddrPort("40.30.20.10:443"),
+				RemoveTLVs: []TLVType{TLVTypeAuthority},
+				AllowTLVs:  []TLVType{TLVTypeALPN, TLVTypeCRC32C},
+				SetTLVs:    map[TLVType][]byte{0xe1: []byte("x")},
+			},
+			want: v2TestHeader(true, custom, alpn, crc),
+		},
+		{
+			name:    "remove",
+			in:      v2TestHeader(true, custom, alpn, crc, authority),
+			rewrite: Rewrite{RemoveTLVs: []TLVType{TLVTypeALPN}},
+			want:    v2TestHeader(true, custom, crc, authority),
+		},
+		{
+			name:    "allow",
+			in:      v2TestHeader(true, custom, alpn, crc, noop, authority),
+			rewrite: Rewrite{AllowTLVs: []TLVType{TLVTypeAuthority, TLVTypeCRC32C}},
+			want:    v2TestHeader(true, crc, authority),
+		},
+		{
+			name: "set",
+			in:   v2TestHeader(true, authority, custom, crc, custom),
+			rewrite: Rewrite{
+				AllowTLVs: []TLVType{},
+				SetTLVs:   map[TLVType][]byte{0xe1: []byte("y"), 0xe2: nil, TLVTypeALPN: []byte("h2")},
+			},
+			want: v2TestHeader(true, []byte{0xe1, 0x00, 0x01, 'y'}, alpn, []byte{0xe2, 0x00, 0x00}),
+		},
+		{
+			name:    "destination",
+			in:      v2TestHeader(true, alpn, crc),
+			rewrite: Rewrite{Dest: netip.MustParseAddrPort("1.2.3.4:8443")},
+			want: func() []byte {
+				b := v2TestHeader(false, alpn, crc)
+				copy(b[20:24], []byte{1, 2, 3, 4})
+				binary.BigEndian.PutUint16(b[26:], 8443)
+				copy(b[len(b)-4:], []byte{0, 0, 0, 0})
+				binary.BigEndian.PutUint32(b[len(b)-4:], crc32.Checksum(b, crc32cTable))
+				return b
+			}(),
+		},
+		{
+			name:    "v1 to v2",
+			in:      []byte("PROXY TCP4 10.20.30.40 40.30.20.10 8000 443\r\n"),
+			rewrite: Rewrite{Version: Version2, SetTLVs: map[TLVType][]byte{TLVTypeALPN: []byte("h2"), TLVTypeCRC32C: make([]byte, 4)}},
+			want:    v2TestHeader(true, alpn, crc),
+		},
+		{
+			name:    "v2 to v1",
+			in:      v2TestHeader(true, alpn, crc),
+			rewrite: Rewrite{Version: Version1},
+			want:    []byte("PROXY TCP4 10.20.30.40 40.30.20.10 8000 443\r\n"),
+		},
+		{
+			name:    "v1 with TLVs",
+			in:      []byte("PROXY TCP4 10.20.30.40 40.30.20.10 8000 443\r\n"),
+			rewrite: Rewrite{SetTLVs: map[TLVType][]byte{TLVTypeALPN: []byte("h2")}},
+			wantErr: true,
+		},
+		{
+			name:    "destination of a LOCAL header",
+			in:      []byte("\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00"),
+			rewrite: Rewrite{Dest: netip.MustParseAddrPort("1.2.3.4:8443")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _, err := ParseBytes(tt.in)
+			if err != nil {
+				t.Fatalf("ParseBytes() error = %v", err)
+			}
+			got, err := tt.rewrite.AppendHeader([]byte("prefix"), d)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AppendHeader() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !bytes.Equal(got, append([]byte("prefix"), tt.want...)) {
+				t.Fatalf("AppendHeader() = %q, want %q", got[len("prefix"):], tt.want)
+			}
+			if !bytes.HasPrefix(tt.in, tt.want) {
+				// rewritten headers always have the right checksum
+				checkCRC32C(t, got[len("prefix"):])
+			}
+		})
+	}
+}
+
+func Test_Rewrite_Apply(t *testing.T) {
+	in := v2TestHeader(true, []byte{0x02, 0x00, 0x01, 'a'})
+	d, _, err := ParseBytes(in)
+	if err != nil {
+		t.Fatalf("ParseBytes() error = %v", err)
+	}
+	if out, err := (&Rewrite{}).Apply(d); err != nil || out != d {
+		t.Fatalf("Apply() = %v, %v, want the inbound data", out, err)
+	}
+	out, err := (&Rewrite{RemoveTLVs: []TLVType{TLVTypeAuthority}}).Apply(d)
+	if err != nil || out == d || len(out.TLVMap()) != 0 || len(d.TLVMap()) != 1 {
+		t.Fatalf("Apply() = %v, %v, inbound TLVs %v", out, err, d.TLVMap())
+	}
+
+	// data changed after parsing is encoded again rather than passed through
+	d.SourcePort = 9000
+	b, err := (&Rewrite{}).AppendHeader(nil, d)
+	if err != nil {
+		t.Fatalf("AppendHeader() error = %v", err)
+	}
+	if p, _, err := ParseBytes(b); err != nil || p.SourcePort != 9000 {
+		t.Fatalf("ParseBytes() = %v, %v, want source port 9000", p, err)
+	}
+
+	// TLVs edited after parsing are rewritten from the map, not the received header
+	d, _, err = ParseBytes(v2TestHeader(true,
+		appendTLV(nil, byte(TLVTypeAuthority), []byte("example.com")),
+		appendTLV(nil, byte(TLVTypeNoop), nil),
+		appendTLV(nil, byte(TLVTypeCRC32C), make([]byte, 4))))
+	if err != nil {
+		t.Fatalf("ParseBytes() error = %v", err)
+	}
+	d.TLVs = d.TLVMap()
+	delete(d.TLVs, TLVTypeAuthority)
+	d.TLVs[TLVTypeALPN] = []byte("h2")
+	for _, rw := range []*Rewrite{{}, {RemoveTLVs: []TLVType{TLVTypeNoop}, SetTLVs: map[TLVType][]byte{0xE2: []byte("tier2")}}} {
+		b, err := rw.AppendHeader(nil, d)
+		if err != nil {
+			t.Fatalf("AppendHeader() error = %v", err)
+		}
+		p, _, err := ParseBytes(b)
+		if err != nil {
+			t.Fatalf("ParseBytes() error = %v", err)
+		}
+		crc, _ := p.TLV(TLVTypeCRC32C)
+		want := map[TLVType][]byte{TLVTypeALPN: []byte("h2"), TLVTypeCRC32C: crc}
+		if len(rw.SetTLVs) == 0 {
+			want[TLVTypeNoop] = []byte{}
+		} else {
+			want[0xE2] = []byte("tier2")
+		}
+		if !equalTLVs(p.TLVMap(), want) {
+			t.Fatalf("AppendHeader() TLVs = %q, want %q", p.TLVMap(), want)
+		}
+		if sum, _ := p.TLVGetCRC32Checksum(); sum == 0 {
+			t.Fatalf("AppendHeader() did not compute the checksum")
+		}
+	}
+
+	// data that was not parsed gets a v2 header
+	nd, err := NewData(TransportStream, netip.MustParseAddrPort("10.20.30.40:8000"), netip.MustParseAddrPort("40.30.20.10:443"))
+	if err != nil {
+		t.Fatalf("NewData() error = %v", err)
+	}
+	b, err = (&Rewrite{SetTLVs: map[TLVType][]byte{TLVTypeAuthority: []byte("a")}}).AppendHeader(nil, nd)
+	if err != nil || !bytes.Equal(b, in) {
+		t.Fatalf("AppendHeader() = %q, %v, want %q", b, err, in)
+	}
+}
@@ -0,0 +1,421 @@
+package proxyproto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tlsRecordTypeHandshake  = 0x16
+	tlsHandshakeClientHello = 0x1
+	tlsExtServerName        = 0x0
+	tlsExtALPN              = 0x10
+
+	// maxTLSRecordLen is the largest TLS record payload a client may send (RFC 8446 5.2)
+	maxTLSRecordLen = 1<<14 + 256
+	// maxClientHelloLen bounds the ClientHello handshake message, the same limit
+	// crypto/tls uses for handshake messages
+	maxClientHelloLen = 1 << 16
+
+	defaultSNIHelloTimeout = 10 * time.Second
+)
+
+// DialFunc connects to a backend for the client described by d. Pool.Dial is a DialFunc
+type DialFunc func(ctx context.Context, d *Data) (net.Conn, error)
+
+// ClientHello holds the fields of a TLS ClientHello used for routing
+type ClientHello struct {
+	// ServerName is the host name from the server_name extension (SNI), lowercased
+	// and without a trailing dot. It is empty if the client did not send one
+	ServerName string
+	// ALPN is the list of protocols offered in the application_layer_protocol_negotiation
+	// extension, nil if the client did not send one
+	ALPN []string
+}
+
+// ParseClientHello parses the ClientHello at the start of b, which holds TLS records
+// as sent by a client. The ClientHello may be split over several records
+func ParseClientHello(b []byte) (*ClientHello, error) {
+	msg, need, err := clientHelloMsg(b)
+	if err != nil {
+		return nil, err
+	}
+	if need > 0 {
+		return nil, fmt.Errorf("failed to parse TLS ClientHello: need %d more bytes: %w", need, io.ErrUnexpectedEOF)
+	}
+	return parseClientHelloMsg(msg)
+}
+
+// readClientHello reads TLS records from r until the ClientHello is complete. The
+// returned bytes are everything that was read, even on failure
+func readClientHello(r io.Reader) ([]byte, *ClientHello, error) {
+	var b []byte
+	for {
+		msg, need, err := clientHelloMsg(b)
+		if err != nil {
+			return b, nil, err
+		}
+		if need == 0 {
+			hello, err := parseClientHelloMsg(msg)
+			return b, hello, err
+		}
+		n := len(b)
+		b = append(b, make([]byte, need)...)
+		m, err := io.ReadFull(r, b[n:])
+		b = b[:n+m]
+		if err != nil {
+			return b, nil, fmt.Errorf("failed to read TLS ClientHello: %w", err)
+		}
+	}
+}
+
+// clientHelloMsg gathers the first handshake message from the TLS records in b. If b
+// is too short, need is the minimum number of bytes missing
+func clientHelloMsg(b []byte) (msg []byte, need int, err error) {
+	var hs []byte
+	for {
+		if len(b) > 0 && b[0] != tlsRecordTypeHandshake {
+			return nil, 0, errors.New("failed to parse TLS ClientHello: not a TLS handshake record")
+		}
+		if len(b) < 5 {
+			return nil, 5 - len(b), nil
+		}
+		if b[1] != 3 {
+			return nil, 0, fmt.Errorf("failed to parse TLS ClientHello: unknown record version %d.%d", b[1], b[2])
+		}
+		n := int(b[3])<<8 | int(b[4])
+		if n == 0 || n > maxTLSRecordLen {
+			return nil, 0, fmt.Errorf("failed to parse TLS ClientHello: invalid record length %d", n)
+		}
+		if len(b) < 5+n {
+			return nil, 5 + n - len(b), nil
+		}
+		hs = append(hs, b[5:5+n]...)
+		b = b[5+n:]
+
+		if len(hs) < 4 {
+			continue
+		}
+		if hs[0] != tlsHandshakeClientHello {
+			return nil, 0, fmt.Errorf("failed to parse TLS ClientHello: handshake message type %d is not a ClientHello", hs[0])
+		}
+		l := int(hs[1])<<16 | int(hs[2])<<8 | int(hs[3])
+		if l > maxClientHelloLen {
+			return nil, 0, fmt.Errorf("failed to parse TLS ClientHello: message is %d bytes, max is %d", l, maxClientHelloLen)
+		}
+		if len(hs) >= 4+l {
+			return hs[4 : 4+l], 0, nil
+		}
+	}
+}
+
+// helloReader reads the length-prefixed fields of a ClientHello
+type helloReader []byte
+
+func (r *helloReader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+// prefixed reads a field preceded by its length in size bytes
+func (r *helloReader) prefixed(size int) (helloReader, bool) {
+	if len(*r) < size {
+		return nil, false
+	}
+	n := 0
+	for _, c := range (*r)[:size] {
+		n = n<<8 | int(c)
+	}
+	*r = (*r)[size:]
+	if len(*r) < n {
+		return nil, false
+	}
+	v := (*r)[:n]
+	*r = (*r)[n:]
+	return v, true
+}
+
+var errMalformedClientHello = errors.New("failed to parse TLS ClientHello: malformed message")
+
+func parseClientHelloMsg(msg []byte) (*ClientHello, error) {
+	r := helloReader(msg)
+	// legacy_version, random
+	if !r.skip(2 + 32) {
+		return nil, errMalformedClientHello
+	}
+	// legacy_session_id, cipher_suites, legacy_compression_methods
+	for _, size := range []int{1, 2, 1} {
+		if _, ok := r.prefixed(size); !ok {
+			return nil, errMalformedClientHello
+		}
+	}
+
+	hello := &ClientHello{}
+	if len(r) == 0 {
+		// extensions are optional before TLS 1.2
+		return hello, nil
+	}
+	exts, ok := r.prefixed(2)
+	if !ok {
+		return nil, errMalformedClientHello
+	}
+	for len(exts) > 0 {
+		if len(exts) < 2 {
+			return nil, errMalformedClientHello
+		}
+		typ := int(exts[0])<<8 | int(exts[1])
+		exts = exts[2:]
+		data, ok := exts.prefixed(2)
+		if !ok {
+			return nil, errMalformedClientHello
+		}
+
+		switch typ {
+		case tlsExtServerName:
+			names, ok := data.prefixed(2)
+			if !ok {
+				return nil, errMalformedClientHello
+			}
+			for len(names) > 0 {
+				nameType := names[0]
+				names = names[1:]
+				name, ok := names.prefixed(2)
+				if !ok {
+					return nil, errMalformedClientHello
+				}
+				if nameType == 0 && hello.ServerName == "" {
+					hello.ServerName = strings.TrimSuffix(strings.ToLower(string(name)), ".")
+				}
+			}
+		case tlsExtALPN:
+			list, ok := data.prefixed(2)
+			if !ok {
+				return nil, errMalformedClientHello
+			}
+			hello.ALPN = []string{}
+			for len(list) > 0 {
+				proto, ok := list.prefixed(1)
+				if !ok || len(proto) == 0 {
+					return nil, errMalformedClientHello
+				}
+				hello.ALPN = append(hello.ALPN, string(proto))
+			}
+		}
+	}
+	return hello, nil
+}
+
+// SNIRouterOption configures optional behavior of an SNIRouter
+type SNIRouterOption func(*SNIRouter)
+
+// WithSNIHelloTimeout bounds how long the router waits for the ClientHello, 10 seconds
+// by default. Connections that time out go to the default route, so protocols where
+// the server speaks first can share the listener
+func WithSNIHelloTimeout(d time.Duration) SNIRouterOption {
+	return func(r *SNIRouter) {
+		r.helloTimeout = d
+	}
+}
+
+// WithSNIIdleTimeout sets the idle timeout of relayed connections, see RelayOptions
+func WithSNIIdleTimeout(d time.Duration) SNIRouterOption {
+	return func(r *SNIRouter) {
+		r.idleTimeout = d
+	}
+}
+
+// SNIRouter forwards TLS connections to backends picked by the server name in the
+// ClientHello, without terminating TLS. Each backend receives a v2 header describing
+// the client (repeating the proxy data of a *Conn, see Relay) with TLVTypeAuthority
+// set to the server name and TLVTypeALPN set to the first protocol the client offered,
+// see TLVTypeALPN. It is safe for concurrent use
+type SNIRouter struct {
+	def          DialFunc
+	helloTimeout time.Duration
+	idleTimeout  time.Duration
+
+	mu       sync.RWMutex
+	exact    map[string]DialFunc
+	wildcard map[string]DialFunc // keyed by the suffix, e.g. ".example.com"
+}
+
+// NewSNIRouter creates a router that sends connections to def when no route matches,
+// there is no server name, or the ClientHello cannot be read. If def is nil those
+// connections are closed
+func NewSNIRouter(def DialFunc, opts ...SNIRouterOption) *SNIRouter {
+	r := &SNIRouter{
+		def:          def,
+		helloTimeout: defaultSNIHelloTimeout,
+		exact:        make(map[string]DialFunc),
+		wildcard:     make(map[string]DialFunc),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Handle routes connections for the server name pattern to dial. A pattern is either a
+// host name, matched exactly, or "*." followed by a domain, matching any single label
+// in front of it like a wildcard certificate ("*.example.com" matches "a.example.com"
+// but neither "example.com" nor "a.b.example.com"). Exact names win over wildcards.
+// Matching is case-insensitive and ignores a trailing dot
+func (r *SNIRouter) Handle(pattern string, dial DialFunc) error {
+	if dial == nil {
+		return errors.New("proxyproto: nil DialFunc")
+	}
+	p := strings.TrimSuffix(strings.ToLower(pattern), ".")
+	wild := strings.HasPrefix(p, "*.")
+	name := p
+	if wild {
+		name = p[1:]
+	}
+	if name == "" || name == "." || strings.Contains(name, "*") || strings.Contains(name, "..") || (!wild && name[0] == '.') {
+		return fmt.Errorf("proxyproto: invalid server name pattern %q", pattern)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m := r.exact
+	if wild {
+		m = r.wildcard
+	}
+	if _, ok := m[name]; ok {
+		return fmt.Errorf("proxyproto: server name pattern %q is already routed", pattern)
+	}
+	m[name] = dial
+	return nil
+}
+
+// Match returns the route for a server name, or nil if there is none
+func (r *SNIRouter) Match(serverName string) DialFunc {
+	name := strings.TrimSuffix(strings.ToLower(serverName), ".")
+	if name == "" {
+		return nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if dial, ok := r.exact[name]; ok {
+		return dial
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		return r.wildcard[name[i:]]
+	}
+	return nil
+}
+
+// ServeConn reads the ClientHello from conn, connects to the matching backend and
+// relays the connection until it is done, like Relay. conn is always closed
+func (r *SNIRouter) ServeConn(ctx context.Context, conn net.Conn) (RelayStats, error) {
+	// cancelling ctx interrupts reading the ClientHello
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(aLongTimeAgo)
+		case <-stop:
+		}
+	}()
+	if r.helloTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(r.helloTimeout))
+	}
+	raw, hello, herr := readClientHello(conn)
+	close(stop)
+	<-done
+	conn.SetReadDeadline(time.Time{})
+	if cerr := ctx.Err(); cerr != nil {
+		conn.Close()
+		return RelayStats{}, cerr
+	}
+
+	d := relayData(conn)
+	dial := r.def
+	if herr == nil {
+		if m := r.Match(hello.ServerName); m != nil {
+			dial = m
+		}
+		if hello.ServerName != "" || len(hello.ALPN) > 0 {
+			d = d.Clone()
+			if hello.ServerName != "" {
+				d.setTLV(TLVTypeAuthority, []byte(hello.ServerName))
+			}
+			if len(hello.ALPN) > 0 {
+				d.setTLV(TLVTypeALPN, []byte(hello.ALPN[0]))
+			}
+		}
+	}
+	if dial == nil {
+		conn.Close()
+		if herr != nil {
+			return RelayStats{}, herr
+		}
+		return RelayStats{}, fmt.Errorf("proxyproto: no route for server name %q", hello.ServerName)
+	}
+
+	backend, err := dial(ctx, d)
+	if err != nil {
+		conn.Close()
+		return RelayStats{}, err
+	}
+	return Relay(ctx, &peekedConn{Conn: conn, buf: raw}, backend, RelayOptions{
+		Version:     Version2,
+		Data:        d,
+		IdleTimeout: r.idleTimeout,
+	})
+}
+
+// Serve accepts connections on l and handles each with ServeConn until l is closed,
+// and returns the error from Accept. Other Accept errors are retried after a short
+// backoff. When l is a *Listener, each connection's header is read in its own goroutine
+// within the hello timeout, and connections whose header cannot be read are skipped,
+// so one slow or bad client does not stop the others
+func (r *SNIRouter) Serve(l net.Listener) error {
+	return serveListener(l, r.helloTimeout, nil, func(conn net.Conn) {
+		r.ServeConn(context.Background(), conn)
+	})
+}
+
+// peekedConn replays bytes that were read ahead of the connection's data
+type peekedConn struct {
+	net.Conn
+	buf []byte
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	if len(c.buf) > 0 {
+		n := copy(b, c.buf)
+		c.buf = c.buf[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// NetConn returns the underlying connection, so DataFromConn sees through peekedConn
+func (c *peekedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return ErrUnsupported
+}
+
+func (c *peekedConn) CloseRead() error {
+	if cr, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return cr.CloseRead()
+	}
+	return ErrUnsupported
+}
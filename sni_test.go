@@ -0,0 +1,437 @@
+package proxyproto
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testCertificate creates a self-signed certificate for names, which is its own CA
+func testCertificate(t *testing.T, cn string, names ...string) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		DNSNames:              names,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error = %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate() error = %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, cert
+}
+
+// captureClientHello returns the records of the ClientHello crypto/tls sends with config
+func captureClientHello(t *testing.T, config *tls.Config) []byte {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go tls.Client(c1, config).Handshake()
+	raw, _, err := readClientHello(c2)
+	if err != nil {
+		t.Fatalf("readClientHello() error = %v", err)
+	}
+	return raw
+}
+
+// refragment splits the handshake data of TLS records into records of at most n bytes
+func refragment(b []byte, n int) []byte {
+	var hs []byte
+	for len(b) >= 5 {
+		l := int(b[3])<<8 | int(b[4])
+		hs = append(hs, b[5:5+l]...)
+		b = b[5+l:]
+	}
+	var out []byte
+	for len(hs) > 0 {
+		m := n
+		if m > len(hs) {
+			m = len(hs)
+		}
+		out = append(out, tlsRecordTypeHandshake, 3, 1, byte(m>>8), byte(m))
+		out = append(out, hs[:m]...)
+		hs = hs[m:]
+	}
+	return out
+}
+
+func Test_ParseClientHello(t *testing.T) {
+	withALPN := captureClientHello(t, &tls.Config{ServerName: "Example.COM.", NextProtos: []string{"h2", "http/1.1"}})
+	tests := []struct {
+		name     string
+		buf      []byte
+		wantName string
+		wantALPN []string
+		wantErr  bool
+	}{
+		{
+			name:     "sni alpn",
+			buf:      withALPN,
+			wantName: "example.com",
+			wantALPN: []string{"h2", "http/1.1"},
+		},
+		{
+			name:     "fragmented",
+			buf:      refragment(withALPN, 3),
+			wantName: "example.com",
+			wantALPN: []string{"h2", "http/1.1"},
+		},
+		{
+			name: "no sni",
+			buf:  captureClientHello(t, &tls.Config{ServerName: "10.0.0.1"}),
+		},
+		{
+			name:    "truncated",
+			buf:     withALPN[:len(withALPN)-1],
+			wantErr: true,
+		},
+		{
+			name:    "http",
+			buf:     []byte("GET / HTTP/1.1\r\n\r\n"),
+			wantErr: true,
+		},
+		{
+			name:    "not a client hello",
+			buf:     []byte{0x16, 3, 1, 0, 4, 2, 0, 0, 0},
+			wantErr: true,
+		},
+		{
+			name:    "malformed",
+			buf:     []byte{0x16, 3, 1, 0, 6, 1, 0, 0, 2, 3, 3},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseClientHello(tt.buf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseClientHello() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.ServerName != tt.wantName || !reflect.DeepEqual(got.ALPN, tt.wantALPN) {
+				t.Fatalf("ParseClientHello() = %q %q, want %q %q", got.ServerName, got.ALPN, tt.wantName, tt.wantALPN)
+			}
+		})
+	}
+}
+
+func Test_SNIRouter_Match(t *testing.T) {
+	// each route reports its index as an error
+	var routes [3]DialFunc
+	for i := range routes {
+		err := fmt.Errorf("%d", i)
+		routes[i] = func(ctx context.Context, d *Data) (net.Conn, error) { return nil, err }
+	}
+	r := NewSNIRouter(nil)
+	mustHandle := func(pattern string, dial DialFunc) {
+		if err := r.Handle(pattern, dial); err != nil {
+			t.Fatalf("Handle(%q) error = %v", pattern, err)
+		}
+	}
+	mustHandle("example.com", routes[0])
+	mustHandle("*.example.com", routes[1])
+	mustHandle("API.example.com.", routes[2])
+
+	for _, bad := range []string{"", "*", "*.", "a.*.com", "*example.com", ".example.com", "a..com", "example.com"} {
+		if err := r.Handle(bad, routes[0]); err == nil {
+			t.Fatalf("Handle(%q) succeeded", bad)
+		}
+	}
+
+	tests := []struct {
+		name string
+		want int // -1 for no match
+	}{
+		{"example.com", 0},
+		{"EXAMPLE.com.", 0},
+		{"www.example.com", 1},
+		{"api.example.com", 2},
+		{"a.b.example.com", -1},
+		{"example.org", -1},
+		{"", -1},
+	}
+	for _, tt := range tests {
+		got := -1
+		if dial := r.Match(tt.name); dial != nil {
+			_, err := dial(context.Background(), nil)
+			got, _ = strconv.Atoi(err.Error())
+		}
+		if got != tt.want {
+			t.Fatalf("Match(%q) = route %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// dialTo returns a DialFunc connecting to addr and records the data it was given
+func dialTo(addr string, got chan<- *Data) DialFunc {
+	return func(ctx context.Context, d *Data) (net.Conn, error) {
+		got <- d
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+}
+
+func Test_SNIRouter_ServeConn(t *testing.T) {
+	cert, ca := testCertificate(t, "backend", "app.example.com")
+	tlsBackend, err := ListenTLS("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2"},
+	})
+	if err != nil {
+		t.Fatalf("ListenTLS() error = %v", err)
+	}
+	defer tlsBackend.Close()
+	backendData := make(chan *Data, 1)
+	go func() {
+		for {
+			c, err := tlsBackend.Accept()
+			if err != nil {
+				return
+			}
+			d, _ := DataFromConn(c)
+			backendData <- d
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	// the default backend speaks plain text
+	plainBackend, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer plainBackend.Close()
+	go func() {
+		for {
+			c, err := plainBackend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	dialed := make(chan *Data, 4)
+	r := NewSNIRouter(dialTo(plainBackend.Addr().String(), dialed), WithSNIHelloTimeout(time.Second))
+	if err := r.Handle("*.example.com", dialTo(tlsBackend.Addr().String(), dialed)); err != nil {
+		t.Fatalf("Handle() error = %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer l.Close()
+	go r.Serve(l)
+
+	t.Run("tls", func(t *testing.T) {
+		pool := x509.NewCertPool()
+		pool.AddCert(ca)
+		c, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			ServerName: "app.example.com",
+			RootCAs:    pool,
+			NextProtos: []string{"h2", "http/1.1"},
+		})
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		defer c.Close()
+		if p := c.ConnectionState().NegotiatedProtocol; p != "h2" {
+			t.Fatalf("NegotiatedProtocol = %q, want %q", p, "h2")
+		}
+		c.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("ReadFull() = %q, %v", buf, err)
+		}
+
+		d := <-backendData
+		if d.Source().String() != c.LocalAddr().String() {
+			t.Fatalf("header source = %v, want %v", d.Source(), c.LocalAddr())
+		}
+		if a, _ := d.TLVGetAuthority(); a != "app.example.com" {
+			t.Fatalf("TLVGetAuthority() = %q, want %q", a, "app.example.com")
+		}
+		if alpn, _ := d.TLVGetALPN(); alpn != "h2" {
+			t.Fatalf("TLVGetALPN() = %q, want %q", alpn, "h2")
+		}
+		<-dialed
+	})
+
+	t.Run("default", func(t *testing.T) {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		defer c.Close()
+		c.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+		c.(*net.TCPConn).CloseWrite()
+		got, _ := io.ReadAll(c)
+		if string(got) != "GET / HTTP/1.0\r\n\r\n" {
+			t.Fatalf("ReadAll() = %q", got)
+		}
+		if d := <-dialed; len(d.TLVMap()) != 0 {
+			t.Fatalf("default route got TLVs %v", d.TLVMap())
+		}
+	})
+
+	t.Run("server speaks first", func(t *testing.T) {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		defer c.Close()
+		// nothing is sent, the hello timeout moves the connection to the default route
+		select {
+		case <-dialed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("default route not dialed")
+		}
+	})
+}
+
+func Test_SNIRouter_chained(t *testing.T) {
+	// the router sits behind another proxy and repeats its client address
+	backend, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer backend.Close()
+	got := make(chan *Data, 1)
+	go func() {
+		c, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		got <- c.(*Conn).ProxyData()
+		io.Copy(io.Discard, c)
+	}()
+
+	dialed := make(chan *Data, 1)
+	r := NewSNIRouter(nil)
+	r.Handle("example.com", dialTo(backend.Addr().String(), dialed))
+
+	client, proxyIn := tcpPair(t)
+	hello := captureClientHello(t, &tls.Config{ServerName: "example.com"})
+	go func() {
+		client.Write([]byte("PROXY TCP4 10.20.30.40 40.30.20.10 8000 443\r\n"))
+		client.Write(hello)
+		client.(*net.TCPConn).CloseWrite()
+	}()
+	in, err := WrapConn(proxyIn)
+	if err != nil {
+		t.Fatalf("WrapConn() error = %v", err)
+	}
+	go r.ServeConn(context.Background(), in)
+
+	d := <-got
+	if d.Source().String() != "10.20.30.40:8000" || d.Dest().String() != "40.30.20.10:443" {
+		t.Fatalf("header = %v, want the upstream client", d)
+	}
+	if a, _ := d.TLVGetAuthority(); a != "example.com" {
+		t.Fatalf("TLVGetAuthority() = %q, want %q", a, "example.com")
+	}
+}
+
+func Test_SNIRouter_Serve(t *testing.T) {
+	backend, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			io.Copy(io.Discard, c)
+			c.Close()
+		}
+	}()
+
+	dialed := make(chan *Data, 1)
+	r := NewSNIRouter(nil)
+	r.Handle("example.com", dialTo(backend.Addr().String(), dialed))
+	l, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- r.Serve(l) }()
+
+	// a client that never sends its header does not hold up the others
+	idle, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer idle.Close()
+
+	// clients with a bad header, or none at all, do not stop the router
+	for _, header := range []string{"GET / HTTP/1.1\r\n\r\n", "PROXY TCP4 10.20.30.40\r\n", ""} {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		c.Write([]byte(header))
+		c.Close()
+	}
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer c.Close()
+	c.Write([]byte("PROXY TCP4 10.20.30.40 40.30.20.10 8000 443\r\n"))
+	c.Write(captureClientHello(t, &tls.Config{ServerName: "example.com"}))
+	select {
+	case d := <-dialed:
+		if d.Source().String() != "10.20.30.40:8000" {
+			t.Fatalf("routed header = %v, want the good client", d)
+		}
+	case err := <-served:
+		t.Fatalf("Serve() = %v after a bad header", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("good connection not routed")
+	}
+
+	l.Close()
+	if err := <-served; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Serve() = %v, want %v", err, net.ErrClosed)
+	}
+}
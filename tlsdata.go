@@ -0,0 +1,247 @@
+package proxyproto
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"strconv"
+)
+
+// tlsVersionNames maps TLS versions to the names OpenSSL's SSL_get_version returns,
+// which HAProxy sends in the SSL version sub-TLV
+var tlsVersionNames = map[uint16]string{
+	tls.VersionSSL30: "SSLv3",
+	tls.VersionTLS10: "TLSv1",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+// cipherSuiteNames maps cipher suites to their OpenSSL names, which HAProxy sends in
+// the SSL cipher sub-TLV. TLS 1.3 suites use the IANA names in OpenSSL too
+var cipherSuiteNames = map[uint16]string{
+	tls.TLS_RSA_WITH_RC4_128_SHA:                      "RC4-SHA",
+	tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA:                 "DES-CBC3-SHA",
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA:                  "AES128-SHA",
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA:                  "AES256-SHA",
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA256:               "AES128-SHA256",
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256:               "AES128-GCM-SHA256",
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384:               "AES256-GCM-SHA384",
+	tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA:              "ECDHE-ECDSA-RC4-SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:          "ECDHE-ECDSA-AES128-SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:          "ECDHE-ECDSA-AES256-SHA",
+	tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA:                "ECDHE-RSA-RC4-SHA",
+	tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA:           "ECDHE-RSA-DES-CBC3-SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA:            "ECDHE-RSA-AES128-SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA:            "ECDHE-RSA-AES256-SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256:       "ECDHE-ECDSA-AES128-SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256:         "ECDHE-RSA-AES128-SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:         "ECDHE-RSA-AES128-GCM-SHA256",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256:       "ECDHE-ECDSA-AES128-GCM-SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:         "ECDHE-RSA-AES256-GCM-SHA384",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384:       "ECDHE-ECDSA-AES256-GCM-SHA384",
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256:   "ECDHE-RSA-CHACHA20-POLY1305",
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256: "ECDHE-ECDSA-CHACHA20-POLY1305",
+	tls.TLS_AES_128_GCM_SHA256:                        "TLS_AES_128_GCM_SHA256",
+	tls.TLS_AES_256_GCM_SHA384:                        "TLS_AES_256_GCM_SHA384",
+	tls.TLS_CHACHA20_POLY1305_SHA256:                  "TLS_CHACHA20_POLY1305_SHA256",
+}
+
+// tlsVersionsByName maps OpenSSL version names back to TLS versions
+var tlsVersionsByName = map[string]uint16{
+	"SSLv3":   tls.VersionSSL30,
+	"TLSv1":   tls.VersionTLS10,
+	"TLSv1.0": tls.VersionTLS10,
+	"TLSv1.1": tls.VersionTLS11,
+	"TLSv1.2": tls.VersionTLS12,
+	"TLSv1.3": tls.VersionTLS13,
+}
+
+// cipherSuitesByName maps OpenSSL cipher names, and the IANA names that BoringSSL and
+// Go use, back to cipher suites
+var cipherSuitesByName = func() map[string]uint16 {
+	m := make(map[string]uint16, 2*len(cipherSuiteNames))
+	for id, n := range cipherSuiteNames {
+		m[n] = id
+	}
+	for _, suites := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+		for _, s := range suites {
+			m[s.Name] = s.ID
+		}
+	}
+	return m
+}()
+
+// signatureAlgorithmNames maps certificate signature algorithms to OpenSSL's short
+// object names, which HAProxy sends in the SSL sig_alg sub-TLV
+var signatureAlgorithmNames = map[x509.SignatureAlgorithm]string{
+	x509.MD5WithRSA:       "RSA-MD5",
+	x509.SHA1WithRSA:      "RSA-SHA1",
+	x509.SHA256WithRSA:    "RSA-SHA256",
+	x509.SHA384WithRSA:    "RSA-SHA384",
+	x509.SHA512WithRSA:    "RSA-SHA512",
+	x509.SHA256WithRSAPSS: "RSASSA-PSS",
+	x509.SHA384WithRSAPSS: "RSASSA-PSS",
+	x509.SHA512WithRSAPSS: "RSASSA-PSS",
+	x509.DSAWithSHA1:      "DSA-SHA1",
+	x509.DSAWithSHA256:    "dsa_with_SHA256",
+	x509.ECDSAWithSHA1:    "ecdsa-with-SHA1",
+	x509.ECDSAWithSHA256:  "ecdsa-with-SHA256",
+	x509.ECDSAWithSHA384:  "ecdsa-with-SHA384",
+	x509.ECDSAWithSHA512:  "ecdsa-with-SHA512",
+	x509.PureEd25519:      "ED25519",
+}
+
+// tlsVersionName gets the OpenSSL name of a TLS version
+func tlsVersionName(v uint16) string {
+	if n, ok := tlsVersionNames[v]; ok {
+		return n
+	}
+	return "0x" + strconv.FormatUint(uint64(v), 16)
+}
+
+// cipherSuiteName gets the OpenSSL name of a cipher suite, or the Go name for suites
+// OpenSSL does not know
+func cipherSuiteName(id uint16) string {
+	if n, ok := cipherSuiteNames[id]; ok {
+		return n
+	}
+	return tls.CipherSuiteName(id)
+}
+
+// TLSVersionFromName gets the crypto/tls version constant, such as tls.VersionTLS13, for
+// a version name as OpenSSL reports it and HAProxy sends it in the SSL version sub-TLV,
+// such as "TLSv1.3". The second return value will be false if the name is not known
+func TLSVersionFromName(name string) (uint16, bool) {
+	v, ok := tlsVersionsByName[name]
+	return v, ok
+}
+
+// CipherSuiteFromName gets the crypto/tls cipher suite ID for a cipher name as OpenSSL
+// reports it and HAProxy sends it in the SSL cipher sub-TLV, such as
+// "ECDHE-RSA-AES128-GCM-SHA256". The IANA names that BoringSSL reports, such as
+// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", are accepted too. The second return value
+// will be false if the name is not known or the suite is not implemented by crypto/tls
+func CipherSuiteFromName(name string) (uint16, bool) {
+	id, ok := cipherSuitesByName[name]
+	return id, ok
+}
+
+// signatureAlgorithmName gets the OpenSSL name of the algorithm that signed cert
+func signatureAlgorithmName(cert *x509.Certificate) string {
+	if n, ok := signatureAlgorithmNames[cert.SignatureAlgorithm]; ok {
+		return n
+	}
+	return cert.SignatureAlgorithm.String()
+}
+
+// keyAlgorithmName describes the key of cert the way HAProxy does, the algorithm
+// followed by the key size in bits, e.g. "RSA2048" or "EC256"
+func keyAlgorithmName(cert *x509.Certificate) string {
+	switch k := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return "RSA" + strconv.Itoa(k.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "EC" + strconv.Itoa(k.Curve.Params().BitSize)
+	case ed25519.PublicKey:
+		return "ED25519"
+	}
+	return cert.PublicKeyAlgorithm.String()
+}
+
+// sslTLVFromState builds the SSL TLV for a TLS connection the way HAProxy's
+// send-proxy-v2-ssl-cn does. The client flags tell whether the client sent a
+// certificate on this connection or in the resumed session, and the verify result
+// is zero unless the client sent a certificate that was not verified. The CN is the
+// client certificate's, while the signature and key algorithms are those of cert,
+// which HAProxy takes from the certificate the frontend presented. cert may be nil
+func sslTLVFromState(cs *tls.ConnectionState, cert *x509.Certificate) *SSLTLVData {
+	d := &SSLTLVData{
+		Client:  TLVSSLClientSSL,
+		SubTLVs: make(map[SSLTLVSubType][]byte, 5),
+	}
+	if len(cs.PeerCertificates) > 0 {
+		d.Client |= TLVSSLClientCertSess
+		if !cs.DidResume {
+			d.Client |= TLVSSLClientCertConn
+		}
+		if cn := cs.PeerCertificates[0].Subject.CommonName; cn != "" {
+			d.SubTLVs[TLVSubTypeSSLCN] = []byte(cn)
+		}
+	}
+	d.Verified = len(cs.PeerCertificates) == 0 || len(cs.VerifiedChains) > 0
+
+	d.SubTLVs[TLVSubTypeSSLVersion] = []byte(tlsVersionName(cs.Version))
+	d.SubTLVs[TLVSubTypeSSLCipher] = []byte(cipherSuiteName(cs.CipherSuite))
+	if cert != nil {
+		d.SubTLVs[TLVSubTypeSSLSigAlg] = []byte(signatureAlgorithmName(cert))
+		d.SubTLVs[TLVSubTypeSSLKeyAlg] = []byte(keyAlgorithmName(cert))
+	}
+	return d
+}
+
+// SetTLSConnectionState fills the TLS related TLVs from the state of a TLS connection,
+// for example one from http.Request.TLS, replacing those already present:
+//
+//   - TLVTypeALPN holds the negotiated protocol, if any
+//   - TLVTypeAuthority holds the server name the client sent, if any
+//   - TLVTypeSSL has the client flags, the verify result (zero unless the client sent a
+//     certificate that was not verified) and the version and cipher sub-TLVs, plus the
+//     CN, signature algorithm and key algorithm of the client certificate if there is
+//     one, all with OpenSSL-style names such as "TLSv1.3", "ECDHE-RSA-AES128-GCM-SHA256",
+//     "RSA-SHA256" and "RSA2048"
+//
+// Note that HAProxy, and Gateway, report the algorithms of the certificate the proxy
+// presented instead, which the connection state does not include
+func (d *Data) SetTLSConnectionState(cs *tls.ConnectionState) {
+	var peer *x509.Certificate
+	if len(cs.PeerCertificates) > 0 {
+		peer = cs.PeerCertificates[0]
+	}
+	var alpn, authority []byte
+	if cs.NegotiatedProtocol != "" {
+		alpn = []byte(cs.NegotiatedProtocol)
+	}
+	if cs.ServerName != "" {
+		authority = []byte(cs.ServerName)
+	}
+	d.setTLV(TLVTypeALPN, alpn)
+	d.setTLV(TLVTypeAuthority, authority)
+	d.setTLV(TLVTypeSSL, appendSSLTLV(nil, sslTLVFromState(cs, peer)))
+}
+
+// SetSSL sets the SSL TLV to ssl, or removes it if ssl is nil, for sending client flags,
+// a verify result and sub-TLVs other than those SetTLSConnectionState fills in.
+// Sub-TLVs are written in ascending type order
+func (d *Data) SetSSL(ssl *SSLTLVData) error {
+	if ssl == nil {
+		d.setTLV(TLVTypeSSL, nil)
+		return nil
+	}
+	if err := ssl.Validate(); err != nil {
+		return err
+	}
+	d.setTLV(TLVTypeSSL, appendSSLTLV(nil, ssl))
+	return nil
+}
+
+// tlsConnFromConn finds the *tls.Conn that conn is or wraps, looking through wrappers
+// like DataFromConn does
+func tlsConnFromConn(conn net.Conn) *tls.Conn {
+	for i := 0; conn != nil && i < maxUnwrapDepth; i++ {
+		switch c := conn.(type) {
+		case *tls.Conn:
+			return c
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		case interface{ Unwrap() net.Conn }:
+			conn = c.Unwrap()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
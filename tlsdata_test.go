@@ -0,0 +1,261 @@
+package proxyproto
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func Test_tlsNames(t *testing.T) {
+	tests := []struct {
+		got  string
+		want string
+	}{
+		{tlsVersionName(tls.VersionTLS10), "TLSv1"},
+		{tlsVersionName(tls.VersionTLS12), "TLSv1.2"},
+		{tlsVersionName(tls.VersionTLS13), "TLSv1.3"},
+		{tlsVersionName(0x7f1c), "0x7f1c"},
+		{cipherSuiteName(tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256), "ECDHE-RSA-AES128-GCM-SHA256"},
+		{cipherSuiteName(tls.TLS_AES_256_GCM_SHA384), "TLS_AES_256_GCM_SHA384"},
+		{cipherSuiteName(0x1234), "0x1234"},
+		{signatureAlgorithmName(&x509.Certificate{SignatureAlgorithm: x509.SHA256WithRSA}), "RSA-SHA256"},
+		{signatureAlgorithmName(&x509.Certificate{SignatureAlgorithm: x509.ECDSAWithSHA384}), "ecdsa-with-SHA384"},
+		{keyAlgorithmName(&x509.Certificate{PublicKey: &rsa.PublicKey{N: new(big.Int).Lsh(big.NewInt(1), 2047)}}), "RSA2048"},
+		{keyAlgorithmName(&x509.Certificate{PublicKey: &ecdsa.PublicKey{Curve: elliptic.P384()}}), "EC384"},
+		{keyAlgorithmName(&x509.Certificate{PublicKey: ed25519.PublicKey(make([]byte, ed25519.PublicKeySize))}), "ED25519"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("got %q, want %q", tt.got, tt.want)
+		}
+	}
+}
+
+func Test_sslTLVFromState(t *testing.T) {
+	_, cert := testCertificate(t, "client.example.com")
+	cs := &tls.ConnectionState{
+		Version:          tls.VersionTLS12,
+		CipherSuite:      tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		DidResume:        true,
+		PeerCertificates: []*x509.Certificate{cert},
+	}
+	got := sslTLVFromState(cs, nil)
+	want := &SSLTLVData{
+		Client:   TLVSSLClientSSL | TLVSSLClientCertSess,
+		Verified: false,
+		SubTLVs: map[SSLTLVSubType][]byte{
+			TLVSubTypeSSLVersion: []byte("TLSv1.2"),
+			TLVSubTypeSSLCipher:  []byte("ECDHE-ECDSA-AES128-GCM-SHA256"),
+			TLVSubTypeSSLCN:      []byte("client.example.com"),
+		},
+	}
+	if !got.Equal(want) {
+		t.Fatalf("sslTLVFromState() = %v, want %v", got, want)
+	}
+}
+
+// tlsPair returns both ends of a loopback TLS connection after the handshake, with
+// the client presenting clientCert and the server verifying it
+func tlsPair(t *testing.T, client, server net.Conn, clientCert tls.Certificate) (*tls.Conn, *tls.Conn) {
+	t.Helper()
+	serverCert, serverLeaf := testCertificate(t, "server", "example.com")
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert.Leaf)
+	roots := x509.NewCertPool()
+	roots.AddCert(serverLeaf)
+
+	sc := tls.Server(server, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		NextProtos:   []string{"h2"},
+	})
+	cc := tls.Client(client, &tls.Config{
+		ServerName:   "example.com",
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{clientCert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	})
+	errs := make(chan error, 1)
+	go func() {
+		errs <- cc.Handshake()
+	}()
+	if err := sc.Handshake(); err != nil {
+		t.Fatalf("Handshake() error = %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("Handshake() error = %v", err)
+	}
+	return cc, sc
+}
+
+func Test_NewDataFromConn(t *testing.T) {
+	t.Run("tcp", func(t *testing.T) {
+		client, server := tcpPair(t)
+		d, err := NewDataFromConn(server)
+		if err != nil {
+			t.Fatalf("NewDataFromConn() error = %v", err)
+		}
+		if d.Source().String() != client.LocalAddr().String() || d.Dest().String() != server.LocalAddr().String() {
+			t.Fatalf("NewDataFromConn() = %v, want %v -> %v", d, client.LocalAddr(), server.LocalAddr())
+		}
+		if d.Transport != TransportStream || len(d.TLVs) != 0 {
+			t.Fatalf("NewDataFromConn() = %v, want a stream without TLVs", d)
+		}
+	})
+
+	t.Run("tls", func(t *testing.T) {
+		client, server := tcpPair(t)
+		clientCert, _ := testCertificate(t, "client.example.com")
+		// a received header is chained, without its TLVs
+		client.Write([]byte("PROXY TCP4 10.20.30.40 40.30.20.10 8000 443\r\n"))
+		pc, err := WrapConn(server)
+		if err != nil {
+			t.Fatalf("WrapConn() error = %v", err)
+		}
+		_, sc := tlsPair(t, client, pc, clientCert)
+
+		d, err := NewDataFromConn(sc)
+		if err != nil {
+			t.Fatalf("NewDataFromConn() error = %v", err)
+		}
+		if d.Source().String() != "10.20.30.40:8000" || d.Dest().String() != "40.30.20.10:443" || d.Version != 0 {
+			t.Fatalf("NewDataFromConn() = %v, want the received addresses", d)
+		}
+		if alpn, _ := d.TLVGetALPN(); alpn != "h2" {
+			t.Fatalf("ALPN = %q, want %q", alpn, "h2")
+		}
+		if authority, _ := d.TLVGetAuthority(); authority != "example.com" {
+			t.Fatalf("Authority = %q, want %q", authority, "example.com")
+		}
+		ssl, ok := d.TLVGetSSLView()
+		if !ok || !ssl.Verified() || ssl.Client() != TLVSSLClientSSL|TLVSSLClientCertConn|TLVSSLClientCertSess {
+			t.Fatalf("TLVGetSSLView() = %v, %v", ssl.Data(), ok)
+		}
+		want := map[SSLTLVSubType]string{
+			TLVSubTypeSSLVersion: "TLSv1.3",
+			TLVSubTypeSSLCipher:  cipherSuiteName(sc.ConnectionState().CipherSuite),
+			TLVSubTypeSSLCN:      "client.example.com",
+			TLVSubTypeSSLSigAlg:  "ecdsa-with-SHA256",
+			TLVSubTypeSSLKeyAlg:  "EC256",
+		}
+		for st, v := range want {
+			if got, _ := ssl.SubTLV(st); string(got) != v {
+				t.Fatalf("SubTLV(%v) = %q, want %q", st, got, v)
+			}
+		}
+
+		// the encoded header carries the same data
+		b, err := d.AppendHeader(nil, Version2)
+		if err != nil {
+			t.Fatalf("AppendHeader() error = %v", err)
+		}
+		parsed, _, err := ParseBytes(b)
+		if err != nil {
+			t.Fatalf("ParseBytes() error = %v", err)
+		}
+		if ssl, _ := parsed.TLVGetSSLView(); !ssl.Verified() {
+			t.Fatalf("parsed SSL TLV = %v", ssl.Data())
+		}
+	})
+
+	t.Run("handshake", func(t *testing.T) {
+		_, server := tcpPair(t)
+		if _, err := NewDataFromConn(tls.Server(server, &tls.Config{})); err == nil {
+			t.Fatalf("NewDataFromConn() succeeded before the handshake")
+		}
+	})
+
+	t.Run("pipe", func(t *testing.T) {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+		if _, err := NewDataFromConn(c1); err == nil {
+			t.Fatalf("NewDataFromConn() succeeded for pipe addresses")
+		}
+	})
+}
+
+func Test_Data_SetTLSConnectionState(t *testing.T) {
+	// parsed TLVs are replaced, and others kept
+	d, _, err := ParseBytes([]byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x14" +
+		"\x0a\x14\x1e\x28\x28\x1e\x14\x0a\x1f\x40\x01\xbb" +
+		"\x01\x00\x02h2\x04\x00\x00"))
+	if err != nil {
+		t.Fatalf("ParseBytes() error = %v", err)
+	}
+	d.SetTLSConnectionState(&tls.ConnectionState{
+		Version:     tls.VersionTLS12,
+		CipherSuite: tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		ServerName:  "example.com",
+	})
+	if _, ok := d.TLVGetALPN(); ok {
+		t.Fatalf("TLVGetALPN() found the replaced ALPN")
+	}
+	if _, ok := d.TLV(TLVTypeNoop); !ok {
+		t.Fatalf("SetTLSConnectionState() dropped the NOOP TLV")
+	}
+	b, err := d.AppendHeader(nil, Version2)
+	if err != nil {
+		t.Fatalf("AppendHeader() error = %v", err)
+	}
+	parsed, _, err := ParseBytes(b)
+	if err != nil {
+		t.Fatalf("ParseBytes() error = %v", err)
+	}
+	ssl, ok := parsed.TLVGetSSLView()
+	if !ok || ssl.Client() != TLVSSLClientSSL || !ssl.Verified() {
+		t.Fatalf("TLVGetSSLView() = %v, %v", ssl.Data(), ok)
+	}
+	if cipher, _ := ssl.SubTLV(TLVSubTypeSSLCipher); string(cipher) != "ECDHE-RSA-AES128-GCM-SHA256" {
+		t.Fatalf("SSL cipher = %q", cipher)
+	}
+	if _, ok := ssl.SubTLV(TLVSubTypeSSLCN); ok {
+		t.Fatalf("SSL CN present without a client certificate")
+	}
+	if authority, _ := parsed.TLVGetAuthority(); authority != "example.com" {
+		t.Fatalf("Authority = %q, want %q", authority, "example.com")
+	}
+}
+
+func Test_Data_SetSSL(t *testing.T) {
+	d, err := NewData(TransportStream, netip.MustParseAddrPort("10.20.30.40:8000"), netip.MustParseAddrPort("40.30.20.10:443"))
+	if err != nil {
+		t.Fatalf("NewData() error = %v", err)
+	}
+	want := &SSLTLVData{
+		Client:  TLVSSLClientSSL | TLVSSLClientCertConn,
+		SubTLVs: map[SSLTLVSubType][]byte{TLVSubTypeSSLCN: []byte("client.example.com"), 0x30: {1, 2}},
+	}
+	if err := d.SetSSL(want); err != nil {
+		t.Fatalf("SetSSL() error = %v", err)
+	}
+	b, err := d.AppendHeader(nil, Version2)
+	if err != nil {
+		t.Fatalf("AppendHeader() error = %v", err)
+	}
+	parsed, _, err := ParseBytes(b)
+	if err != nil {
+		t.Fatalf("ParseBytes() error = %v", err)
+	}
+	if got, ok := parsed.TLVGetSSL(); !ok || !got.Equal(want) {
+		t.Fatalf("TLVGetSSL() = %+v, %v, want %+v", got, ok, want)
+	}
+
+	if err := d.SetSSL(&SSLTLVData{SubTLVs: map[SSLTLVSubType][]byte{TLVSubTypeSSLCN: make([]byte, maxTLVLen+1)}}); err == nil {
+		t.Fatalf("SetSSL() accepted an oversized sub-TLV")
+	}
+	if err := parsed.SetSSL(nil); err != nil {
+		t.Fatalf("SetSSL(nil) error = %v", err)
+	}
+	if _, ok := parsed.TLVGetSSL(); ok {
+		t.Fatalf("SetSSL(nil) kept the SSL TLV")
+	}
+}
@@ -1,17 +1,27 @@
 package proxyproto
 
 import (
+	"errors"
+	"fmt"
 	"net"
-	"strconv"
-	"strings"
+	"net/netip"
 )
 
 const (
-	// 108 bytes is the ideal buffer size for proxy proto v1
-	v1BufSize = 108
+	// 107 bytes is the max length of a v1 header line, including CR/LF
+	v1MaxLineSize = 107
 
-	// 56 chars is the max len for TCP4 (minus 10)
-	v1Tcp4MaxSize = 56
+	// Version1 is the human-readable text header format
+	Version1 Version = 1
+	// Version2 is the binary header format
+	Version2 Version = 2
+
+	// CommandProxy means the connection was relayed on behalf of another node and the
+	// header describes the original connection (always the case for v1)
+	CommandProxy Command = 0
+	// CommandLocal means the connection was established by the proxy itself (e.g. for
+	// health checks) and the real connection endpoints should be used (v2 only)
+	CommandLocal Command = 1
 
 	// AddressFamilyLocal means the address type was specified as "unspec" (v1) or "local" (v2)
 	AddressFamilyLocal AddressFamily = 0
@@ -30,9 +40,11 @@ const (
 	TransportDgram Transport = 2
 
 	// TLVTypeALPN is for Application-Layer Protocol Negotiation (ALPN). It is a byte sequence defining
-	// the upper layer protocol in use over the connection. The most common use case
-	// will be to pass the exact copy of the ALPN extension of the Transport Layer
-	// Security (TLS) protocol as defined by RFC7301
+	// the upper layer protocol in use over the connection. The spec suggests an exact
+	// copy of the TLS ALPN extension (RFC7301), but like HAProxy this package always
+	// sends a single protocol name such as "h2": the negotiated protocol when TLS is
+	// terminated (Gateway, SetTLSConnectionState), or the client's first choice when it
+	// is not (SNIRouter)
 	TLVTypeALPN TLVType = 0x1
 	// TLVTypeAuthority contains the host name value passed by the client, as an UTF8-encoded string.
 	// In case of TLS being used on the client connection, this is the exact copy of
@@ -48,6 +60,11 @@ const (
 	// TLVTypeNetNS defines the value as the US-ASCII string representation
 	// of the namespace's name.
 	TLVTypeNetNS TLVType = 0x30
+	// TLVTypeMinCustom is the first TLV type of the range reserved for application-specific
+	// data, which will never be used by future versions of the protocol
+	TLVTypeMinCustom TLVType = 0xE0
+	// TLVTypeMaxCustom is the last TLV type of the range reserved for application-specific data
+	TLVTypeMaxCustom TLVType = 0xEF
 
 	// TLVSubTypeSSLVersion is the US-ASCII string representation of the TLS version
 	TLVSubTypeSSLVersion SSLTLVSubType = 0x21
@@ -85,7 +102,7 @@ var (
 	// value is "TCP6 "
 	inetProtoTCP6 = [5]byte{0x54, 0x43, 0x50, 0x36, 0x20}
 	// value is "UNKNOWN"
-	inetProtoUnknown = [8]byte{0x55, 0x4E, 0x4B, 0x4E, 0x4F, 0x57, 0x4E}
+	inetProtoUnknown = [7]byte{0x55, 0x4E, 0x4B, 0x4E, 0x4F, 0x57, 0x4E}
 	// value is "\r\n"
 	lineCrLf = [2]byte{0x0D, 0x0A}
 
@@ -114,6 +131,14 @@ var (
 	afpLowerDgram = byte(0x2)
 )
 
+// Version is the Proxy Protocol version a header was received in. The zero value means
+// the data was not parsed from a header
+type Version int
+
+// Command is the command of a header. It tells you whether the header describes a
+// proxied connection or one made by the proxy itself. The zero value is CommandProxy
+type Command int
+
 // AddressFamily is the address family used (this tells you how to deal with the Addr data)
 // If it's AddressFamilyIPv4 or AddressFamilyIPv6 you can
 // safely cast SourceAddr or DestAddr to net.IP. AddressFamilyUnix means treat the
@@ -136,80 +161,226 @@ type SSLTLVClientField byte
 
 // Data represents the version-independent data captured via Proxy Protocol
 type Data struct {
+	Version       Version
+	Command       Command
 	AddressFamily AddressFamily
 	Transport     Transport
 	SourceAddr    []byte
 	DestAddr      []byte
 	SourcePort    int
 	DestPort      int
-	TLVs          map[TLVType][]byte
-	remainingData []byte
+	// TLVs holds the TLVs of data built in code. Parsing leaves it nil and keeps the
+	// received TLVs as header bytes, in the order they arrived, so read them with TLV,
+	// TLVMap, TLVIterator or the TLVGet methods and change them with SetTLV. Once TLVs
+	// is set it replaces the received TLVs: start from d.TLVs = d.TLVMap() to edit the
+	// map of parsed data, or set an empty map to drop them all
+	TLVs map[TLVType][]byte
+
+	// rawTLVs is the TLV portion of a parsed v2 header, in the order it was received.
+	// It is only used while TLVs is nil
+	rawTLVs []byte
+	// raw is the whole header as it was parsed, for forwarding it unchanged
+	raw []byte
 }
 
-// Source gets the source as a net.Addr
+// Source gets the source as a net.Addr. The concrete type follows the address family
+// and transport so it can be type-asserted like a socket address:
+//   - IPv4/IPv6 over TransportStream is a *net.TCPAddr
+//   - IPv4/IPv6 over TransportDgram is a *net.UDPAddr
+//   - IPv4/IPv6 over TransportUnspec is a *net.IPAddr (the port is still in SourcePort)
+//   - Unix is a *net.UnixAddr with network "unix" or "unixgram"
+//
+// For AddressFamilyLocal (v2 LOCAL, v1 UNKNOWN or an unspecified family) there is no
+// address to report, and the result is an address whose Network and String are
+// empty. Conn.RemoteAddr falls back to the underlying connection's address in that case
 func (d *Data) Source() net.Addr {
-	return &dataAddr{
-		AddressFamily: d.AddressFamily,
-		Transport:     d.Transport,
-		Addr:          d.SourceAddr,
-		Port:          d.SourcePort,
+	if a := dataNetAddr(d.AddressFamily, d.Transport, d.SourceAddr, d.SourcePort); a != nil {
+		return a
 	}
+	return unspecAddr{}
 }
 
-// Dest gets the destination as a net.Addr
+// Dest gets the destination as a net.Addr. The concrete types, and the empty address
+// for AddressFamilyLocal, are the same as for Source
 func (d *Data) Dest() net.Addr {
-	return &dataAddr{
-		AddressFamily: d.AddressFamily,
-		Transport:     d.Transport,
-		Addr:          d.DestAddr,
-		Port:          d.DestPort,
+	if a := dataNetAddr(d.AddressFamily, d.Transport, d.DestAddr, d.DestPort); a != nil {
+		return a
 	}
+	return unspecAddr{}
 }
 
-type dataAddr struct {
-	AddressFamily AddressFamily
-	Transport     Transport
-	Addr          []byte
-	Port          int
+// unspecAddr is the address of a header that has none
+type unspecAddr struct{}
+
+func (unspecAddr) Network() string {
+	return ""
 }
 
-func (a *dataAddr) Network() string {
-	if a.Transport == TransportStream {
-		if a.AddressFamily == AddressFamilyIPv4 {
-			return "tcp4"
-		}
-		if a.AddressFamily == AddressFamilyIPv6 {
-			return "tcp6"
+func (unspecAddr) String() string {
+	return ""
+}
+
+// SourceAddrPort gets the source address and port as a netip.AddrPort. IPv4-mapped IPv6
+// addresses are unmapped, so the same client compares equal regardless of the
+// header version or address family the proxy used. The zero value is returned
+// if the address family is not IPv4 or IPv6
+func (d *Data) SourceAddrPort() netip.AddrPort {
+	return addrPortFromBytes(d.AddressFamily, d.SourceAddr, d.SourcePort)
+}
+
+// DestAddrPort gets the destination address and port as a netip.AddrPort. IPv4-mapped IPv6
+// addresses are unmapped, so the same address compares equal regardless of the
+// header version or address family the proxy used. The zero value is returned
+// if the address family is not IPv4 or IPv6
+func (d *Data) DestAddrPort() netip.AddrPort {
+	return addrPortFromBytes(d.AddressFamily, d.DestAddr, d.DestPort)
+}
+
+// NewData builds proxy data for an IPv4 or IPv6 connection from netip values.
+// IPv4-mapped IPv6 addresses are unmapped first; if the source and destination
+// still differ in family both are stored as IPv6, since a header can only carry
+// a single address family. Addresses are stored in their normalized form
+// (4 bytes for IPv4, 16 bytes for IPv6), matching what Parse produces
+func NewData(tr Transport, src, dest netip.AddrPort) (*Data, error) {
+	if !src.IsValid() || !dest.IsValid() {
+		return nil, fmt.Errorf("proxy protocol data requires valid source and dest addresses, got %v and %v", src, dest)
+	}
+	if src.Addr().Zone() != "" || dest.Addr().Zone() != "" {
+		return nil, fmt.Errorf("proxy protocol data cannot carry IPv6 zones, got %v and %v", src, dest)
+	}
+	sa := src.Addr().Unmap()
+	da := dest.Addr().Unmap()
+
+	d := &Data{
+		Transport:  tr,
+		SourcePort: int(src.Port()),
+		DestPort:   int(dest.Port()),
+	}
+	if sa.Is4() && da.Is4() {
+		d.AddressFamily = AddressFamilyIPv4
+		d.SourceAddr = sa.AsSlice()
+		d.DestAddr = da.AsSlice()
+		return d, nil
+	}
+	s16 := sa.As16()
+	d16 := da.As16()
+	d.AddressFamily = AddressFamilyIPv6
+	d.SourceAddr = s16[:]
+	d.DestAddr = d16[:]
+	return d, nil
+}
+
+// NewDataFromConn builds the proxy data describing conn, for sending headers from a
+// proxy. It is named apart from DataFromConn, which retrieves the proxy data a
+// connection received.
+//
+// The address family, transport, addresses and ports come from the proxy data of a
+// *Conn that conn is or wraps (see DataFromConn), so headers chain correctly, or else
+// from conn's remote (source) and local (destination) addresses, which must be TCP,
+// UDP or Unix addresses. TLVs of a received header are not copied. If conn is or wraps
+// a *tls.Conn, the TLS TLVs are filled in as SetTLSConnectionState does, and its
+// handshake must be complete
+func NewDataFromConn(conn net.Conn) (*Data, error) {
+	var d *Data
+	if pd, ok := DataFromConn(conn); ok && pd.Command == CommandProxy && pd.AddressFamily != AddressFamilyLocal {
+		d = pd.Clone()
+		d.Version = 0
+		d.TLVs = nil
+		d.rawTLVs = nil
+		d.raw = nil
+	} else {
+		var err error
+		if d, err = dataFromAddrs(conn.RemoteAddr(), conn.LocalAddr()); err != nil {
+			return nil, err
 		}
-		if a.AddressFamily == AddressFamilyUnix {
-			return "unix"
+	}
+
+	if tc := tlsConnFromConn(conn); tc != nil {
+		cs := tc.ConnectionState()
+		if !cs.HandshakeComplete {
+			return nil, errors.New("proxyproto: TLS handshake is not complete")
 		}
+		d.SetTLSConnectionState(&cs)
 	}
-	if a.Transport == TransportDgram {
-		if a.AddressFamily == AddressFamilyIPv4 {
-			return "udp4"
+	return d, nil
+}
+
+// dataFromAddrs builds proxy data from a pair of standard library addresses
+func dataFromAddrs(src, dest net.Addr) (*Data, error) {
+	switch s := src.(type) {
+	case *net.TCPAddr:
+		if d, ok := dest.(*net.TCPAddr); ok {
+			return NewData(TransportStream, s.AddrPort(), d.AddrPort())
+		}
+	case *net.UDPAddr:
+		if d, ok := dest.(*net.UDPAddr); ok {
+			return NewData(TransportDgram, s.AddrPort(), d.AddrPort())
 		}
-		if a.AddressFamily == AddressFamilyIPv6 {
-			return "udp6"
+	case *net.UnixAddr:
+		d, ok := dest.(*net.UnixAddr)
+		if !ok {
+			break
 		}
-		if a.AddressFamily == AddressFamilyUnix {
-			return "unixpacket"
+		if len(s.Name) > unixAddrSize || len(d.Name) > unixAddrSize {
+			return nil, fmt.Errorf("proxyproto: Unix addresses must be at most %v bytes, got %q and %q", unixAddrSize, s.Name, d.Name)
 		}
+		tr := TransportStream
+		if s.Net == "unixgram" {
+			tr = TransportDgram
+		}
+		return &Data{
+			AddressFamily: AddressFamilyUnix,
+			Transport:     tr,
+			SourceAddr:    []byte(s.Name),
+			DestAddr:      []byte(d.Name),
+		}, nil
 	}
-	return ""
+	return nil, fmt.Errorf("proxyproto: cannot describe %v addresses %v and %v", addrNetwork(src), src, dest)
 }
 
-func (a *dataAddr) String() string {
-	if a.AddressFamily == AddressFamilyIPv4 || a.AddressFamily == AddressFamilyIPv6 {
-		return strings.Join([]string{
-			net.IP(a.Addr).String(),
-			strconv.Itoa(a.Port),
-		}, ":")
+// addrNetwork gets the network of an address, which may be nil
+func addrNetwork(a net.Addr) string {
+	if a == nil {
+		return "nil"
 	}
-	if a.AddressFamily == AddressFamilyUnix {
-		return string(a.Addr)
+	return a.Network()
+}
+
+// addrPortFromBytes converts a raw address field into a normalized netip.AddrPort
+func addrPortFromBytes(af AddressFamily, addr []byte, port int) netip.AddrPort {
+	if af != AddressFamilyIPv4 && af != AddressFamilyIPv6 {
+		return netip.AddrPort{}
+	}
+	a, ok := netip.AddrFromSlice(addr)
+	if !ok {
+		return netip.AddrPort{}
+	}
+	return netip.AddrPortFrom(a.Unmap(), uint16(port))
+}
+
+// dataNetAddr converts a raw address field into the matching standard library net.Addr,
+// or returns nil if the address family has no addresses
+func dataNetAddr(af AddressFamily, tr Transport, addr []byte, port int) net.Addr {
+	switch af {
+	case AddressFamilyIPv4, AddressFamilyIPv6:
+		ip := net.IP(addr)
+		switch tr {
+		case TransportStream:
+			return &net.TCPAddr{IP: ip, Port: port}
+		case TransportDgram:
+			return &net.UDPAddr{IP: ip, Port: port}
+		default:
+			return &net.IPAddr{IP: ip}
+		}
+	case AddressFamilyUnix:
+		addr = trimUnixAddr(addr)
+		if tr == TransportDgram {
+			return &net.UnixAddr{Name: string(addr), Net: "unixgram"}
+		}
+		return &net.UnixAddr{Name: string(addr), Net: "unix"}
+	default:
+		return nil
 	}
-	return ""
 }
 
 // SSLTLVData contains information about any client-presented TLS certificate
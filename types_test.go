@@ -0,0 +1,197 @@
+package proxyproto
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func Test_Data_SourceAddrPort(t *testing.T) {
+	want := netip.MustParseAddrPort("10.20.30.40:8000")
+	tests := []struct {
+		name string
+		buf  []byte
+	}{
+		{
+			name: "v1 tcp4",
+			buf:  []byte("PROXY TCP4 10.20.30.40 40.30.20.10 8000 9000\r\n"),
+		},
+		{
+			name: "v1 tcp6 mapped",
+			buf:  []byte("PROXY TCP6 ::ffff:10.20.30.40 ::ffff:40.30.20.10 8000 9000\r\n"),
+		},
+		{
+			name: "v2 tcp4",
+			buf: []byte{
+				0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A,
+				0x21, 0x11, 0x0, 0xc,
+				10, 20, 30, 40,
+				40, 30, 20, 10,
+				0x1f, 0x40,
+				0x23, 0x28,
+			},
+		},
+		{
+			name: "v2 tcp6 mapped",
+			buf: []byte{
+				0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A,
+				0x21, 0x21, 0x0, 0x24,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 10, 20, 30, 40,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 40, 30, 20, 10,
+				0x1f, 0x40,
+				0x23, 0x28,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := Parse(bytes.NewBuffer(tt.buf))
+			if err != nil {
+				t.Fatalf("Parse() err = %v", err)
+			}
+			if got := d.SourceAddrPort(); got != want {
+				t.Fatalf("SourceAddrPort() = %v, want %v", got, want)
+			}
+			if got := d.DestAddrPort(); got != netip.MustParseAddrPort("40.30.20.10:9000") {
+				t.Fatalf("DestAddrPort() = %v, want 40.30.20.10:9000", got)
+			}
+		})
+	}
+}
+
+func Test_NewData(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     netip.AddrPort
+		dest    netip.AddrPort
+		want    *Data
+		wantErr bool
+	}{
+		{
+			name: "ipv4",
+			src:  netip.MustParseAddrPort("10.20.30.40:8000"),
+			dest: netip.MustParseAddrPort("[::ffff:40.30.20.10]:9000"),
+			want: &Data{
+				AddressFamily: AddressFamilyIPv4,
+				Transport:     TransportStream,
+				SourceAddr:    []byte{10, 20, 30, 40},
+				SourcePort:    8000,
+				DestAddr:      []byte{40, 30, 20, 10},
+				DestPort:      9000,
+			},
+		},
+		{
+			name: "mixed families",
+			src:  netip.MustParseAddrPort("10.20.30.40:8000"),
+			dest: netip.MustParseAddrPort("[2606:4700:4700::1111]:9000"),
+			want: &Data{
+				AddressFamily: AddressFamilyIPv6,
+				Transport:     TransportStream,
+				SourceAddr:    []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 10, 20, 30, 40},
+				SourcePort:    8000,
+				DestAddr:      []byte{0x26, 0x6, 0x47, 0x0, 0x47, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x11, 0x11},
+				DestPort:      9000,
+			},
+		},
+		{
+			name:    "invalid",
+			src:     netip.AddrPort{},
+			dest:    netip.MustParseAddrPort("40.30.20.10:9000"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewData(TransportStream, tt.src, tt.dest)
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewData() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("NewData() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_Data_Source(t *testing.T) {
+	tests := []struct {
+		name string
+		data *Data
+		want net.Addr
+	}{
+		{
+			name: "tcp4",
+			data: &Data{
+				AddressFamily: AddressFamilyIPv4,
+				Transport:     TransportStream,
+				SourceAddr:    []byte{10, 20, 30, 40},
+				SourcePort:    8000,
+			},
+			want: &net.TCPAddr{IP: net.IP{10, 20, 30, 40}, Port: 8000},
+		},
+		{
+			name: "udp6",
+			data: &Data{
+				AddressFamily: AddressFamilyIPv6,
+				Transport:     TransportDgram,
+				SourceAddr:    []byte{0x26, 0x7, 0xf8, 0xb0, 0x40, 0x8, 0x8, 0xe, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x20, 0x0e},
+				SourcePort:    8000,
+			},
+			want: &net.UDPAddr{IP: net.IP{0x26, 0x7, 0xf8, 0xb0, 0x40, 0x8, 0x8, 0xe, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x20, 0x0e}, Port: 8000},
+		},
+		{
+			name: "ipv4 unspec",
+			data: &Data{
+				AddressFamily: AddressFamilyIPv4,
+				Transport:     TransportUnspec,
+				SourceAddr:    []byte{10, 20, 30, 40},
+				SourcePort:    8000,
+			},
+			want: &net.IPAddr{IP: net.IP{10, 20, 30, 40}},
+		},
+		{
+			name: "unix stream",
+			data: &Data{
+				AddressFamily: AddressFamilyUnix,
+				Transport:     TransportStream,
+				SourceAddr:    append([]byte("/var/run/src.sock"), make([]byte, 91)...),
+			},
+			want: &net.UnixAddr{Name: "/var/run/src.sock", Net: "unix"},
+		},
+		{
+			name: "local",
+			data: &Data{},
+			want: unspecAddr{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.data.Source()
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Source() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_Data_Source_noAddresses(t *testing.T) {
+	for _, b := range [][]byte{
+		[]byte("\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00"),
+		[]byte("PROXY UNKNOWN\r\n"),
+	} {
+		d, _, err := ParseBytes(b)
+		if err != nil {
+			t.Fatalf("ParseBytes(%q) error = %v", b, err)
+		}
+		if s := d.Source().String(); s != "" {
+			t.Fatalf("Source().String() = %q, want empty", s)
+		}
+		if n := d.Dest().Network(); n != "" {
+			t.Fatalf("Dest().Network() = %q, want empty", n)
+		}
+	}
+}